@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// If AccessLogPath is set in config.json, requests are logged to it in
+// Apache Combined Log Format (for e.g. GoAccess). Lines are queued by
+// request handlers and written by AccessLog.Run() which flushes every
+// accessLogFlushInterval. If the queue is full, lines are dropped (and
+// counted in dropped_access_log_lines metric) so that requests never wait.
+// Every day the file is renamed to ${path}.${yyyy-mm-dd} and gzipped; gzipped
+// files older than AccessLogRetentionDays (defaultAccessLogRetentionDays
+// if 0) are deleted.
+
+const (
+	accessLogQueueSize            = 4096
+	accessLogFlushInterval        = time.Second
+	defaultAccessLogRetentionDays = 30
+	accessLogDayFormat            = "2006-01-02"
+)
+
+// nil if AccessLogPath is not set
+var accessLog *AccessLog
+
+type AccessLog struct {
+	path  string
+	lines chan string
+	// only used by Run()
+	f   *os.File
+	w   *bufio.Writer
+	day string
+}
+
+func NewAccessLog(path string) *AccessLog {
+	return &AccessLog{path: path, lines: make(chan string, accessLogQueueSize)}
+}
+
+// path from AccessLogPath, relative to data directory unless it's absolute
+func accessLogPath() string {
+	path := stringOrEmpty(getConfig().AccessLogPath)
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(getDataDir(), path)
+}
+
+func accessLogRetention() time.Duration {
+	days := getConfig().AccessLogRetentionDays
+	if days == 0 {
+		days = defaultAccessLogRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// queues a line. Returns false if the queue is full and it was dropped
+func (l *AccessLog) Log(line string) bool {
+	select {
+	case l.lines <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// escapes strings in quotes like Apache does
+func clfEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// formats a request in Combined Log Format
+func formatAccessLogLine(r *http.Request, t time.Time, status, size int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	sizeStr := "-"
+	if size > 0 {
+		sizeStr = strconv.Itoa(size)
+	}
+	reqLine := r.Method + " " + r.URL.RequestURI() + " " + r.Proto
+	return fmt.Sprintf(`%s - - [%s] "%s" %d %s "%s" "%s"`, getIpAddress(r),
+		t.Format("02/Jan/2006:15:04:05 -0700"), clfEscape(reqLine), status, sizeStr,
+		clfEscape(r.Referer()), clfEscape(r.UserAgent()))
+}
+
+func (l *AccessLog) rotatedPath(day string) string {
+	return l.path + "." + day
+}
+
+func (l *AccessLog) open(now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w = f, bufio.NewWriter(f)
+	l.day = now.Format(accessLogDayFormat)
+	// left from a previous day (we weren't running at midnight)
+	if st.Size() > 0 {
+		l.day = st.ModTime().Format(accessLogDayFormat)
+	}
+	return nil
+}
+
+func (l *AccessLog) flush() {
+	if l.w == nil {
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		logger.Errorf("AccessLog.flush(): writing to %s failed with %s", l.path, err)
+	}
+}
+
+func (l *AccessLog) close() {
+	if l.f == nil {
+		return
+	}
+	l.flush()
+	l.f.Close()
+	l.f, l.w = nil, nil
+}
+
+// renames the file of the current day and compresses it in the background
+func (l *AccessLog) rotate(now time.Time) {
+	day := l.day
+	l.close()
+	if err := os.Rename(l.path, l.rotatedPath(day)); err != nil {
+		logger.Errorf("AccessLog.rotate(): %s", err)
+	}
+	backgroundJobs.Add(1)
+	go func() {
+		compressAndPruneAccessLogs(l.path, accessLogRetention(), now)
+		backgroundJobs.Done()
+	}()
+}
+
+func (l *AccessLog) write(line string, now time.Time) {
+	if l.f == nil {
+		if err := l.open(now); err != nil {
+			logger.Errorf("AccessLog.write(): %s", err)
+			return
+		}
+	}
+	// after midnight or the file we opened is from a previous day
+	if l.day != now.Format(accessLogDayFormat) {
+		l.rotate(now)
+		if err := l.open(now); err != nil {
+			logger.Errorf("AccessLog.write(): %s", err)
+			return
+		}
+	}
+	l.w.WriteString(line)
+	l.w.WriteByte('\n')
+}
+
+// writes queued lines until done is closed
+func (l *AccessLog) Run(done chan struct{}) {
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-l.lines:
+			l.write(line, time.Now())
+		case <-ticker.C:
+			l.flush()
+		case <-done:
+			// write what's already queued
+			for {
+				select {
+				case line := <-l.lines:
+					l.write(line, time.Now())
+				default:
+					l.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpPath := path + ".gz.tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// gzips rotated files of log at path and deletes the ones older than
+// retention
+func compressAndPruneAccessLogs(path string, retention time.Duration, now time.Time) {
+	dir, base := filepath.Split(path)
+	files, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		logger.Errorf("compressAndPruneAccessLogs(): %s", err)
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		rest := name[len(base)+1:]
+		gzipped := strings.HasSuffix(rest, ".gz")
+		day, err := time.ParseInLocation(accessLogDayFormat, strings.TrimSuffix(rest, ".gz"), now.Location())
+		if err != nil {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if now.Sub(day) > retention {
+			if err = os.Remove(p); err != nil {
+				logger.Errorf("compressAndPruneAccessLogs(): %s", err)
+			}
+			continue
+		}
+		if !gzipped {
+			if err = gzipFile(p); err != nil {
+				logger.Errorf("compressAndPruneAccessLogs(): gzipFile() failed with %s", err)
+			}
+		}
+	}
+}
+
+// starts writing access log if AccessLogPath is set
+func startAccessLog(done chan struct{}) {
+	path := accessLogPath()
+	if path == "" {
+		return
+	}
+	l := NewAccessLog(path)
+	// in case we stopped before compressing
+	compressAndPruneAccessLogs(path, accessLogRetention(), time.Now())
+	accessLog = l
+	backgroundJobs.Add(1)
+	go func() {
+		l.Run(done)
+		backgroundJobs.Done()
+	}()
+	logger.Noticef("startAccessLog(): logging requests to %s", path)
+}
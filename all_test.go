@@ -1,10 +1,53 @@
 package main
 
 import (
-	_ "fmt"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/crowdmob/goamz/s3"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var initTestGlobalsOnce sync.Once
+
+// sets up globals that handlers expect to be initialized by main()
+func initTestGlobals() {
+	initTestGlobalsOnce.Do(func() {
+		logger = NewServerLogger(256, 256, false)
+		InitMetrics()
+		getConfig().AnalyticsCode = &emptyString
+		cookieAuthKey = securecookie.GenerateRandomKey(32)
+		cookieEncrKey = securecookie.GenerateRandomKey(32)
+		secureCookie = securecookie.New(cookieAuthKey, cookieEncrKey)
+	})
+}
+
 func testShortenId(t *testing.T, n int) {
 	s := ShortenId(n)
 	n2 := UnshortenId(s)
@@ -22,3 +65,5607 @@ func TestShortenId(t *testing.T) {
 	testShortenId(t, 37)
 	testShortenId(t, 123413343)
 }
+
+func TestOgImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "og_images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &Article{
+		Id:          5,
+		Title:       "A very long title that will need to be wrapped into several lines and possibly shrunk to fit in the image",
+		PublishedOn: time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	d, err := getOgImage(dir, a)
+	if err != nil {
+		t.Fatalf("getOgImage() failed with %s", err)
+	}
+	img, err := png.Decode(bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("png.Decode() failed with %s", err)
+	}
+	if dx, dy := img.Bounds().Dx(), img.Bounds().Dy(); dx != ogImageDx || dy != ogImageDy {
+		t.Fatalf("image is %dx%d, expected %dx%d", dx, dy, ogImageDx, ogImageDy)
+	}
+
+	// the second call must be served from the cache file
+	path := ogImageCachePath(dir, a)
+	if err = ioutil.WriteFile(path, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err = getOgImage(dir, a)
+	if err != nil || string(d) != "cached" {
+		t.Fatalf("getOgImage() didn't re-use cached file, err: %v", err)
+	}
+
+	// changing title must generate a new image
+	a.Title = "Short"
+	if ogImageCachePath(dir, a) == path {
+		t.Fatalf("cache path didn't change after changing the title")
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	initTestGlobals()
+	body := strings.Repeat("hello world ", 100)
+	h := makeTimingHandler(func(w http.ResponseWriter, r *http.Request) {
+		textResponse(w, r, body)
+	})
+	r := httptest.NewRequest("GET", "/foo", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding is %q, expected gzip", enc)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Fatalf("Content-Length of uncompressed data (%s) wasn't removed", cl)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadAll(gr)
+	if err != nil || string(d) != body {
+		t.Fatalf("bad decompressed body, err: %v", err)
+	}
+
+	// images are not re-compressed
+	h = makeTimingHandler(func(w http.ResponseWriter, r *http.Request) {
+		setContentType(w, "image/png")
+		writeResponse(w, r, http.StatusOK, body)
+	})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("image/png was compressed")
+	}
+	if w.Body.String() != body {
+		t.Fatalf("bad body")
+	}
+
+	// caches must know that html depends on Accept-Encoding even if this
+	// client didn't get it compressed
+	h = makeTimingHandler(func(w http.ResponseWriter, r *http.Request) {
+		textResponse(w, r, body)
+	})
+	r = httptest.NewRequest("GET", "/foo", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "" || w.Body.String() != body {
+		t.Fatalf("response to client without gzip was compressed")
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Fatalf("Vary is %q, expected Accept-Encoding", vary)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		accept string
+		exp    bool
+	}{
+		{"", false},
+		{"deflate", false},
+		{"gzip", true},
+		{"deflate, gzip", true},
+		{"GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=1", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0", false},
+		{"gzip; q=0", false},
+		{"gzip;q=0.000", false},
+		{"gzip ; q = 0", false},
+		{"gzip;q=bad", false},
+		{"deflate, gzip;q=0", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", test.accept)
+		if got := acceptsGzip(r); got != test.exp {
+			t.Errorf("acceptsGzip(%q) = %v, expected %v", test.accept, got, test.exp)
+		}
+	}
+}
+
+func TestFingerprintedAssets(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "main.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := parseFingerprintedName("main.css"); ok {
+		t.Fatalf("main.css is not fingerprinted")
+	}
+	name, hash, ok := parseFingerprintedName("main.0123abcd.css")
+	if !ok || name != "main.css" || hash != "0123abcd" {
+		t.Fatalf("bad parse: %q, %q, %v", name, hash, ok)
+	}
+
+	serve := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/static/"+name, nil)
+		if !serveFingerprintedAsset(w, r, dir, name) {
+			return nil
+		}
+		return w
+	}
+	hash = getAssetHash(dir, "main.css")
+	w := serve(fingerprintedName("main.css", hash))
+	if w == nil || w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Fatalf("failed to serve fingerprinted file")
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Fatalf("bad Cache-Control: %q", cc)
+	}
+	w = serve("main.00000000.css")
+	if w == nil || w.Code != http.StatusNotFound {
+		t.Fatalf("hash mismatch should 404")
+	}
+	if serve("main.css") != nil {
+		t.Fatalf("not fingerprinted name shouldn't be handled")
+	}
+
+	// pages link to fingerprinted favicon
+	w = httptest.NewRecorder()
+	serve404(w, httptest.NewRequest("GET", "/missing", nil))
+	favicon := assetUrl("favicon.ico")
+	if favicon == "/static/favicon.ico" || !strings.Contains(w.Body.String(), `<link rel="icon" href="`+favicon+`">`) {
+		t.Fatalf("no fingerprinted favicon %q in:\n%s", favicon, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleStatic(w, httptest.NewRequest("GET", favicon, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Fatalf("%s returned %d", favicon, w.Code)
+	}
+}
+
+func TestMetricsSideBySide(t *testing.T) {
+	initTestGlobals()
+	m1 := NewMetrics()
+	m2 := NewMetrics()
+	h1 := newTimingHandler(m1, func(w http.ResponseWriter, r *http.Request) {
+		textResponse(w, r, "one")
+	})
+	h2 := newTimingHandler(m2, func(w http.ResponseWriter, r *http.Request) {
+		textResponse(w, r, "two")
+	})
+	for i := 0; i < 3; i++ {
+		h1.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	h2.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := m1.HttpReqTime.Count(); n != 3 {
+		t.Fatalf("m1 counted %d requests, expected 3", n)
+	}
+	if n := m2.HttpReqTime.Count(); n != 1 {
+		t.Fatalf("m2 counted %d requests, expected 1", n)
+	}
+	if m1.CurrentReqs.Count() != 0 || m2.CurrentReqs.Count() != 0 {
+		t.Fatalf("in-flight request counters not decremented")
+	}
+	// must not panic on duplicate registration
+	InitMetrics()
+	InitMetrics()
+	if _, err := appMetrics.MarshalJSON(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://blog.example.com:80/article/foo.html?a=1&b=2", nil)
+	w := httptest.NewRecorder()
+	handleRedirectToHttps(w, r)
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("got code %d, expected %d", w.Code, http.StatusMovedPermanently)
+	}
+	exp := "https://blog.example.com/article/foo.html?a=1&b=2"
+	if loc := w.Header().Get("Location"); loc != exp {
+		t.Fatalf("redirected to %q, expected %q", loc, exp)
+	}
+}
+
+const testCsrfToken = "test-csrf-token"
+
+// returns a request with a login cookie for the given twitter user
+func newTestRequest(method, url, user string) *http.Request {
+	r := httptest.NewRequest(method, url, nil)
+	if user != "" {
+		w := httptest.NewRecorder()
+		setSecureCookie(w, &SecureCookieValue{TwitterUser: user, CsrfToken: testCsrfToken, LoggedInAt: time.Now()})
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestAdminOnlyElements(t *testing.T) {
+	initTestGlobals()
+	a := &Article{
+		Id:          3,
+		Title:       "Hello",
+		PublishedOn: time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC),
+		Path:        "blog_posts/2014/hello.md",
+		BodyHtml:    "<p>hello</p>",
+	}
+	store = &Store{articles: []*Article{a}, idToArticle: map[int]*Article{a.Id: a}}
+	rebuildArticlesCache()
+	url := "/" + a.Permalink()
+
+	render := func(user string) string {
+		w := httptest.NewRecorder()
+		handleArticle(w, newTestRequest("GET", url, user))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d", url, w.Code)
+		}
+		return w.Body.String()
+	}
+	for _, user := range []string{"", "someone"} {
+		if s := render(user); strings.Contains(s, "admin_edit") || strings.Contains(s, a.Path) {
+			t.Fatalf("admin-only element rendered for user %q", user)
+		}
+	}
+	if s := render("kjk"); !strings.Contains(s, a.Path) {
+		t.Fatalf("admin-only element not rendered for admin")
+	}
+
+	r := newTestRequest("GET", "/", "kjk")
+	if m := newBasePageModel(r); !m.IsAdmin || m.CsrfToken == "" {
+		t.Fatalf("bad model for admin: %#v", m)
+	}
+	r = newTestRequest("GET", "/", "")
+	if m := newBasePageModel(r); m.IsAdmin || m.User != "" || m.CsrfToken != "" {
+		t.Fatalf("bad model for anonymous: %#v", m)
+	}
+}
+
+func TestDeletedArticleGone(t *testing.T) {
+	initTestGlobals()
+	a := &Article{Id: 5, Title: "Live", BodyHtml: "<p>live</p>"}
+	deleted := &Article{Id: 6, Title: "Gone", IsDeleted: true}
+	live, del := splitDeletedArticles([]*Article{a, deleted})
+	if len(live) != 1 || len(del) != 1 || del[0] != deleted {
+		t.Fatalf("bad split: %v, %v", live, del)
+	}
+	store = &Store{articles: live, idToArticle: map[int]*Article{a.Id: a}, deletedArticles: del}
+	rebuildArticlesCache()
+
+	get := func(a *Article) int {
+		w := httptest.NewRecorder()
+		handleArticle(w, newTestRequest("GET", "/"+a.Permalink(), ""))
+		return w.Code
+	}
+	if code := get(a); code != http.StatusOK {
+		t.Fatalf("live article returned %d", code)
+	}
+	if code := get(deleted); code != http.StatusGone {
+		t.Fatalf("deleted article returned %d, expected 410", code)
+	}
+	if code := get(&Article{Id: 7, Title: "Missing"}); code != http.StatusNotFound {
+		t.Fatalf("missing article returned %d, expected 404", code)
+	}
+}
+
+func TestSafeLoginRedirect(t *testing.T) {
+	initTestGlobals()
+	tests := [][2]string{
+		{"/archives.html", "/archives.html"},
+		{"/app/crashes?app_name=x", "/app/crashes?app_name=x"},
+		{"", "/"},
+		{"archives.html", "/"},
+		{"//evil.com/", "/"},
+		{"/\\evil.com/", "/"},
+		{"/a\\b", "/"},
+		{"http://evil.com/", "/"},
+	}
+	for _, test := range tests {
+		if got := safeLoginRedirect(test[0]); got != test[1] {
+			t.Errorf("safeLoginRedirect(%q) = %q, expected %q", test[0], got, test[1])
+		}
+	}
+	w := httptest.NewRecorder()
+	handleLogout(w, httptest.NewRequest("GET", "/logout?redirect=/%5Cevil.com/", nil))
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Fatalf("logout redirected to %q", loc)
+	}
+}
+
+func TestLoginBasic(t *testing.T) {
+	initTestGlobals()
+	defer func() { getConfig().AdminPasswordBcryptHash = nil }()
+
+	post := func(password string) *httptest.ResponseRecorder {
+		form := "password=" + password + "&redirect=/archives.html"
+		r := httptest.NewRequest("POST", "/login/basic", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handleLoginBasic(w, r)
+		return w
+	}
+
+	if w := post("secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d when disabled, expected 404", w.Code)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashStr := string(hash)
+	getConfig().AdminPasswordBcryptHash = &hashStr
+	basicLoginLimiter = NewLoginLimiter()
+
+	w := post("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/archives.html" {
+		t.Fatalf("correct password: got %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if !IsAdmin(r) {
+		t.Fatalf("cookie after password login doesn't make user an admin")
+	}
+
+	for i := 0; i < maxLoginFailures; i++ {
+		if w := post("wrong"); w.Code != http.StatusForbidden {
+			t.Fatalf("wrong password: got %d, expected 403", w.Code)
+		}
+	}
+	// locked out, even with correct password
+	if w := post("secret"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d after %d failures, expected 429", w.Code, maxLoginFailures)
+	}
+	if !basicLoginLimiter.IsLockedOut("10.0.0.1", time.Now()) {
+		t.Fatalf("not locked out")
+	}
+	if basicLoginLimiter.IsLockedOut("10.0.0.1", time.Now().Add(loginLockoutDuration+time.Second)) {
+		t.Fatalf("still locked out after lockout duration")
+	}
+}
+
+func Test404Stats(t *testing.T) {
+	initTestGlobals()
+	now := time.Now()
+	s := &Stats404{}
+	s.Add("/b", "", now.Add(-24*time.Hour))
+	for i := 0; i < 3; i++ {
+		s.Add("/a", "http://ref1", now)
+	}
+	s.Add("/a", "http://ref2", now)
+	s.Add("/b", "", now)
+	top := s.Top(1, 0)
+	if len(top) != 2 || top[0].Url != "/a" || top[0].Count != 4 || len(top[0].Referrers) != 2 {
+		t.Fatalf("bad top: %#v", top)
+	}
+	for i := 0; i < Max404sPerDay+10; i++ {
+		s.Add(fmt.Sprintf("/x%d", i), "", now)
+	}
+	s.Lock()
+	n := len(s.Days[len(s.Days)-1].Urls)
+	s.Unlock()
+	if n > Max404sPerDay {
+		t.Fatalf("tracking %d urls, max is %d", n, Max404sPerDay)
+	}
+	if top = s.Top(1, 1); top[0].Url != "/a" {
+		t.Fatalf("most hit url was dropped")
+	}
+
+	// 404s from handlers are recorded unless ignored
+	stats404 = &Stats404{}
+	h := makeTimingHandler(http.NotFound)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing.html", nil))
+	ignore404("/ignored.html")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ignored.html", nil))
+	if top = stats404.Top(1, 0); len(top) != 1 || top[0].Url != "/missing.html" {
+		t.Fatalf("bad recorded 404s: %#v", top)
+	}
+}
+
+func TestRelatedArticles(t *testing.T) {
+	articles := []*Article{
+		{Id: 1, Title: "Go tips", Tags: []string{"go", "programming"}},
+		{Id: 2, Title: "Go profiling", Tags: []string{"go", "programming", "performance"}},
+		{Id: 3, Title: "C++ tricks", Tags: []string{"c++", "programming"}},
+		{Id: 4, Title: "Optimizing Go", Tags: []string{"go", "performance"}, IsDeleted: true},
+		{Id: 5, Title: "Notes on profiling"},
+		{Id: 6, Title: "Random thoughts"},
+	}
+	related := buildRelatedArticles(articles)
+	r := related[2]
+	if len(r) != 2 || r[0].Id != 1 || r[1].Id != 3 {
+		t.Fatalf("bad related for 2: %v", r)
+	}
+	for _, arr := range related {
+		for _, a := range arr {
+			if a.IsDeleted {
+				t.Fatalf("deleted article %d suggested as related", a.Id)
+			}
+		}
+	}
+	// no tags, related by title
+	if r = related[5]; len(r) != 1 || r[0].Id != 2 {
+		t.Fatalf("bad related for 5: %v", r)
+	}
+	if len(related[6]) != 0 {
+		t.Fatalf("unrelated article has related: %v", related[6])
+	}
+}
+
+func TestTagAliases(t *testing.T) {
+	initTestGlobals()
+	aliases, err := parseTagAliases([]byte("golang|go\ncpp|c++\n\nc++|cplusplus\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases["golang"] != "go" || aliases["cpp"] != "cplusplus" || aliases["c++"] != "cplusplus" {
+		t.Fatalf("bad aliases: %v", aliases)
+	}
+	if _, err = parseTagAliases([]byte("foo\n")); err == nil {
+		t.Fatalf("malformed line not rejected")
+	}
+
+	a := &Article{Tags: []string{"go", "golang", "cpp", "misc"}}
+	if !applyTagAliases(a, aliases) {
+		t.Fatalf("tags not changed")
+	}
+	if strings.Join(a.Tags, ",") != "go,cplusplus,misc" {
+		t.Fatalf("bad tags after merge: %v", a.Tags)
+	}
+	if applyTagAliases(a, aliases) {
+		t.Fatalf("tags changed second time")
+	}
+
+	tagAliasesMu.Lock()
+	tagAliases = aliases
+	tagAliasesMu.Unlock()
+	defer func() {
+		tagAliasesMu.Lock()
+		tagAliases = make(map[string]string)
+		tagAliasesMu.Unlock()
+	}()
+	w := httptest.NewRecorder()
+	handleTag(w, httptest.NewRequest("GET", "/tag/golang", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/tag/go" {
+		t.Fatalf("got %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestSwapArticlesWhileServing(t *testing.T) {
+	initTestGlobals()
+	newArticles := func(n int) []*Article {
+		var res []*Article
+		for i := 1; i <= n; i++ {
+			res = append(res, &Article{
+				Id:          i,
+				Title:       fmt.Sprintf("Article %d", i),
+				Tags:        []string{"tag", fmt.Sprintf("tag%d", i%3)},
+				PublishedOn: time.Date(2014, 1, i, 0, 0, 0, 0, time.UTC),
+				BodyHtml:    "<p>body</p>",
+			})
+		}
+		return res
+	}
+	store = &Store{}
+	if err := store.SetArticles(newArticles(10)); err != nil {
+		t.Fatal(err)
+	}
+	rebuildArticlesCache()
+	url := "/" + newArticles(1)[0].Permalink()
+	rebuildsBefore := appMetrics.CacheRebuildTime.Count()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				handleArticle(w, httptest.NewRequest("GET", url, nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("%s returned %d", url, w.Code)
+					return
+				}
+				handleTag(httptest.NewRecorder(), httptest.NewRequest("GET", "/tag/tag1", nil))
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := swapArticles(newArticles(5 + i%10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	// swaps in a row are coalesced into fewer re-builds
+	articlesCacheRebuilder.wait()
+	if n := appMetrics.CacheRebuildTime.Count() - rebuildsBefore; n < 1 || n > 50 {
+		t.Fatalf("recorded %d rebuilds, expected between 1 and 50", n)
+	}
+	if n := len(getCachedArticles()); n != 14 {
+		t.Fatalf("cache has %d articles after the last swap, expected 14", n)
+	}
+	if appMetrics.CacheRebuildLastTime.Value() == 0 {
+		t.Fatalf("time of the last rebuild not recorded")
+	}
+}
+
+// run with -race to catch data races between serving and re-building the
+// articles cache
+func TestArticlesCacheSnapshot(t *testing.T) {
+	initTestGlobals()
+	newArticles := func(n int) []*Article {
+		var res []*Article
+		for i := 1; i <= n; i++ {
+			res = append(res, &Article{
+				Id:          i,
+				Title:       fmt.Sprintf("Article %d", i),
+				Tags:        []string{fmt.Sprintf("tag%d", i%2)},
+				PublishedOn: time.Date(2015, 2, i, 0, 0, 0, 0, time.UTC),
+				BodyHtml:    "<p>body</p>",
+			})
+		}
+		return res
+	}
+	store = &Store{}
+	defer rebuildArticlesCache()
+	if err := swapArticles(newArticles(6)); err != nil {
+		t.Fatal(err)
+	}
+	articlesCacheRebuilder.wait()
+
+	d := articlesCache.get()
+	if info := d.byId[3]; info == nil || info.pos != 2 || info.prev.Id != 2 || info.next.Id != 4 {
+		t.Fatalf("bad article info: %#v", info)
+	}
+	if info := d.byId[6]; info == nil || info.next != nil {
+		t.Fatalf("bad article info for the last article: %#v", info)
+	}
+	if n := len(d.byTag["tag1"]); n != 3 {
+		t.Fatalf("expected 3 articles with tag1, got %d", n)
+	}
+	if len(d.atom) == 0 || len(d.atomAll) == 0 {
+		t.Fatalf("feeds not built")
+	}
+
+	// the last article comes and goes, so its prev/next links and article
+	// count change while it's being served
+	last := newArticles(6)[5]
+	urls := []string{"/" + newArticles(1)[0].Permalink(), "/" + last.Permalink(), "/", "/atom.xml", "/atom-all.xml", "/tag/tag0", "/archives.html"}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, uri := range urls {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", uri, nil)
+				switch {
+				case strings.HasPrefix(uri, "/atom"):
+					handleAtomAll(w, r)
+				case strings.HasPrefix(uri, "/tag/"):
+					handleTag(w, r)
+				case uri == "/archives.html":
+					handleArchives(w, r)
+				case uri == "/":
+					handleMainPage(w, r)
+				default:
+					handleArticle(w, r)
+				}
+				if w.Code != http.StatusOK && !(uri == "/"+last.Permalink() && w.Code == http.StatusNotFound) {
+					t.Errorf("%s returned %d", uri, w.Code)
+					return
+				}
+			}
+		}(uri)
+	}
+	for i := 0; i < 50; i++ {
+		if err := swapArticles(newArticles(5 + i%2)); err != nil {
+			t.Fatal(err)
+		}
+		d := articlesCache.get()
+		for _, a := range d.articles {
+			if info := d.byId[a.Id]; info == nil || d.articles[info.pos] != a {
+				t.Fatalf("article %d: bad info in cache", a.Id)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	articlesCacheRebuilder.wait()
+}
+
+func TestCacheRebuildCoalescing(t *testing.T) {
+	initTestGlobals()
+	newArticles := func(n int) []*Article {
+		var res []*Article
+		for i := 1; i <= n; i++ {
+			res = append(res, &Article{
+				Id:          i,
+				Title:       fmt.Sprintf("Article %d", i),
+				PublishedOn: time.Date(2015, 2, i, 0, 0, 0, 0, time.UTC),
+			})
+		}
+		return res
+	}
+	store = &Store{}
+	defer rebuildArticlesCache()
+	if err := swapArticles(newArticles(3)); err != nil {
+		t.Fatal(err)
+	}
+	articlesCacheRebuilder.wait()
+
+	// pretend a re-build is running so that changes only mark it dirty
+	r := articlesCacheRebuilder
+	r.mu.Lock()
+	r.running = true
+	r.mu.Unlock()
+	rebuildsBefore := appMetrics.CacheRebuildTime.Count()
+	for n := 4; n <= 8; n++ {
+		if err := swapArticles(newArticles(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the old cache is served until the re-build is done
+	if n := len(getCachedArticles()); n != 3 {
+		t.Fatalf("cache has %d articles during the re-build, expected 3", n)
+	}
+	r.run()
+	if n := appMetrics.CacheRebuildTime.Count() - rebuildsBefore; n != 1 {
+		t.Fatalf("5 changes caused %d re-builds, expected 1", n)
+	}
+	if n := len(getCachedArticles()); n != 8 {
+		t.Fatalf("cache has %d articles after the re-build, expected 8", n)
+	}
+	r.wait()
+}
+
+// e.g. a file re-read while a tag is renamed, none of the changes is lost
+func TestConcurrentArticleUpdates(t *testing.T) {
+	initTestGlobals()
+	store = &Store{}
+	defer rebuildArticlesCache()
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			err := updateArticles(func(articles []*Article) []*Article {
+				a := &Article{Id: id, Title: fmt.Sprintf("Article %d", id), PublishedOn: time.Date(2015, 2, id, 0, 0, 0, 0, time.UTC)}
+				return append(articles, a)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	articlesCacheRebuilder.wait()
+	if n := len(store.GetAllArticles()); n != 20 {
+		t.Fatalf("got %d articles, expected 20", n)
+	}
+	// nil means no change
+	if err := updateArticles(func([]*Article) []*Article { return nil }); err != nil || len(store.GetAllArticles()) != 20 {
+		t.Fatalf("articles changed: %v", err)
+	}
+}
+
+func TestPruneCrashes(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if err = s.SaveCrash("SumatraPDF", "3.0", "10.0.0.1", []byte(fmt.Sprintf("crash %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		s.crashes[i].CreatedOn = now.AddDate(0, 0, -10*i)
+	}
+	// 0 is new, 1 is starred, 2 and 3 are too old
+	if err = s.SetStarred(s.crashes[1], true); err != nil {
+		t.Fatal(err)
+	}
+	nFiles, nBytes, err := s.Prune(now, 5, 0)
+	if err != nil || nFiles != 2 || nBytes == 0 {
+		t.Fatalf("Prune() returned %d, %d, %v", nFiles, nBytes, err)
+	}
+	for i, c := range s.crashes {
+		shouldPrune := i >= 2
+		if c.IsPruned != shouldPrune || s.MessageFileExists(c.Sha1[:]) == shouldPrune {
+			t.Fatalf("crash %d: IsPruned: %v", i, c.IsPruned)
+		}
+	}
+	s.dataFile.Close()
+
+	// pruned and starred state survives re-loading
+	s, err = NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	if s.CrashesCount() != 4 || !s.crashes[1].IsStarred || !s.crashes[2].IsPruned || s.crashes[0].IsPruned {
+		t.Fatalf("bad state after re-loading")
+	}
+
+	// keep only 1 newest per version, starred don't count
+	toPrune := crashesToPrune(s.crashes, now, 0, 1)
+	if len(toPrune) != 0 {
+		t.Fatalf("nothing should be pruned, got %d", len(toPrune))
+	}
+}
+
+func TestCrashesFsck(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dataDirLockPath(dir), []byte("999999999"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// lock of a process that doesn't run is ignored
+	if unlock, err = lockDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = s.SaveCrash("SumatraPDF", "3.0", "10.0.0.1", []byte(fmt.Sprintf("crash %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// starring and un-starring leaves 2 lines that compacting drops
+	for _, starred := range []bool{true, false} {
+		if err = s.SetStarred(s.crashes[0], starred); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.dataFile.Close()
+
+	res, err := fsckCrashes(dir, false)
+	if err != nil || res.HasErrors() || res.Checked != 3 {
+		t.Fatalf("fsckCrashes() returned %v, %v", res, err)
+	}
+
+	corrupt := s.MessageFilePath(s.crashes[1].Sha1[:])
+	missing := s.MessageFilePath(s.crashes[2].Sha1[:])
+	dangling := blobCrahesPath(dir, strings.Repeat("ab", 20))
+	if err = ioutil.WriteFile(corrupt, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(dangling), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dangling, []byte("dangling"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = fsckCrashes(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Corrupt) != 1 || res.Corrupt[0] != corrupt || len(res.Missing) != 1 || res.Missing[0] != missing || len(res.Dangling) != 1 || res.Dangling[0] != dangling || res.Quarantined != 1 {
+		t.Fatalf("bad report:\n%s", res)
+	}
+	if s.MessageFileExists(s.crashes[1].Sha1[:]) {
+		t.Fatalf("corrupt file %s wasn't quarantined", corrupt)
+	}
+
+	before, after, err := compactCrashes(dir)
+	if err != nil || after >= before {
+		t.Fatalf("compactCrashes() returned %d, %d, %v", before, after, err)
+	}
+	s2, err := loadStoreCrashesIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.CrashesCount() != 3 || s2.crashes[0].IsStarred {
+		t.Fatalf("bad state after compacting")
+	}
+	for i, c := range s2.crashes {
+		if c.Sha1 != s.crashes[i].Sha1 || *c.CrashingLine != *s.crashes[i].CrashingLine {
+			t.Fatalf("crash %d changed after compacting", i)
+		}
+	}
+}
+
+// fails uploads like an interrupted run
+type failingPutTarget struct {
+	BackupTarget
+}
+
+func (t failingPutTarget) Put(path string, r io.Reader) error {
+	return errors.New("connection reset")
+}
+
+func TestCrashArchive(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports [][]byte
+	for i := 0; i < 3; i++ {
+		d := []byte(fmt.Sprintf("crash %d %s", i, strings.Repeat("x", 600*i)))
+		reports = append(reports, d)
+		if err = s.SaveCrash("SumatraPDF", "3.0", "10.0.0.1", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.SetStarred(s.crashes[2], true); err != nil {
+		t.Fatal(err)
+	}
+	key, err := backupKeyFromHex(strings.Repeat("ab", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &localDirTarget{dir: filepath.Join(dir, "backup")}
+	now := time.Now().AddDate(0, 0, 10)
+
+	if _, _, err = s.Archive(failingPutTarget{target}, key, now, 5); err == nil {
+		t.Fatalf("Archive() didn't fail")
+	}
+	left, _ := filepath.Glob(filepath.Join(crashArchiveSpoolDir(dir), "*.tar.gz"))
+	if len(left) != 1 || s.crashes[0].IsArchived() || !s.MessageFileExists(s.crashes[0].Sha1[:]) {
+		t.Fatalf("bad state after interrupted archiving, left: %v", left)
+	}
+	// resumes upload of the bundle left over by the failed run
+	nFiles, _, err := s.Archive(target, key, now, 5)
+	if err != nil || nFiles != 2 {
+		t.Fatalf("Archive() returned %d, %v", nFiles, err)
+	}
+	if left, _ = filepath.Glob(filepath.Join(crashArchiveSpoolDir(dir), "*")); len(left) != 0 {
+		t.Fatalf("left over bundles: %v", left)
+	}
+	if !s.crashes[1].IsArchived() || s.crashes[2].IsArchived() || s.MessageFileExists(s.crashes[1].Sha1[:]) || !s.MessageFileExists(s.crashes[2].Sha1[:]) {
+		t.Fatalf("bad state after archiving")
+	}
+	if !strings.HasSuffix(s.crashes[0].Archive, ".tar.gz.enc") || s.crashes[0].ArchiveOffset != 0 || s.crashes[1].ArchiveOffset != 1024 {
+		t.Fatalf("crash archived in %s at %d", s.crashes[0].Archive, s.crashes[0].ArchiveOffset)
+	}
+	// nothing more to archive
+	if nFiles, _, err = s.Archive(target, key, now, 5); err != nil || nFiles != 0 {
+		t.Fatalf("Archive() returned %d, %v", nFiles, err)
+	}
+	s.dataFile.Close()
+
+	s, err = NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	c := s.crashes[1]
+	if c.Archive != s.crashes[0].Archive || c.ArchiveOffset != 1024 {
+		t.Fatalf("archive of crash not read from index: %s %d", c.Archive, c.ArchiveOffset)
+	}
+	if _, err = s.FetchArchived(target, nil, c); err == nil {
+		t.Fatalf("fetching encrypted archive without key didn't fail")
+	}
+	d, err := s.FetchArchived(target, key, c)
+	if err != nil || !bytes.Equal(d, reports[1]) {
+		t.Fatalf("FetchArchived() returned %q, %v", d, err)
+	}
+	if d, err = ioutil.ReadFile(s.MessageFilePath(c.Sha1[:])); err != nil || !bytes.Equal(d, reports[1]) {
+		t.Fatalf("fetched report wasn't cached: %v", err)
+	}
+	res, err := fsckCrashes(dir, false)
+	if err != nil || res.HasErrors() || res.Checked != 1 {
+		t.Fatalf("fsckCrashes() returned %v, %v", res, err)
+	}
+}
+
+func TestCrashSignature(t *testing.T) {
+	initTestGlobals()
+	sig := ExtractSumatraCrashSignature(test)
+	exp := "CrashMe;PrintToDevice;PrintThreadData::PrintThread;kernel32.dll!BaseThreadInitThunk;ntdll.dll!RtlInitializeExceptionChain"
+	if sig != exp {
+		t.Fatalf("got %q, expected %q", sig, exp)
+	}
+	if sig = ExtractSumatraCrashSignature([]byte("garbage")); sig != "" {
+		t.Fatalf("got %q for unparseable crash", sig)
+	}
+
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same crash in a different build has different addresses and offsets
+	other := bytes.Replace(test, []byte("CrashMe+0x2"), []byte("CrashMe+0x8"), 1)
+	crashes := [][]byte{test, []byte("garbage"), other}
+	for i, d := range crashes {
+		if err = s.SaveCrash("SumatraPDF", fmt.Sprintf("3.%d", i), "10.0.0.1", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.dataFile.Close()
+
+	s, err = NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	groups := s.GetCrashesBySignature(s.GetAppByName("SumatraPDF"))
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(groups))
+	}
+	g := groups[0]
+	if g.Signature != exp || g.CrashesCount() != 2 || g.FirstSeenVersion() != "3.0" || g.LastSeenVersion() != "3.2" {
+		t.Fatalf("bad group %q, count: %d", g.Signature, g.CrashesCount())
+	}
+	if groups[1].Name() != "unparsed" || groups[1].CrashesCount() != 1 {
+		t.Fatalf("bad unparsed group %q", groups[1].Name())
+	}
+}
+
+func TestOutboundLinks(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+
+	body := `<a href="https://github.com/kjk?a=1&amp;b=2">gh</a> <a href="/article/1/foo.html">me</a> <a href="http://blog.kowalczyk.info/">home</a>`
+	s := trackOutboundLinks(5, body)
+	if !strings.Contains(s, `href="/out?`) || strings.Count(s, "/out?") != 1 || !strings.Contains(s, `href="http://blog.kowalczyk.info/"`) {
+		t.Fatalf("bad rewrite: %s", s)
+	}
+	outUrl := html.UnescapeString(regexp.MustCompile(`href="(/out[^"]+)"`).FindStringSubmatch(s)[1])
+
+	w := httptest.NewRecorder()
+	handleOutboundLink(w, httptest.NewRequest("GET", outUrl, nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://github.com/kjk?a=1&b=2" {
+		t.Fatalf("got %d, location: %q", w.Code, w.Header().Get("Location"))
+	}
+	// can't be used to redirect to arbitrary urls
+	tampered := strings.Replace(outUrl, "github.com", "evil.com", 1)
+	w = httptest.NewRecorder()
+	handleOutboundLink(w, httptest.NewRequest("GET", tampered, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("tampered link returned %d", w.Code)
+	}
+
+	clicks := getOutboundClicks(5)
+	if len(clicks) != 1 || clicks[0].Host != "github.com" || clicks[0].Count != 1 {
+		t.Fatalf("bad clicks: %v", clicks)
+	}
+	// counts survive restart and only the host is stored
+	d, err := ioutil.ReadFile(outboundClicksPath())
+	if err != nil || string(d) != "5|github.com\n" {
+		t.Fatalf("bad outbound clicks file: %q, %v", d, err)
+	}
+	outboundClicksMu.Lock()
+	outboundClicks = make(map[int]map[string]int)
+	outboundClicksMu.Unlock()
+	readOutboundClicks()
+	if clicks = getOutboundClicks(5); len(clicks) != 1 || clicks[0].Count != 1 {
+		t.Fatalf("bad clicks after reload: %v", clicks)
+	}
+}
+
+func TestCrashFilter(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	crashes := []struct {
+		ver string
+		d   string
+	}{
+		{"3.1.2", "OS: Windows 7 SP1\n" + string(test)},
+		{"3.1.2", "OS: Windows 10\ngarbage"},
+		{"3.1.1", "OS: Windows 10\n" + string(test)},
+	}
+	for _, c := range crashes {
+		if err = s.SaveCrash("SumatraPDF", c.ver, "10.0.0.1", []byte(c.d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.crashes[0].CreatedOn = time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC)
+	app := s.GetAppByName("SumatraPDF")
+
+	filter := func(query string) ([]*Crash, error) {
+		r := httptest.NewRequest("GET", "/app/crashes?"+query, nil)
+		f, err := parseCrashFilter(r, "SumatraPDF")
+		if err != nil {
+			return nil, err
+		}
+		return s.FilterCrashes(app, f), nil
+	}
+	tests := []struct {
+		query string
+		ids   string
+	}{
+		{"ver=3.1.2&contains=printtodevice", "0"},
+		{"ver=3.1.2", "1,0"},
+		{"os=windows+10", "2,1"},
+		{"from=2014-01-01&to=2014-01-03", "0"},
+		{"contains=PrintThread&os=windows", "2,0"},
+	}
+	for _, test := range tests {
+		res, err := filter(test.query)
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		var ids []string
+		for _, c := range res {
+			ids = append(ids, fmt.Sprintf("%d", c.Id))
+		}
+		if got := strings.Join(ids, ","); got != test.ids {
+			t.Fatalf("%s: got %q, expected %q", test.query, got, test.ids)
+		}
+	}
+	for _, query := range []string{"from=yesterday", "from=2014-02-01&to=2014-01-01"} {
+		if _, err = filter(query); err == nil {
+			t.Fatalf("%s: invalid filter not rejected", query)
+		}
+	}
+
+	f := &CrashFilter{AppName: "SumatraPDF", Ver: "3.1.2", Os: "win"}
+	active := f.Active()
+	if len(active) != 2 || active[0].RemoveUrl != "/app/crashes?app_name=SumatraPDF&os=win" {
+		t.Fatalf("bad active filters: %v", active)
+	}
+	if u := f.PageUrl(2); u != "/app/crashes?app_name=SumatraPDF&os=win&page=2&ver=3.1.2" {
+		t.Fatalf("bad page url: %s", u)
+	}
+
+	prevStoreCrashes := storeCrashes
+	storeCrashes = s
+	defer func() { storeCrashes = prevStoreCrashes }()
+	for _, query := range []string{"ver=3.1.2", "from=yesterday", ""} {
+		w := httptest.NewRecorder()
+		handleCrashes(w, newTestRequest("GET", "/app/crashes?app_name=SumatraPDF&"+query, "kjk"))
+		body := w.Body.String()
+		if w.Code != http.StatusOK || strings.Contains(body, "class=\"error\"") != (query == "from=yesterday") {
+			t.Fatalf("%s: got %d, %s", query, w.Code, body)
+		}
+	}
+	// version comes from the client
+	if err = s.SaveCrash("SumatraPDF", "<script>x</script>", "10.0.0.1", test); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"", "&contains=CrashMe"} {
+		w := httptest.NewRecorder()
+		handleCrashes(w, newTestRequest("GET", "/app/crashes?app_name=SumatraPDF"+query, "kjk"))
+		if body := w.Body.String(); strings.Contains(body, "<script>x") || !strings.Contains(body, "&lt;script&gt;x") {
+			t.Fatalf("%s: version not escaped: %s", query, body)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	initTestGlobals()
+	m := NewMetrics()
+	ls := NewLoadShedder(4, 2, m)
+	release := make(chan struct{})
+	started := make(chan struct{}, 16)
+	h := newTimingHandler(m, ls.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("block") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		textResponse(w, r, "ok")
+	}))
+	get := func(url, user string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest("GET", url, user))
+		return w.Code
+	}
+
+	// fill crash limit and then the global limit with slow requests
+	var wg sync.WaitGroup
+	codes := make(chan int, 16)
+	for _, url := range []string{"/app/crashes?block=1", "/app/crashes?block=1", "/app/tags?block=1", "/archives.html?block=1"} {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			codes <- get(url, "")
+		}(url)
+		<-started
+	}
+
+	// a burst of expensive requests gets shed quickly
+	var burst sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		burst.Add(1)
+		go func(i int) {
+			defer burst.Done()
+			url := "/app/tags"
+			if i%2 == 0 {
+				url = "/app/crashshow"
+			}
+			if code := get(url, ""); code != http.StatusServiceUnavailable {
+				t.Errorf("%s: got %d, expected 503", url, code)
+			}
+		}(i)
+	}
+	burst.Wait()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("GET", "/app/crashes", ""))
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("no Retry-After in shed response")
+	}
+
+	// cheap pages and admin's requests are still served
+	for _, url := range []string{"/article/1/foo.html", "/", "/static/main.css", "/app/crashsubmit"} {
+		if code := get(url, ""); code != http.StatusOK {
+			t.Fatalf("%s: got %d while overloaded", url, code)
+		}
+	}
+	for _, url := range []string{"/app/crashes", "/app/tags", "/app/404s"} {
+		if code := get(url, "kjk"); code != http.StatusOK {
+			t.Fatalf("%s: admin got %d while overloaded", url, code)
+		}
+	}
+
+	stats := ls.Stats()
+	if stats.CurrReqs != 4 || stats.CurrCrashReqs != 2 || stats.ShedReqs != 33 {
+		t.Fatalf("bad stats while overloaded: %+v", stats)
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("blocked request got %d", code)
+		}
+	}
+	if stats = ls.Stats(); stats.CurrReqs != 0 || stats.CurrCrashReqs != 0 || m.CurrentCrashReqs.Count() != 0 {
+		t.Fatalf("bad stats after load: %+v", stats)
+	}
+	if code := get("/app/crashes", ""); code != http.StatusOK {
+		t.Fatalf("got %d after load went down", code)
+	}
+}
+
+func TestCrashApiV2(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "crashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStoreCrashes := storeCrashes
+	storeCrashes = s
+	defer func() { storeCrashes = prevStoreCrashes }()
+
+	post := func(body []byte, compress bool) (int, CrashApiResponse) {
+		if compress {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			body = buf.Bytes()
+		}
+		r := httptest.NewRequest("POST", "/api/crash/v2", bytes.NewReader(body))
+		if compress {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		handleCrashApiV2(w, r)
+		var rsp CrashApiResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("invalid json response %q", w.Body.String())
+		}
+		return w.Code, rsp
+	}
+
+	req := CrashApiRequest{AppName: "SumatraPDF", AppVer: "3.1.2", Os: "Windows 10", InstallId: "abc123", Crash: string(test)}
+	body, _ := json.Marshal(req)
+	code, rsp := post(body, true)
+	if code != http.StatusOK || rsp.Id == nil || *rsp.Id != 0 {
+		t.Fatalf("got %d, %+v", code, rsp)
+	}
+	// plain json works too, same crash from a different install keeps its
+	// own os and install id
+	other := req
+	other.Os, other.InstallId = "Windows 8", ""
+	otherBody, _ := json.Marshal(other)
+	if code, rsp = post(otherBody, false); code != http.StatusOK || *rsp.Id != 1 {
+		t.Fatalf("got %d, %+v", code, rsp)
+	}
+
+	bad := req
+	bad.Os = "Windows\nC|foo"
+	body, _ = json.Marshal(bad)
+	if code, rsp = post(body, true); code != http.StatusBadRequest || rsp.Error == "" {
+		t.Fatalf("invalid os: got %d, %+v", code, rsp)
+	}
+	big := req
+	big.Crash = strings.Repeat("a", maxCrashApiPayload)
+	body, _ = json.Marshal(big)
+	if code, _ = post(body, true); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too big: got %d", code)
+	}
+	if code, _ = post([]byte("not json"), true); code != http.StatusBadRequest {
+		t.Fatalf("not json: got %d", code)
+	}
+
+	// the old endpoint stores crashes the same way
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "crash.txt")
+	fw.Write([]byte("Ver: 3.1.2\nOS: Windows 7\n" + string(test)))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/app/crashsubmit?appname=SumatraPDF", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	handleCrashSubmit(httptest.NewRecorder(), r)
+	s.dataFile.Close()
+
+	s, err = NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	if s.CrashesCount() != 3 {
+		t.Fatalf("expected 3 crashes, got %d", s.CrashesCount())
+	}
+	c := s.GetCrashById(0)
+	if c.OsName() != "Windows 10" || c.InstallId == nil || *c.InstallId != "abc123" || *c.Signature == "" {
+		t.Fatalf("bad api crash: os: %q", c.OsName())
+	}
+	c = s.GetCrashById(1)
+	if c.Sha1 != s.GetCrashById(0).Sha1 || c.OsName() != "Windows 8" || c.InstallId != nil {
+		t.Fatalf("bad duplicate api crash: os: %q", c.OsName())
+	}
+	c = s.GetCrashById(2)
+	if c.OsName() != "Windows 7" || c.InstallId != nil || c.Version() != "3.1.2" || *c.Signature != *s.GetCrashById(0).Signature {
+		t.Fatalf("bad plain text crash: os: %q, ver: %q", c.OsName(), c.Version())
+	}
+}
+
+func TestLinkifyCrashReport(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "sumatrasrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"src/utils/BaseUtil.cpp", "src/Print.cpp", "ext/openjpeg/j2k.c", "src/Print.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := buildSrcIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.FilesCount() != 3 {
+		t.Fatalf("expected 3 files, got %d", idx.FilesCount())
+	}
+
+	urlTmpl := "https://github.com/sumatrapdfreader/sumatrapdf/blob/master/${path}#L${line}"
+	crash := append([]byte("<script>\n"), test...)
+	timeStart := time.Now()
+	s := string(linkifyCrashReport(crash, idx, urlTmpl))
+	if dur := time.Since(timeStart); dur > 50*time.Millisecond {
+		t.Fatalf("linkifyCrashReport() took %s", dur)
+	}
+	exp := `sumatrapdf.exe!CrashMe+0x2 <a href="https://github.com/sumatrapdfreader/sumatrapdf/blob/master/src/utils/BaseUtil.cpp#L14">c:\users\kkowalczyk\src\sumatrapdf\src\utils\baseutil.cpp+14</a>`
+	if !strings.Contains(s, exp) || strings.Count(s, "<a href") != 3 {
+		t.Fatalf("bad links in:\n%s", s)
+	}
+	if strings.Contains(s, "<script>") {
+		t.Fatalf("crash report not escaped")
+	}
+	// without an index there are no links
+	if s = string(linkifyCrashReport(crash, nil, "")); strings.Contains(s, "<a ") {
+		t.Fatalf("unexpected links in:\n%s", s)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	initTestGlobals()
+	var gotId string
+	h := newTimingHandler(NewMetrics(), func(w http.ResponseWriter, r *http.Request) {
+		gotId = getRequestId(r)
+		textResponse(w, r, "hello")
+	})
+	w := httptest.NewRecorder()
+	r := newTestRequest("GET", "/", "")
+	h.ServeHTTP(w, r)
+	id := w.Header().Get("X-Request-Id")
+	if id == "" || id != gotId {
+		t.Fatalf("X-Request-Id is %q, id in handler is %q", id, gotId)
+	}
+	// it's only in the request passed to the handler
+	if id := getRequestId(r); id != "" {
+		t.Fatalf("id %q is in the original request", id)
+	}
+	h.ServeHTTP(w, newTestRequest("GET", "/", ""))
+	if id2 := w.Header().Get("X-Request-Id"); id2 == id {
+		t.Fatalf("two requests got the same id %q", id)
+	}
+	if id := getRequestId(httptest.NewRequest("GET", "/", nil)); id != "" {
+		t.Fatalf("got id %q for request without id", id)
+	}
+
+	l := NewServerLogger(16, 16, false)
+	kv := []interface{}{"path", "/a b", "status", 200, "size", 0}
+	s := l.formatFields("request", "request", kv)
+	if exp := `request path="/a b" status=200 size=0`; s != exp {
+		t.Fatalf("got %q, expected %q", s, exp)
+	}
+	l.JSON = true
+	s = l.formatFields("request", "request", kv)
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid json %q: %s", s, err)
+	}
+	if v["level"] != "request" || v["path"] != "/a b" || v["status"] != 200.0 || v["time"] == nil {
+		t.Fatalf("bad json %q", s)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	initTestGlobals()
+	s := NewTrafficStats()
+	now := time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+	for i := 1; i <= 100; i++ {
+		s.Add("/slow", trafficHuman, http.StatusOK, time.Duration(i)*time.Millisecond, now)
+	}
+	s.Add("/fast", trafficHuman, http.StatusOK, time.Millisecond, now.Add(-2*time.Hour))
+	s.Add("/missing", trafficHuman, http.StatusNotFound, time.Second, now)
+	// counts older than a day are ignored
+	s.Add("/fast", trafficHuman, http.StatusOK, time.Millisecond, now.Add(-24*time.Hour))
+	// counted but latencies of the admin and bots are not remembered
+	s.Add("/admin", trafficAdmin, http.StatusOK, time.Second, now)
+	s.Add("/bot", trafficBot, http.StatusOK, time.Second, now)
+	s.Add("/bot", trafficBot, http.StatusOK, time.Second, now)
+
+	hours := s.RequestsPerHour(now)
+	if len(hours) != dashboardHours {
+		t.Fatalf("got %d hours", len(hours))
+	}
+	last := hours[len(hours)-1]
+	if last.Hour != "2016-03-01 12:00" || last.Count != 104 || last.Human != 101 || last.Admin != 1 || last.Bot != 2 {
+		t.Fatalf("bad last hour: %+v", last)
+	}
+	if hours[len(hours)-3].Count != 1 || hours[0].Count != 0 {
+		t.Fatalf("bad hours: %+v", hours)
+	}
+
+	slowest := s.Slowest(10)
+	if len(slowest) != 2 {
+		t.Fatalf("got %d urls, 404s shouldn't be included", len(slowest))
+	}
+	if u := slowest[0]; u.Url != "/slow" || u.P50Ms != 50 || u.P95Ms != 95 || u.Count != 100 {
+		t.Fatalf("bad latencies: %+v", u)
+	}
+
+	w := httptest.NewRecorder()
+	handleDashboardJson(w, newTestRequest("GET", "/app/dashboard.json", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("non-admin got %d", w.Code)
+	}
+	setLastBackup("", fmt.Errorf("no network"))
+	w = httptest.NewRecorder()
+	handleDashboardJson(w, newTestRequest("GET", "/app/dashboard.json", "kjk"))
+	var d DashboardData
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatalf("invalid json: %s", err)
+	}
+	if len(d.RequestsPerHour) != dashboardHours || d.Backup == nil || !d.Backup.Failed || d.Backup.Result != "no network" {
+		t.Fatalf("bad dashboard data: %s", w.Body.String())
+	}
+}
+
+func TestSuppress404(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "ignored404s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+
+	// defaults are written to the file on first start
+	readIgnored404s()
+	if shouldLog404("/crossdomain.xml") || shouldLog404("/apple-touch-icon-120x120.png") {
+		t.Fatalf("default ignored 404s are logged")
+	}
+	m := NewMetrics()
+	h := newTimingHandler(m, http.NotFound)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/wp-login.php", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/crossdomain.xml", nil))
+	if m.Logged404s.Count() != 1 || m.Suppressed404s.Count() != 1 {
+		t.Fatalf("logged: %d, suppressed: %d", m.Logged404s.Count(), m.Suppressed404s.Count())
+	}
+
+	w := httptest.NewRecorder()
+	r := newTestRequest("POST", "/app/404s", "kjk")
+	r.Form = map[string][]string{"ignore": {"/wp-login.php"}, "csrf_token": {testCsrfToken}}
+	handle404s(w, r)
+	if w.Code != http.StatusSeeOther || shouldLog404("/wp-login.php") {
+		t.Fatalf("got %d, url not suppressed", w.Code)
+	}
+	if err = suppress404("/wp-login.php"); err != nil {
+		t.Fatal(err)
+	}
+
+	// survives restart, written once
+	noLog404Mu.Lock()
+	noLog404 = make(map[string]bool)
+	noLog404Mu.Unlock()
+	readIgnored404s()
+	if shouldLog404("/wp-login.php") || !shouldLog404("/index.php") {
+		t.Fatalf("bad ignored 404s after reload")
+	}
+	d, _ := ioutil.ReadFile(ignored404sPath())
+	if n := strings.Count(string(d), "/wp-login.php\n"); n != 1 {
+		t.Fatalf("url written %d times", n)
+	}
+
+	getConfig().Ignored404Prefixes = []string{"/wp-"}
+	defer func() { getConfig().Ignored404Prefixes = nil }()
+	if shouldLog404("/wp-admin/") || !shouldLog404("/apple-touch-icon.png") {
+		t.Fatalf("Ignored404Prefixes not used")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	initTestGlobals()
+	anyArticle := func(int) bool { return true }
+	d, err := ioutil.ReadFile("article_redirects.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := parseRedirects(d, anyArticle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 || list[0].ArticleId != 3 || list[0].From != "/article/Diet.html" {
+		t.Fatalf("bad first redirect: %#v", list[0])
+	}
+	// saving doesn't change the file
+	var buf bytes.Buffer
+	for _, r := range list {
+		buf.WriteString(r.line() + "\n")
+	}
+	if buf.String() != strings.TrimSpace(string(d))+"\n" {
+		t.Fatalf("saved redirects differ from article_redirects.txt")
+	}
+
+	dir, err := ioutil.TempDir("", "redirects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "article_redirects.txt")
+	prevHits := redirectHits
+	redirectHits = &RedirectHits{Hits: make(map[string]int)}
+	defer func() { redirectHits = prevHits }()
+	rs := NewRedirects(map[string]string{"/index.html": "/"})
+	add := func(from, to string) {
+		r, err := newRedirect(from, to, anyArticle)
+		if err != nil {
+			t.Fatalf("newRedirect(%q, %q) failed with %s", from, to, err)
+		}
+		if err = rs.Add(r, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("re:/blog/(\\d+)/(\\d+)/(.*)", "/$3")
+	add("/blog/2005/01/exact.html", "/exact.html")
+	add("/old.html", "/new.html")
+	add("/old.html", "/newer.html")
+	add("re:/go(.*)", "$1")
+	tests := [][2]string{
+		{"/index.html", "/"},
+		{"/blog/2005/01/exact.html", "/exact.html"},
+		{"/blog/2006/02/foo.html", "/foo.html"},
+		{"/x/blog/2006/02/foo.html", ""},
+		{"/old.html", "/newer.html"},
+		{"/missing.html", ""},
+	}
+	for _, test := range tests {
+		if got, err := rs.Find(test[0]); got != test[1] || err != nil {
+			t.Errorf("Find(%q) = %q, %v, expected %q", test[0], got, err, test[1])
+		}
+	}
+	// pattern can't be used to redirect to other sites
+	for _, uri := range []string{"/go//evil.com/", "/go/\\evil.com/", "/gohttp://evil.com/"} {
+		if got, err := rs.Find(uri); got != "" || err != errRedirectNotLocal {
+			t.Errorf("Find(%q) = %q, %v", uri, got, err)
+		}
+	}
+	if got, err := rs.Find("/go/x/y.html"); got != "/x/y.html" || err != nil {
+		t.Errorf("Find() = %q, %v", got, err)
+	}
+	d, _ = ioutil.ReadFile(path)
+	if exp := "re:/blog/(\\d+)/(\\d+)/(.*)|/$3\n/blog/2005/01/exact.html|/exact.html\n/old.html|/newer.html\nre:/go(.*)|$1\n"; string(d) != exp {
+		t.Fatalf("bad file:\n%s", d)
+	}
+	for _, r := range rs.All() {
+		if r.From == "/old.html" && r.Hits() != 1 {
+			t.Fatalf("got %d hits", r.Hits())
+		}
+	}
+	// hits are kept across restarts
+	hitsPath := filepath.Join(dir, "redirect_hits.json")
+	if err = redirectHits.save(hitsPath); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := loadRedirectHits(hitsPath); err != nil || h.Get("/old.html") != 1 || h.Get("re:/go(.*)") != 1 {
+		t.Fatalf("loadRedirectHits() returned %v, %v", h, err)
+	}
+
+	if ok, err := rs.Delete("re:/blog/(\\d+)/(\\d+)/(.*)", path); !ok || err != nil {
+		t.Fatalf("Delete() returned %v, %v", ok, err)
+	}
+	if got, _ := rs.Find("/blog/2006/02/foo.html"); got != "" {
+		t.Fatalf("deleted pattern still redirects to %q", got)
+	}
+	if ok, _ := rs.Delete("/index.html", path); ok {
+		t.Fatalf("deleted built-in redirect")
+	}
+	d, _ = ioutil.ReadFile(path)
+	list, err = parseRedirects(d, anyArticle)
+	if err != nil || len(list) != 3 {
+		t.Fatalf("got %d redirects after delete, %v", len(list), err)
+	}
+
+	for _, bad := range [][2]string{{"old.html", "/new.html"}, {"re:(", "/"}, {"/a|b", "/"}, {"/a", ""}, {"/a", "/b|c"}, {"re:/a", "/b|c"}, {"/a\nb", "/c"}} {
+		if _, err := newRedirect(bad[0], bad[1], anyArticle); err == nil {
+			t.Errorf("newRedirect(%q, %q) didn't fail", bad[0], bad[1])
+		}
+	}
+	// alternation in patterns
+	list, err = parseRedirects([]byte("re:/(a|b)/(.*)|/$2\n"), anyArticle)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("parseRedirects() of pattern with '|' returned %v, %v", list, err)
+	}
+	if to, err := list[0].target("/b/x.html"); err != nil || to != "/x.html" {
+		t.Fatalf("pattern with '|' redirects to %q, %v", to, err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	authKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	encrKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	write := func(extra string) {
+		s := fmt.Sprintf(`{"CookieAuthKeyHexStr":"%s","CookieEncrKeyHexStr":"%s"%s}`, authKey, encrKey, extra)
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`,"TLSHosts":["blog.example.com"]`)
+	c, err := parseConfig(mustReadFile(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(c)
+
+	write(`,"TLSHosts":["other.example.com"],"CrashRetentionDays":30,"AwsAccess":"key"`)
+	res, err := reloadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Changed, ",") != "AwsAccess,CrashRetentionDays" || strings.Join(res.RequiresRestart, ",") != "TLSHosts" {
+		t.Fatalf("bad reload result: %s", res)
+	}
+	c = getConfig()
+	if c.CrashRetentionDays != 30 || *c.AwsAccess != "key" || c.TLSHosts[0] != "blog.example.com" {
+		t.Fatalf("bad config after reload: %+v", c)
+	}
+	if strings.Contains(res.String(), "key") {
+		t.Fatalf("reload result shows values: %s", res)
+	}
+
+	// invalid config is rejected and the current one is kept
+	encrKey = "zz"
+	write(`,"CrashRetentionDays":1`)
+	if _, err = reloadConfig(path); err == nil {
+		t.Fatalf("invalid cookie key accepted")
+	}
+	if getConfig() != c {
+		t.Fatalf("config changed after failed reload")
+	}
+
+	w := httptest.NewRecorder()
+	handleReloadConfig(w, newTestRequest("POST", "/app/reload-config", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("non-admin got %d", w.Code)
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestBackupManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "backup.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	files := map[string]string{"crashesdata.txt": "C1|2\n", "tag_aliases.txt": "go|golang\n"}
+	for name, s := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(s))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	zipData := mustReadFile(t, zipPath)
+
+	blob := []byte("crash report")
+	blobSha1 := sha1HexOfBytes(blob)
+	blobPath := blobSha1[:2] + "/" + blobSha1[2:4] + "/" + blobSha1
+	zipKey := "blog/160301_1204_" + sha1HexOfBytes(zipData) + ".zip"
+	if key := backupManifestKey(zipKey); !strings.HasSuffix(key, "_"+sha1HexOfBytes(zipData)+".manifest.json") {
+		t.Fatalf("bad manifest key %q", key)
+	}
+	m, err := newBackupManifest(zipPath, zipKey, sha1HexOfBytes(zipData), []string{blobPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Files[0].Size == 0 {
+		t.Fatalf("bad manifest: %+v", m)
+	}
+
+	// fake s3
+	objects := map[string][]byte{
+		zipKey: zipData,
+		blobBackupPath("blog/blobs_crashes", blobPath): blob,
+	}
+	get := func(key string) ([]byte, error) {
+		if d, ok := objects[key]; ok {
+			return d, nil
+		}
+		return nil, fmt.Errorf("no %s", key)
+	}
+	if n, err := verifyBackupSample(get, m, "blog/blobs_crashes", 5); n != 2 || err != nil {
+		t.Fatalf("verifyBackupSample() returned %d, %v", n, err)
+	}
+
+	dst := filepath.Join(dir, "restored")
+	res, err := restoreFromManifest(get, m, "blog/blobs_crashes", dst)
+	if err != nil || len(res.Errors) != 0 || res.Files != 2 || res.Blobs != 1 {
+		t.Fatalf("restoreFromManifest() returned %v, %v", res, err)
+	}
+	for name, s := range files {
+		if d := mustReadFile(t, filepath.Join(dst, "data", name)); string(d) != s {
+			t.Fatalf("bad restored %s: %q", name, d)
+		}
+	}
+	mustReadFile(t, filepath.Join(dst, "blobs_crashes", filepath.FromSlash(blobPath)))
+
+	// corrupted uploads are detected
+	objects[blobBackupPath("blog/blobs_crashes", blobPath)] = []byte("garbage")
+	if _, err = verifyBackupSample(get, m, "blog/blobs_crashes", 5); err == nil {
+		t.Fatalf("corrupted blob not detected")
+	}
+	res, err = restoreFromManifest(get, m, "blog/blobs_crashes", filepath.Join(dir, "restored2"))
+	if err != nil || len(res.Errors) != 1 {
+		t.Fatalf("restoreFromManifest() returned %v, %v", res, err)
+	}
+	objects[zipKey] = append(zipData, 0)
+	if _, err = verifyBackupSample(get, m, "blog/blobs_crashes", 0); err == nil {
+		t.Fatalf("corrupted zip not detected")
+	}
+}
+
+type fakeBackupRemote struct {
+	files map[string]int64
+	puts  []string
+	dels  []string
+}
+
+func (r *fakeBackupRemote) List() (map[string]int64, error) {
+	res := make(map[string]int64)
+	for k, v := range r.files {
+		res[k] = v
+	}
+	return res, nil
+}
+
+func (r *fakeBackupRemote) Put(localPath, path string) error {
+	st, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	r.files[path] = st.Size()
+	r.puts = append(r.puts, path)
+	return nil
+}
+
+func (r *fakeBackupRemote) Del(path string) error {
+	delete(r.files, path)
+	r.dels = append(r.dels, path)
+	return nil
+}
+
+func (r *fakeBackupRemote) KeyId() string {
+	return ""
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobsDir := filepath.Join(dir, "blobs_crashes")
+	write := func(rel, s string) {
+		path := filepath.Join(blobsDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("aa/bb/a", "hello")
+	write("cc/dd/b", "world!")
+	remote := &fakeBackupRemote{files: map[string]int64{"aa/bb/a": 5, "ee/ff/gone": 3}}
+
+	statePath := backupStatePath(dir)
+	state, err := readBackupState(statePath)
+	if err != nil || !state.needsFullSync(time.Now()) {
+		t.Fatalf("new state: %v, %v", state, err)
+	}
+	stats, paths, err := syncBackupDir(remote, blobsDir, state, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || stats.UploadedFiles != 1 || stats.SkippedFiles != 1 || stats.SkippedBytes != 5 || stats.KeptFiles != 1 {
+		t.Fatalf("bad full sync stats: %+v", stats)
+	}
+	if len(remote.puts) != 1 || remote.puts[0] != "cc/dd/b" {
+		t.Fatalf("bad uploads: %v", remote.puts)
+	}
+	state.LastFullSync = time.Now()
+	if err = state.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = readBackupState(statePath); err != nil || len(state.Files) != 2 || state.needsFullSync(time.Now()) {
+		t.Fatalf("bad saved state: %+v, %v", state, err)
+	}
+
+	// only changed files are uploaded
+	remote.puts = nil
+	write("cc/dd/b", "world, again")
+	stats, _, err = syncBackupDir(remote, blobsDir, state, false, false)
+	if err != nil || stats.UploadedFiles != 1 || stats.UploadedBytes != 12 || stats.SkippedFiles != 1 {
+		t.Fatalf("bad incremental stats: %+v, %v", stats, err)
+	}
+
+	// files deleted locally are only deleted from s3 if asked to
+	os.Remove(filepath.Join(blobsDir, "aa", "bb", "a"))
+	stats, _, err = syncBackupDir(remote, blobsDir, state, false, true)
+	if err != nil || stats.DeletedFiles != 1 || len(remote.dels) != 1 || remote.dels[0] != "aa/bb/a" {
+		t.Fatalf("bad delete stats: %+v, %v, deleted: %v", stats, err, remote.dels)
+	}
+	if _, ok := state.Files["aa/bb/a"]; ok {
+		t.Fatalf("deleted file still in state")
+	}
+
+	// missing dir is not an error
+	if _, paths, err = syncBackupDir(remote, filepath.Join(dir, "missing"), &BackupState{Files: map[string]backupFileState{}}, false, false); err != nil || len(paths) != 0 {
+		t.Fatalf("missing dir: %v, %v", paths, err)
+	}
+}
+
+func TestLocalDirBackupTarget(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "backup_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := "local"
+	target, err := newBackupTarget(&Config{BackupTarget: &local})
+	if err == nil {
+		t.Fatalf("missing BackupLocalDir not detected")
+	}
+	backupDir := filepath.Join(dir, "backup")
+	target, err = newBackupTarget(&Config{BackupTarget: &local, BackupLocalDir: &backupDir})
+	if err != nil || target.Name() != "local" {
+		t.Fatalf("newBackupTarget() returned %v, %v", target, err)
+	}
+	if files, err := target.List("", false); err != nil || len(files) != 0 {
+		t.Fatalf("List() of missing dir returned %v, %v", files, err)
+	}
+
+	zip1 := "160301_1204_" + strings.Repeat("a", 40) + ".zip"
+	zip2 := "160302_1204_" + strings.Repeat("b", 40) + ".zip"
+	for _, name := range []string{zip2, zip1, backupManifestKey(zip1)} {
+		if err = target.Put(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, err := target.Get(zip1); err != nil || string(d) != zip1 {
+		t.Fatalf("Get() returned %q, %v", d, err)
+	}
+	if zips, err := listBackupZips(target); err != nil || len(zips) != 2 || zips[0] != zip1 {
+		t.Fatalf("listBackupZips() returned %v, %v", zips, err)
+	}
+	if err = target.Put("../outside", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "outside")); err == nil {
+		t.Fatalf("Put() wrote outside of the target dir")
+	}
+	target.Delete("outside")
+
+	// crash reports are backed up to blobs_crashes
+	blobsDir := filepath.Join(dir, "blobs_crashes")
+	blobPath := filepath.Join(blobsDir, "aa", "bb", "crash")
+	if err = os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(blobPath, []byte("crash"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote := &targetBlobsRemote{target: target, dir: blobsBackupDir}
+	state := &BackupState{Files: make(map[string]backupFileState)}
+	if stats, _, err := syncBackupDir(remote, blobsDir, state, true, false); err != nil || stats.UploadedFiles != 1 {
+		t.Fatalf("syncBackupDir() returned %+v, %v", stats, err)
+	}
+	if files, err := remote.List(); err != nil || files["aa/bb/crash"] != 5 {
+		t.Fatalf("List() returned %v, %v", files, err)
+	}
+	if files, err := target.List("", false); err != nil || len(files) != 3 {
+		t.Fatalf("non-recursive List() returned %v, %v", files, err)
+	}
+
+	if err = target.Delete(zip1); err != nil {
+		t.Fatal(err)
+	}
+	if err = target.Delete(zip1); err != nil {
+		t.Fatalf("deleting missing file failed with %s", err)
+	}
+	if zips, _ := listBackupZips(target); len(zips) != 1 || zips[0] != zip2 {
+		t.Fatalf("listBackupZips() returned %v", zips)
+	}
+}
+
+// doesn't talk to s3, targets only create the bucket on first upload
+func TestS3BackupAcl(t *testing.T) {
+	initTestGlobals()
+	access, secret, bucket, dir := "key", "secret", "bucket", "blog"
+	c := &Config{AwsAccess: &access, AwsSecret: &secret, S3BackupBucket: &bucket, S3BackupDir: &dir}
+	target, err := newS3Target(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := target.(*s3Target)
+	if s.acl != s3.Private || s.bucketCreator.created {
+		t.Fatalf("default acl is %s, bucket created: %v", s.acl, s.bucketCreator.created)
+	}
+	c.S3BackupPublicRead = true
+	if target, err = newS3Target(c); err != nil {
+		t.Fatal(err)
+	}
+	if acl := target.(*s3Target).acl; acl != s3.PublicRead {
+		t.Fatalf("acl with S3BackupPublicRead is %s", acl)
+	}
+	private := privateBackupTarget(target).(*s3Target)
+	if private.acl != s3.Private || private.bucketCreator != target.(*s3Target).bucketCreator {
+		t.Fatalf("acl of privateBackupTarget() is %s", private.acl)
+	}
+	if target.(*s3Target).acl != s3.PublicRead {
+		t.Fatalf("privateBackupTarget() changed acl of the original target")
+	}
+}
+
+func TestBackupEncryption(t *testing.T) {
+	initTestGlobals()
+	if _, err := backupKeyFromHex("abcd"); err == nil {
+		t.Fatalf("short key not detected")
+	}
+	if key, err := backupKeyFromHex(""); key != nil || err != nil {
+		t.Fatalf("backupKeyFromHex(\"\") returned %v, %v", key, err)
+	}
+	key, err := backupKeyFromHex(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := backupKeyFromHex(strings.Repeat("cd", 32))
+	plain := []byte("crash report")
+	enc, err := encryptBackup(key, plain)
+	if err != nil || len(enc) != len(plain)+backupEncryptionOverhead {
+		t.Fatalf("encryptBackup() returned %d bytes, %v", len(enc), err)
+	}
+	if enc2, _ := encryptBackup(key, plain); bytes.Equal(enc, enc2) {
+		t.Fatalf("nonce is not random")
+	}
+	if d, err := decryptBackup(key, enc); err != nil || !bytes.Equal(d, plain) {
+		t.Fatalf("decryptBackup() returned %q, %v", d, err)
+	}
+	if _, err = decryptBackup(otherKey, enc); err != errBackupWrongKey {
+		t.Fatalf("wrong key not detected: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "backup_encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := &localDirTarget{dir: filepath.Join(dir, "backup")}
+	blobsDir := filepath.Join(dir, "blobs_crashes")
+	blobSha1 := sha1HexOfBytes(plain)
+	blob := blobSha1[:2] + "/" + blobSha1[2:4] + "/" + blobSha1
+	blobPath := filepath.Join(blobsDir, filepath.FromSlash(blob))
+	if err = os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(blobPath, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// blobs are re-uploaded when the key changes, but not otherwise
+	state := &BackupState{Files: make(map[string]backupFileState)}
+	syncBlobs := func(key []byte, full bool) *BackupSyncStats {
+		remote := &targetBlobsRemote{target: target, dir: blobsBackupDir, key: key}
+		stats, _, err := syncBackupDir(remote, blobsDir, state, full, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+	if stats := syncBlobs(nil, false); stats.UploadedFiles != 1 {
+		t.Fatalf("sync returned %+v", stats)
+	}
+	if stats := syncBlobs(key, false); stats.UploadedFiles != 1 {
+		t.Fatalf("not re-uploaded after setting key: %+v", stats)
+	}
+	if stats := syncBlobs(key, true); stats.UploadedFiles != 0 {
+		t.Fatalf("full sync re-uploaded encrypted files: %+v", stats)
+	}
+	if d, _ := target.Get(blobBackupPath(blobsBackupDir, blob)); bytes.Contains(d, plain) {
+		t.Fatalf("blob is not encrypted")
+	}
+
+	zipName := "160301_1204_" + blobSha1 + ".zip"
+	zipPath := filepath.Join(dir, "backup.zip")
+	zf, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	fw, _ := zw.Create("crashesdata.txt")
+	fw.Write([]byte("C1|2\n"))
+	zw.Close()
+	zf.Close()
+	if err = backupPutFileEncrypted(target, zipPath, zipName, key); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newBackupManifest(zipPath, zipName, sha1HexOfBytes(mustReadFile(t, zipPath)), []string{blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Encrypted = true
+	m.KeyId = backupKeyId(key)
+
+	if _, err = newBackupGetter(target, m, nil); err == nil {
+		t.Fatalf("missing key not detected")
+	}
+	if _, err = newBackupGetter(target, m, otherKey); err == nil {
+		t.Fatalf("wrong key not detected")
+	}
+	get, err := newBackupGetter(target, m, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := restoreFromManifest(get, m, blobsBackupDir, filepath.Join(dir, "restored"))
+	if err != nil || len(res.Errors) != 0 || res.Files != 1 || res.Blobs != 1 {
+		t.Fatalf("restoreFromManifest() returned %v, %v", res, err)
+	}
+	if d := mustReadFile(t, filepath.Join(dir, "restored", "blobs_crashes", filepath.FromSlash(blob))); !bytes.Equal(d, plain) {
+		t.Fatalf("bad restored blob %q", d)
+	}
+
+	// manifests of older backups don't have Encrypted and their files are
+	// used as they are, which here fails sha1 check instead of restoring
+	// garbage
+	m.Encrypted = false
+	m.KeyId = ""
+	if get, err = newBackupGetter(target, m, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restoreFromManifest(get, m, blobsBackupDir, filepath.Join(dir, "restored2")); err == nil {
+		t.Fatalf("encrypted zip restored as unencrypted")
+	}
+}
+
+func TestPermalinkScheme(t *testing.T) {
+	initTestGlobals()
+	for _, s := range []string{"{year}/{slug}.html", "/{year}/{title}.html", "/{year}/{month}.html"} {
+		if err := validatePermalinkScheme(s); err == nil {
+			t.Fatalf("invalid scheme %q not detected", s)
+		}
+	}
+	prev := getConfig()
+	defer rebuildArticlesCache()
+	defer setConfig(prev)
+	scheme := "/{year}/{month}/{slug}.html"
+	if err := validatePermalinkScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(&Config{PermalinkScheme: &scheme})
+
+	published := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	a := &Article{Id: 7, Title: "Hello world", PublishedOn: published, BodyHtml: "<p>hello</p>"}
+	dup := &Article{Id: 8, Title: "Hello world", PublishedOn: published, BodyHtml: "<p>dup</p>"}
+	deleted := &Article{Id: 9, Title: "Gone", PublishedOn: published, IsDeleted: true}
+	store = &Store{articles: []*Article{a, dup}, idToArticle: map[int]*Article{a.Id: a, dup.Id: dup},
+		deletedArticles: []*Article{deleted}}
+	rebuildArticlesCache()
+	if p := a.Permalink(); p != "2016/03/Hello-world.html" {
+		t.Fatalf("bad permalink %q", p)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		if strings.HasPrefix(url, "/article/") {
+			handleArticle(w, r)
+		} else {
+			handleMainPage(w, r)
+		}
+		return w
+	}
+	if w := get("/2016/03/Hello-world.html"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<p>hello</p>") {
+		t.Fatalf("permalink returned %d", w.Code)
+	}
+	legacy := renderPermalink(legacyPermalinkScheme, a)
+	if w := get(legacy); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/2016/03/Hello-world.html" {
+		t.Fatalf("legacy url returned %d, %q", w.Code, w.Header().Get("Location"))
+	}
+	// dup has the same permalink as a, so it's served on its legacy url
+	if w := get(renderPermalink(legacyPermalinkScheme, dup)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<p>dup</p>") {
+		t.Fatalf("legacy url of colliding article returned %d", w.Code)
+	}
+	if w := get("/2016/03/Gone.html"); w.Code != http.StatusGone {
+		t.Fatalf("deleted article returned %d", w.Code)
+	}
+	if w := get("/2016/03/Missing.html"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing article returned %d", w.Code)
+	}
+}
+
+func TestArticleSlugs(t *testing.T) {
+	initTestGlobals()
+	if s := sanitizeForFile("Hello, World (again)", 32); s != "hello-world-again" {
+		t.Fatalf("sanitizeForFile() returned %q", s)
+	}
+	for max := 1; max < 20; max++ {
+		s := sanitizeForFile("Zażółć gęślą jaźń 𝄞", max)
+		if len(s) > max || !utf8.ValidString(s) {
+			t.Fatalf("sanitizeForFile(%d) returned %q", max, s)
+		}
+	}
+	slugTests := []struct {
+		title string
+		max   int
+		exp   string
+	}{
+		{"Zażółć gęślą jaźń", 32, "zazolc-gesla-jazn"},
+		{"Über Größe und Maße", 32, "ueber-groesse-und-masse"},
+		// combining characters give the same slug as precomposed ones
+		{"U\u0308ber Gro\u0308sse", 32, "ueber-groesse"},
+		{"Cafe\u0301 ÅÆØ œuvre", 32, "cafe-aaeo-oeuvre"},
+		{"I ❤️ Go 🎉🎉 1.10!", 32, "i-go-1-10"},
+		{"Go 语言 入门", 32, "go"},
+		{"你好，世界", 32, ""},
+		{"?!?... --- ()", 32, ""},
+		{"", 32, ""},
+		{"Don't   panic -- it’s __fine__", 32, "dont-panic-its-fine"},
+		// cut at a word boundary if it's not too far back
+		{"Writing a blog engine in Go and why", 24, "writing-a-blog-engine-in"},
+		{"Writing a blog engine in Go and why", 23, "writing-a-blog-engine"},
+		{"Internationalization is hard", 10, "internatio"},
+		{"Łódź", 3, "lod"},
+	}
+	for _, test := range slugTests {
+		s := sanitizeForFile(test.title, test.max)
+		if s != test.exp {
+			t.Errorf("sanitizeForFile(%q, %d) returned %q, expected %q", test.title, test.max, s, test.exp)
+		}
+		if s != "" && !regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`).MatchString(s) {
+			t.Errorf("sanitizeForFile(%q) returned invalid slug %q", test.title, s)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "slugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.md")
+	s := "Id: 12\nTitle: Helo world\nSlug: hello-world\nOldSlugs: helo-world, Helo-world\nDate: 2016-03-01T00:00:00Z\n-----\nbody"
+	if err = ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := readArticle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GetSlug() != "hello-world" || len(a.OldSlugs) != 2 || a.OldSlugs[1] != "Helo-world" {
+		t.Fatalf("bad slugs: %q, %v", a.Slug, a.OldSlugs)
+	}
+	if (&Article{Title: "Helo world"}).GetSlug() != "Helo-world" {
+		t.Fatalf("default slug is not made from the title")
+	}
+	ioutil.WriteFile(path, []byte("Id: 12\nSlug: a/b\n-----\n"), 0644)
+	if _, err = readArticle(path); err == nil {
+		t.Fatalf("invalid slug not detected")
+	}
+
+	defer rebuildArticlesCache()
+	a.BodyHtml = "<p>body</p>"
+	store = &Store{articles: []*Article{a}, idToArticle: map[int]*Article{a.Id: a}}
+	rebuildArticlesCache()
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleArticle(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	permalink := "/" + a.Permalink()
+	if w := get(permalink); w.Code != http.StatusOK || !strings.HasSuffix(permalink, "/hello-world.html") {
+		t.Fatalf("permalink returned %d", w.Code)
+	}
+	w := get(renderPermalinkWithSlug(legacyPermalinkScheme, a, "Helo-world"))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != permalink {
+		t.Fatalf("old slug returned %d, %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+var updateGolden = flag.Bool("update-golden", false, "re-generate testdata/markdown_golden.txt")
+
+const markdownGoldenPath = "testdata/markdown_golden.txt"
+
+func TestNewArticleSlug(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "newarticle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// -newarticle works in the current directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Mkdir("blog_posts", 0755); err != nil {
+		t.Fatal(err)
+	}
+	month := time.Now().Format("2006-01")
+	prevMaxSlugLen := maxSlugLen
+	maxSlugLen = 32
+	defer func() { maxSlugLen = prevMaxSlugLen }()
+
+	if err = genNewArticle("Zażółć gęślą jaźń"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := readArticle(filepath.Join("blog_posts", month, "zazolc-gesla-jazn.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Slug != "zazolc-gesla-jazn" || a.Title != "Zażółć gęślą jaźń" {
+		t.Fatalf("bad article: slug: %q, title: %q", a.Slug, a.Title)
+	}
+
+	// no latin letters, the id is the slug
+	if err = genNewArticle("你好，世界"); err != nil {
+		t.Fatal(err)
+	}
+	name := strconv.Itoa(a.Id+1) + ".md"
+	if a, err = readArticle(filepath.Join("blog_posts", month, name)); err != nil {
+		t.Fatal(err)
+	}
+	if a.Slug != strconv.Itoa(a.Id) {
+		t.Fatalf("bad slug %q of article %d", a.Slug, a.Id)
+	}
+}
+
+// sha1 of html of every article in blog_posts. Rendering of existing
+// articles must not change when we change the markdown pipeline
+func TestMarkdownGolden(t *testing.T) {
+	initTestGlobals()
+	articles, _, err := readArticles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, a := range articles {
+		html := msgToHTML(a.Body, a.Format)
+		lines = append(lines, filepath.ToSlash(a.Path)+" "+sha1HexOfBytes([]byte(html)))
+	}
+	sort.Strings(lines)
+	if *updateGolden {
+		d := []byte(strings.Join(lines, "\n") + "\n")
+		if err = ioutil.WriteFile(markdownGoldenPath, d, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	golden := strings.Split(strings.TrimSpace(string(mustReadFile(t, markdownGoldenPath))), "\n")
+	expected := make(map[string]string)
+	for _, l := range golden {
+		parts := strings.SplitN(l, " ", 2)
+		expected[parts[0]] = parts[1]
+	}
+	for _, l := range lines {
+		parts := strings.SplitN(l, " ", 2)
+		if exp, ok := expected[parts[0]]; ok && exp != parts[1] {
+			t.Errorf("html of %s changed", parts[0])
+		}
+	}
+	if len(lines) != len(golden) {
+		t.Errorf("%d articles, %d in %s (run with -update-golden after adding articles)", len(lines), len(golden), markdownGoldenPath)
+	}
+}
+
+func TestMarkdownExtensions(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	s := "a | b\n---|---\n1 | 2\n\n~~old~~ new, see http://example.com\n\nnote[^1]\n\n- [ ] todo\n- [x] done\n\n[^1]: the note\n"
+	html := markdown([]byte(s))
+	for _, exp := range []string{"<table>", "<td>1</td>", "<del>old</del>", `<a href="http://example.com"`,
+		`id="fnref:1"`, `href="#fn:1"`, `<li id="fn:1">`, `href="#fnref:1"`,
+		`<li><input type="checkbox" disabled="disabled" /> todo</li>`,
+		`<li><input type="checkbox" checked="checked" disabled="disabled" /> done</li>`} {
+		if !strings.Contains(html, exp) {
+			t.Errorf("%q not in %s", exp, html)
+		}
+	}
+
+	off := false
+	setConfig(&Config{MarkdownTables: &off, MarkdownFootnotes: &off, MarkdownStrikethrough: &off,
+		MarkdownTaskLists: &off, MarkdownAutolink: &off})
+	html = markdown([]byte(s))
+	for _, notExp := range []string{"<table>", "<del>", "<a ", "fnref", "<input"} {
+		if strings.Contains(html, notExp) {
+			t.Errorf("%q in %s with extensions turned off", notExp, html)
+		}
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	s := "```go\n// comment\nfunc f() string { return \"a<b\" + `raw\\` }\nvar n = 0x1F\n```\n\n```cobol\nMOVE A TO B. <x>\n```\n"
+	html := markdown([]byte(s))
+	for _, exp := range []string{`<pre><code class="language-go hljs">`, `<span class="hljs-comment">// comment</span>`,
+		`<span class="hljs-keyword">func</span> f()`, `<span class="hljs-string">&#34;a&lt;b&#34;</span>`,
+		"<span class=\"hljs-string\">`raw\\`</span>", `<span class="hljs-number">0x1F</span>`,
+		`<pre><code class="language-cobol">MOVE A TO B. &lt;x&gt;`} {
+		if !strings.Contains(html, exp) {
+			t.Errorf("%q not in %s", exp, html)
+		}
+	}
+	if highlightJsUrl() != "" {
+		t.Errorf("highlight.js used with server-side highlighting")
+	}
+
+	setConfig(&Config{ClientSideHighlighting: true})
+	html = markdown([]byte(s))
+	if strings.Contains(html, "hljs") || !strings.Contains(html, `<pre><code class="language-go">`) {
+		t.Errorf("code highlighted with ClientSideHighlighting: %s", html)
+	}
+	if highlightJsUrl() == "" {
+		t.Errorf("no highlight.js with ClientSideHighlighting")
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	initTestGlobals()
+	s := `<h1>Intro</h1><p>a</p><h2 class="x">Setup &amp; run</h2><h3>Details</h3><h2 id="own">Own id</h2><h2>Intro</h2><h1>Zażółć</h1>`
+	html, headings := addHeadingIds(s)
+	for _, exp := range []string{`<h1 id="intro">Intro</h1>`, `<h2 id="setup-run" class="x">`, `<h3 id="details">`,
+		`<h2 id="own">Own id</h2>`, `<h2 id="intro-2">Intro</h2>`, `<h1 id="zażółć">`} {
+		if !strings.Contains(html, exp) {
+			t.Errorf("%q not in %s", exp, html)
+		}
+	}
+	if html2, _ := addHeadingIds(html); html2 != html {
+		t.Errorf("ids changed when re-rendered: %s", html2)
+	}
+	if len(headings) != 6 || headings[1].Text != "Setup & run" {
+		t.Fatalf("bad headings: %v", headings)
+	}
+	exp := `<ul><li><a href="#intro">Intro</a><ul><li><a href="#setup-run">Setup &amp; run</a><ul><li><a href="#details">Details</a></li></ul></li><li><a href="#own">Own id</a></li><li><a href="#intro-2">Intro</a></li></ul></li><li><a href="#zażółć">Zażółć</a></li></ul>`
+	if toc := renderToc(headings); toc != exp {
+		t.Errorf("renderToc() returned %s", toc)
+	}
+	if toc := renderToc([]TocHeading{{Level: 3, Id: "a", Text: "a"}, {Level: 1, Id: "b", Text: "b"}}); toc != `<ul><li><a href="#a">a</a></li><li><a href="#b">b</a></li></ul>` {
+		t.Errorf("renderToc() returned %s", toc)
+	}
+
+	body := []byte("# One\n\n## Two\n\n## Three\n")
+	a := &Article{Body: body, Format: FormatMarkdown}
+	if a.GetHtmlStr(); a.TocHtml == "" {
+		t.Errorf("no toc for 3 headings")
+	}
+	no := false
+	a = &Article{Body: body, Format: FormatMarkdown, ShowToc: &no}
+	if a.GetHtmlStr(); a.TocHtml != "" {
+		t.Errorf("toc with Toc: no")
+	}
+	yes := true
+	a = &Article{Body: []byte("# One\n"), Format: FormatMarkdown, ShowToc: &yes}
+	if a.GetHtmlStr(); a.TocHtml == "" {
+		t.Errorf("no toc with Toc: yes")
+	}
+}
+
+func TestOgMeta(t *testing.T) {
+	initTestGlobals()
+	s := "<p>Fish &amp; chips <b>are</b>\n good.</p><script>var x = 1;</script>"
+	if d := ogDescription(s, 200); d != "Fish & chips are good." {
+		t.Fatalf("ogDescription() returned %q", d)
+	}
+	if d := ogDescription(s, 14); d != "Fish & chips…" {
+		t.Fatalf("ogDescription() returned %q", d)
+	}
+	if d := ogDescription("<p>Zażółć gęślą jaźń</p>", 8); d != "Zażółć…" {
+		t.Fatalf("ogDescription() returned %q", d)
+	}
+
+	prev := getConfig()
+	defer rebuildArticlesCache()
+	defer setConfig(prev)
+	site, defImg := "https://example.com/", "/img/default.png"
+	setConfig(&Config{BaseURL: &site, DefaultOgImageUrl: &defImg})
+
+	published := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	withImg := &Article{Id: 7, Title: "A <b>", PublishedOn: published, BodyHtml: `<p>Text</p><img alt="x" src="/img/a.png?x=1&amp;y=2">`}
+	noImg := &Article{Id: 8, Title: "B", PublishedOn: published, BodyHtml: "<p>Text</p>"}
+	draft := &Article{Id: 9, Title: "C", PublishedOn: published, BodyHtml: "<p>Secret</p>", IsDraft: true}
+	store = &Store{articles: []*Article{withImg, noImg, draft},
+		idToArticle: map[int]*Article{withImg.Id: withImg, noImg.Id: noImg, draft.Id: draft}}
+	rebuildArticlesCache()
+
+	m := getOgMeta(withImg)
+	if m == nil || m.Url != "https://example.com/"+withImg.Permalink() || m.Description != "Text" ||
+		m.ImageUrl != "https://example.com/img/a.png?x=1&y=2" || m.TwitterCard != "summary_large_image" {
+		t.Fatalf("bad og meta: %#v", m)
+	}
+	if m = getOgMeta(noImg); m == nil || m.ImageUrl != "https://example.com/img/default.png" {
+		t.Fatalf("bad og meta: %#v", m)
+	}
+	if m = getOgMeta(draft); m != nil {
+		t.Fatalf("og meta for a draft: %#v", m)
+	}
+
+	setConfig(&Config{BaseURL: &site})
+	if m = getOgMeta(noImg); m == nil || m.ImageUrl != "" || m.TwitterCard != "summary" {
+		t.Fatalf("bad og meta: %#v", m)
+	}
+}
+
+func TestBaseUrl(t *testing.T) {
+	initTestGlobals()
+	for _, s := range []string{"example.com", "ftp://example.com", "https://example.com/blog", "https://"} {
+		if err := validateBaseUrl(s); err == nil {
+			t.Fatalf("invalid BaseURL %q not detected", s)
+		}
+	}
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	if u := absURL("/atom.xml"); u != defaultBaseUrl+"/atom.xml" {
+		t.Fatalf("absURL() returned %q", u)
+	}
+	r := httptest.NewRequest("GET", "http://1.2.3.4/foo?a=b", nil)
+	if u := canonicalHostRedirectUrl(r); u != "" {
+		t.Fatalf("redirect to %q without BaseURL", u)
+	}
+
+	base := "https://Example.com/"
+	setConfig(&Config{BaseURL: &base})
+	if u := absURL("article/1/a.html"); u != "https://Example.com/article/1/a.html" {
+		t.Fatalf("absURL() returned %q", u)
+	}
+	h := withCanonicalHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	for _, host := range []string{"1.2.3.4:5020", "www.example.com"} {
+		r = httptest.NewRequest("GET", "http://"+host+"/foo?a=b", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://Example.com/foo?a=b" {
+			t.Fatalf("%s: got %d to %q", host, w.Code, w.Header().Get("Location"))
+		}
+	}
+	for _, host := range []string{"example.com", "EXAMPLE.com:443"} {
+		r = httptest.NewRequest("GET", "http://"+host+"/foo", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", host, w.Code)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	limits := map[string]RateLimit{"/a": {PerMinute: 60, Burst: 2}, "/off": {PerMinute: 0}}
+	setConfig(&Config{RateLimits: limits})
+
+	rl := NewRateLimiter(NewMetrics())
+	now := time.Now()
+	limit, _ := getRateLimit("/a")
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.take("/a", "1.1.1.1", limit, now); !ok {
+			t.Fatalf("request %d throttled", i)
+		}
+	}
+	ok, wait := rl.take("/a", "1.1.1.1", limit, now)
+	if ok || wait != time.Second {
+		t.Fatalf("expected to wait 1s, got %v %s", ok, wait)
+	}
+	if ok, _ = rl.take("/a", "2.2.2.2", limit, now); !ok {
+		t.Fatalf("other ip throttled")
+	}
+	if ok, _ = rl.take("/a", "1.1.1.1", limit, now.Add(time.Second)); !ok {
+		t.Fatalf("throttled after refill")
+	}
+	// 2.2.2.2 has a full bucket again
+	if n := rl.evictIdle(now.Add(time.Second)); n != 1 {
+		t.Fatalf("evictIdle() left %d buckets, expected 1", n)
+	}
+	if n := rl.evictIdle(now.Add(time.Minute)); n != 0 {
+		t.Fatalf("evictIdle() left %d buckets, expected 0", n)
+	}
+	if limit, ok = getRateLimit("/app/crashsubmit"); !ok || limit.PerMinute == 0 {
+		t.Fatalf("no default limit for /app/crashsubmit")
+	}
+
+	h := rl.Wrap("/a", func(w http.ResponseWriter, r *http.Request) {})
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/a", nil))
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Fatalf("bad Retry-After: %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status codes %v", codes)
+	}
+	if n := rl.m.ThrottledReqsOf("/a").Count(); n != 1 {
+		t.Fatalf("throttled counter is %d, expected 1", n)
+	}
+	h = rl.Wrap("/off", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/off", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("throttled with PerMinute 0")
+		}
+	}
+}
+
+func TestCsrf(t *testing.T) {
+	initTestGlobals()
+	called := 0
+	post := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if checkCsrf(w, r) {
+			called++
+		}
+		return w
+	}
+
+	r := newTestRequest("POST", "/app/tags", "kjk")
+	r.Form = map[string][]string{"from": {"a"}, "to": {"b"}, "csrf_token": {testCsrfToken}}
+	post(r)
+	r = newTestRequest("GET", "/app/tags", "kjk")
+	r.Header.Set(csrfHeader, testCsrfToken)
+	post(r)
+	if called != 2 {
+		t.Fatalf("valid token rejected")
+	}
+
+	r = newTestRequest("POST", "/app/tags", "kjk")
+	r.Form = map[string][]string{"from": {"<typed>"}, "to": {"b"}, "csrf_token": {"old-token"}}
+	r.Header.Set("Referer", "http://evil.example.com/")
+	w := post(r)
+	body := w.Body.String()
+	if called != 2 || w.Code != http.StatusForbidden {
+		t.Fatalf("invalid token accepted, got %d", w.Code)
+	}
+	for _, exp := range []string{`value="` + testCsrfToken + `"`, "&lt;typed&gt;", `action="/app/tags"`, "Submit again"} {
+		if !strings.Contains(body, exp) {
+			t.Errorf("%q not in %s", exp, body)
+		}
+	}
+	if strings.Contains(body, "old-token") {
+		t.Errorf("old token in %s", body)
+	}
+
+	r = newTestRequest("POST", "/app/reload-config", "kjk")
+	r.Header.Set(csrfHeader, "wrong")
+	if w = post(r); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "<html") {
+		t.Fatalf("bad response to api call: %d %s", w.Code, w.Body.String())
+	}
+	// anonymous users have no token, so nothing matches
+	r = newTestRequest("POST", "/app/crashstar", "")
+	r.Form = map[string][]string{"csrf_token": {""}}
+	if post(r); called != 2 {
+		t.Fatalf("POST without a token accepted")
+	}
+	if newCsrfToken() == newCsrfToken() {
+		t.Fatalf("same token twice")
+	}
+}
+
+func TestGetIpAddress(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+
+	for addr, exp := range map[string]string{"1.2.3.4:80": "1.2.3.4", "[::1]:5020": "::1",
+		"[2001:db8::1]:443": "2001:db8::1", "2001:db8::1": "2001:db8::1", "1.2.3.4": "1.2.3.4"} {
+		if ip := ipAddrFromRemoteAddr(addr); ip != exp {
+			t.Errorf("ipAddrFromRemoteAddr(%q) returned %q, expected %q", addr, ip, exp)
+		}
+	}
+
+	tests := []struct {
+		remoteAddr string
+		xff        []string
+		realIp     string
+		exp        string
+	}{
+		// headers of clients that connect directly are ignored
+		{"8.8.8.8:1234", []string{"1.1.1.1"}, "", "8.8.8.8"},
+		{"127.0.0.1:1234", nil, "", "127.0.0.1"},
+		{"127.0.0.1:1234", nil, "5.5.5.5", "5.5.5.5"},
+		// spoofed first entry is skipped
+		{"127.0.0.1:1234", []string{"1.1.1.1, 9.9.9.9"}, "", "9.9.9.9"},
+		{"[::1]:1234", []string{"1.1.1.1, 9.9.9.9, 10.0.0.1", "192.168.1.1"}, "", "9.9.9.9"},
+		{"127.0.0.1:1234", []string{"2001:db8::1, 10.1.1.1"}, "", "2001:db8::1"},
+		// all trusted
+		{"127.0.0.1:1234", []string{"10.0.0.1, 192.168.0.5"}, "", "127.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, h := range test.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if test.realIp != "" {
+			r.Header.Set("X-Real-Ip", test.realIp)
+		}
+		if ip := getIpAddress(r); ip != test.exp {
+			t.Errorf("%s %v: got %q, expected %q", test.remoteAddr, test.xff, ip, test.exp)
+		}
+	}
+
+	setConfig(&Config{TrustedProxies: []string{"8.8.8.0/24"}})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "8.8.8.8:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 10.0.0.1")
+	if ip := getIpAddress(r); ip != "10.0.0.1" {
+		t.Errorf("got %q with TrustedProxies, expected 10.0.0.1", ip)
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.1"}); err == nil {
+		t.Errorf("invalid TrustedProxies not detected")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+
+	withLogin := func(loggedInAt time.Time) *http.Request {
+		w := httptest.NewRecorder()
+		setSecureCookie(w, &SecureCookieValue{TwitterUser: "kjk", LoggedInAt: loggedInAt})
+		c := w.Result().Cookies()[0]
+		// expired logins get MaxAge < 0 so that the browser deletes them
+		if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || (c.MaxAge > 0) != (time.Since(loggedInAt) < sessionTTL()) {
+			t.Fatalf("bad cookie: %#v", c)
+		}
+		r := httptest.NewRequest("GET", "/app/tags", nil)
+		r.AddCookie(c)
+		return r
+	}
+	if !IsAdmin(withLogin(time.Now().Add(-29 * 24 * time.Hour))) {
+		t.Fatalf("29 days old login expired")
+	}
+	old := withLogin(time.Now().Add(-31 * 24 * time.Hour))
+	if IsAdmin(old) {
+		t.Fatalf("31 days old login not expired")
+	}
+	setConfig(&Config{SessionTTLDays: 60})
+	if !IsAdmin(old) {
+		t.Fatalf("31 days old login expired with SessionTTLDays 60")
+	}
+	// logins from before expiration
+	if IsAdmin(withLogin(time.Time{})) {
+		t.Fatalf("login without time not expired")
+	}
+
+	w := httptest.NewRecorder()
+	handleTags(w, withLogin(time.Now()))
+	if !strings.Contains(w.Body.String(), `@kjk <a href="/logout">log out</a>`) {
+		t.Fatalf("no logout link in %s", w.Body.String())
+	}
+
+	for _, redirect := range []string{"", "//evil.example.com"} {
+		w = httptest.NewRecorder()
+		handleLogout(w, httptest.NewRequest("GET", "/logout?redirect="+redirect, nil))
+		c := w.Result().Cookies()
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" || len(c) != 1 || c[0].MaxAge != -1 {
+			t.Fatalf("bad logout: %d %q %v", w.Code, w.Header().Get("Location"), c)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"ok.html":      "<p>{{ .Title }}</p>",
+		"broken1.html": "line 1\nline 2\n{{ if .X }}\nline 4\n",
+		"broken2.html": "<p>\n{{ .Title | nosuchfunc }}</p>",
+	}
+	for name, s := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpl, errs := parseTemplates(dir, []string{"ok.html", "broken1.html", "broken2.html"})
+	if tmpl != nil || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if e := errs[1]; e.Name != "broken2.html" || e.Line != 2 || !strings.Contains(e.Msg, "nosuchfunc") ||
+		len(e.Context) != 2 || !e.Context[1].IsError {
+		t.Fatalf("bad error: %#v", e)
+	}
+	w := httptest.NewRecorder()
+	serveTemplateErrors(w, errs)
+	body := w.Body.String()
+	if w.Code != http.StatusInternalServerError || !strings.Contains(body, "broken1.html") ||
+		!strings.Contains(body, "broken2.html, line 2") || !strings.Contains(body, "{{ .Title | nosuchfunc }}") {
+		t.Fatalf("bad error page: %s", body)
+	}
+
+	if _, errs = parseTemplates(dir, []string{"ok.html"}); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	// all real templates parse
+	if _, errs = parseTemplates("tmpl", templateNames[:]); errs != nil {
+		t.Fatalf("broken templates: %s", templateErrorsString(errs))
+	}
+	if !isAssetChange(filepath.Join("tmpl", "article.html")) || isAssetChange(filepath.Join("blog_posts", "a.md")) {
+		t.Fatalf("isAssetChange() is wrong")
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	initTestGlobals()
+	a := &Article{Id: 7, Title: "Hello world", BodyHtml: "<p>hello</p>"}
+	b := &Article{Id: 8, Title: "Go tips", Slug: "go-tips-and-tricks", BodyHtml: "<p>go</p>"}
+	deleted := &Article{Id: 9, Title: "Gone", IsDeleted: true}
+	store = &Store{articles: []*Article{a, b}, idToArticle: map[int]*Article{a.Id: a, b.Id: b},
+		deletedArticles: []*Article{deleted}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	if d := editDistance("kitten", "sitting"); d != 3 {
+		t.Fatalf("editDistance() returned %d", d)
+	}
+	for uri, exp := range map[string]*Article{"/article/x/Helo-wrld.html": a, "/2016/go-tips-and-trick.html": b,
+		"/go-tips-and": b, "/completely-different.html": nil, "/a": nil} {
+		s := suggestArticles(uri, getCachedArticles())
+		if (exp == nil && len(s) != 0) || (exp != nil && (len(s) == 0 || s[0] != exp)) {
+			t.Errorf("suggestArticles(%q) returned %v", uri, s)
+		}
+	}
+
+	h := newTimingHandler(NewMetrics(), handleMainPage)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/article/x/Helo-wrld.html", nil))
+	if body := w.Body.String(); w.Code != http.StatusNotFound || !strings.Contains(body, `href="/`+a.Permalink()+`"`) ||
+		!strings.Contains(body, "tophdr") {
+		t.Fatalf("bad 404 page: %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/"+deleted.Permalink(), nil))
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "Article deleted") {
+		t.Fatalf("bad 410 page: %d %s", w.Code, w.Body.String())
+	}
+
+	h = newTimingHandler(NewMetrics(), func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"] = 1
+	})
+	prevProduction := inProduction
+	defer func() { inProduction = prevProduction }()
+	for _, inProduction = range []bool{false, true} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		body := w.Body.String()
+		if w.Code != http.StatusInternalServerError || !strings.Contains(body, w.Header().Get("X-Request-Id")) {
+			t.Fatalf("bad 500 page: %d %s", w.Code, body)
+		}
+		if strings.Contains(body, "assignment to entry in nil map") != !inProduction {
+			t.Fatalf("stack shown: %v, in production: %v", !inProduction, inProduction)
+		}
+	}
+}
+
+func TestArticleViews(t *testing.T) {
+	initTestGlobals()
+	a := &Article{Id: 1, Title: "One", BodyHtml: "<p>one</p>"}
+	b := &Article{Id: 2, Title: "Two", BodyHtml: "<p>two</p>"}
+	c := &Article{Id: 3, Title: "Three", BodyHtml: "<p>three</p>"}
+	store = &Store{articles: []*Article{a, b, c}, idToArticle: map[int]*Article{a.Id: a, b.Id: b, c.Id: c}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+	prevViews := articleViews
+	defer func() { articleViews = prevViews }()
+	articleViews = &ArticleViews{Days: make(map[string]map[int]int)}
+
+	now := time.Now()
+	articleViews.Add(a.Id, now.AddDate(0, 0, -40))
+	articleViews.Add(a.Id, now.AddDate(0, 0, -20))
+	articleViews.Add(a.Id, now.AddDate(0, 0, -20))
+	articleViews.Add(a.Id, now.AddDate(0, 0, -20))
+	articleViews.Add(b.Id, now.AddDate(0, 0, -3))
+	articleViews.Add(b.Id, now)
+	for _, ua := range []string{"", "Googlebot/2.1", "curl/7.54", "Slackbot-LinkExpanding 1.0"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		recordArticleView(r, c)
+	}
+	r := newTestRequest("GET", "/", "kjk")
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	recordArticleView(r, c)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	recordArticleView(r, c)
+
+	if v := articleViews.Since(now.AddDate(0, -1, 0)); v[a.Id] != 3 || v[b.Id] != 2 || v[c.Id] != 1 {
+		t.Fatalf("bad views in the last month: %v", v)
+	}
+	if v := articleViews.Since(now.AddDate(0, 0, -7)); v[a.Id] != 0 || v[b.Id] != 2 {
+		t.Fatalf("bad views in the last week: %v", v)
+	}
+	popular := PopularArticles(2, 30*24*time.Hour)
+	if len(popular) != 2 || popular[0].Article != a || popular[1].Article != b || popular[0].Views != 3 {
+		t.Fatalf("bad PopularArticles(): %v", popular)
+	}
+	if popular = PopularArticles(0, 24*time.Hour); len(popular) != 2 || popular[0].Views != 1 {
+		t.Fatalf("bad PopularArticles() for the last day: %v", popular)
+	}
+
+	dir, err := ioutil.TempDir("", "views")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "article_views.json")
+	articleViews.prune(now)
+	if err = articleViews.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadArticleViews(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := loaded.Since(now.AddDate(-1, 0, 0)); v[a.Id] != 3 || v[b.Id] != 2 || v[c.Id] != 1 {
+		t.Fatalf("bad views after loading: %v", v)
+	}
+	if loaded, err = loadArticleViews(filepath.Join(dir, "missing.json")); err != nil || len(loaded.Days) != 0 {
+		t.Fatalf("loading missing file: %v, %v", loaded, err)
+	}
+
+	w := httptest.NewRecorder()
+	handleArticleViews(w, newTestRequest("GET", "/app/views?sort=week", "kjk"))
+	body := w.Body.String()
+	two, one := strings.Index(body, ">Two<"), strings.Index(body, ">One<")
+	if w.Code != http.StatusOK || two == -1 || one == -1 || two > one {
+		t.Fatalf("bad views page: %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleArticleViews(w, httptest.NewRequest("GET", "/app/views", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("views page shown to non-admin: %d", w.Code)
+	}
+}
+
+func TestEmailSubscriptions(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	host, from := "localhost", "blog@example.com"
+	setConfig(&Config{SmtpHost: &host, EmailFrom: &from})
+	prevSend, prevQueue, prevSubscribers := sendEmail, emailQueue, subscribers
+	defer func() { sendEmail, emailQueue, subscribers = prevSend, prevQueue, prevSubscribers }()
+	var sent []*Email
+	failing := map[string]bool{}
+	sendEmail = func(e *Email) error {
+		if failing[e.To] {
+			return errors.New("failed")
+		}
+		sent = append(sent, e)
+		return nil
+	}
+	emailQueue = NewEmailQueue()
+
+	for s, exp := range map[string]string{"Foo@Example.com ": "foo@example.com", "foo": "", "Foo <foo@example.com>": "",
+		"foo@localhost": "", "a@b.c, d@e.f": ""} {
+		if got := normalizeEmail(s); got != exp {
+			t.Errorf("normalizeEmail(%q) returned %q, expected %q", s, got, exp)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "subscribers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "subscribers.json")
+	if subscribers, err = loadSubscribers(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/subscribe", strings.NewReader("email=Reader@example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handleSubscribe(w, r)
+	if w.Code != http.StatusOK || subscribers.Has("reader@example.com") {
+		t.Fatalf("bad response to subscribe: %d %s", w.Code, w.Body.String())
+	}
+	emailQueue.sendPending(sendEmail)
+	if len(sent) != 1 || sent[0].To != "reader@example.com" {
+		t.Fatalf("confirmation email not sent: %v", sent)
+	}
+	confirmUrl := regexp.MustCompile(`http\S+/subscribe/confirm\?t=\S+`).FindString(sent[0].Body)
+	u, err := url.Parse(confirmUrl)
+	if err != nil || confirmUrl == "" {
+		t.Fatalf("no confirmation link in %q", sent[0].Body)
+	}
+	// unsubscribe links can't be used for confirming
+	if _, err = decodeSubscriptionToken(unsubscribeTokenName, u.Query().Get("t")); err == nil {
+		t.Fatal("subscribe token decoded as unsubscribe token")
+	}
+	w = httptest.NewRecorder()
+	handleSubscribeConfirm(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if w.Code != http.StatusOK || !subscribers.Has("reader@example.com") {
+		t.Fatalf("bad response to confirm: %d %s", w.Code, w.Body.String())
+	}
+	subscribers.Add("other@example.com")
+
+	a := &Article{Id: 1, Title: "First", BodyHtml: "<p>first</p>"}
+	b := &Article{Id: 2, Title: "Second", BodyHtml: "<p>second article</p>"}
+	draft := &Article{Id: 3, Title: "Draft", IsDraft: true}
+	// articles we see first are treated as already sent
+	if n := notifySubscribers([]*Article{a}); n != 0 {
+		t.Fatalf("queued %d emails for existing articles", n)
+	}
+	if n := notifySubscribers([]*Article{a, b, draft}); n != 2 {
+		t.Fatalf("queued %d emails for a new article, expected 2", n)
+	}
+	if n := notifySubscribers([]*Article{a, b, draft}); n != 0 {
+		t.Fatalf("queued %d emails for the same article twice", n)
+	}
+
+	// failed emails are re-tried up to maxEmailTries times
+	sent = nil
+	failing["other@example.com"] = true
+	for i := 0; i < maxEmailTries; i++ {
+		emailQueue.sendPending(sendEmail)
+	}
+	if len(sent) != 1 || emailQueue.Len() != 0 || !strings.Contains(sent[0].Body, "second article") {
+		t.Fatalf("bad emails sent: %v, left: %d", sent, emailQueue.Len())
+	}
+
+	// only emailsPerRun emails are sent at once
+	for i := 0; i < emailsPerRun+10; i++ {
+		emailQueue.Add(&Email{To: fmt.Sprintf("r%d@example.com", i)})
+	}
+	if n, _ := emailQueue.sendPending(sendEmail); n != emailsPerRun || emailQueue.Len() != 10 {
+		t.Fatalf("sent %d emails in one run, %d left", n, emailQueue.Len())
+	}
+
+	loaded, err := loadSubscribers(path)
+	if err != nil || !loaded.Has("reader@example.com") || !loaded.notified[b.Id] || loaded.notified[draft.Id] {
+		t.Fatalf("bad subscribers after loading: %v, %v", loaded, err)
+	}
+
+	u, _ = url.Parse(sent[0].UnsubscribeUrl)
+	w = httptest.NewRecorder()
+	handleUnsubscribe(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if w.Code != http.StatusOK || subscribers.Has("reader@example.com") {
+		t.Fatalf("bad response to unsubscribe: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebSub(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	prevBackoff := hubPingBackoff
+	defer func() { hubPingBackoff = prevBackoff }()
+	hubPingBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "websub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "published_articles.json")
+	a := &Article{Id: 1, Title: "First", Body: []byte("first")}
+	b := &Article{Id: 2, Title: "Second", Body: []byte("second")}
+	draft := &Article{Id: 3, Title: "Draft", Body: []byte("draft"), IsDraft: true}
+	check := func(articles []*Article, exp ...int) {
+		changed, err := updatePublishedArticles(path, articles)
+		if err != nil || fmt.Sprint(changed) != fmt.Sprint(exp) {
+			t.Fatalf("updatePublishedArticles() returned %v, %v, expected %v", changed, err, exp)
+		}
+	}
+	// nothing is new the first time
+	check([]*Article{a})
+	check([]*Article{a, b, draft}, b.Id)
+	check([]*Article{a, b, draft})
+	edited := *a
+	edited.Body = []byte("first, edited")
+	check([]*Article{&edited, b}, a.Id)
+	draft.Body = []byte("draft, edited")
+	check([]*Article{&edited, b, draft})
+
+	var mu sync.Mutex
+	var pings []url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		pings = append(pings, r.PostForm)
+		// fails the first time
+		if len(pings) == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+	if !pingHubWithRetries(hub.URL, feedUrls()) || len(pings) != 2 {
+		t.Fatalf("ping not re-tried: %v", pings)
+	}
+	if v := pings[1]; v.Get("hub.mode") != "publish" || fmt.Sprint(v["hub.url"]) != fmt.Sprint(feedUrls()) {
+		t.Fatalf("bad ping: %v", v)
+	}
+	if pingHubWithRetries(hub.URL+"/missing", feedUrls()) {
+		t.Fatal("ping to a missing url succeeded")
+	}
+
+	setConfig(&Config{WebSubHubs: []string{"https://hub.example.com/"}})
+	feed := []byte(`<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><title>blog</title></feed>`)
+	exp := `<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><link rel="self" href="http://x.com/atom.xml"></link>` +
+		`<link rel="hub" href="https://hub.example.com/"></link><title>blog</title></feed>`
+	if got := string(addFeedHubLinks(feed, "http://x.com/atom.xml", webSubHubs())); got != exp {
+		t.Fatalf("addFeedHubLinks() returned %s", got)
+	}
+	if got := addFeedHubLinks(feed, "http://x.com/atom.xml", nil); !bytes.Equal(got, feed) {
+		t.Fatalf("addFeedHubLinks() without hubs returned %s", got)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	initTestGlobals()
+	day := func(d int) time.Time { return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC) }
+	intro := &Article{Id: 1, Title: "Intro", Series: "Go tutorial", SeriesPart: 1, PublishedOn: day(5), BodyHtml: "<p>1</p>"}
+	extra := &Article{Id: 2, Title: "Extra", Series: "Go tutorial", PublishedOn: day(1), BodyHtml: "<p>2</p>"}
+	basics := &Article{Id: 3, Title: "Basics", Series: "Go tutorial", SeriesPart: 2, PublishedOn: day(3), BodyHtml: "<p>3</p>"}
+	// the same part number, earlier date
+	types := &Article{Id: 4, Title: "Types", Series: "Go tutorial", SeriesPart: 2, PublishedOn: day(2), BodyHtml: "<p>4</p>"}
+	other := &Article{Id: 5, Title: "Other", PublishedOn: day(4), BodyHtml: "<p>5</p>"}
+	articles := []*Article{extra, types, basics, other, intro}
+	idToArticle := make(map[int]*Article)
+	for _, a := range articles {
+		idToArticle[a.Id] = a
+	}
+	store = &Store{articles: articles, idToArticle: idToArticle}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	s := getSeries(Urlify("Go tutorial"))
+	if s == nil {
+		t.Fatal("series not found")
+	}
+	var titles []string
+	for _, a := range s.Articles {
+		titles = append(titles, a.Title)
+	}
+	if got := strings.Join(titles, ", "); got != "Intro, Types, Basics, Extra" {
+		t.Fatalf("bad order of parts: %s", got)
+	}
+	if nav := getSeriesNav(types); nav == nil || nav.Part != 2 || nav.Prev != intro || nav.Next != basics {
+		t.Fatalf("bad series nav: %+v", nav)
+	}
+	if nav := getSeriesNav(extra); nav == nil || nav.Next != nil || nav.Prev != basics {
+		t.Fatalf("bad series nav of the last part: %+v", nav)
+	}
+	if nav := getSeriesNav(other); nav != nil {
+		t.Fatalf("series nav for article not in a series: %+v", nav)
+	}
+
+	w := httptest.NewRecorder()
+	handleSeries(w, httptest.NewRequest("GET", s.Url(), nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Index(body, "Types") > strings.Index(body, "Basics") || !strings.Contains(body, "/"+extra.Permalink()) {
+		t.Fatalf("bad series page: %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleSeries(w, httptest.NewRequest("GET", "/series/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing series returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	serveArticle(w, httptest.NewRequest("GET", "/"+types.Permalink(), nil), articlesCache.get(), &ArticleInfo{this: types})
+	body = w.Body.String()
+	if !strings.Contains(body, "Part 2 of 4") || !strings.Contains(body, "next part: Basics") || !strings.Contains(body, "previous part: Intro") {
+		t.Fatalf("bad series navigation in article: %s", body)
+	}
+}
+
+func TestArticleStats(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+
+	s := computeArticleStats("<p>Hello <b>big</b> world &amp; more.</p><pre><code>x := 1\ny := 2</code></pre><script>var a = 1;</script><pre class=\"x\">z</pre>")
+	if s.Words != 12 || s.TextWords != 5 || s.CodeBlocks != 2 {
+		t.Fatalf("bad stats: %+v", s)
+	}
+	for _, tc := range []struct {
+		format int
+		body   string
+	}{
+		{FormatMarkdown, "Hello *big* world & more.\n\n```\nx := 1\n```\n"},
+		{FormatHtml, "<p>Hello <i>big</i> world &amp; more.</p>\n<pre>x := 1</pre>"},
+		{FormatText, "Hello big world & more."},
+		{FormatTextile, "Hello _big_ world & more."},
+	} {
+		a := &Article{Body: []byte(tc.body), Format: tc.format}
+		if s := computeArticleStats(a.GetHtmlStr()); s.TextWords != 5 {
+			t.Errorf("format %d: %d words in %q", tc.format, s.TextWords, a.GetHtmlStr())
+		}
+	}
+
+	s = &ArticleStats{TextWords: 401}
+	if n := s.ReadingTime(); n != 3 {
+		t.Fatalf("reading time of 401 words is %d", n)
+	}
+	setConfig(&Config{WordsPerMinute: 100})
+	if n := s.ReadingTime(); n != 5 {
+		t.Fatalf("reading time of 401 words at 100 wpm is %d", n)
+	}
+	if n := (&ArticleStats{}).ReadingTime(); n != 1 {
+		t.Fatalf("reading time of empty article is %d", n)
+	}
+
+	a := &Article{Id: 1, Title: "A", PublishedOn: time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>one two</p>"}
+	b := &Article{Id: 2, Title: "B", PublishedOn: time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>three</p><pre>x</pre>"}
+	c := &Article{Id: 3, Title: "C", PublishedOn: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>four five six</p>"}
+	store = &Store{articles: []*Article{a, b, c}, idToArticle: map[int]*Article{a.Id: a, b.Id: b, c.Id: c}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+	years := buildYearStats(getCachedArticles())
+	if len(years) != 2 || *years[0] != (YearStats{2017, 1, 3, 0}) || *years[1] != (YearStats{2016, 2, 4, 1}) {
+		t.Fatalf("bad year stats: %+v %+v", years[0], years[1])
+	}
+	w := httptest.NewRecorder()
+	handleStats(w, newTestRequest("GET", "/app/stats", "kjk"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<b>7</b>") {
+		t.Fatalf("bad stats page: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestArchivesByDate(t *testing.T) {
+	initTestGlobals()
+	date := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC) }
+	a := &Article{Id: 1, Title: "June one", PublishedOn: date(2014, 6, 3), BodyHtml: "<p>1</p>"}
+	b := &Article{Id: 2, Title: "June two", PublishedOn: date(2014, 6, 20), BodyHtml: "<p>2</p>"}
+	c := &Article{Id: 3, Title: "December", PublishedOn: date(2014, 12, 1), BodyHtml: "<p>3</p>"}
+	d := &Article{Id: 4, Title: "Next year", PublishedOn: date(2015, 2, 1), BodyHtml: "<p>4</p>"}
+	draft := &Article{Id: 5, Title: "Draft", PublishedOn: date(2014, 7, 1), BodyHtml: "<p>5</p>", IsDraft: true}
+	articles := []*Article{a, b, draft, c, d}
+	idToArticle := make(map[int]*Article)
+	for _, a := range articles {
+		idToArticle[a.Id] = a
+	}
+	store = &Store{articles: articles, idToArticle: idToArticle}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	years := articlesCache.get().archive
+	if len(years) != 2 || years[0].Year != 2015 || years[1].Count != 3 || len(years[1].Months) != 2 ||
+		years[1].Month(6) == nil || len(years[1].Month(6).Articles) != 2 || years[1].Month(7) != nil {
+		t.Fatalf("bad archive: %+v", years)
+	}
+
+	get := func(uri string) (int, string) {
+		w := httptest.NewRecorder()
+		handleArchivesByDate(w, httptest.NewRequest("GET", uri, nil))
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/archives/")
+	if code != http.StatusOK || !strings.Contains(body, `href="/archives/2014/06/">June</a> (2)`) || strings.Contains(body, "July") {
+		t.Fatalf("bad archives index: %d %s", code, body)
+	}
+	code, body = get("/archives/2014/")
+	if code != http.StatusOK || !strings.Contains(body, "December") || strings.Contains(body, "Next year") || strings.Contains(body, "Draft") {
+		t.Fatalf("bad year page: %d %s", code, body)
+	}
+	code, body = get("/archives/2014/06/")
+	if code != http.StatusOK || !strings.Contains(body, "June two") || strings.Contains(body, "December") ||
+		!strings.Contains(body, `id="2014-06"`) {
+		t.Fatalf("bad month page: %d %s", code, body)
+	}
+	if code, _ = get("/archives/2014"); code != http.StatusMovedPermanently {
+		t.Fatalf("no redirect to url with /: %d", code)
+	}
+	for _, uri := range []string{"/archives/2013/", "/archives/2014/07/", "/archives/2014/13/", "/archives/2014/6/",
+		"/archives/abcd/", "/archives/2014/06/01/", "/archives/20140/"} {
+		if code, _ = get(uri); code != http.StatusNotFound {
+			t.Errorf("%s returned %d, expected 404", uri, code)
+		}
+	}
+}
+
+func TestPrivateArticles(t *testing.T) {
+	initTestGlobals()
+	a := &Article{Id: 1, Title: "Public one", BodyHtml: "<p>1</p>"}
+	private := &Article{Id: 2, Title: "Secret", BodyHtml: "<p>secret</p>", IsPrivate: true}
+	b := &Article{Id: 3, Title: "Public two", BodyHtml: "<p>3</p>"}
+	store = &Store{articles: []*Article{a, private, b}, idToArticle: map[int]*Article{a.Id: a, private.Id: private, b.Id: b}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	for _, curr := range getCachedArticles() {
+		if curr == private {
+			t.Fatal("private article in cached articles")
+		}
+	}
+	if info := getCachedArticlesById(a.Id); info == nil || info.next != b {
+		t.Fatalf("next of public article is not the next public article: %+v", info)
+	}
+	if info := getCachedArticlesById(private.Id); info != nil {
+		t.Fatal("private article found by id")
+	}
+
+	get := func(uri, user string) (int, string) {
+		w := httptest.NewRecorder()
+		handleArticle(w, newTestRequest("GET", uri, user))
+		return w.Code, w.Body.String()
+	}
+	uri := "/" + private.Permalink()
+	if code, _ := get(uri, ""); code != http.StatusNotFound {
+		t.Fatalf("private article returned %d to anonymous", code)
+	}
+	if code, body := get(uri, "kjk"); code != http.StatusOK || !strings.Contains(body, "noindex") || !strings.Contains(body, `action="/app/share"`) {
+		t.Fatalf("private article returned %d to admin: %s", code, body)
+	}
+	if code, body := get("/"+a.Permalink(), ""); code != http.StatusOK || strings.Contains(body, "noindex") {
+		t.Fatalf("bad public article: %d", code)
+	}
+
+	now := time.Now()
+	token := newShareToken(private, now.Add(time.Hour))
+	if code, body := get(uri+"?share="+url.QueryEscape(token), ""); code != http.StatusOK || !strings.Contains(body, "noindex") || strings.Contains(body, "/app/share") {
+		t.Fatalf("private article with share token returned %d", code)
+	}
+	if !isValidShareToken(private, token, now) || isValidShareToken(private, token, now.Add(2*time.Hour)) {
+		t.Fatal("bad expiration of share token")
+	}
+	if isValidShareToken(a, token, now) {
+		t.Fatal("share token valid for another article")
+	}
+	expired := newShareToken(private, now.Add(-time.Minute))
+	if code, _ := get(uri+"?share="+url.QueryEscape(expired), ""); code != http.StatusNotFound {
+		t.Fatalf("private article with expired token returned %d", code)
+	}
+	for _, bad := range []string{"x", "123.abc", token + "0", strings.Replace(token, ".", "0.", 1)} {
+		if isValidShareToken(private, bad, now) {
+			t.Errorf("invalid token %q accepted", bad)
+		}
+	}
+	revoked := *private
+	revoked.ShareGeneration++
+	if isValidShareToken(&revoked, token, now) {
+		t.Fatal("share token valid after bumping share generation")
+	}
+
+	r := newTestRequest("POST", "/app/share", "kjk")
+	r.Form = url.Values{"csrf_token": {testCsrfToken}, "id": {"2"}, "days": {"3"}}
+	w := httptest.NewRecorder()
+	handleShare(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), private.Permalink()+"?share=") {
+		t.Fatalf("bad response to share: %d %s", w.Code, w.Body.String())
+	}
+	r = newTestRequest("POST", "/app/share", "kjk")
+	r.Form = url.Values{"csrf_token": {testCsrfToken}, "id": {"1"}, "days": {"3"}}
+	w = httptest.NewRecorder()
+	handleShare(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("share of public article returned %d", w.Code)
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	initTestGlobals()
+	a := &Article{
+		Id:          21,
+		Title:       "Head",
+		PublishedOn: time.Date(2016, 3, 4, 0, 0, 0, 0, time.UTC),
+		BodyHtml:    "<p>head</p>",
+	}
+	store = &Store{articles: []*Article{a}, idToArticle: map[int]*Article{a.Id: a}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	for _, tc := range []struct {
+		url string
+		fn  func(http.ResponseWriter, *http.Request)
+	}{
+		{"/" + a.Permalink(), handleArticle},
+		{"/atom.xml", handleAtom},
+		{"/atom-all.xml", handleAtomAll},
+	} {
+		h := makeTimingHandler(tc.fn)
+		get := httptest.NewRecorder()
+		h.ServeHTTP(get, httptest.NewRequest("GET", tc.url, nil))
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, httptest.NewRequest("HEAD", tc.url, nil))
+		if get.Code != http.StatusOK || head.Code != http.StatusOK {
+			t.Fatalf("%s: GET returned %d, HEAD returned %d", tc.url, get.Code, head.Code)
+		}
+		if head.Body.Len() != 0 {
+			t.Fatalf("%s: HEAD returned a body", tc.url)
+		}
+		if cl := head.Header().Get("Content-Length"); cl != strconv.Itoa(get.Body.Len()) {
+			t.Fatalf("%s: HEAD Content-Length is %q, GET body is %d bytes", tc.url, cl, get.Body.Len())
+		}
+	}
+
+	// helpers honor HEAD without the timing handler too
+	w := httptest.NewRecorder()
+	writeResponse(w, httptest.NewRequest("HEAD", "/", nil), http.StatusCreated, "created")
+	if w.Code != http.StatusCreated || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "7" {
+		t.Fatalf("got %d, body %q, Content-Length %q", w.Code, w.Body.String(), w.Header().Get("Content-Length"))
+	}
+}
+
+func TestRobotsTxt(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	prevProduction := inProduction
+	defer func() { inProduction = prevProduction }()
+
+	if s := buildRobotsTxt(false, []string{"/drafts/"}); s != "User-agent: *\nDisallow: /\n" {
+		t.Fatalf("not in production everything should be disallowed, got:\n%s", s)
+	}
+	s := buildRobotsTxt(true, []string{"/drafts/", "/app/"})
+	for _, line := range []string{"Disallow: /app/\n", "Disallow: /logout\n", "Disallow: /drafts/\n", "Allow: /\n"} {
+		if !strings.Contains(s, line) {
+			t.Fatalf("missing %q in:\n%s", line, s)
+		}
+	}
+	if strings.Count(s, "Disallow: /app/\n") != 1 {
+		t.Fatalf("duplicate path in:\n%s", s)
+	}
+
+	// RobotsDisallow is re-read with the config
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	authKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	encrKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	write := func(robots string) {
+		s := fmt.Sprintf(`{"CookieAuthKeyHexStr":"%s","CookieEncrKeyHexStr":"%s","RobotsDisallow":%s}`, authKey, encrKey, robots)
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[]`)
+	c, err := parseConfig(mustReadFile(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(c)
+	write(`["/private/"]`)
+	if res, err := reloadConfig(path); err != nil || len(res.RequiresRestart) != 0 {
+		t.Fatalf("reloadConfig() returned %v, %v", res, err)
+	}
+	inProduction = true
+	w := httptest.NewRecorder()
+	handleRobotsTxt(w, httptest.NewRequest("GET", "/robots.txt", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Disallow: /private/\n") {
+		t.Fatalf("got %d:\n%s", w.Code, w.Body.String())
+	}
+
+	write(`["private"]`)
+	if _, err = reloadConfig(path); err == nil {
+		t.Fatalf("path without / accepted")
+	}
+}
+
+func TestJsonFeed(t *testing.T) {
+	initTestGlobals()
+	var articles []*Article
+	for i := 1; i <= 30; i++ {
+		tags := []string{"go"}
+		if i%10 == 0 {
+			tags = []string{"note"}
+		}
+		articles = append(articles, &Article{
+			Id:          100 + i,
+			Title:       fmt.Sprintf("Feed %d", i),
+			Tags:        tags,
+			PublishedOn: time.Date(2017, 1, i, 0, 0, 0, 0, time.UTC),
+			UpdatedOn:   time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+			BodyHtml:    fmt.Sprintf("<p>body %d</p>", i),
+		})
+	}
+	store = &Store{}
+	if err := store.SetArticles(articles); err != nil {
+		t.Fatal(err)
+	}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	get := func(uri string) (*httptest.ResponseRecorder, *JsonFeed) {
+		w := httptest.NewRecorder()
+		handleJsonFeed(w, httptest.NewRequest("GET", uri, nil))
+		var feed JsonFeed
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+				t.Fatalf("%s: %s", uri, err)
+			}
+		}
+		return w, &feed
+	}
+	w, feed := get("/feed.json")
+	if ct := w.Header().Get("Content-Type"); ct != "application/feed+json" {
+		t.Fatalf("bad Content-Type %q", ct)
+	}
+	if feed.Version != "https://jsonfeed.org/version/1.1" || len(feed.Items) != feedMaxItems {
+		t.Fatalf("bad feed: %+v", feed)
+	}
+	first := feed.Items[0]
+	if first.Title != "Feed 29" || first.ContentHtml != "<p>body 29</p>" || first.Url != absURL(articles[28].Permalink()) ||
+		first.DatePublished != "2017-01-29T00:00:00Z" || first.DateModified != "2017-03-01T00:00:00Z" || first.Tags[0] != "go" {
+		t.Fatalf("bad item: %+v", first)
+	}
+	// same articles as in atom feed
+	for i, a := range feedArticles(filterArticlesByTag(getCachedArticles(), "note", false)) {
+		if feed.Items[i].Title != a.Title {
+			t.Fatalf("item %d is %q, expected %q", i, feed.Items[i].Title, a.Title)
+		}
+	}
+
+	_, feed = get("/feed.json?tag=note")
+	if len(feed.Items) != 3 || feed.Items[0].Title != "Feed 30" || !strings.HasSuffix(feed.FeedUrl, "/feed.json?tag=note") {
+		t.Fatalf("bad feed for tag: %+v", feed)
+	}
+	if w, _ = get("/feed.json?tag=missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("feed for missing tag returned %d", w.Code)
+	}
+}
+
+func TestCrashSpam(t *testing.T) {
+	initTestGlobals()
+	if err := checkCrashReport(test); err != nil {
+		t.Fatalf("real crash report rejected: %s", err)
+	}
+	spam := []string{
+		"crash 1",
+		"Buy cheap stuff at http://spam.example.com/",
+		string(test) + strings.Repeat("http://a.example.com/ ", maxCrashReportUrls+1),
+		string(test) + "\x00\x01",
+	}
+	for _, s := range spam {
+		if checkCrashReport([]byte(s)) == nil {
+			t.Fatalf("accepted %q", s)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "crashspam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createDataDirSkeleton(dir); err != nil {
+		t.Fatal(err)
+	}
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+	prev := getConfig()
+	defer setConfig(prev)
+	c := *prev
+	c.BlockCrashSpammers = true
+	setConfig(&c)
+	s, err := NewStoreCrashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.dataFile.Close()
+	prevStoreCrashes := storeCrashes
+	storeCrashes = s
+	defer func() { storeCrashes = prevStoreCrashes }()
+
+	post := func(ip, crash string) int {
+		body, _ := json.Marshal(CrashApiRequest{AppName: "SumatraPDF", AppVer: "3.1.2", Os: "Windows 10", Crash: crash})
+		r := httptest.NewRequest("POST", "/api/crash/v2", bytes.NewReader(body))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handleCrashApiV2(w, r)
+		return w.Code
+	}
+	rejectedBefore := appMetrics.RejectedCrashes.Count()
+	if code := post("10.1.1.1", spam[1]); code != http.StatusBadRequest {
+		t.Fatalf("spam returned %d", code)
+	}
+	// once rejected, even real crash reports from that address are
+	if code := post("10.1.1.1", string(test)); code != http.StatusForbidden {
+		t.Fatalf("blocked address returned %d", code)
+	}
+	if code := post("10.1.1.2", string(test)); code != http.StatusOK {
+		t.Fatalf("crash report returned %d", code)
+	}
+	if n := appMetrics.RejectedCrashes.Count() - rejectedBefore; n != 2 {
+		t.Fatalf("counted %d rejected crashes, expected 2", n)
+	}
+	if s.CrashesCount() != 1 {
+		t.Fatalf("expected 1 crash, got %d", s.CrashesCount())
+	}
+	if d := string(mustReadFile(t, crashSpamIpsPath())); d != "10.1.1.1\n" {
+		t.Fatalf("bad blocklist file %q", d)
+	}
+
+	crashSpamIpsMu.Lock()
+	crashSpamIps = make(map[string]bool)
+	crashSpamIpsMu.Unlock()
+	defer func() {
+		crashSpamIpsMu.Lock()
+		crashSpamIps = make(map[string]bool)
+		crashSpamIpsMu.Unlock()
+	}()
+	readCrashSpamIps()
+	if !isCrashSpammer("10.1.1.1") || isCrashSpammer("10.1.1.2") {
+		t.Fatalf("blocklist not re-read")
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	owner := "Site Owner"
+	setConfig(&Config{SiteOwner: &owner})
+
+	day := func(d int) time.Time { return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC) }
+	own := &Article{Id: 1, Title: "Own", PublishedOn: day(1), BodyHtml: "<p>1</p>"}
+	guest := &Article{Id: 2, Title: "Guest", Authors: parseAuthors(" Jane Doe , Site Owner,"), PublishedOn: day(2), BodyHtml: "<p>2</p>"}
+	articles := []*Article{guest, own}
+	idToArticle := make(map[int]*Article)
+	for _, a := range articles {
+		idToArticle[a.Id] = a
+	}
+	store = &Store{articles: articles, idToArticle: idToArticle}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	if got := strings.Join(guest.AuthorNames(), "|"); got != "Jane Doe|Site Owner" {
+		t.Fatalf("bad authors: %q", got)
+	}
+	if got := own.AuthorNames(); len(got) != 1 || got[0] != owner {
+		t.Fatalf("bad default author: %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	serveArticle(w, httptest.NewRequest("GET", "/"+guest.Permalink(), nil), articlesCache.get(), &ArticleInfo{this: guest})
+	if body := w.Body.String(); !strings.Contains(body, `Written by <a href="/author/Jane-Doe">Jane Doe</a>, <a href="/author/Site-Owner">Site Owner</a>`) {
+		t.Fatalf("bad byline: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handleAuthor(w, httptest.NewRequest("GET", "/author/Site-Owner", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Index(body, ">Guest<") > strings.Index(body, ">Own<") {
+		t.Fatalf("bad author page: %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleAuthor(w, httptest.NewRequest("GET", "/author/Jane-Doe", nil))
+	if body = w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, ">Guest<") || strings.Contains(body, ">Own<") {
+		t.Fatalf("bad author page: %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleAuthor(w, httptest.NewRequest("GET", "/author/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing author returned %d", w.Code)
+	}
+
+	item := newJsonFeedItem(guest)
+	if len(item.Authors) != 2 || item.Authors[0].Name != "Jane Doe" || item.Authors[0].Url != absURL("/author/Jane-Doe") {
+		t.Fatalf("bad feed item authors: %+v", item.Authors)
+	}
+	got := string(addFeedEntryAuthors([]byte(`<feed><entry><title>a</title></entry><entry xml:lang="en"></entry></feed>`), [][]string{{"A & B"}, {"C", "D"}}))
+	if strings.Count(got, "<author>") != 3 || !strings.Contains(got, `<entry><author><name>A &amp; B</name>`) ||
+		!strings.Contains(got, `<entry xml:lang="en"><author><name>C</name>`) {
+		t.Fatalf("bad atom authors: %s", got)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	initTestGlobals()
+	d := "Id: 7\r\nTitle: Hello\r\nDate: 2016-03-01\r\nTags: Go, web\r\ntags: ,Tools\r\nDraft: yes\r\nX-Source: http://example.com/a:b\r\n-----\r\nbody\r\n"
+	a, errs := parseArticle("a.md", []byte(d))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if a.Id != 7 || a.Title != "Hello" || a.Format != FormatMarkdown || !a.IsDraft || strings.Join(a.Tags, "|") != "go|web|tools" ||
+		a.PublishedOn.Format("2006-01-02") != "2016-03-01" || string(a.Body) != "body\r\n" {
+		t.Fatalf("bad article: %+v", a)
+	}
+	if len(a.Headers) != 1 || a.Headers[0].Key != "X-Source" || a.Headers[0].Value != "http://example.com/a:b" {
+		t.Fatalf("unknown header not preserved: %+v", a.Headers)
+	}
+	hdr := serArticleHeader(a)
+	a2, errs := parseArticle("a.txt", []byte(hdr+"body\r\n"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if hdr2 := serArticleHeader(a2); hdr2 != hdr || !strings.Contains(hdr, "X-Source: http://example.com/a:b\n") || string(a2.Body) != "body\r\n" {
+		t.Fatalf("header didn't round-trip:\n%s\n%s", hdr, hdr2)
+	}
+
+	// each has errors that must all be reported, with file name and line
+	malformed := []struct {
+		path string
+		d    string
+		errs []string
+	}{
+		{"a.md", "Id: 1\nTitle: a\nDate: 2016-03-01\n", []string{"a.md:3: header is not ended with ----- line"}},
+		{"a.md", "", []string{"a.md: header is not ended with ----- line"}},
+		{"a.dat", "Id: 1\nTitle: a\nDate: 2016-03-01\n-----\n", []string{"a.dat: missing Format: header"}},
+		{"a.md", "Id: x\nTitle: a\nDate: 2016-13-01\nFormat: rtf\n-----\n", []string{
+			`a.md:1: "x" is not a valid id`, `a.md:3: "2016-13-01" is not a valid date`, `a.md:4: "rtf" is not a valid format`}},
+		{"a.md", "Title: a\nno colon\nDraft: maybe\nTitle: b\n-----\n", []string{
+			`a.md:2: unexpected line "no colon"`, `a.md:3: Draft: "maybe" is not a valid value`, "a.md:4: Title is already set in line 1",
+			"a.md: missing Id: header", "a.md: missing Date: header"}},
+	}
+	for _, test := range malformed {
+		a, errs := parseArticle(test.path, []byte(test.d))
+		if a != nil || len(errs) != len(test.errs) {
+			t.Fatalf("%q: expected %d errors, got %v", test.d, len(test.errs), errs)
+		}
+		for i, err := range errs {
+			if !strings.HasPrefix(err.Error(), test.errs[i]) {
+				t.Fatalf("%q: error %d is %q, expected %q", test.d, i, err, test.errs[i])
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.md"), []byte("Id: 1\nTitle: a\nDate: 2016-03-01\n-----\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.md"), []byte("Id: 1\nTitle: b\nDate: 2016-03-01\n-----\n"), 0644)
+	if validatePosts(dir) != 1 {
+		t.Fatalf("duplicate id not detected")
+	}
+	os.Remove(filepath.Join(dir, "b.md"))
+	if validatePosts(dir) != 0 {
+		t.Fatalf("valid posts reported as invalid")
+	}
+}
+
+func TestReloadArticleFiles(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDataDir := dataDir
+	dataDir = filepath.Join(dir, "data")
+	defer func() { dataDir = prevDataDir }()
+	post := func(id int, title string) string {
+		return fmt.Sprintf("Id: %d\nTitle: %s\nDate: 2016-03-0%d\n-----\nbody", id, title, id)
+	}
+	write := func(name, s string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pathA, pathB := write("a.md", post(1, "A")), write("b.md", post(2, "B"))
+	var articles []*Article
+	for _, path := range []string{pathA, pathB} {
+		a, err := readArticle(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		articles = append(articles, a)
+	}
+	store = &Store{}
+	defer rebuildArticlesCache()
+	if err = swapArticles(articles); err != nil {
+		t.Fatal(err)
+	}
+	articlesCacheRebuilder.wait()
+
+	for _, name := range []string{"a.md.swp", ".#a.md", "#a.md#", "a.md~", "4913", "a.md.tmp"} {
+		if isArticleFile(filepath.Join(dir, name)) {
+			t.Fatalf("%s is an article file", name)
+		}
+	}
+
+	write("a.md", post(1, "A2"))
+	os.Remove(pathB)
+	pathC := write("c.md", post(3, "C"))
+	reloadArticleFiles([]string{pathA, pathB, pathC})
+	articlesCacheRebuilder.wait()
+	if a := store.GetArticleById(1); a == nil || a.Title != "A2" {
+		t.Fatalf("changed article not re-read: %+v", a)
+	}
+	if a := store.GetArticleById(3); a == nil || a.Title != "C" {
+		t.Fatalf("new article not read: %+v", a)
+	}
+	deleted := false
+	for _, a := range store.GetAllArticles() {
+		if a.Id == 2 {
+			deleted = a.IsDeleted
+		}
+	}
+	if !deleted {
+		t.Fatalf("article of deleted file not marked deleted")
+	}
+	if len(getCachedArticles()) != 3 {
+		t.Fatalf("cache not rebuilt, %d articles", len(getCachedArticles()))
+	}
+
+	// broken file keeps the previous version
+	write("a.md", "Id: 1\nTitle: A3\n-----\n")
+	reloadArticleFiles([]string{pathA})
+	articlesCacheRebuilder.wait()
+	if a := store.GetArticleById(1); a == nil || a.Title != "A2" {
+		t.Fatalf("broken article replaced the previous version: %+v", a)
+	}
+
+	// moved file is the same article, not a deleted one and a new one
+	os.Remove(pathC)
+	pathD := write("d.md", post(3, "C"))
+	reloadArticleFiles([]string{pathC, pathD})
+	articlesCacheRebuilder.wait()
+	if a := store.GetArticleById(3); a == nil || a.Path != pathD || store.IsDeletedArticleId(3) {
+		t.Fatalf("moved article: %+v", a)
+	}
+
+	// changed date adds a redirect from the old permalink
+	prev := getConfig()
+	defer setConfig(prev)
+	scheme := "/{year}/{month}/{slug}.html"
+	setConfig(&Config{PermalinkScheme: &scheme})
+	prevRedirectsPath, prevRedirects := redirectsPath, fileRedirects
+	redirectsPath, fileRedirects = filepath.Join(dir, "redirects.txt"), NewRedirects(nil)
+	defer func() { redirectsPath, fileRedirects = prevRedirectsPath, prevRedirects }()
+	write("d.md", "Id: 3\nTitle: C\nDate: 2015-11-20 23:30\n-----\nbody")
+	reloadArticleFiles([]string{pathD})
+	articlesCacheRebuilder.wait()
+	if a := store.GetArticleById(3); a == nil || a.Permalink() != "2015/11/C.html" {
+		t.Fatalf("date not changed: %+v", a)
+	}
+	if to, _ := fileRedirects.Find("/2016/03/C.html"); to != "/2015/11/C.html" {
+		t.Fatalf("old permalink redirects to %q", to)
+	}
+	if d, _ := ioutil.ReadFile(redirectsPath); string(d) != "3|2016/03/C.html\n" {
+		t.Fatalf("redirect not saved: %q", d)
+	}
+	// changing it back removes the redirect that would be a loop
+	write("d.md", post(3, "C"))
+	reloadArticleFiles([]string{pathD})
+	articlesCacheRebuilder.wait()
+	if to, _ := fileRedirects.Find("/2016/03/C.html"); to != "" {
+		t.Fatalf("permalink redirects to %q", to)
+	}
+	if to, _ := fileRedirects.Find("/2015/11/C.html"); to != "/2016/03/C.html" {
+		t.Fatalf("second old permalink redirects to %q", to)
+	}
+}
+
+func TestArticleDateChange(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	scheme := "/{year}/{month}/{slug}.html"
+	tz := "Europe/Warsaw"
+	setConfig(&Config{PermalinkScheme: &scheme, TimeZone: &tz})
+
+	dateTests := []struct {
+		s   string
+		exp string
+	}{
+		// date and time are in TimeZone, with daylight saving time
+		{"2017-03-04 10:30", "2017-03-04T09:30:00Z"},
+		{"2017-07-04 10:30", "2017-07-04T08:30:00Z"},
+		{"2017-03-04T10:30:00+02:00", "2017-03-04T08:30:00Z"},
+		{"2017-03-04", "2017-03-04T00:00:00Z"},
+		{"2017-03-04 25:30", ""},
+	}
+	for _, test := range dateTests {
+		d, err := parseDate(test.s)
+		if test.exp == "" {
+			if err == nil {
+				t.Errorf("parseDate(%q) didn't fail", test.s)
+			}
+			continue
+		}
+		if err != nil || d.UTC().Format(time.RFC3339) != test.exp {
+			t.Errorf("parseDate(%q) returned %s, %v, expected %s", test.s, d.UTC(), err, test.exp)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "datechange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevRedirectsPath, prevRedirects := redirectsPath, fileRedirects
+	redirectsPath, fileRedirects = filepath.Join(dir, "redirects.txt"), NewRedirects(nil)
+	defer func() { redirectsPath, fileRedirects = prevRedirectsPath, prevRedirects }()
+	prevStore := store
+	defer func() { store = prevStore }()
+
+	a := &Article{Id: 1, Title: "A", PublishedOn: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)}
+	moved := *a
+	moved.PublishedOn = time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)
+	// another article has the old permalink of a, it's not redirected
+	b := &Article{Id: 2, Title: "A", PublishedOn: time.Date(2016, 3, 2, 0, 0, 0, 0, time.UTC)}
+	store = &Store{}
+	if err = store.SetArticles([]*Article{&moved, b}); err != nil {
+		t.Fatal(err)
+	}
+	redirectIfDateChanged(a, &moved)
+	if to, _ := fileRedirects.Find("/2016/03/A.html"); to != "" {
+		t.Fatalf("permalink of another article redirects to %q", to)
+	}
+	store = &Store{}
+	if err = store.SetArticles([]*Article{&moved}); err != nil {
+		t.Fatal(err)
+	}
+	redirectIfDateChanged(a, &moved)
+	if to, _ := fileRedirects.Find("/2016/03/A.html"); to != "/2015/11/A.html" {
+		t.Fatalf("old permalink redirects to %q", to)
+	}
+}
+
+func TestArticleCli(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.md")
+	ioutil.WriteFile(path, []byte("Id: 5\nTitle: Hello\nDate: 2016-03-01\nTags: go\nDraft: yes\nX-Extra: kept\n-----\nbody\n"), 0644)
+	a, err := readArticle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	listArticles(&b, []*Article{a}, false)
+	if got := b.String(); got != "5\t2016-03-01\tHello\tgo\tdraft\n" {
+		t.Fatalf("bad list: %q", got)
+	}
+	b.Reset()
+	listArticles(&b, []*Article{a}, true)
+	var items []*ArticleListItem
+	if err = json.Unmarshal(b.Bytes(), &items); err != nil || len(items) != 1 || items[0].Id != 5 || !items[0].Draft || items[0].Path != path {
+		t.Fatalf("bad json list: %s %s", err, b.String())
+	}
+
+	b.Reset()
+	if err = deleteArticleFile(a, true, strings.NewReader("n\n"), &b); err == nil || !strings.Contains(b.String(), `Delete article 5 "Hello"`) {
+		t.Fatalf("deleted without confirmation: %v %q", err, b.String())
+	}
+	if err = deleteArticleFile(a, true, strings.NewReader("y\n"), &b); err != nil {
+		t.Fatal(err)
+	}
+	a, err = readArticle(path)
+	if err != nil || !a.IsDeleted || !a.IsDraft || string(a.Body) != "body\n" || len(a.Headers) != 1 {
+		t.Fatalf("bad deleted article: %s %+v", err, a)
+	}
+	if err = deleteArticleFile(a, false, nil, &b); err == nil {
+		t.Fatalf("deleted article deleted again")
+	}
+}
+
+func TestCors(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{CorsAllowedOrigins: []string{"https://admin.example.com"}})
+
+	called := false
+	h := withCors(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte("ok"))
+	})
+	do := func(method, origin string) *httptest.ResponseRecorder {
+		called = false
+		r := httptest.NewRequest(method, "/api/crash/v2", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := do("OPTIONS", "https://admin.example.com")
+	hdr := w.Header()
+	if w.Code != http.StatusNoContent || called || hdr.Get("Access-Control-Allow-Origin") != "https://admin.example.com" ||
+		hdr.Get("Access-Control-Allow-Credentials") != "true" || !strings.Contains(hdr.Get("Access-Control-Allow-Methods"), "POST") ||
+		!strings.Contains(hdr.Get("Access-Control-Allow-Headers"), csrfHeader) || hdr.Get("Vary") != "Origin" {
+		t.Fatalf("bad preflight: %d %v", w.Code, hdr)
+	}
+	w = do("OPTIONS", "https://evil.example.com")
+	if w.Code != http.StatusForbidden || called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("preflight from not allowed origin: %d %v", w.Code, w.Header())
+	}
+	w = do("POST", "https://admin.example.com")
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" {
+		t.Fatalf("bad cross-origin request: %v %v", called, w.Header())
+	}
+	w = do("POST", "https://evil.example.com")
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("not allowed origin got CORS headers: %v", w.Header())
+	}
+	w = do("POST", "")
+	if !called || w.Header().Get("Vary") != "" {
+		t.Fatalf("same-origin request got CORS headers: %v", w.Header())
+	}
+
+	// not /api/ urls don't have CORS headers
+	r := httptest.NewRequest("GET", "/robots.txt", nil)
+	r.Header.Set("Origin", "https://admin.example.com")
+	w = httptest.NewRecorder()
+	handleRobotsTxt(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("CORS headers on non-api url: %v", w.Header())
+	}
+
+	for _, origin := range []string{"https://admin.example.com", "http://localhost:8080"} {
+		if !isValidCorsOrigin(origin) {
+			t.Fatalf("%q is valid", origin)
+		}
+	}
+	for _, origin := range []string{"*", "https://admin.example.com/", "admin.example.com", "ftp://a.com", "https://a.com/x"} {
+		if isValidCorsOrigin(origin) {
+			t.Fatalf("%q is not valid", origin)
+		}
+	}
+}
+
+func TestRstAndOrg(t *testing.T) {
+	initTestGlobals()
+	if parseFormat("reStructuredText") != FormatRst || parseFormat("org") != FormatOrg || formatFromExt("a.rst") != FormatRst ||
+		formatFromExt("a.org") != FormatOrg || !validFormat(FormatOrg) || FormatNameToId("Rst") != FormatRst {
+		t.Fatalf("rst and org formats not registered")
+	}
+
+	rstDoc := "=====\nTitle\n=====\n\nSome **bold**, *em*, ``a<b`` and `a link <http://x.com/?a=1&b>`_, `ref`_.\n\nSection\n-------\n\n" +
+		"- one\n- two\n  continued\n\n  * nested\n\n#. first\n#. second\n\nExample::\n\n    x := 1\n\n" +
+		".. code-block:: python\n   :linenos:\n\n   print('<hi>')\n\n.. note:: Be <careful>\n\n.. a comment\n\n   Quoted <text>\n\n----\n\n`bad <javascript:alert(1)>`_\n"
+	orgDoc := "#+TITLE: Notes\n#+CAPTION: a <caption>\n* Heading\n** Sub\nSome *bold*, /em/, _u_, =a<b=, ~c~, +del+ and [[http://x.com/?a=1&b][a link]], [[http://y.com]].\n\n" +
+		"- one\n- two\n  - nested\n1. first\n2. second\n\n#+BEGIN_SRC python\nprint('<hi>')\n#+END_SRC\n\n#+begin_quote\nQuoted *text*\n#+end_quote\n\n" +
+		"#+BEGIN_VERSE\nroses <are>\n#+END_VERSE\n\n: fixed <1>\n# comment\n-----\n[[javascript:alert(1)][bad]] 2*3*4\n"
+	for _, tc := range []struct {
+		name     string
+		html     string
+		expected []string
+		absent   []string
+	}{
+		{"rst", rst([]byte(rstDoc)), []string{
+			"<h1>Title</h1>", "<h2>Section</h2>",
+			`<p>Some <strong>bold</strong>, <em>em</em>, <code>a&lt;b</code> and <a href="http://x.com/?a=1&amp;b">a link</a>, ref.</p>`,
+			"<li>two\ncontinued<ul>\n<li>nested</li>\n</ul>\n</li>", "<ol>\n<li>first</li>\n<li>second</li>\n</ol>",
+			"<p>Example:</p>\n<pre class=\"prettyprint\">x := 1</pre>", `<pre class="prettyprint lang-py">print(&#39;&lt;hi&gt;&#39;)</pre>`,
+			"<pre>.. note:: Be &lt;careful&gt;</pre>", "<hr>", "<p>bad</p>",
+		}, []string{"comment", "Quoted", "javascript"}},
+		{"org", org([]byte(orgDoc)), []string{
+			"<p>#+CAPTION: a &lt;caption&gt;</p>", "<h1>Heading</h1>", "<h2>Sub</h2>",
+			`<p>Some <strong>bold</strong>, <em>em</em>, <u>u</u>, <code>a&lt;b</code>, <code>c</code>, <del>del</del> and <a href="http://x.com/?a=1&amp;b">a link</a>, <a href="http://y.com">http://y.com</a>.</p>`,
+			"<li>two<ul>\n<li>nested</li>\n</ul>\n</li>", "<ol>\n<li>first</li>\n<li>second</li>\n</ol>",
+			`<pre class="prettyprint lang-py">print(&#39;&lt;hi&gt;&#39;)</pre>`, "<blockquote>\n<p>Quoted <strong>text</strong></p>\n</blockquote>",
+			"<pre>#+BEGIN_VERSE\nroses &lt;are&gt;\n#+END_VERSE</pre>", `<pre class="prettyprint">fixed &lt;1&gt;</pre>`, "<hr>", "<p>bad 2*3*4</p>",
+		}, []string{"Notes", "comment", "javascript"}},
+	} {
+		for _, s := range tc.expected {
+			if !strings.Contains(tc.html, s) {
+				t.Errorf("%s: %q not in:\n%s", tc.name, s, tc.html)
+			}
+		}
+		for _, s := range tc.absent {
+			if strings.Contains(tc.html, s) {
+				t.Errorf("%s: %q in:\n%s", tc.name, s, tc.html)
+			}
+		}
+	}
+
+	a := &Article{Body: []byte("Title\n=====\n\ntext"), Format: FormatRst}
+	if h := a.GetHtmlStr(); !strings.Contains(h, ">Title</h1>") || !strings.Contains(h, "<p>text</p>") {
+		t.Fatalf("bad html of rst article: %s", h)
+	}
+}
+
+func TestJsonErrors(t *testing.T) {
+	initTestGlobals()
+	store = &Store{}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	jsonError := func(w *httptest.ResponseRecorder) *JsonError {
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("bad Content-Type %q of %s", ct, w.Body.String())
+		}
+		var res JsonError
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+	for _, hdr := range [][2]string{{"Accept", "application/json"}, {"X-Requested-With", "XMLHttpRequest"}} {
+		r := httptest.NewRequest("GET", "/missing", nil)
+		r.Header.Set(hdr[0], hdr[1])
+		w := httptest.NewRecorder()
+		serve404(w, r)
+		if e := jsonError(w); w.Code != http.StatusNotFound || e.Error != "There's no page /missing." || e.Field != "" {
+			t.Fatalf("%s: bad 404: %d %+v", hdr[0], w.Code, e)
+		}
+	}
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	serve404(w, r)
+	if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "no page /missing.") {
+		t.Fatalf("bad html 404: %d %s", w.Code, w.Body.String())
+	}
+
+	share := func(xhr bool, days string) *httptest.ResponseRecorder {
+		r := newTestRequest("POST", "/app/share", "kjk")
+		r.Form = url.Values{"csrf_token": {testCsrfToken}, "id": {"12345"}, "days": {days}}
+		if xhr {
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		w := httptest.NewRecorder()
+		handleShare(w, r)
+		return w
+	}
+	w = share(true, "3")
+	if e := jsonError(w); w.Code != http.StatusBadRequest || e.Field != "id" || e.Error != "no private article with that id" {
+		t.Fatalf("bad field error: %d %+v", w.Code, e)
+	}
+	w = share(false, "3")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid id") || !strings.Contains(w.Body.String(), "no private article with that id") {
+		t.Fatalf("bad html field error: %d %s", w.Code, w.Body.String())
+	}
+
+	r = newTestRequest("POST", "/app/share", "kjk")
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	handleShare(w, r)
+	if e := jsonError(w); w.Code != http.StatusForbidden || e.Field != csrfFormField {
+		t.Fatalf("bad csrf error: %d %+v", w.Code, e)
+	}
+}
+
+func TestExportStatic(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	prevDataDir := dataDir
+	dataDir, _ = ioutil.TempDir("", "blog-export-data")
+	defer func() {
+		os.RemoveAll(dataDir)
+		dataDir = prevDataDir
+	}()
+
+	day := func(d int) time.Time { return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC) }
+	pub := &Article{Id: 1, Title: "Public", Tags: []string{"go"}, PublishedOn: day(1), BodyHtml: `<p><a href="#top">top</a></p>`}
+	other := &Article{Id: 2, Title: "Other", PublishedOn: day(2), BodyHtml: "<p>2</p>"}
+	draft := &Article{Id: 3, Title: "Draft", IsDraft: true, PublishedOn: day(3), BodyHtml: "<p>3</p>"}
+	private := &Article{Id: 4, Title: "Private", IsPrivate: true, PublishedOn: day(4), BodyHtml: "<p>4</p>"}
+	note := &Article{Id: 5, Title: "Note", Tags: []string{noteTag}, PublishedOn: day(5), BodyHtml: "<p>short note</p>"}
+	setArticles := func(articles ...*Article) {
+		idToArticle := make(map[int]*Article)
+		for _, a := range articles {
+			idToArticle[a.Id] = a
+		}
+		store = &Store{articles: articles, idToArticle: idToArticle}
+		rebuildArticlesCache()
+	}
+	defer rebuildArticlesCache()
+	setArticles(private, draft, other, pub, note)
+
+	dir, err := ioutil.TempDir("", "blog-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats, err := exportStatic(dir)
+	if err != nil || len(stats.Failed) > 0 {
+		t.Fatalf("exportStatic() failed: %v %s", err, stats)
+	}
+	if stats.Files == 0 || stats.Written != stats.Files || stats.Bytes == 0 {
+		t.Fatalf("bad stats: %s", stats)
+	}
+	exists := func(uri string, isHtml bool) bool {
+		_, err := os.Stat(filepath.Join(dir, exportFilePath(uri, isHtml)))
+		return err == nil
+	}
+	for _, uri := range []string{"/", "/archives.html", "/tag/go", "/" + pub.Permalink(), "/" + other.Permalink()} {
+		if !exists(uri, true) {
+			t.Fatalf("%s not exported", uri)
+		}
+	}
+	for _, uri := range []string{"/atom.xml", "/feed.json", "/notes/atom.xml"} {
+		if !exists(uri, false) {
+			t.Fatalf("%s not exported", uri)
+		}
+	}
+	for _, a := range []*Article{draft, private} {
+		if exists("/"+a.Permalink(), true) {
+			t.Fatalf("%s was exported", a.Title)
+		}
+	}
+	d, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := string(d)
+	if !strings.Contains(index, `href="`+exportFilePath("/"+pub.Permalink(), true)+`"`) || strings.Contains(index, `href="/`+pub.Permalink()) {
+		t.Fatalf("links in index.html not rewritten: %s", index)
+	}
+	d, _ = ioutil.ReadFile(filepath.Join(dir, exportFilePath("/"+pub.Permalink(), true)))
+	if !strings.Contains(string(d), `href="#top"`) {
+		t.Fatalf("bad fragment link in %s", d)
+	}
+	d, _ = ioutil.ReadFile(filepath.Join(dir, exportFilePath("/notes/", true)))
+	if !strings.Contains(string(d), "<p>short note</p>") {
+		t.Fatalf("note not in exported notes page: %s", d)
+	}
+
+	stats, err = exportStatic(dir)
+	if err != nil || stats.Written != 0 || stats.Unchanged != stats.Files || stats.Removed != 0 {
+		t.Fatalf("bad re-export: %v %s", err, stats)
+	}
+
+	setArticles(pub)
+	stats, err = exportStatic(dir)
+	if err != nil || stats.Removed == 0 || exists("/"+other.Permalink(), true) {
+		t.Fatalf("bad export after removing an article: %v %s", err, stats)
+	}
+}
+
+// config.json with valid cookie keys and extra fields
+func testConfigJson(extra string) []byte {
+	authKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	encrKey := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	return []byte(fmt.Sprintf(`{"CookieAuthKeyHexStr":"%s","CookieEncrKeyHexStr":"%s"%s}`, authKey, encrKey, extra))
+}
+
+func TestBodyLimits(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{MaxBodyBytes: map[string]int64{"/small": 10}})
+
+	h := withBodyLimits(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(r.FormValue("a")))
+	}))
+	post := func(path, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := post("/small", "a=12345", false); w.Code != http.StatusOK || w.Body.String() != "12345" {
+		t.Fatalf("small body: %d %s", w.Code, w.Body.String())
+	}
+	for _, chunked := range []bool{false, true} {
+		if w := post("/small", "a=1234567890", chunked); w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("chunked: %v, big body: %d %s", chunked, w.Code, w.Body.String())
+		}
+	}
+	big := "a=" + strings.Repeat("x", defaultMaxBodyBytesOther)
+	if w := post("/other", big, true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("default limit: %d", w.Code)
+	}
+	if w := post("/api/crash/v2", big, false); w.Code != http.StatusOK {
+		t.Fatalf("crash api limit: %d", w.Code)
+	}
+	w := post("/api/other", big, false)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		t.Fatalf("api: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	srv := &http.Server{}
+	setConfig(&Config{ReadTimeoutSeconds: 5})
+	setServerTimeouts(srv)
+	if srv.ReadTimeout != 5*time.Second || srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.IdleTimeout != defaultIdleTimeout {
+		t.Fatalf("bad timeouts: %+v", srv)
+	}
+	if _, err := parseConfig(testConfigJson(`,"WriteTimeoutSeconds":5,"MaxBodyBytes":{"/small":10}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig(testConfigJson(`,"WriteTimeoutSeconds":-1`)); err == nil {
+		t.Fatal("negative timeout should be invalid")
+	}
+	if _, err := parseConfig(testConfigJson(`,"MaxBodyBytes":{"/small":0}`)); err == nil {
+		t.Fatal("MaxBodyBytes of 0 should be invalid")
+	}
+}
+
+func TestReactions(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	prevReactions := articleReactions
+	articleReactions = newArticleReactions()
+	defer func() { articleReactions = prevReactions }()
+
+	a := &Article{Id: 1, Title: "Liked", PublishedOn: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>1</p>"}
+	store = &Store{articles: []*Article{a}, idToArticle: map[int]*Article{1: a}}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	react := func(cookies []*http.Cookie, form map[string][]string) *httptest.ResponseRecorder {
+		r := newTestRequest("POST", "/app/react", "")
+		r.Header.Set("User-Agent", "Mozilla/5.0")
+		r.Form = form
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handleReact(w, r)
+		return w
+	}
+	like := map[string][]string{"id": {"1"}, "type": {"like"}}
+	w := react(nil, like)
+	if w.Code != http.StatusSeeOther || !strings.HasSuffix(w.Header().Get("Location"), "#reactions") {
+		t.Fatalf("bad response: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != visitorCookieName {
+		t.Fatalf("no visitor cookie: %v", cookies)
+	}
+	// reacting again with the cookie doesn't count twice
+	if w = react(cookies, like); len(w.Result().Cookies()) != 0 {
+		t.Fatalf("visitor cookie was replaced")
+	}
+	react(nil, like)
+	if counts, _ := articleReactions.Get(1, ""); counts["like"] != 2 {
+		t.Fatalf("expected 2 likes, got %v", counts)
+	}
+
+	r := httptest.NewRequest("GET", "/"+a.Permalink(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	serveArticle(w, r, articlesCache.get(), &ArticleInfo{this: a})
+	if body := w.Body.String(); !strings.Contains(body, `value="Liked (2)"`) || strings.Contains(body, "Bookmark") {
+		t.Fatalf("bad reaction buttons: %s", body)
+	}
+
+	w = react(cookies, map[string][]string{"id": {"1"}, "type": {"like"}, "undo": {"1"}})
+	if counts, mine := articleReactions.Get(1, getVisitorId(r)); counts["like"] != 1 || mine["like"] {
+		t.Fatalf("undo failed: %v %v", counts, mine)
+	}
+	r = newTestRequest("POST", "/app/react", "")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	r.Form = like
+	w = httptest.NewRecorder()
+	handleReact(w, r)
+	var rsp ReactionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil || rsp.Counts["like"] != 2 || !rsp.Mine["like"] {
+		t.Fatalf("bad json response: %v %s", err, w.Body.String())
+	}
+	for _, typ := range []string{"hate", "bookmark"} {
+		if w = react(nil, map[string][]string{"id": {"1"}, "type": {typ}}); w.Code != http.StatusBadRequest {
+			t.Fatalf("invalid type %s: %d", typ, w.Code)
+		}
+	}
+	if w = react(nil, map[string][]string{"id": {"2"}, "type": {"like"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid id: %d", w.Code)
+	}
+	r = newTestRequest("POST", "/app/react", "")
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Form = like
+	w = httptest.NewRecorder()
+	handleReact(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("cross-origin: %d", w.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "blog-reactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "article_reactions.json")
+	if err = articleReactions.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadArticleReactions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts, _ := loaded.Get(1, ""); counts["like"] != 2 {
+		t.Fatalf("bad loaded counts: %v", counts)
+	}
+
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+	r = newTestRequest("POST", "/app/reactions/reset", "kjk")
+	r.Form = map[string][]string{"id": {"1"}, "csrf_token": {testCsrfToken}}
+	w = httptest.NewRecorder()
+	handleReactionsReset(w, r)
+	if counts, _ := articleReactions.Get(1, ""); w.Code != http.StatusOK || len(counts) != 0 {
+		t.Fatalf("reset failed: %d %v", w.Code, counts)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	tz, format := "Asia/Tokyo", "2006-01-02 15:04"
+	c, err := parseConfig(testConfigJson(`,"TimeZone":"Asia/Tokyo"`))
+	if err != nil || *c.TimeZone != tz {
+		t.Fatalf("parseConfig() failed: %v", err)
+	}
+	if _, err = parseConfig(testConfigJson(`,"TimeZone":"Nowhere/Special"`)); err == nil {
+		t.Fatal("invalid TimeZone should be rejected")
+	}
+
+	published := time.Date(2017, 3, 31, 20, 0, 0, 0, time.UTC)
+	setConfig(&Config{TimeZone: &tz, DateFormat: &format})
+	if got := fmtDate(published); got != "2017-04-01 05:00" {
+		t.Fatalf("fmtDate() = %q", got)
+	}
+	if got := fmtDate(published, "January 2"); got != "April 1" {
+		t.Fatalf("fmtDate() with layout = %q", got)
+	}
+	setConfig(&Config{TimeZone: &tz})
+	if got := fmtDate(published); got != "Apr 1 2017" {
+		t.Fatalf("fmtDate() with default format = %q", got)
+	}
+	years := buildYearsFromArticles([]*Article{{Id: 1, PublishedOn: published}})
+	if len(years) != 1 || years[0].Name != "2017" || years[0].Articles[0].MonthAnchor != "2017-04" {
+		t.Fatalf("archive not in TimeZone: %+v", years)
+	}
+
+	if got := truncateWords(3, " one two  three four "); got != "one two three…" {
+		t.Fatalf("truncateWords() = %q", got)
+	}
+	if got := truncateWords(3, "one two"); got != "one two" {
+		t.Fatalf("truncateWords() = %q", got)
+	}
+	for n, exp := range map[int]string{0: "0 posts", 1: "1 post", 2: "2 posts"} {
+		if got := plural(n, "post", "posts"); got != exp {
+			t.Fatalf("plural(%d) = %q", n, got)
+		}
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).Parse(`{{ fmtDate .T }}|{{ .S | truncateWords 2 }}|{{ plural .N "article" "articles" }}|{{ safeHTML .S }}|{{ absURL "/atom.xml" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	model := map[string]interface{}{"T": published, "S": "<b>a</b> b c", "N": 1}
+	if err = tmpl.Execute(&buf, model); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "Apr 1 2017|<b>a</b> b…|1 article|<b>a</b> b c|" + absURL("/atom.xml"); buf.String() != exp {
+		t.Fatalf("got %q, expected %q", buf.String(), exp)
+	}
+}
+
+func TestPreviewLinks(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	setConfig(&Config{})
+	dir, err := ioutil.TempDir("", "blog-preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDataDir, prevDraftsDir, prevLinks := dataDir, draftsDir, previewLinks
+	dataDir, draftsDir, previewLinks = filepath.Join(dir, "data"), filepath.Join(dir, "blog_posts"), &PreviewLinks{}
+	defer func() { dataDir, draftsDir, previewLinks = prevDataDir, prevDraftsDir, prevLinks }()
+	os.MkdirAll(dataDir, 0755)
+	os.MkdirAll(draftsDir, 0755)
+	write := func(name, s string) {
+		if err := ioutil.WriteFile(filepath.Join(draftsDir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("draft.md", "Id: 7\nTitle: Coming soon\nDate: 2017-01-02\nDraft: yes\n-----\nnot *yet*")
+	write("published.md", "Id: 8\nTitle: Out\nDate: 2017-01-01\n-----\nout")
+	store = &Store{}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+
+	drafts := readDrafts(draftsDir)
+	if len(drafts) != 1 || drafts[0].Id != 7 {
+		t.Fatalf("bad drafts: %v", drafts)
+	}
+
+	post := func(path string, form map[string][]string) *httptest.ResponseRecorder {
+		r := newTestRequest("POST", path, "kjk")
+		form["csrf_token"] = []string{testCsrfToken}
+		r.Form = form
+		w := httptest.NewRecorder()
+		switch path {
+		case "/app/preview-link":
+			handleNewPreviewLink(w, r)
+		default:
+			handleRevokePreviewLink(w, r)
+		}
+		return w
+	}
+	if w := post("/app/preview-link", map[string][]string{"id": {"8"}, "days": {"1"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("preview link to published article: %d", w.Code)
+	}
+	if w := post("/app/preview-link", map[string][]string{"id": {"7"}, "days": {"100"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("too many days: %d", w.Code)
+	}
+	if w := post("/app/preview-link", map[string][]string{"id": {"7"}, "days": {"2"}}); w.Code != http.StatusOK {
+		t.Fatalf("creating preview link failed: %d %s", w.Code, w.Body.String())
+	}
+	links := previewLinks.Active(time.Now())
+	if len(links) != 1 {
+		t.Fatalf("expected 1 link, got %d", len(links))
+	}
+	token := links[0].Token
+	if saved, err := loadPreviewLinks(previewLinksPath()); err != nil || len(saved.Links) != 1 {
+		t.Fatalf("preview links not saved: %v", err)
+	}
+
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePreview(w, httptest.NewRequest("GET", "/preview/"+token, nil))
+		return w
+	}
+	w := get(token)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "<em>yet</em>") || !strings.Contains(body, "Draft preview, expires at") ||
+		!strings.Contains(body, `content="noindex"`) || w.Header().Get("X-Robots-Tag") != "noindex" {
+		t.Fatalf("bad preview: %d %s", w.Code, body)
+	}
+	parts := strings.Split(token, ".")
+	for _, bad := range []string{parts[0] + "." + parts[1] + ".00", "8." + parts[1] + "." + parts[2], "nonsense"} {
+		if w = get(bad); w.Code != http.StatusNotFound {
+			t.Fatalf("tampered token %s: %d", bad, w.Code)
+		}
+	}
+	expires, _ := strconv.ParseInt(parts[1], 10, 64)
+	if isValidPreviewToken(drafts[0], token, time.Unix(expires+1, 0)) {
+		t.Fatal("expired token is valid")
+	}
+
+	// editing the draft invalidates the link
+	write("draft.md", "Id: 7\nTitle: Coming soon\nDate: 2017-01-02\nDraft: yes\n-----\nnow *edited*")
+	if w = get(token); w.Code != http.StatusNotFound {
+		t.Fatalf("link to edited draft: %d", w.Code)
+	}
+	write("draft.md", "Id: 7\nTitle: Coming soon\nDate: 2017-01-02\nDraft: yes\n-----\nnot *yet*")
+	if w = get(token); w.Code != http.StatusOK {
+		t.Fatalf("link to restored draft: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleDrafts(w, newTestRequest("GET", "/app/drafts", "kjk"))
+	if body = w.Body.String(); !strings.Contains(body, "Coming soon") || !strings.Contains(body, token) {
+		t.Fatalf("bad drafts page: %s", body)
+	}
+	if w = post("/app/preview-link/revoke", map[string][]string{"token": {token}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("revoking failed: %d", w.Code)
+	}
+	if w = get(token); w.Code != http.StatusNotFound {
+		t.Fatalf("revoked link: %d", w.Code)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "blog.log")
+	const maxSize = 200
+	rf, err := OpenRotatingFile(path, maxSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewServerLogger(16, 16, false)
+	l.File = rf
+
+	// writes from many goroutines must not interleave or get lost in
+	// rotation
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				l.Noticef("goroutine %d message %02d", g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	l.Debugf("dropped %d", 1)
+	l.SetLevel(LevelError)
+	l.Noticef("dropped %d", 2)
+	l.Errorf("kept error")
+	l.SetLevel(LevelDebug)
+	l.Debugf("kept debug")
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Errorf("after close")
+
+	lineRe := regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d [NED]: (goroutine \d message \d\d|kept error|kept debug|openLogFile.*)$`)
+	var last []string
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		d, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d) > maxSize {
+			t.Fatalf("%s has %d bytes, max is %d", p, len(d), maxSize)
+		}
+		last = strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+		for _, line := range last {
+			if !lineRe.MatchString(line) {
+				t.Fatalf("bad line %q in %s", line, p)
+			}
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 old files, err: %v", err)
+	}
+	if n := len(last); n < 2 || !strings.HasSuffix(last[n-2], " E: kept error") || !strings.HasSuffix(last[n-1], " D: kept debug") {
+		t.Fatalf("unexpected end of log: %q", last)
+	}
+	if errs := l.GetErrors(); len(errs) != 2 || errs[0].Msg != "after close" {
+		t.Fatalf("errors for /logs: %v", errs)
+	}
+
+	for _, s := range []string{"debug", "Notice", "error"} {
+		if lvl, ok := parseLogLevel(s); !ok || !strings.EqualFold(lvl.String(), s) {
+			t.Fatalf("parseLogLevel(%q) = %s, %v", s, lvl, ok)
+		}
+	}
+	if _, ok := parseLogLevel("verbose"); ok {
+		t.Fatalf("parseLogLevel() accepted verbose")
+	}
+	if _, err = parseConfig(testConfigJson(`,"LogLevel":"verbose"`)); err == nil {
+		t.Fatalf("expected error for invalid LogLevel")
+	}
+	if _, err = parseConfig(testConfigJson(`,"LogMaxFiles":-1`)); err == nil {
+		t.Fatalf("expected error for negative LogMaxFiles")
+	}
+
+	prevLevel := logger.Level()
+	defer logger.SetLevel(prevLevel)
+	post := func(level string) *httptest.ResponseRecorder {
+		r := newTestRequest("POST", "/app/log-level", "kjk")
+		r.Form = map[string][]string{"level": {level}, "csrf_token": {testCsrfToken}}
+		w := httptest.NewRecorder()
+		handleLogLevel(w, r)
+		return w
+	}
+	if w := post("debug"); w.Code != http.StatusSeeOther || logger.Level() != LevelDebug {
+		t.Fatalf("POST /app/log-level: %d, level %s", w.Code, logger.Level())
+	}
+	if w := post("verbose"); w.Code != http.StatusBadRequest || logger.Level() != LevelDebug {
+		t.Fatalf("POST /app/log-level with invalid level: %d, level %s", w.Code, logger.Level())
+	}
+}
+
+func TestLogViewer(t *testing.T) {
+	initTestGlobals()
+	prevLogger := logger
+	defer func() { logger = prevLogger }()
+	logger = NewServerLogger(4, 4, false)
+	logger.SetLevel(LevelDebug)
+
+	logger.Noticef("started")
+	logger.Errorw("db failed", "req_id", "r-42")
+	logger.Debugf("cache <miss>")
+	all := &LogFilter{MinLevel: LevelDebug}
+	res := getLogsResponse(logger, 0, all)
+	if len(res.Entries) != 3 || res.Cursor != 3 || res.More || res.Gap || res.Reset {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	if e := res.Entries[1]; e.Seq != 2 || e.Level != "error" || e.ReqId != "r-42" || !strings.HasPrefix(e.Msg, "db failed") {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if res = getLogsResponse(logger, 0, &LogFilter{MinLevel: LevelError}); len(res.Entries) != 1 || res.Cursor != 3 {
+		t.Fatalf("level filter: %+v", res)
+	}
+	if res = getLogsResponse(logger, 0, &LogFilter{Query: "R-42"}); len(res.Entries) != 1 {
+		t.Fatalf("request id filter: %+v", res)
+	}
+	if res = getLogsResponse(logger, 3, all); len(res.Entries) != 0 || res.Cursor != 3 {
+		t.Fatalf("nothing new: %+v", res)
+	}
+
+	// notices wrap around, the error is still there
+	for i := 0; i < 6; i++ {
+		logger.Noticef("notice %d", i)
+	}
+	res = getLogsResponse(logger, 3, all)
+	if !res.Gap || len(res.Entries) != 4 || res.Entries[0].Msg != "notice 2" || res.Cursor != 9 {
+		t.Fatalf("after wrap around: %+v", res)
+	}
+	if res = getLogsResponse(logger, 7, all); res.Gap || len(res.Entries) != 2 {
+		t.Fatalf("cursor not affected by wrap around: %+v", res)
+	}
+	// cursor from before the server restarted
+	if res = getLogsResponse(logger, 1000, all); !res.Reset || len(res.Entries) != 5 || res.Cursor != 9 {
+		t.Fatalf("reset: %+v", res)
+	}
+
+	logger = NewServerLogger(4, 500, false)
+	for i := 0; i < maxLogEntriesPerResponse+50; i++ {
+		logger.Noticef("message %d", i)
+	}
+	res = getLogsResponse(logger, 0, all)
+	if len(res.Entries) != maxLogEntriesPerResponse || !res.More || res.Cursor != maxLogEntriesPerResponse {
+		t.Fatalf("capped response: %d entries, %+v", len(res.Entries), res.More)
+	}
+	if res = getLogsResponse(logger, res.Cursor, all); len(res.Entries) != 50 || res.More {
+		t.Fatalf("rest of entries: %d, %v", len(res.Entries), res.More)
+	}
+	big := strings.Repeat("x", maxLogResponseBytes/2)
+	logger.Notice(big)
+	logger.Notice(big)
+	logger.Notice(big)
+	if res = getLogsResponse(logger, uint64(maxLogEntriesPerResponse+50), all); len(res.Entries) != 1 || !res.More {
+		t.Fatalf("size cap: %d entries, %v", len(res.Entries), res.More)
+	}
+
+	logger.Errorf("<script>")
+	w := httptest.NewRecorder()
+	handleLogs(w, newTestRequest("GET", "/logs?level=error", "kjk"))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "&lt;script&gt;") || strings.Contains(body, "message 1") {
+		t.Fatalf("/logs: %d\n%s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleLogsJson(w, newTestRequest("GET", "/app/logs.json?after=0&q=script", "kjk"))
+	var d LogsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil || len(d.Entries) != 1 || d.Entries[0].Msg != "<script>" {
+		t.Fatalf("/app/logs.json: %v %s", err, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleLogsJson(w, newTestRequest("GET", "/app/logs.json", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("/app/logs.json for non-admin: %d", w.Code)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+	prevStore := store
+	defer func() { store = prevStore; rebuildArticlesCache() }()
+	prev := getConfig()
+	defer setConfig(prev)
+	base := "https://blog.example.com"
+	setConfig(&Config{BaseURL: &base})
+
+	h := withHealthChecks(withCanonicalHost(http.DefaultServeMux))
+	get := func(path string) (*httptest.ResponseRecorder, *ReadyResponse) {
+		w := httptest.NewRecorder()
+		// probes from load balancers don't use the canonical host
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.1"+path, nil))
+		var res ReadyResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w, &res
+	}
+
+	w, _ := get("/healthz")
+	var health HealthResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &health); err != nil || w.Code != http.StatusOK || health.GitSha != gitSha {
+		t.Fatalf("/healthz: %d %s", w.Code, w.Body.String())
+	}
+
+	store = nil
+	if w, res := get("/readyz"); w.Code != http.StatusServiceUnavailable || len(res.Failed) != 1 || res.Failed[0].Check != "store" {
+		t.Fatalf("/readyz without articles: %d %s", w.Code, w.Body.String())
+	}
+	a := &Article{Id: 1, Title: "Ready", PublishedOn: time.Now(), BodyHtml: "<p>body</p>"}
+	store = &Store{articles: []*Article{a}, idToArticle: map[int]*Article{a.Id: a}}
+	rebuildArticlesCache()
+	if w, res := get("/readyz"); w.Code != http.StatusOK || res.Status != "ok" {
+		t.Fatalf("/readyz: %d %s", w.Code, w.Body.String())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("/readyz left %d files in data directory", len(files))
+	}
+
+	setShuttingDown()
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	if w, res := get("/readyz"); w.Code != http.StatusServiceUnavailable || len(res.Failed) != 1 || res.Failed[0].Check != "shutdown" {
+		t.Fatalf("/readyz when shutting down: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := get("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("/healthz when shutting down: %d", w.Code)
+	}
+	if w, _ := get("/about"); w.Code != http.StatusMovedPermanently {
+		t.Fatalf("other urls should still be redirected: %d", w.Code)
+	}
+}
+
+func TestArticleIds(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "blog-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, s string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.md", "Id: 1\nTitle: A\nDate: 2017-01-01\n-----\na")
+	write("b.md", "Id: 3\nTitle: B\nDate: 2017-01-02\nDeleted: yes\n-----\nb")
+	write("c.md", "Id: 9\nTitle: C\nDate: 2017-01-03\nDraft: yes\n-----\nc")
+	if maxId, err := checkArticleIds(dir); err != nil || maxId != 9 {
+		t.Fatalf("checkArticleIds() = %d, %v", maxId, err)
+	}
+	write("d.md", "Id: 3\nTitle: D\nDate: 2017-01-04\n-----\nd")
+	write("e.md", "Id: 1\nTitle: E\nDate: 2017-01-05\n-----\ne")
+	_, err = checkArticleIds(dir)
+	if err == nil || !strings.Contains(err.Error(), "2 article ids") ||
+		!strings.Contains(err.Error(), "1: "+filepath.Join(dir, "a.md")+", "+filepath.Join(dir, "e.md")) ||
+		!strings.Contains(err.Error(), "3: "+filepath.Join(dir, "b.md")+", "+filepath.Join(dir, "d.md")) {
+		t.Fatalf("duplicate ids not reported: %v", err)
+	}
+	// real posts must not have duplicate ids or the server won't start
+	if _, err = checkArticleIds("blog_posts"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Store{}
+	var articles []*Article
+	for i := 1; i <= 5; i++ {
+		articles = append(articles, &Article{Id: i, Title: fmt.Sprintf("Article %d", i), PublishedOn: time.Date(2017, 1, i, 0, 0, 0, 0, time.UTC)})
+	}
+	if err = s.SetArticles(articles); err != nil {
+		t.Fatal(err)
+	}
+	// removing the newest article doesn't make its id available again
+	if err = s.SetArticles(articles[:2]); err != nil {
+		t.Fatal(err)
+	}
+	a := &Article{Title: "New", PublishedOn: time.Now()}
+	if err = s.CreateOrUpdateArticle(a); err != nil || a.Id != 6 || s.GetArticleById(6) != a || s.ArticlesCount() != 3 {
+		t.Fatalf("new article got id %d, err: %v", a.Id, err)
+	}
+	updated := &Article{Id: 6, Title: "Updated", PublishedOn: a.PublishedOn}
+	if err = s.CreateOrUpdateArticle(updated); err != nil || s.GetArticleById(6) != updated || s.ArticlesCount() != 3 {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	created := make([]*Article, 20)
+	for i := range created {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			created[i] = &Article{Title: "Concurrent", PublishedOn: time.Now()}
+			s.CreateOrUpdateArticle(created[i])
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int]bool)
+	for _, a := range created {
+		if seen[a.Id] || a.Id < 7 || a.Id > 26 {
+			t.Fatalf("bad id %d of a concurrently created article", a.Id)
+		}
+		seen[a.Id] = true
+	}
+	if s.ArticlesCount() != 23 {
+		t.Fatalf("expected 23 articles, got %d", s.ArticlesCount())
+	}
+}
+
+func TestNotes(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	notesScheme := "/note/{id}"
+	setConfig(&Config{NotesPermalinkScheme: &notesScheme})
+	prevStore := store
+	defer func() {
+		store = prevStore
+		if store != nil {
+			rebuildArticlesCache()
+		}
+	}()
+
+	d := []byte("Id: 12\nDate: 2017-05-01\nTags: note\n-----\n**Quick** thought: one two three four five six seven\n")
+	note, errs := parseArticle("note.md", d)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if !note.IsNote() || !note.NoTitle || note.Title != "Quick thought: one two three four five six…" {
+		t.Fatalf("bad note: %+v", note)
+	}
+	if strings.Contains(serArticleHeader(note), "Title:") {
+		t.Fatalf("made up title written to header:\n%s", serArticleHeader(note))
+	}
+	if _, errs = parseArticle("a.md", []byte("Id: 13\nDate: 2017-05-01\n-----\nbody\n")); len(errs) != 1 {
+		t.Fatalf("article without title: %v", errs)
+	}
+	note.BodyHtml = "<p>quick thought</p>"
+	titled := &Article{Id: 14, Title: "Titled note", Tags: []string{"note"}, PublishedOn: time.Date(2017, 5, 2, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>titled</p>"}
+	a := &Article{Id: 15, Title: "Long article", PublishedOn: time.Date(2017, 5, 3, 0, 0, 0, 0, time.UTC), BodyHtml: "<p>long</p>"}
+	store = &Store{}
+	if err := store.SetArticles([]*Article{note, titled, a}); err != nil {
+		t.Fatal(err)
+	}
+	rebuildArticlesCache()
+	if note.Permalink() != "note/"+ShortenId(12) || a.Permalink() != "article/"+ShortenId(15)+"/Long-article.html" {
+		t.Fatalf("bad permalinks: %s %s", note.Permalink(), a.Permalink())
+	}
+
+	get := func(h http.HandlerFunc, uri string) string {
+		w := httptest.NewRecorder()
+		h(w, newTestRequest("GET", uri, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d", uri, w.Code)
+		}
+		return w.Body.String()
+	}
+	if body := get(handleMainPage, "/"); strings.Contains(body, "Titled note") || !strings.Contains(body, "Long article") {
+		t.Fatalf("notes on the main page:\n%s", body)
+	}
+	if body := get(handleMainPage, "/"+note.Permalink()); !strings.Contains(body, "quick thought") {
+		t.Fatalf("note permalink:\n%s", body)
+	}
+	body := get(handleNotes, "/notes/")
+	if !strings.Contains(body, "2 notes") || !strings.Contains(body, "<b>Titled note</b>") || strings.Contains(body, "<b>Quick") ||
+		strings.Index(body, "titled") > strings.Index(body, "quick thought") || strings.Contains(body, "Long article") {
+		t.Fatalf("bad /notes/:\n%s", body)
+	}
+	get(handleNotesAtom, "/notes/atom.xml")
+	if body = get(handleJsonFeed, "/feed.json"); strings.Contains(body, "Titled note") || !strings.Contains(body, "Long article") {
+		t.Fatalf("notes in /feed.json:\n%s", body)
+	}
+	w := httptest.NewRecorder()
+	handleNotes(w, newTestRequest("GET", "/notes/?page=2", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("/notes/?page=2: %d", w.Code)
+	}
+
+	setConfig(&Config{NotesPermalinkScheme: &notesScheme, NotesOnMainPage: true, NotesInMainFeeds: true})
+	rebuildArticlesCache()
+	if body = get(handleMainPage, "/"); !strings.Contains(body, "Titled note") {
+		t.Fatalf("NotesOnMainPage: notes not on the main page")
+	}
+	if body = get(handleJsonFeed, "/feed.json"); !strings.Contains(body, "Titled note") {
+		t.Fatalf("NotesInMainFeeds: notes not in /feed.json")
+	}
+}
+
+func TestCrossposts(t *testing.T) {
+	initTestGlobals()
+	prevBackoff, prevPost := crosspostBackoff, postCrosspost
+	defer func() { crosspostBackoff, postCrosspost = prevBackoff, prevPost }()
+	crosspostBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "crossposts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "crossposts.json")
+	c, err := loadCrossposts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := []string{crosspostMastodon, crosspostTwitter}
+	a := &Article{Id: 1, Title: "First"}
+	b := &Article{Id: 2, Title: "Second"}
+	private := &Article{Id: 3, Title: "Private", IsPrivate: true}
+	// nothing is posted the first time
+	if posts, err := c.addNew([]*Article{a}, services); err != nil || len(posts) != 0 {
+		t.Fatalf("addNew() returned %v, %v", posts, err)
+	}
+	posts, err := c.addNew([]*Article{a, b, private}, services)
+	if err != nil || len(posts) != 2 || posts[0].ArticleId != b.Id || posts[1].Service != crosspostTwitter ||
+		posts[0].Text != "Second "+absURL(b.Permalink()) {
+		t.Fatalf("addNew() returned %v, %v", posts, err)
+	}
+	edited := *b
+	edited.Title = "Second, edited"
+	if posts, _ := c.addNew([]*Article{a, &edited, private}, services); len(posts) != 0 {
+		t.Fatalf("edited article posted again: %v", posts)
+	}
+
+	// fails the first time
+	nCalls := 0
+	postCrosspost = func(service, text string, articleId int) (string, error) {
+		nCalls++
+		if nCalls == 1 {
+			return "", errors.New("try later")
+		}
+		return "https://mastodon.example.com/@kjk/1", nil
+	}
+	if !crosspostWithRetries(c, posts[0]) || nCalls != 2 {
+		t.Fatalf("post not re-tried, %d calls", nCalls)
+	}
+	if p := c.Get(b.Id, crosspostMastodon); p == nil || p.Url != "https://mastodon.example.com/@kjk/1" || p.Tries != 2 || p.Error != "" {
+		t.Fatalf("bad post: %+v", p)
+	}
+
+	postCrosspost = func(service, text string, articleId int) (string, error) {
+		return "", errors.New("unauthorized")
+	}
+	if crosspostWithRetries(c, posts[1]) {
+		t.Fatal("failed post succeeded")
+	}
+	if failed := c.Failed(); len(failed) != 1 || failed[0].Service != crosspostTwitter || failed[0].Tries != maxCrosspostTries || failed[0].Error != "unauthorized" {
+		t.Fatalf("Failed() returned %+v", failed)
+	}
+
+	// what was posted and seen is remembered
+	c, err = loadCrossposts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts, _ := c.addNew([]*Article{a, b}, services); len(posts) != 0 {
+		t.Fatalf("article posted again after restart: %v", posts)
+	}
+	if p := c.Get(b.Id, crosspostMastodon); p == nil || p.Url != "https://mastodon.example.com/@kjk/1" {
+		t.Fatalf("post not remembered: %+v", p)
+	}
+	if c.Retry(b.Id, crosspostMastodon) != nil {
+		t.Fatal("re-tried a post that succeeded")
+	}
+	if p := c.Retry(b.Id, crosspostTwitter); p == nil || p.Error != "" || len(c.Failed()) != 0 {
+		t.Fatalf("Retry() returned %+v", p)
+	}
+
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r
+		w.Write([]byte(`{"id":"1","url":"https://mastodon.example.com/@kjk/1"}`))
+	}))
+	defer srv.Close()
+	u, err := postToMastodon(srv.URL+"/", "token", "blog-article-2", "Second https://blog/2")
+	if err != nil || u != "https://mastodon.example.com/@kjk/1" {
+		t.Fatalf("postToMastodon() returned %q, %v", u, err)
+	}
+	if got.URL.Path != "/api/v1/statuses" || got.Header.Get("Authorization") != "Bearer token" ||
+		got.Header.Get("Idempotency-Key") != "blog-article-2" || got.PostForm.Get("status") != "Second https://blog/2" {
+		t.Fatalf("bad request: %s %v %v", got.URL, got.Header, got.PostForm)
+	}
+}
+
+func TestFrontPage(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	day := func(d int) time.Time { return time.Date(2017, 2, d, 0, 0, 0, 0, time.UTC) }
+	var articles []*Article
+	for i := 1; i <= 6; i++ {
+		articles = append(articles, &Article{Id: i, Title: fmt.Sprintf("Article %d", i), PublishedOn: day(i)})
+	}
+	articles[1].IsPinned = true
+	articles[4].Tags = []string{noteTag}
+	intro := &Article{Id: 10, Title: "About me", PublishedOn: day(1), IsPrivate: true}
+	all := append([]*Article{intro}, articles...)
+	ids := func(articles []*Article) string {
+		var res []string
+		for _, a := range articles {
+			res = append(res, strconv.Itoa(a.Id))
+		}
+		return strings.Join(res, ",")
+	}
+
+	// the default is titles of all articles, without notes
+	fp := buildFrontPage(articles, all)
+	if fp.Intro != nil || ids(fp.Pinned) != "2" || len(fp.Full) != 0 || ids(fp.Titles) != "6,4,3,1" || fp.Count != 5 || fp.More {
+		t.Fatalf("bad default front page: %+v", fp)
+	}
+
+	setConfig(&Config{FrontPageFullPosts: 2, FrontPageTitles: 1, FrontPageIntroArticleId: intro.Id, NotesOnMainPage: true})
+	fp = buildFrontPage(articles, all)
+	if fp.Intro != intro || ids(fp.Pinned) != "2" || ids(fp.Full) != "6,5" || ids(fp.Titles) != "4" || fp.Count != 6 || !fp.More {
+		t.Fatalf("bad front page: %+v", fp)
+	}
+	// the intro is not listed
+	setConfig(&Config{FrontPageFullPosts: 10, FrontPageIntroArticleId: 6})
+	fp = buildFrontPage(articles, all)
+	if fp.Intro != articles[5] || ids(fp.Full) != "4,3,1" || len(fp.Titles) != 0 || fp.Count != 4 || fp.More {
+		t.Fatalf("bad front page with intro: %+v", fp)
+	}
+
+	d := []byte("Id: 3\nTitle: Pinned\nDate: 2017-02-01\nPinned: yes\n-----\nbody\n")
+	a, errs := parseArticle("pinned.md", d)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if !a.IsPinned || !strings.Contains(serArticleHeader(a), "Pinned: yes\n") {
+		t.Fatalf("Pinned: header not parsed or serialized: %+v", a)
+	}
+}
+
+func TestLinkChecker(t *testing.T) {
+	initTestGlobals()
+	prevStore := store
+	defer func() {
+		store = prevStore
+		if store != nil {
+			rebuildArticlesCache()
+		}
+	}()
+
+	links := extractArticleLinks("/article/1/a.html", `<a href="#top">top</a> <a href="b.html">b</a> <a href="/article/1/a.html#x">me</a>
+<a href="mailto:kjk@example.com">mail</a> <a href="https://example.com/x?a=1&amp;b=2">ex</a> <a href="`+siteBaseUrl()+`/software/">sw</a> <a href="b.html">again</a>`)
+	if exp := "/article/1/b.html /article/1/a.html https://example.com/x?a=1&b=2 /software/"; strings.Join(links, " ") != exp {
+		t.Fatalf("extractArticleLinks() returned %v", links)
+	}
+
+	var mu sync.Mutex
+	nRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nRequests++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/ok":
+		case "/head-not-allowed":
+			if r.Method == "HEAD" {
+				http.Error(w, "no HEAD", http.StatusMethodNotAllowed)
+			}
+		case "/moved":
+			http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	a := &Article{Id: 1, Title: "First", PublishedOn: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		BodyHtml: `<a href="` + srv.URL + `/ok">ok</a> <a href="` + srv.URL + `/missing">missing</a> <a href="/article/2/second.html">second</a>`}
+	b := &Article{Id: 2, Title: "Second", PublishedOn: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+		BodyHtml: `<a href="` + srv.URL + `/head-not-allowed">x</a> <a href="` + srv.URL + `/moved">y</a> <a href="/article/3/gone.html">gone</a> <a href="` + srv.URL + `/ok">ok</a>`}
+	store = &Store{}
+	if err := store.SetArticles([]*Article{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	rebuildArticlesCache()
+
+	var lastDone, lastTotal int
+	progress := func(done, total int) { lastDone, lastTotal = done, total }
+	r := checkLinks(store.GetArticles(), nil, time.Hour, progress)
+	if lastDone != 6 || lastTotal != 6 || nRequests != 6 {
+		t.Fatalf("progress %d of %d, %d requests", lastDone, lastTotal, nRequests)
+	}
+	check := func(link string, status int, redirectUrl string) {
+		c := r.Links[link]
+		if c == nil || c.Status != status || c.RedirectUrl != redirectUrl || c.Error != "" {
+			t.Fatalf("bad check of %s: %+v", link, c)
+		}
+	}
+	check(srv.URL+"/ok", 200, "")
+	check(srv.URL+"/missing", 404, "")
+	check(srv.URL+"/head-not-allowed", 200, "")
+	check(srv.URL+"/moved", 200, srv.URL+"/ok")
+	// with legacy permalinks, urls with outdated title are fine
+	check("/article/2/second.html", 200, "")
+	check("/article/3/gone.html", 404, "")
+
+	res := linkCheckArticles(r, false)
+	if len(res) != 2 || res[0].Article != b || len(res[0].Links) != 2 || res[1].Article != a || len(res[1].Links) != 1 {
+		t.Fatalf("linkCheckArticles() returned %+v", res)
+	}
+	if res = linkCheckArticles(r, true); len(res) != 2 || len(res[0].Links) != 1 || len(res[1].Links) != 1 {
+		t.Fatalf("linkCheckArticles() of broken returned %+v", res)
+	}
+
+	// links checked recently are not checked again, local links always are
+	dir, err := ioutil.TempDir("", "linkcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link_check.json")
+	if err = saveLinkCheckReport(path, r); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := loadLinkCheckReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.Links[srv.URL+"/missing"].CheckedAt = time.Now().Add(-2 * time.Hour)
+	nRequests = 0
+	r = checkLinks(store.GetArticles(), prev, time.Hour, progress)
+	if nRequests != 1 || lastTotal != 3 || r.Links[srv.URL+"/ok"].Status != 200 || r.Links[srv.URL+"/missing"].Status != 404 {
+		t.Fatalf("re-check made %d requests, checked %d links", nRequests, lastTotal)
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	initTestGlobals()
+	d := []byte("Id: 5\nTitle: Syndicated\nDate: 2017-03-01\nCanonicalURL: https://example.com/orig.html\n-----\nbody\n")
+	a, errs := parseArticle("a.md", d)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if a.CanonicalUrl() != "https://example.com/orig.html" || !strings.Contains(serArticleHeader(a), "CanonicalURL: https://example.com/orig.html\n") {
+		t.Fatalf("bad CanonicalURL: %+v", a)
+	}
+	for _, s := range []string{"/orig.html", "example.com/orig.html", "ftp://example.com/x", "https://"} {
+		d := []byte("Id: 5\nTitle: T\nDate: 2017-03-01\nCanonicalURL: " + s + "\n-----\nbody\n")
+		if _, errs := parseArticle("a.md", d); len(errs) != 1 {
+			t.Fatalf("invalid CanonicalURL %q accepted", s)
+		}
+	}
+	other := &Article{Id: 6, Title: "Other"}
+	if other.CanonicalUrl() != absURL(other.Permalink()) {
+		t.Fatalf("CanonicalUrl() returned %q", other.CanonicalUrl())
+	}
+	item := newJsonFeedItem(a)
+	if item.Url != "https://example.com/orig.html" || item.Id != absURL(a.Permalink()) {
+		t.Fatalf("bad feed item: %+v", item)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	initTestGlobals()
+	r := httptest.NewRequest("GET", "/article/1/a.html?x=1", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	r.Header.Set("Referer", "https://example.com/")
+	r.Header.Set("User-Agent", `Mozilla "quoted"`)
+	tm := time.Date(2017, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3600))
+	exp := `1.2.3.4 - - [04/Mar/2017:05:06:07 +0100] "GET /article/1/a.html?x=1 HTTP/1.1" 200 1234 "https://example.com/" "Mozilla \"quoted\""`
+	if s := formatAccessLogLine(r, tm, 200, 1234); s != exp {
+		t.Fatalf("formatAccessLogLine() returned\n%s\nexpected\n%s", s, exp)
+	}
+	r = httptest.NewRequest("POST", "/app/react", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	if s := formatAccessLogLine(r, tm, 0, 0); !strings.HasSuffix(s, `"POST /app/react HTTP/1.1" 200 - "-" "-"`) {
+		t.Fatalf("formatAccessLogLine() returned %s", s)
+	}
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	l := NewAccessLog(path)
+	// never blocks, drops lines when the queue is full
+	for i := 0; i < accessLogQueueSize; i++ {
+		l.Log("line")
+	}
+	if l.Log("dropped") {
+		t.Fatal("line queued in full queue")
+	}
+	l = NewAccessLog(path)
+
+	day1 := time.Date(2017, 3, 4, 23, 59, 0, 0, time.Local)
+	l.write("day 1", day1)
+	l.close()
+	// the file is from a previous day when we start again
+	os.Chtimes(path, day1, day1)
+	l.write("day 2", day1.Add(2*time.Minute))
+	l.write("day 2 again", day1.Add(3*time.Minute))
+	l.close()
+	backgroundJobs.Wait()
+	read := func(path string) string {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(d)
+	}
+	if s := read(path); s != "day 2\nday 2 again\n" {
+		t.Fatalf("bad current file: %q", s)
+	}
+	f, err := os.Open(path + ".2017-03-04.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := ioutil.ReadAll(zr)
+	f.Close()
+	if string(d) != "day 1\n" {
+		t.Fatalf("bad rotated file: %q", d)
+	}
+	if _, err = os.Stat(path + ".2017-03-04"); !os.IsNotExist(err) {
+		t.Fatalf("rotated file not removed after compressing: %v", err)
+	}
+
+	// old files are deleted
+	ioutil.WriteFile(path+".2017-01-01.gz", []byte("old"), 0644)
+	compressAndPruneAccessLogs(path, 30*24*time.Hour, day1)
+	if _, err = os.Stat(path + ".2017-01-01.gz"); !os.IsNotExist(err) {
+		t.Fatalf("old file not deleted: %v", err)
+	}
+	if _, err = os.Stat(path + ".2017-03-04.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// queued lines are written when stopping
+	done := make(chan struct{})
+	l = NewAccessLog(path)
+	l.Log("queued")
+	close(done)
+	l.Run(done)
+	if s := read(path); !strings.HasSuffix(s, "queued\n") {
+		t.Fatalf("queued line not written: %q", s)
+	}
+}
+
+func TestTrafficClass(t *testing.T) {
+	initTestGlobals()
+	prev := getConfig()
+	defer setConfig(prev)
+	c := *prev
+	c.BotUserAgents = []string{"MyMonitor"}
+	setConfig(&c)
+
+	browser := "Mozilla/5.0 (X11; Linux x86_64) Firefox/60.0"
+	tests := []struct {
+		user string
+		ua   string
+		exp  trafficClass
+	}{
+		{"", browser, trafficHuman},
+		{"kjk", browser, trafficAdmin},
+		{"kjk", "", trafficAdmin},
+		{"", "", trafficBot},
+		{"", "Mozilla/5.0 (compatible; Googlebot/2.1)", trafficBot},
+		{"", "mymonitor/1.0", trafficBot},
+		{"", exportUserAgent, trafficBot},
+	}
+	for _, test := range tests {
+		r := newTestRequest("GET", "/", test.user)
+		r.Header.Set("User-Agent", test.ua)
+		if got := classifyRequest(r); got != test.exp {
+			t.Errorf("classifyRequest(%q, %q) = %s, expected %s", test.user, test.ua, got, test.exp)
+		}
+	}
+
+	// class set by newTimingHandler is used by handlers
+	var got trafficClass
+	h := newTimingHandler(NewMetrics(), func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("User-Agent", "")
+		got = getTrafficClass(r)
+	})
+	r := newTestRequest("GET", "/", "")
+	r.Header.Set("User-Agent", browser)
+	h(httptest.NewRecorder(), r)
+	if got != trafficHuman {
+		t.Fatalf("got class %s", got)
+	}
+	// it's only in the request passed to the handler
+	if got = getTrafficClass(r); got != trafficBot {
+		t.Fatalf("got class %s after the request", got)
+	}
+
+	aCode := "UA-1234"
+	c.AnalyticsCode = &aCode
+	if s := newBasePageModel(newTestRequest("GET", "/", "")).AnalyticsCode; s != aCode {
+		t.Fatalf("got AnalyticsCode %q", s)
+	}
+	if s := newBasePageModel(newTestRequest("GET", "/", "kjk")).AnalyticsCode; s != "" {
+		t.Fatalf("admin got AnalyticsCode %q", s)
+	}
+
+	if _, err := parseConfig(testConfigJson(`,"BotUserAgents":[" "]`)); err == nil {
+		t.Fatal("parseConfig() accepted empty BotUserAgents")
+	}
+}
+
+func TestUploads(t *testing.T) {
+	initTestGlobals()
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDataDir := dataDir
+	dataDir = dir
+	defer func() { dataDir = prevDataDir }()
+	prevUploads := uploads
+	uploads = &Uploads{}
+	defer func() { uploads = prevUploads }()
+
+	zip := strings.Repeat("0123456789", 100)
+	upload := func(user string, api bool, files map[string]string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if !api {
+			mw.WriteField("csrf_token", testCsrfToken)
+		}
+		for name, content := range files {
+			fw, _ := mw.CreateFormFile("file", name)
+			fw.Write([]byte(content))
+		}
+		mw.Close()
+		r := newTestRequest("POST", "/app/uploads", user)
+		r.Body = ioutil.NopCloser(&buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if api {
+			r.Header.Set(csrfHeader, testCsrfToken)
+		}
+		w := httptest.NewRecorder()
+		handleUploads(w, r)
+		return w
+	}
+	if w := upload("", false, map[string]string{"a.zip": zip}); w.Code != http.StatusNotFound {
+		t.Fatalf("non-admin got %d", w.Code)
+	}
+	w := upload("kjk", false, map[string]string{`C:\docs\source code.zip`: zip})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload got %d", w.Code)
+	}
+	w = upload("kjk", true, map[string]string{"copy [1].zip": zip, "doc.pdf": "%PDF-1.4"})
+	var res struct {
+		Uploads []UploadJson `json:"uploads"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Uploads) != 2 {
+		t.Fatalf("bad api response %q: %v", w.Body.String(), err)
+	}
+	if w := upload("kjk", false, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("upload without files got %d", w.Code)
+	}
+
+	// the same content is stored once
+	files, _ := ioutil.ReadDir(uploadsDir())
+	if len(files) != 2 {
+		t.Fatalf("expected 2 stored files, got %d", len(files))
+	}
+	loaded, err := loadUploads(uploadsPath())
+	if err != nil || len(loaded.Uploads) != 3 {
+		t.Fatalf("loadUploads() returned %v, %v", loaded, err)
+	}
+
+	w = httptest.NewRecorder()
+	handleUploadsJson(w, newTestRequest("GET", "/app/uploads.json", "kjk"))
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Uploads) != 3 {
+		t.Fatalf("bad list %q: %v", w.Body.String(), err)
+	}
+	zipSha1 := sha1HexOfBytes([]byte(zip))
+	first := res.Uploads[2]
+	if first.Name != "source code.zip" || first.Size != 1000 || first.ContentType != "application/zip" ||
+		first.Url != "/files/"+zipSha1+"/source%20code.zip" || first.Markdown != "[source code.zip](/files/"+zipSha1+"/source%20code.zip)" {
+		t.Fatalf("bad upload: %+v", first)
+	}
+	var copyUpload UploadJson
+	for _, up := range res.Uploads {
+		if up.Name == "copy [1].zip" {
+			copyUpload = up
+		}
+	}
+	if copyUpload.Markdown != `[copy \[1\].zip](/files/`+zipSha1+`/copy%20%5B1%5D.zip)` {
+		t.Fatalf("bad markdown: %s", copyUpload.Markdown)
+	}
+	w = httptest.NewRecorder()
+	handleUploads(w, newTestRequest("GET", "/app/uploads", "kjk"))
+	if !strings.Contains(w.Body.String(), `value="[source code.zip](/files/`+zipSha1) {
+		t.Fatalf("markdown not on the page: %s", w.Body.String())
+	}
+
+	get := func(url string, hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		for i := 0; i < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		handleFiles(w, r)
+		return w
+	}
+	w = get(first.Url)
+	if w.Code != http.StatusOK || w.Body.String() != zip {
+		t.Fatalf("got %d", w.Code)
+	}
+	if ct, cd := w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"); ct != "application/zip" || cd != `attachment; filename="source code.zip"` {
+		t.Fatalf("bad headers: %q, %q", ct, cd)
+	}
+	// resuming a download
+	w = get(first.Url, "Range", "bytes=995-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "56789" || w.Header().Get("Content-Range") != "bytes 995-999/1000" {
+		t.Fatalf("range request got %d %q", w.Code, w.Body.String())
+	}
+	w = get(first.Url, "If-None-Match", `"`+zipSha1+`"`)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("conditional request got %d", w.Code)
+	}
+	pdfSha1 := sha1HexOfBytes([]byte("%PDF-1.4"))
+	if cd := get("/files/" + pdfSha1 + "/doc.pdf").Header().Get("Content-Disposition"); cd != `inline; filename=doc.pdf` {
+		t.Fatalf("bad pdf Content-Disposition: %q", cd)
+	}
+	// svg can have scripts, it's not shown on our domain
+	if cd := (&Upload{Name: "a.svg", ContentType: "image/svg+xml"}).ContentDisposition(); cd != `attachment; filename=a.svg` {
+		t.Fatalf("bad svg Content-Disposition: %q", cd)
+	}
+	if cd := (&Upload{Name: "a.png", ContentType: "image/png"}).ContentDisposition(); cd != `inline; filename=a.png` {
+		t.Fatalf("bad png Content-Disposition: %q", cd)
+	}
+	for _, uri := range []string{"/files/" + zipSha1 + "/other.zip", "/files/" + pdfSha1 + "/source code.zip", "/files/../uploads.json", "/files/" + zipSha1} {
+		if w = get(strings.Replace(uri, " ", "%20", -1)); w.Code != http.StatusNotFound {
+			t.Fatalf("%s: got %d", uri, w.Code)
+		}
+	}
+}
+
+func TestLinkPosts(t *testing.T) {
+	initTestGlobals()
+	d := []byte("Id: 5\nTitle: Worth reading\nDate: 2017-03-01\nLinkURL: https://example.com/post?a=1&b=2\n-----\nMy take.\n")
+	a, errs := parseArticle("a.md", d)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if !a.IsLinkPost() || a.TitleUrl() != "https://example.com/post?a=1&b=2" || a.LinkHost() != "example.com" ||
+		!strings.Contains(serArticleHeader(a), "LinkURL: https://example.com/post?a=1&b=2\n") {
+		t.Fatalf("bad link post: %+v", a)
+	}
+	for _, s := range []string{"/post.html", "example.com/post", "mailto:me@example.com", "https://"} {
+		d := []byte("Id: 5\nTitle: T\nDate: 2017-03-01\nLinkURL: " + s + "\n-----\nbody\n")
+		if _, errs := parseArticle("a.md", d); len(errs) != 1 {
+			t.Fatalf("invalid LinkURL %q accepted", s)
+		}
+	}
+	other := &Article{Id: 6, Title: "Other"}
+	if other.IsLinkPost() || other.TitleUrl() != "/"+other.Permalink() {
+		t.Fatalf("TitleUrl() returned %q", other.TitleUrl())
+	}
+	if item := newJsonFeedItem(other); item.ExternalUrl != "" {
+		t.Fatalf("bad feed item: %+v", item)
+	}
+	item := newJsonFeedItem(a)
+	if item.ExternalUrl != a.LinkURL || item.Url != absURL(a.Permalink()) || item.Id != item.Url {
+		t.Fatalf("bad feed item: %+v", item)
+	}
+
+	feed := []byte(`<feed><entry><title>A</title><link href="https://blog/a.html"></link><id>https://blog/a.html</id></entry>` +
+		`<entry><title>B</title><link href="https://blog/b.html"/><id>https://blog/b.html</id></entry><entry><title>C</title></entry></feed>`)
+	exp := `<feed><entry><title>A</title><link href="https://example.com/post?a=1&amp;b=2"></link><link rel="related" href="https://blog/a.html"/><id>https://blog/a.html</id></entry>` +
+		`<entry><title>B</title><link href="https://blog/b.html"/><id>https://blog/b.html</id></entry><entry><title>C</title></entry></feed>`
+	if s := string(addFeedEntryLinks(feed, []string{a.LinkURL, "", "https://example.com/c"})); s != exp {
+		t.Fatalf("addFeedEntryLinks() returned\n%s\nexpected\n%s", s, exp)
+	}
+
+	store = &Store{}
+	if err := store.SetArticles([]*Article{a, other}); err != nil {
+		t.Fatal(err)
+	}
+	defer rebuildArticlesCache()
+	rebuildArticlesCache()
+	w := httptest.NewRecorder()
+	handleMainPage(w, newTestRequest("GET", "/", ""))
+	body := w.Body.String()
+	for _, s := range []string{`href="https://example.com/post?a=1&amp;b=2">Worth reading</a> <a class="permalink" href="/` + a.Permalink() + `"`, `href="/` + other.Permalink() + `">Other</a>`} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q not on main page", s)
+		}
+	}
+	w = httptest.NewRecorder()
+	handleArticle(w, newTestRequest("GET", "/"+a.Permalink(), ""))
+	if !strings.Contains(w.Body.String(), `Link: <a href="https://example.com/post?a=1&amp;b=2">example.com</a>`) {
+		t.Fatalf("link not on article page: %s", w.Body.String())
+	}
+}
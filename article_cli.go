@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// -list-articles, -show-article ${id} and -delete-article ${id} manage
+// articles in blog_posts from the terminal. Only -delete-article changes
+// files: it sets "Deleted: yes" header of the article (a running server
+// picks it up, see reload_articles.go).
+
+type ArticleListItem struct {
+	Id      int      `json:"id"`
+	Date    string   `json:"date"`
+	Title   string   `json:"title"`
+	Tags    []string `json:"tags"`
+	Path    string   `json:"path"`
+	Draft   bool     `json:"draft,omitempty"`
+	Deleted bool     `json:"deleted,omitempty"`
+	Private bool     `json:"private,omitempty"`
+	Pinned  bool     `json:"pinned,omitempty"`
+}
+
+func articleFlags(a *Article) string {
+	var flags []string
+	if a.IsDraft {
+		flags = append(flags, "draft")
+	}
+	if a.IsDeleted {
+		flags = append(flags, "deleted")
+	}
+	if a.IsPrivate {
+		flags = append(flags, "private")
+	}
+	if a.IsPinned {
+		flags = append(flags, "pinned")
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, ",")
+}
+
+// articles are most recent first
+func listArticles(w io.Writer, articles []*Article, asJson bool) error {
+	if asJson {
+		items := []*ArticleListItem{}
+		for _, a := range articles {
+			items = append(items, &ArticleListItem{
+				Id:      a.Id,
+				Date:    a.PublishedOn.Format(time.RFC3339),
+				Title:   a.Title,
+				Tags:    a.Tags,
+				Path:    a.Path,
+				Draft:   a.IsDraft,
+				Deleted: a.IsDeleted,
+				Private: a.IsPrivate,
+				Pinned:  a.IsPinned,
+			})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	}
+	for _, a := range articles {
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", a.Id, a.PublishedOn.Format("2006-01-02"), a.Title, strings.Join(a.Tags, ","), articleFlags(a))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findArticleById(articles []*Article, id int) *Article {
+	for _, a := range articles {
+		if a.Id == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// re-writes the file of a with "Deleted: yes" header. Asks for
+// confirmation on in if confirm is true
+func deleteArticleFile(a *Article, confirm bool, in io.Reader, out io.Writer) error {
+	if a.IsDeleted {
+		return fmt.Errorf("article %d (%s) is already deleted", a.Id, a.Path)
+	}
+	if confirm {
+		fmt.Fprintf(out, "Delete article %d %q (%s)? [y/N] ", a.Id, a.Title, a.Path)
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("not deleted")
+		}
+	}
+	// re-read so that we write the current version
+	d, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+	curr, errs := parseArticle(a.Path, d)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	curr.IsDeleted = true
+	s := serArticleHeader(curr) + string(curr.Body)
+	tmpPath := a.Path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, []byte(s), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.Path)
+}
+
+// runs -list-articles, -show-article or -delete-article. Returns exit code
+func runArticlesCommand() int {
+	articles, _, err := readArticles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading articles failed with %s\n", err)
+		return 1
+	}
+	sort.Sort(sort.Reverse(ArticlesByTime(articles)))
+	if listArticlesFlag {
+		if err = listArticles(os.Stdout, articles, jsonFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		return 0
+	}
+	id := showArticleId
+	if id == 0 {
+		id = deleteArticleId
+	}
+	a := findArticleById(articles, id)
+	if a == nil {
+		fmt.Fprintf(os.Stderr, "no article with id %d\n", id)
+		return 1
+	}
+	if showArticleId != 0 {
+		os.Stdout.Write(a.Body)
+		return 0
+	}
+	if err = deleteArticleFile(a, !yesFlag, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Printf("deleted article %d (%s)\n", a.Id, a.Path)
+	return 0
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Number of words, code blocks and reading time of articles. They're counted
+// in html of the article (when building articles cache), so all formats are
+// counted the same way. Code (<pre>) counts as words but not for reading
+// time, which is at WordsPerMinute from config.json.
+
+const defaultWordsPerMinute = 200
+
+var preBlockRx = regexp.MustCompile(`(?is)<pre[\s>].*?</pre>`)
+
+type ArticleStats struct {
+	Words int
+	// words outside of <pre>
+	TextWords  int
+	CodeBlocks int
+}
+
+func countWords(s string) int {
+	s = ogSkipTagsRx.ReplaceAllString(s, " ")
+	s = htmlTagRx.ReplaceAllString(s, " ")
+	return len(strings.Fields(html.UnescapeString(s)))
+}
+
+func computeArticleStats(s string) *ArticleStats {
+	return &ArticleStats{
+		Words:      countWords(s),
+		TextWords:  countWords(preBlockRx.ReplaceAllString(s, " ")),
+		CodeBlocks: len(preBlockRx.FindAllStringIndex(s, -1)),
+	}
+}
+
+// returns article id => stats
+func buildArticleStats(articles []*Article) map[int]*ArticleStats {
+	res := make(map[int]*ArticleStats, len(articles))
+	for _, a := range articles {
+		res[a.Id] = computeArticleStats(a.GetHtmlStr())
+	}
+	return res
+}
+
+func wordsPerMinute() int {
+	if wpm := getConfig().WordsPerMinute; wpm > 0 {
+		return wpm
+	}
+	return defaultWordsPerMinute
+}
+
+// in minutes, at least 1
+func (s *ArticleStats) ReadingTime() int {
+	n := int(math.Ceil(float64(s.TextWords) / float64(wordsPerMinute())))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+type YearStats struct {
+	Year       int
+	Articles   int
+	Words      int
+	CodeBlocks int
+}
+
+// returns stats per year, most recent first
+func buildYearStats(articles []*Article) []*YearStats {
+	stats := articlesCache.get().stats
+	years := make(map[int]*YearStats)
+	var res []*YearStats
+	for _, a := range articles {
+		s := stats[a.Id]
+		if s == nil || a.IsDraft {
+			continue
+		}
+		year := a.PublishedOn.Year()
+		ys := years[year]
+		if ys == nil {
+			ys = &YearStats{Year: year}
+			years[year] = ys
+			res = append(res, ys)
+		}
+		ys.Articles++
+		ys.Words += s.Words
+		ys.CodeBlocks += s.CodeBlocks
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Year > res[j].Year
+	})
+	return res
+}
+
+// /app/stats
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	years := buildYearStats(getCachedArticles())
+	total := &YearStats{}
+	for _, ys := range years {
+		total.Articles += ys.Articles
+		total.Words += ys.Words
+		total.CodeBlocks += ys.CodeBlocks
+	}
+	model := struct {
+		BasePageModel
+		Years          []*YearStats
+		Total          *YearStats
+		WordsPerMinute int
+	}{
+		BasePageModel:  newBasePageModel(r),
+		Years:          years,
+		Total:          total,
+		WordsPerMinute: wordsPerMinute(),
+	}
+	ExecTemplate(w, tmplStats, model)
+}
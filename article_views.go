@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// We count views of articles (not by the admin or bots) per day, to show
+// the most read articles. Counts are kept in memory and saved to
+// article_views.json in data directory every few minutes and when
+// shutting down. Only the last maxViewDays days are kept.
+
+const (
+	maxViewDays    = 31
+	viewsFlushFreq = 5 * time.Minute
+	viewsDayFormat = "2006-01-02"
+	// how many most read articles are shown on the main page
+	mostReadCount = 5
+)
+
+type ArticleViews struct {
+	sync.Mutex
+	// day (viewsDayFormat) => article id => views
+	Days map[string]map[int]int
+	// true if there are views not saved to the file
+	dirty bool
+}
+
+var articleViews = &ArticleViews{Days: make(map[string]map[int]int)}
+
+func articleViewsPath() string {
+	return filepath.Join(getDataDir(), "article_views.json")
+}
+
+// counts a view of an article, unless it's by the admin or a bot (see
+// traffic_class.go)
+func recordArticleView(r *http.Request, a *Article) {
+	if getTrafficClass(r) != trafficHuman {
+		return
+	}
+	articleViews.Add(a.Id, time.Now())
+}
+
+func (v *ArticleViews) Add(articleId int, now time.Time) {
+	day := now.Format(viewsDayFormat)
+	v.Lock()
+	defer v.Unlock()
+	m := v.Days[day]
+	if m == nil {
+		m = make(map[int]int)
+		v.Days[day] = m
+	}
+	m[articleId]++
+	v.dirty = true
+}
+
+// returns article id => views since a given time. Days are counted whole
+func (v *ArticleViews) Since(t time.Time) map[int]int {
+	first := t.Format(viewsDayFormat)
+	res := make(map[int]int)
+	v.Lock()
+	defer v.Unlock()
+	for day, m := range v.Days {
+		if day < first {
+			continue
+		}
+		for id, n := range m {
+			res[id] += n
+		}
+	}
+	return res
+}
+
+// forgets days older than maxViewDays
+func (v *ArticleViews) prune(now time.Time) {
+	first := now.AddDate(0, 0, -maxViewDays).Format(viewsDayFormat)
+	v.Lock()
+	defer v.Unlock()
+	for day := range v.Days {
+		if day < first {
+			delete(v.Days, day)
+		}
+	}
+}
+
+// doesn't write the file if nothing changed since last save
+func (v *ArticleViews) save(path string) error {
+	v.Lock()
+	if !v.dirty {
+		v.Unlock()
+		return nil
+	}
+	d, err := json.Marshal(v)
+	v.dirty = false
+	v.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadArticleViews(path string) (*ArticleViews, error) {
+	v := &ArticleViews{Days: make(map[string]map[int]int)}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, v); err != nil {
+		return nil, err
+	}
+	if v.Days == nil {
+		v.Days = make(map[string]map[int]int)
+	}
+	return v, nil
+}
+
+func readArticleViews() {
+	v, err := loadArticleViews(articleViewsPath())
+	if err != nil {
+		logger.Errorf("readArticleViews(): %s", err)
+		return
+	}
+	articleViews = v
+}
+
+func saveArticleViews() {
+	articleViews.prune(time.Now())
+	if err := articleViews.save(articleViewsPath()); err != nil {
+		logger.Errorf("saveArticleViews(): %s", err)
+	}
+}
+
+// saves views, reactions (see reactions.go) and redirect hits (see
+// handler_redirects.go) every viewsFlushFreq and when done is closed
+func SaveArticleViewsLoop(done chan struct{}) {
+	for {
+		select {
+		case <-time.After(viewsFlushFreq):
+			saveArticleViews()
+			saveArticleReactions()
+			saveRedirectHits()
+		case <-done:
+			saveArticleViews()
+			saveArticleReactions()
+			saveRedirectHits()
+			return
+		}
+	}
+}
+
+type PopularArticle struct {
+	*Article
+	Views int
+}
+
+func sortPopularArticles(res []*PopularArticle) {
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Views > res[j].Views
+	})
+}
+
+// returns up to n articles with most views in the last since (n <= 0 for
+// all viewed articles)
+func PopularArticles(n int, since time.Duration) []*PopularArticle {
+	views := articleViews.Since(time.Now().Add(-since))
+	var res []*PopularArticle
+	for _, a := range getCachedArticles() {
+		if nViews := views[a.Id]; nViews > 0 {
+			res = append(res, &PopularArticle{Article: a, Views: nViews})
+		}
+	}
+	sortPopularArticles(res)
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+type ArticleViewsRow struct {
+	*Article
+	Day   int
+	Week  int
+	Month int
+}
+
+// GET /app/views?sort=${day|week|month}
+func handleArticleViews(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	day := articleViews.Since(now.Add(-24 * time.Hour))
+	week := articleViews.Since(now.AddDate(0, 0, -7))
+	month := articleViews.Since(now.AddDate(0, -1, 0))
+	var rows []*ArticleViewsRow
+	for _, a := range getCachedArticles() {
+		if month[a.Id] > 0 {
+			rows = append(rows, &ArticleViewsRow{Article: a, Day: day[a.Id], Week: week[a.Id], Month: month[a.Id]})
+		}
+	}
+	sortBy := getTrimmedFormValue(r, "sort")
+	if sortBy != "day" && sortBy != "week" {
+		sortBy = "month"
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		switch sortBy {
+		case "day":
+			return rows[i].Day > rows[j].Day
+		case "week":
+			return rows[i].Week > rows[j].Week
+		}
+		return rows[i].Month > rows[j].Month
+	})
+	model := struct {
+		BasePageModel
+		SortBy string
+		Rows   []*ArticleViewsRow
+	}{
+		BasePageModel: newBasePageModel(r),
+		SortBy:        sortBy,
+		Rows:          rows,
+	}
+	ExecTemplate(w, tmplArticleViews, model)
+}
@@ -3,18 +3,72 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kjk/u"
 )
 
 var articlesCache ArticlesCache
 
-type ArticlesCache struct {
-	sync.Mutex
+// data in the cache is never modified. When articles change we build new
+// data and swap it in, so readers see either old or new data. Code that
+// looks up more than one thing (e.g. serving an article) should call
+// articlesCache.get() once and use the result, so that all of it comes from
+// the same state
+type articlesCacheData struct {
+	// articles without private ones
 	articles       []*Article
 	articlesJs     []byte
 	articlesJsSha1 string
+	related        map[int][]*Article
+	// "/" + Permalink() => article
+	permalinks map[string]*Article
+	// permalinks with old slugs, that redirect to the current permalink
+	oldPermalinks map[string]*Article
+	// article id => data for Open Graph tags (see og_meta.go)
+	og map[int]*ogArticleData
+	// slug of series name => series (see series.go)
+	series map[string]*Series
+	// slug of author name => author (see authors.go)
+	authors map[string]*Author
+	// article id => number of words etc. (see article_stats.go)
+	stats map[int]*ArticleStats
+	// public articles by year and month (see handler_archive.go)
+	archive []*ArchiveYear
+	// "/" + Permalink() => private article (see share_links.go)
+	private map[string]*Article
+	// article id => article with its position and neighbours in articles
+	byId map[int]*ArticleInfo
+	// tag => articles with that tag, in the same order as articles
+	byTag map[string][]*Article
+	// what's on the main page (see front_page.go)
+	frontPage *FrontPage
+	// /atom.xml (without notes unless NotesInMainFeeds), /atom-all.xml and
+	// /notes/atom.xml, without WebSub links
+	atom      []byte
+	atomAll   []byte
+	atomNotes []byte
+}
+
+var emptyArticlesCacheData = &articlesCacheData{frontPage: &FrontPage{}}
+
+type ArticlesCache struct {
+	// *articlesCacheData
+	data atomic.Value
+}
+
+func (c *ArticlesCache) get() *articlesCacheData {
+	if d, ok := c.data.Load().(*articlesCacheData); ok && d != nil {
+		return d
+	}
+	return emptyArticlesCacheData
+}
+
+func (c *ArticlesCache) set(d *articlesCacheData) {
+	c.data.Store(d)
 }
 
 func appendJsonMarshalled(buf *bytes.Buffer, val interface{}) {
@@ -47,24 +101,195 @@ func buildArticlesJson(articles []*Article) ([]byte, string) {
 	return jsData, sha1
 }
 
-func buildArticlesCache() {
-	u.PanicIf(articlesCache.articles != nil)
+func buildArticlesCacheData(all []*Article) *articlesCacheData {
+	var articles, private []*Article
+	for _, a := range all {
+		if a.IsPrivate {
+			private = append(private, a)
+		} else {
+			articles = append(articles, a)
+		}
+	}
+	d := &articlesCacheData{articles: articles}
+	d.private = buildPermalinks(private)
+	d.articlesJs, d.articlesJsSha1 = buildArticlesJson(articles)
+	d.related = buildRelatedArticles(articles)
+	d.permalinks = buildPermalinks(articles)
+	d.oldPermalinks = buildOldPermalinks(articles, d.permalinks)
+	d.og = buildOgArticleData(articles)
+	d.series = buildSeries(articles)
+	d.authors = buildAuthors(articles)
+	d.stats = buildArticleStats(articles)
+	d.archive = buildArchive(articles)
+	d.byId = buildArticleInfos(articles)
+	d.byTag = buildArticlesByTag(articles)
+	d.frontPage = buildFrontPage(articles, all)
+	d.atom = buildAtomFeed(articles, feedTitle, "/atom.xml", !getConfig().NotesInMainFeeds)
+	d.atomAll = buildAtomFeed(articles, feedTitle, "/atom-all.xml", false)
+	d.atomNotes = buildAtomFeed(d.byTag[noteTag], feedTitle+" - notes", "/notes/atom.xml", false)
+	return d
+}
+
+func buildArticleInfos(articles []*Article) map[int]*ArticleInfo {
+	res := make(map[int]*ArticleInfo, len(articles))
+	for i, a := range articles {
+		info := &ArticleInfo{this: a, pos: i}
+		if i > 0 {
+			info.prev = articles[i-1]
+		}
+		if i+1 < len(articles) {
+			info.next = articles[i+1]
+		}
+		res[a.Id] = info
+	}
+	return res
+}
+
+func buildArticlesByTag(articles []*Article) map[string][]*Article {
+	res := make(map[string][]*Article)
+	for _, a := range articles {
+		for _, tag := range a.Tags {
+			res[tag] = append(res[tag], a)
+		}
+	}
+	return res
+}
+
+func buildArticlesCache() error {
+	if articlesCache.get().articles != nil {
+		return errors.New("articles cache already built")
+	}
+	articlesCache.set(buildArticlesCacheData(store.GetArticles()))
+	return nil
+}
+
+// must be called after articles in the store change
+func rebuildArticlesCache() {
+	articlesCache.set(buildArticlesCacheData(store.GetArticles()))
+}
+
+// Re-building the cache for many articles takes a while, so after articles
+// change it's re-built in the background while requests are served from
+// the old cache. Changes made while it's being re-built mark it dirty and
+// the same goroutine re-builds it once more when it's done, so many changes
+// in a row cause at most 2 re-builds.
+type cacheRebuilder struct {
+	mu sync.Mutex
+	// signalled when the goroutine exits
+	idle    *sync.Cond
+	dirty   bool
+	running bool
+}
+
+var articlesCacheRebuilder = newCacheRebuilder()
+
+func newCacheRebuilder() *cacheRebuilder {
+	r := &cacheRebuilder{}
+	r.idle = sync.NewCond(&r.mu)
+	return r
+}
+
+func (r *cacheRebuilder) request() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirty = true
+	if r.running {
+		return
+	}
+	r.running = true
+	go r.run()
+}
+
+func (r *cacheRebuilder) run() {
+	for {
+		r.mu.Lock()
+		if !r.dirty {
+			r.running = false
+			r.idle.Broadcast()
+			r.mu.Unlock()
+			return
+		}
+		r.dirty = false
+		r.mu.Unlock()
+
+		timeStart := time.Now()
+		rebuildArticlesCache()
+		dur := time.Since(timeStart)
+		appMetrics.CacheRebuildTime.Update(dur)
+		appMetrics.CacheRebuildLastMs.Update(dur.Nanoseconds() / int64(time.Millisecond))
+		appMetrics.CacheRebuildLastTime.Update(time.Now().Unix())
+	}
+}
+
+// waits until all requested re-builds are done
+func (r *cacheRebuilder) wait() {
+	r.mu.Lock()
+	for r.running {
+		r.idle.Wait()
+	}
+	r.mu.Unlock()
+}
+
+// articles are changed by re-reading files and renaming tags. Both read
+// articles, change copies and swap them in, so they're serialized to not
+// lose one of the changes
+var articlesUpdateMu sync.Mutex
+
+// calls fn with all articles (including deleted) and replaces them with
+// what it returns, unless it's nil. The cache is re-built in the background
+// and requests served in the meantime use the old cache
+func updateArticles(fn func([]*Article) []*Article) error {
+	articlesUpdateMu.Lock()
+	defer articlesUpdateMu.Unlock()
+	articles := fn(store.GetAllArticles())
+	if articles == nil {
+		return nil
+	}
+	if err := store.SetArticles(articles); err != nil {
+		return err
+	}
+	articlesCacheRebuilder.request()
+	return nil
+}
+
+// replaces articles in the store, see updateArticles()
+func swapArticles(articles []*Article) error {
+	return updateArticles(func([]*Article) []*Article { return articles })
+}
+
+// tells subscribers and WebSub hubs about articles published since the last
+// time. Called after articles are loaded at startup and when reloaded
+func notifyArticlesPublished() {
 	articles := store.GetArticles()
-	articlesCache.articles = articles
-	articlesCache.articlesJs, articlesCache.articlesJsSha1 = buildArticlesJson(articles)
+	notifySubscribers(articles)
+	pingHubsIfChanged(articles)
+	crosspostNewArticles(articles)
+}
+
+func getRelatedArticles(articleId int) []*Article {
+	return articlesCache.get().related[articleId]
+}
+
+func (d *articlesCacheData) articlesJsUrl() string {
+	return "/djs/articles-" + d.articlesJsSha1 + ".js"
 }
 
 func getArticlesJsUrl() string {
-	sha1 := articlesCache.articlesJsSha1
-	return "/djs/articles-" + sha1 + ".js"
+	return articlesCache.get().articlesJsUrl()
 }
 
 func getArticlesJsData() ([]byte, string) {
-	return articlesCache.articlesJs, articlesCache.articlesJsSha1
+	d := articlesCache.get()
+	return d.articlesJs, d.articlesJsSha1
 }
 
 func getCachedArticles() []*Article {
-	return articlesCache.articles
+	return articlesCache.get().articles
+}
+
+// articles with a given tag
+func getCachedArticlesWithTag(tag string) []*Article {
+	return articlesCache.get().byTag[tag]
 }
 
 type ArticleInfo struct {
@@ -74,19 +299,7 @@ type ArticleInfo struct {
 	pos  int
 }
 
+// returns nil for private articles
 func getCachedArticlesById(articleId int) *ArticleInfo {
-	articles := store.GetArticles()
-	res := &ArticleInfo{}
-	for i, curr := range articles {
-		if curr.Id == articleId {
-			if i != len(articles)-1 {
-				res.next = articles[i+1]
-			}
-			res.this = curr
-			res.pos = i
-			return res
-		}
-		res.prev = curr
-	}
-	return nil
+	return articlesCache.get().byId[articleId]
 }
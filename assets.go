@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kjk/blog/internal/fsutil"
+	"github.com/kjk/u"
+)
+
+// Static assets can be referenced via urls that include a hash of file's
+// content (e.g. /static/main.0123abcd.css) so that they can be cached
+// forever by browsers and proxies.
+// In production hashes are calculated once at startup. In dev they're
+// re-calculated on every request so that edits show up immediately.
+
+const assetHashLen = 8
+
+var (
+	assetHashesMu sync.Mutex
+	assetHashes   = make(map[string]string)
+)
+
+func hashAssetFile(path string) string {
+	sha1, err := u.Sha1HexOfFile(path)
+	if err != nil {
+		return ""
+	}
+	return sha1[:assetHashLen]
+}
+
+// calculates hashes of all files in dir. Keys are paths relative to dir,
+// always with '/' as separator
+func buildAssetHashes(dir string) {
+	hashes := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		hashes[filepath.ToSlash(name)] = hashAssetFile(path)
+		return nil
+	})
+	assetHashesMu.Lock()
+	assetHashes = hashes
+	assetHashesMu.Unlock()
+	logger.Noticef("buildAssetHashes(): hashed %d files in %q", len(hashes), dir)
+}
+
+func getAssetHash(dir, name string) string {
+	if !inProduction {
+		return hashAssetFile(filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	assetHashesMu.Lock()
+	defer assetHashesMu.Unlock()
+	return assetHashes[name]
+}
+
+func fingerprintedName(name, hash string) string {
+	ext := filepath.Ext(name)
+	return name[:len(name)-len(ext)] + "." + hash + ext
+}
+
+// template helper: assetUrl("main.css") => "/static/main.0123abcd.css"
+func assetUrl(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	hash := getAssetHash(getStaticDir(), name)
+	if hash == "" {
+		logger.Errorf("assetUrl(): no file %q in static dir", name)
+		return "/static/" + name
+	}
+	return "/static/" + fingerprintedName(name, hash)
+}
+
+func isHexStr(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// "main.0123abcd.css" => "main.css", "0123abcd"
+func parseFingerprintedName(name string) (string, string, bool) {
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+	idx := strings.LastIndex(base, ".")
+	if idx == -1 {
+		return "", "", false
+	}
+	hash := base[idx+1:]
+	if len(hash) != assetHashLen || !isHexStr(hash) {
+		return "", "", false
+	}
+	return base[:idx] + ext, hash, true
+}
+
+// returns false if name is not a fingerprinted url of a file in dir
+func serveFingerprintedAsset(w http.ResponseWriter, r *http.Request, dir, name string) bool {
+	origName, hash, ok := parseFingerprintedName(name)
+	if !ok {
+		return false
+	}
+	filePath := filepath.Join(dir, filepath.FromSlash(origName))
+	exists, err := fsutil.PathExists(filePath)
+	if err != nil {
+		logger.Errorf("serveFingerprintedAsset(): %s", err)
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return true
+	}
+	if !exists {
+		return false
+	}
+	if hash != getAssetHash(dir, origName) {
+		logger.Noticef("serveFingerprintedAsset(): hash mismatch for %q, referer: %q", name, getReferer(r))
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, filePath)
+	return true
+}
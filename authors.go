@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Articles are written by the site owner (SiteOwner in config.json) unless
+// they have "Authors: ${name}, ${name}" header (e.g. guest posts).
+// /author/${slug} lists public articles of an author.
+
+const defaultSiteOwner = "Krzysztof Kowalczyk"
+
+func siteOwner() string {
+	if s := stringOrEmpty(getConfig().SiteOwner); s != "" {
+		return s
+	}
+	return defaultSiteOwner
+}
+
+func parseAuthors(s string) []string {
+	var res []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// returns names of authors of a
+func (a *Article) AuthorNames() []string {
+	if len(a.Authors) > 0 {
+		return a.Authors
+	}
+	return []string{siteOwner()}
+}
+
+type Author struct {
+	Name string
+	// Urlify(Name), used in /author/${slug}
+	Slug string
+	// most recent first
+	Articles []*Article
+}
+
+func (a *Author) Url() string {
+	return "/author/" + a.Slug
+}
+
+// authors of a, for showing with links to their pages
+func articleAuthors(a *Article) []*Author {
+	var res []*Author
+	for _, name := range a.AuthorNames() {
+		res = append(res, &Author{Name: name, Slug: Urlify(name)})
+	}
+	return res
+}
+
+// atom generator doesn't support authors of entries so we add
+// <author> elements to the generated xml. authors[i] are authors of i-th
+// <entry>
+func addFeedEntryAuthors(d []byte, authors [][]string) []byte {
+	var b bytes.Buffer
+	for _, names := range authors {
+		start := bytes.Index(d, []byte("<entry"))
+		if start == -1 {
+			break
+		}
+		end := bytes.IndexByte(d[start:], '>')
+		if end == -1 || d[start+end-1] == '/' {
+			break
+		}
+		end += start + 1
+		b.Write(d[:end])
+		for _, name := range names {
+			fmt.Fprintf(&b, `<author><name>%s</name><uri>%s</uri></author>`, html.EscapeString(name), html.EscapeString(absURL("/author/"+Urlify(name))))
+		}
+		d = d[end:]
+	}
+	b.Write(d)
+	return b.Bytes()
+}
+
+// returns slug => author
+func buildAuthors(articles []*Article) map[string]*Author {
+	res := make(map[string]*Author)
+	for _, a := range articles {
+		for _, name := range a.AuthorNames() {
+			slug := Urlify(name)
+			author := res[slug]
+			if author == nil {
+				author = &Author{Name: name, Slug: slug}
+				res[slug] = author
+			}
+			author.Articles = append(author.Articles, a)
+		}
+	}
+	for _, author := range res {
+		sort.SliceStable(author.Articles, func(i, j int) bool {
+			return author.Articles[i].PublishedOn.After(author.Articles[j].PublishedOn)
+		})
+	}
+	return res
+}
+
+// /author/${slug}
+func handleAuthor(w http.ResponseWriter, r *http.Request) {
+	slug := strings.TrimPrefix(r.URL.Path, "/author/")
+	author := articlesCache.get().authors[slug]
+	if author == nil {
+		serve404(w, r)
+		return
+	}
+	model := struct {
+		BasePageModel
+		Author *Author
+	}{
+		BasePageModel: newBasePageModel(r),
+		Author:        author,
+	}
+	ExecTemplate(w, tmplAuthor, model)
+}
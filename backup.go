@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/blog/internal/fsutil"
+	"github.com/kjk/u"
+)
+
+var backupFreq = 12 * time.Hour
+
+// since we backup twice a day, that should be ~32 days of backups
+const MaxBackupsToKeep = 64
+
+// dir (relative to the root of backup target) where crash reports are
+// backed up
+const blobsBackupDir = "blobs_crashes"
+
+type BackupConfig struct {
+	Target   BackupTarget
+	LocalDir string
+	// if true, files deleted locally are deleted from the backup
+	DeleteRemoved bool
+	// if not nil, files are encrypted with it before upload
+	EncryptionKey []byte
+}
+
+// target etc. are taken from the current config because they can change
+// while we're running
+func newBackupConfig() (*BackupConfig, error) {
+	c := getConfig()
+	key, err := backupKeyFromHex(stringOrEmpty(c.BackupEncryptionKeyHexStr))
+	if err != nil {
+		return nil, err
+	}
+	target, err := newBackupTarget(c)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupConfig{
+		Target:        target,
+		LocalDir:      getDataDir(),
+		DeleteRemoved: c.S3BackupDeleteRemoved,
+		EncryptionKey: key,
+	}, nil
+}
+
+// tests if backup target is accessible and aborts if it isn't
+func ensureValidConfig(config *BackupConfig) {
+	name := config.Target.Name()
+	exists, err := fsutil.PathExists(config.LocalDir)
+	if err != nil {
+		log.Fatalf("Invalid %s backup: %s", name, err)
+	}
+	if !exists {
+		log.Fatalf("Invalid %s backup: directory to backup %q doesn't exist", name, config.LocalDir)
+	}
+
+	_, err = config.Target.List("", false)
+	if err != nil {
+		log.Fatalf("Invalid %s backup: List failed %s", name, err)
+	}
+}
+
+// returns names of backup zips, oldest first
+func listBackupZips(t BackupTarget) ([]string, error) {
+	files, err := t.List("", false)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, f := range files {
+		if isBackupFile(f.Path) {
+			res = append(res, f.Path)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Return true if a backup file with given sha1 content has already been uploaded
+// (and encrypted with the current key, if any). Checks if sha1 is part of
+// the name, on the theory that if the content hasn't changed, the last
+// backup file should have the same content, so we don't need to check all
+// files
+func alreadyUploaded(config *BackupConfig, sha1 string) bool {
+	zips, err := listBackupZips(config.Target)
+	if err != nil {
+		logger.Errorf("alreadyUploaded(): listBackupZips() failed with %s", err)
+		return false
+	}
+	for _, name := range zips {
+		if !strings.Contains(name, sha1) {
+			continue
+		}
+		// backups without a manifest are not encrypted
+		keyId := ""
+		if d, err := config.Target.Get(backupManifestKey(name)); err == nil {
+			var m BackupManifest
+			if json.Unmarshal(d, &m) == nil {
+				keyId = m.KeyId
+			}
+		}
+		if keyId == backupKeyId(config.EncryptionKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// backup file name is in the form:
+// 121011_1121_c7fedc06cf4b08fef66090eaa0ad7a68dc13a325.zip
+// return true if s matches that form
+func isBackupFile(s string) bool {
+	parts := strings.Split(s, "_")
+	if len(parts) != 3 || len(parts[0]) != 6 || len(parts[1]) != 4 {
+		return false
+	}
+	if len(parts[2]) != 40+4 {
+		return false
+	}
+	return strings.HasSuffix(parts[2], ".zip")
+}
+
+func deleteOldBackups(config *BackupConfig, maxToKeep int) {
+	zips, err := listBackupZips(config.Target)
+	if err != nil {
+		logger.Errorf("deleteOldBackups(): listBackupZips() failed with %s", err)
+		return
+	}
+	toDelete := len(zips) - maxToKeep
+	if toDelete <= 0 {
+		return
+	}
+	// zips are sorted with the oldest first, so we delete those
+	for _, name := range zips[:toDelete] {
+		if err = config.Target.Delete(name); err != nil {
+			logger.Noticef("deleteOldBackups(): failed to delete %s from %s, error: %s", name, config.Target.Name(), err)
+		} else {
+			logger.Noticef("deleteOldBackups(): deleted %s from %s", name, config.Target.Name())
+		}
+		// older backups don't have a manifest
+		config.Target.Delete(backupManifestKey(name))
+	}
+}
+
+// result of the last backup, shown on /app/dashboard
+type BackupStatus struct {
+	Time   time.Time
+	Result string
+	Failed bool
+}
+
+var (
+	lastBackupMu sync.Mutex
+	lastBackup   *BackupStatus
+)
+
+func setLastBackup(result string, err error) {
+	st := &BackupStatus{Time: time.Now(), Result: result}
+	if err != nil {
+		st.Result = err.Error()
+		st.Failed = true
+	}
+	lastBackupMu.Lock()
+	lastBackup = st
+	lastBackupMu.Unlock()
+}
+
+// returns nil if there was no backup yet
+func getLastBackup() *BackupStatus {
+	lastBackupMu.Lock()
+	defer lastBackupMu.Unlock()
+	return lastBackup
+}
+
+// returns a short description of what was done
+func doBackup(config *BackupConfig) (string, error) {
+	startTime := time.Now()
+	target := config.Target
+	name := target.Name()
+	defer target.Close()
+
+	blobsDir := filepath.Join(config.LocalDir, "blobs_crashes")
+	statePath := backupStatePath(config.LocalDir)
+	state, err := readBackupState(statePath)
+	if err != nil {
+		logger.Errorf("doBackup(): readBackupState() failed with %s, doing a full sync", err)
+		state = &BackupState{Files: make(map[string]backupFileState)}
+	}
+	remote := &targetBlobsRemote{target: target, dir: blobsBackupDir, key: config.EncryptionKey}
+	full := state.needsFullSync(startTime)
+	stats, blobs, err := syncBackupDir(remote, blobsDir, state, full, config.DeleteRemoved)
+	if err == nil && full {
+		state.LastFullSync = startTime
+	}
+	if err2 := state.save(statePath); err2 != nil {
+		logger.Errorf("doBackup(): state.save() failed with %s", err2)
+	}
+	if err != nil {
+		logger.Errorf("doBackup(): syncBackupDir() %s => %s:%s failed with %s", blobsDir, name, blobsBackupDir, err)
+		return "", err
+	}
+	logger.Noticef("doBackup(): %s: blobs: uploaded %d files (%d bytes), skipped %d files (%d bytes), deleted %d, kept %d deleted locally, full sync: %v",
+		name, stats.UploadedFiles, stats.UploadedBytes, stats.SkippedFiles, stats.SkippedBytes, stats.DeletedFiles, stats.KeptFiles, stats.FullSync)
+
+	dataDir := filepath.Join(config.LocalDir, "data")
+
+	zipLocalPath := filepath.Join(os.TempDir(), "blog-tmp-backup.zip")
+	// TODO: do I need os.Remove() won't os.Create() over-write the file anyway?
+	os.Remove(zipLocalPath) // remove before trying to create a new one, just in cased
+	err = u.CreateZipWithDirContent(zipLocalPath, dataDir)
+	defer os.Remove(zipLocalPath)
+	if err != nil {
+		return "", err
+	}
+	sha1, err := u.Sha1HexOfFile(zipLocalPath)
+	if err != nil {
+		return "", err
+	}
+	if alreadyUploaded(config, sha1) {
+		dur := time.Now().Sub(startTime)
+		logger.Noticef("%s backup not done because data (%s) didn't changed, took %.2f secs", name, sha1, dur.Seconds())
+		return "skipped, data didn't change", nil
+	}
+	timeStr := time.Now().Format("060102_1504_")
+	zipName := timeStr + sha1 + ".zip"
+
+	if err = backupPutFileEncrypted(target, zipLocalPath, zipName, config.EncryptionKey); err != nil {
+		logger.Errorf("%s: Put of %q to %q failed with %s", name, zipLocalPath, zipName, err)
+		return "", err
+	}
+	manifest, err := newBackupManifest(zipLocalPath, zipName, sha1, blobs)
+	if err != nil {
+		logger.Errorf("doBackup(): newBackupManifest() failed with %s", err)
+		return "", err
+	}
+	manifest.Encrypted = config.EncryptionKey != nil
+	manifest.KeyId = backupKeyId(config.EncryptionKey)
+	if err = putBackupManifest(target, manifest); err != nil {
+		logger.Errorf("doBackup(): %s: putBackupManifest() failed with %s", name, err)
+		return "", err
+	}
+
+	deleteOldBackups(config, MaxBackupsToKeep)
+
+	dur := time.Now().Sub(startTime)
+	logger.Noticef("%s backup of %q to %q took %.2f secs", name, zipLocalPath, zipName, dur.Seconds())
+	appMetrics.BackupTime.Update(dur)
+	appMetrics.BackupTimeOf(name).Update(dur)
+
+	get, err := newBackupGetter(target, manifest, config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nChecked, err := verifyBackupSample(get, manifest, blobsBackupDir, backupVerifySampleSize)
+	if err != nil {
+		appMetrics.BackupVerifyFailures.Inc(1)
+		logger.Errorf("doBackup(): %s: verification of %s failed: %s", name, zipName, err)
+		return "", fmt.Errorf("uploaded %s to %s but verification failed: %s", zipName, name, err)
+	}
+	return fmt.Sprintf("uploaded %s to %s in %.2f secs, verified %d objects", zipName, name, dur.Seconds(), nChecked), nil
+}
+
+// backs up data every backupFreq until done is closed. A backup that is in
+// progress when done is closed is allowed to finish. newConfig is called
+// before each backup
+func BackupLoop(newConfig func() (*BackupConfig, error), done chan struct{}) {
+	config, err := newConfig()
+	if err != nil {
+		log.Fatalf("Invalid backup config: %s", err)
+	}
+	ensureValidConfig(config)
+	config.Target.Close()
+	for {
+		if config, err = newConfig(); err != nil {
+			// config.json was reloaded with invalid backup settings
+			logger.Errorf("BackupLoop(): %s", err)
+			setLastBackup("", err)
+		} else {
+			setLastBackup(doBackup(config))
+		}
+		select {
+		case <-time.After(backupFreq):
+		case <-done:
+			logger.Noticef("BackupLoop(): exiting")
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// If BackupEncryptionKeyHexStr is set in config.json, backup zips and crash
+// reports are encrypted with AES-256-GCM before upload. The key is sha256 of
+// the config value. Each file has a random nonce, which is stored before
+// the ciphertext. Manifests are not encrypted (they only have names and
+// sha1 of files) and say if the backup is encrypted and with which key.
+
+const (
+	backupNonceSize = 12
+	// nonce + GCM tag
+	backupEncryptionOverhead = backupNonceSize + 16
+	// min length of BackupEncryptionKeyHexStr, decoded
+	minBackupKeyLen = 16
+)
+
+var errBackupWrongKey = errors.New("decryption failed (wrong BackupEncryptionKeyHexStr?)")
+
+// returns nil key if s is empty
+func backupKeyFromHex(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	secret, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BackupEncryptionKeyHexStr: %s", err)
+	}
+	if len(secret) < minBackupKeyLen {
+		return nil, fmt.Errorf("BackupEncryptionKeyHexStr should be at least %d bytes, is %d", minBackupKeyLen, len(secret))
+	}
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+// identifies the key in manifests and backup state without revealing it.
+// Empty for no encryption
+func backupKeyId(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+func newBackupGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptBackup(key, d []byte) ([]byte, error) {
+	gcm, err := newBackupGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, backupNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, d, nil), nil
+}
+
+func decryptBackup(key, d []byte) ([]byte, error) {
+	gcm, err := newBackupGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < backupEncryptionOverhead {
+		return nil, errors.New("encrypted file too short")
+	}
+	res, err := gcm.Open(nil, d[:backupNonceSize], d[backupNonceSize:], nil)
+	if err != nil {
+		return nil, errBackupWrongKey
+	}
+	return res, nil
+}
+
+// uploads local file, encrypted if key is not nil
+func backupPutFileEncrypted(t BackupTarget, localPath, path string, key []byte) error {
+	if key == nil {
+		return backupPutFile(t, localPath, path)
+	}
+	d, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	if d, err = encryptBackup(key, d); err != nil {
+		return err
+	}
+	return t.Put(path, bytes.NewReader(d))
+}
+
+// returns a function that downloads files of backup m, decrypting them if
+// needed. Fails if m is encrypted with a key different than key
+func newBackupGetter(t BackupTarget, m *BackupManifest, key []byte) (func(path string) ([]byte, error), error) {
+	if !m.Encrypted {
+		return t.Get, nil
+	}
+	if key == nil {
+		return nil, errors.New("backup is encrypted but BackupEncryptionKeyHexStr is not set")
+	}
+	if id := backupKeyId(key); id != m.KeyId {
+		return nil, fmt.Errorf("backup is encrypted with key %s but BackupEncryptionKeyHexStr is key %s", m.KeyId, id)
+	}
+	get := func(path string) ([]byte, error) {
+		d, err := t.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		return decryptBackup(key, d)
+	}
+	return get, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// Crash blobs are backed up incrementally. We remember size, modification
+// time and sha1 of each uploaded file in a local state file and only upload
+// files that are new or changed since. Once a week (and when there's no
+// state file) we do a full pass that compares local files with a list of
+// what's in backup target, to fix things that the state file doesn't know
+// about.
+
+// how often we compare local files with backup target
+const backupFullSyncFreq = 7 * 24 * time.Hour
+
+type backupFileState struct {
+	Size int64 `json:"size"`
+	// unix time in nanoseconds
+	ModTime int64  `json:"mtime"`
+	Sha1    string `json:"sha1"`
+	// id of the key it was encrypted with, empty if it wasn't
+	KeyId string `json:"key_id,omitempty"`
+}
+
+type BackupState struct {
+	// paths relative to the backed up dir, with '/' separators
+	Files        map[string]backupFileState `json:"files"`
+	LastFullSync time.Time                  `json:"last_full_sync"`
+}
+
+// it's outside of data/ so that it doesn't change the data zip
+func backupStatePath(localDir string) string {
+	return filepath.Join(localDir, "s3backup_state.json")
+}
+
+// returns empty state if the file doesn't exist
+func readBackupState(path string) (*BackupState, error) {
+	state := &BackupState{Files: make(map[string]backupFileState)}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, state); err != nil {
+		return nil, err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]backupFileState)
+	}
+	return state, nil
+}
+
+func (s *BackupState) save(path string) error {
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *BackupState) needsFullSync(now time.Time) bool {
+	return now.Sub(s.LastFullSync) > backupFullSyncFreq
+}
+
+// where we back up files to. Paths are relative to the backed up dir
+type backupRemote interface {
+	// returns sizes of remote files
+	List() (map[string]int64, error)
+	Put(localPath, path string) error
+	Del(path string) error
+	// id of the key files are encrypted with by Put(), empty if they
+	// aren't. Files encrypted with a different key are uploaded again
+	KeyId() string
+}
+
+// backupRemote for a dir in backup target
+type targetBlobsRemote struct {
+	target BackupTarget
+	// e.g. blobs_crashes
+	dir string
+	// nil if files are not encrypted
+	key []byte
+}
+
+func (r *targetBlobsRemote) List() (map[string]int64, error) {
+	files, err := r.target.List(r.dir, true)
+	if err != nil {
+		return nil, err
+	}
+	prefix := r.dir + "/"
+	res := make(map[string]int64, len(files))
+	for _, f := range files {
+		res[strings.TrimPrefix(f.Path, prefix)] = f.Size
+	}
+	return res, nil
+}
+
+func (r *targetBlobsRemote) Put(localPath, path string) error {
+	return backupPutFileRetry(r.target, localPath, blobBackupPath(r.dir, path), r.key)
+}
+
+func (r *targetBlobsRemote) Del(path string) error {
+	return r.target.Delete(blobBackupPath(r.dir, path))
+}
+
+func (r *targetBlobsRemote) KeyId() string {
+	return backupKeyId(r.key)
+}
+
+type BackupSyncStats struct {
+	UploadedFiles int
+	UploadedBytes int64
+	SkippedFiles  int
+	SkippedBytes  int64
+	DeletedFiles  int
+	// files deleted locally that we didn't delete from backup target
+	KeptFiles int
+	FullSync  bool
+}
+
+// uploads files in dir that are new or changed according to state, which
+// is updated. If full is true, we compare with files in remote instead.
+// Files deleted locally are deleted from remote if deleteRemoved is true. Returns
+// paths of all local files.
+// On error, state has the files uploaded so far and can be saved.
+func syncBackupDir(remote backupRemote, dir string, state *BackupState, full, deleteRemoved bool) (*BackupSyncStats, []string, error) {
+	stats := &BackupSyncStats{FullSync: full}
+	keyId := remote.KeyId()
+	var remoteFiles map[string]int64
+	if full {
+		var err error
+		if remoteFiles, err = remote.List(); err != nil {
+			return stats, nil, err
+		}
+	}
+
+	var paths []string
+	local := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// the dir doesn't exist before the first crash is saved
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		local[rel] = true
+		paths = append(paths, rel)
+		remoteSize := fi.Size()
+		if keyId != "" {
+			remoteSize += backupEncryptionOverhead
+		}
+
+		prev, inState := state.Files[rel]
+		unchanged := inState && prev.Size == fi.Size() && prev.ModTime == fi.ModTime().UnixNano()
+		if full {
+			size, inRemote := remoteFiles[rel]
+			unchanged = inRemote && size == remoteSize
+		}
+		if inState && prev.KeyId != keyId {
+			unchanged = false
+		}
+		if unchanged {
+			stats.SkippedFiles++
+			stats.SkippedBytes += fi.Size()
+			if !inState {
+				// first full sync, don't re-upload what's already there
+				if sha1, err := u.Sha1HexOfFile(path); err == nil {
+					state.Files[rel] = backupFileState{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Sha1: sha1, KeyId: keyId}
+				}
+			}
+			return nil
+		}
+		sha1, err := u.Sha1HexOfFile(path)
+		if err != nil {
+			return err
+		}
+		if err = remote.Put(path, rel); err != nil {
+			logger.Errorf("syncBackupDir(): upload of %q failed with %s", path, err)
+			return err
+		}
+		state.Files[rel] = backupFileState{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Sha1: sha1, KeyId: keyId}
+		stats.UploadedFiles++
+		stats.UploadedBytes += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, nil, err
+	}
+
+	// files that were deleted locally
+	var removed []string
+	for rel := range state.Files {
+		if !local[rel] {
+			removed = append(removed, rel)
+		}
+	}
+	for rel := range remoteFiles {
+		if _, inState := state.Files[rel]; !local[rel] && !inState {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	for _, rel := range removed {
+		if deleteRemoved {
+			if err = remote.Del(rel); err != nil {
+				logger.Errorf("syncBackupDir(): delete of %q failed with %s", rel, err)
+				return stats, nil, err
+			}
+			stats.DeletedFiles++
+		} else {
+			stats.KeptFiles++
+		}
+		delete(state.Files, rel)
+	}
+	return stats, paths, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/blog/internal/fsutil"
+)
+
+// BackupTarget is where backups are stored (s3, local directory or sftp
+// server, see BackupTarget in config.json). Paths are relative to the root
+// of the target and use '/' as separator.
+type BackupTarget interface {
+	// used in log lines and metric names e.g. "s3"
+	Name() string
+	Put(path string, r io.Reader) error
+	Get(path string) ([]byte, error)
+	// returns files in dir (in its sub-directories too if recursive).
+	// Returns no files if dir doesn't exist
+	List(dir string, recursive bool) ([]BackupObject, error)
+	// deleting a file that doesn't exist is not an error
+	Delete(path string) error
+	Close() error
+}
+
+type BackupObject struct {
+	Path string
+	Size int64
+}
+
+// returns target configured in c or an error describing what is missing
+func newBackupTarget(c *Config) (BackupTarget, error) {
+	switch name := stringOrEmpty(c.BackupTarget); name {
+	case "", "s3":
+		return newS3Target(c)
+	case "local":
+		return newLocalDirTarget(c)
+	case "sftp":
+		return newSftpTarget(c)
+	default:
+		return nil, fmt.Errorf("unknown BackupTarget %q (should be s3, local or sftp)", name)
+	}
+}
+
+func backupPutFile(t BackupTarget, localPath, path string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.Put(path, f)
+}
+
+// Put() likes to fail when putting lots of files in a sequence (at least
+// in s3), so retry once for better reliability
+func backupPutFileRetry(t BackupTarget, localPath, path string, key []byte) error {
+	if err := backupPutFileEncrypted(t, localPath, path, key); err != nil {
+		time.Sleep(100 * time.Millisecond)
+		return backupPutFileEncrypted(t, localPath, path, key)
+	}
+	return nil
+}
+
+// localDirTarget backs up to a directory e.g. one that is rsync'ed to
+// another machine
+type localDirTarget struct {
+	dir string
+}
+
+func newLocalDirTarget(c *Config) (BackupTarget, error) {
+	if StringEmpty(c.BackupLocalDir) {
+		return nil, errors.New("BackupLocalDir not defined in config.json")
+	}
+	return &localDirTarget{dir: *c.BackupLocalDir}, nil
+}
+
+func (t *localDirTarget) Name() string {
+	return "local"
+}
+
+func (t *localDirTarget) localPath(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid backup path %q", p)
+	}
+	return filepath.Join(t.dir, filepath.FromSlash(clean[1:])), nil
+}
+
+// writes to a temporary file first so that a partially written file is
+// never mistaken for a backup
+func (t *localDirTarget) Put(p string, r io.Reader) error {
+	dst, err := t.localPath(p)
+	if err != nil {
+		return err
+	}
+	if err = fsutil.CreateDirForFile(dst); err != nil {
+		return err
+	}
+	tmpPath := dst + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+func (t *localDirTarget) Get(p string) ([]byte, error) {
+	src, err := t.localPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(src)
+}
+
+func (t *localDirTarget) List(dir string, recursive bool) ([]BackupObject, error) {
+	root := filepath.Join(t.dir, filepath.FromSlash(dir))
+	var res []BackupObject
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if p != root && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// left over by a failed Put()
+		if strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(t.dir, p)
+		if err != nil {
+			return err
+		}
+		res = append(res, BackupObject{Path: filepath.ToSlash(rel), Size: fi.Size()})
+		return nil
+	})
+	return res, err
+}
+
+func (t *localDirTarget) Delete(p string) error {
+	dst, err := t.localPath(p)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(dst); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *localDirTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/crowdmob/goamz/aws"
+	"github.com/crowdmob/goamz/s3"
+)
+
+var bucketDelim = "/"
+
+type s3Target struct {
+	bucket *s3.Bucket
+	// s3 dir of backups, without leading "/" and with trailing "/"
+	dir string
+	// of uploaded files, private unless S3BackupPublicRead is set
+	acl s3.ACL
+	// shared with copies made by privateBackupTarget()
+	bucketCreator *s3BucketCreator
+}
+
+// targets are created often (e.g. to fetch an archived crash) so we don't
+// talk to s3 until the first upload. Creating the bucket is retried until
+// it succeeds
+type s3BucketCreator struct {
+	mu      sync.Mutex
+	created bool
+}
+
+// creates the bucket if it doesn't exist
+func (c *s3BucketCreator) ensure(bucket *s3.Bucket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.created {
+		return nil
+	}
+	if err := bucket.PutBucket(s3.Private); err != nil {
+		return err
+	}
+	c.created = true
+	return nil
+}
+
+func newS3Target(c *Config) (BackupTarget, error) {
+	if StringEmpty(c.AwsAccess) {
+		return nil, errors.New("AwsAccess not defined in config.json")
+	}
+	if StringEmpty(c.AwsSecret) {
+		return nil, errors.New("AwsSecret not defined in config.json")
+	}
+	if StringEmpty(c.S3BackupBucket) {
+		return nil, errors.New("S3BackupBucket not defined in config.json")
+	}
+	if StringEmpty(c.S3BackupDir) {
+		return nil, errors.New("S3BackupDir not defined in config.json")
+	}
+	acl := s3.Private
+	if c.S3BackupPublicRead {
+		acl = s3.PublicRead
+	}
+	auth := aws.Auth{AccessKey: *c.AwsAccess, SecretKey: *c.AwsSecret}
+	t := &s3Target{
+		bucket:        s3.New(auth, aws.USEast).Bucket(*c.S3BackupBucket),
+		dir:           sanitizeDirForList(*c.S3BackupDir, bucketDelim),
+		acl:           acl,
+		bucketCreator: &s3BucketCreator{},
+	}
+	return t, nil
+}
+
+// returns t that uploads files as private even if S3BackupPublicRead is set.
+// Other targets don't have public files
+func privateBackupTarget(t BackupTarget) BackupTarget {
+	if s, ok := t.(*s3Target); ok && s.acl != s3.Private {
+		res := *s
+		res.acl = s3.Private
+		return &res
+	}
+	return t
+}
+
+// removes "/" if exists and adds delim if missing
+func sanitizeDirForList(dir, delim string) string {
+	if strings.HasPrefix(dir, "/") {
+		dir = dir[1:]
+	}
+	if !strings.HasSuffix(dir, delim) {
+		dir = dir + delim
+	}
+	return dir
+}
+
+func (t *s3Target) Name() string {
+	return "s3"
+}
+
+func (t *s3Target) key(p string) string {
+	return t.dir + strings.TrimPrefix(p, "/")
+}
+
+// s3 needs to know the size up front, so unless r is a file we read it
+// into memory
+func (t *s3Target) Put(p string, r io.Reader) error {
+	if err := t.bucketCreator.ensure(t.bucket); err != nil {
+		return err
+	}
+	var size int64
+	if f, ok := r.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	} else {
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		size = int64(len(d))
+		r = bytes.NewReader(d)
+	}
+	contType := mime.TypeByExtension(path.Ext(p))
+	if contType == "" {
+		contType = "binary/octet-stream"
+	}
+	return t.bucket.PutReader(t.key(p), r, size, contType, t.acl, s3.Options{})
+}
+
+func (t *s3Target) Get(p string) ([]byte, error) {
+	return t.bucket.Get(t.key(p))
+}
+
+func (t *s3Target) List(dir string, recursive bool) ([]BackupObject, error) {
+	prefix := t.dir
+	if dir != "" {
+		prefix = sanitizeDirForList(t.key(dir), bucketDelim)
+	}
+	delim := ""
+	if !recursive {
+		delim = bucketDelim
+	}
+	var res []BackupObject
+	marker := ""
+	for {
+		// note: according to my tests, 1000 is max
+		rsp, err := t.bucket.List(prefix, delim, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range rsp.Contents {
+			res = append(res, BackupObject{Path: strings.TrimPrefix(k.Key, t.dir), Size: k.Size})
+		}
+		if !rsp.IsTruncated || len(rsp.Contents) == 0 {
+			break
+		}
+		marker = rsp.Contents[len(rsp.Contents)-1].Key
+	}
+	return res, nil
+}
+
+func (t *s3Target) Delete(p string) error {
+	return t.bucket.Del(t.key(p))
+}
+
+func (t *s3Target) Close() error {
+	return nil
+}
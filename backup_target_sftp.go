@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTarget backs up to a directory on an sftp server. We log in with
+// a private key and check the server's key against known_hosts
+type sftpTarget struct {
+	host           string
+	user           string
+	keyPath        string
+	knownHostsPath string
+	dir            string
+
+	// connected on first use, closed by Close()
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSftpTarget(c *Config) (BackupTarget, error) {
+	if StringEmpty(c.BackupSftpHost) {
+		return nil, errors.New("BackupSftpHost not defined in config.json")
+	}
+	if StringEmpty(c.BackupSftpUser) {
+		return nil, errors.New("BackupSftpUser not defined in config.json")
+	}
+	if StringEmpty(c.BackupSftpKeyPath) {
+		return nil, errors.New("BackupSftpKeyPath not defined in config.json")
+	}
+	if StringEmpty(c.BackupSftpDir) {
+		return nil, errors.New("BackupSftpDir not defined in config.json")
+	}
+	host := *c.BackupSftpHost
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	knownHostsPath := stringOrEmpty(c.BackupSftpKnownHosts)
+	if knownHostsPath == "" {
+		knownHostsPath = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	return &sftpTarget{
+		host:           host,
+		user:           *c.BackupSftpUser,
+		keyPath:        *c.BackupSftpKeyPath,
+		knownHostsPath: knownHostsPath,
+		dir:            *c.BackupSftpDir,
+	}, nil
+}
+
+func (t *sftpTarget) Name() string {
+	return "sftp"
+}
+
+func (t *sftpTarget) connect() (*sftp.Client, error) {
+	if t.client != nil {
+		return t.client, nil
+	}
+	key, err := ioutil.ReadFile(t.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %s", t.keyPath, err)
+	}
+	hostKeyCallback, err := knownhosts.New(t.knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	conn, err := ssh.Dial("tcp", t.host, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.conn = conn
+	t.client = client
+	return client, nil
+}
+
+func (t *sftpTarget) remotePath(p string) string {
+	return path.Join(t.dir, path.Clean("/"+p))
+}
+
+func (t *sftpTarget) Put(p string, r io.Reader) error {
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+	dst := t.remotePath(p)
+	if err = client.MkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	f, err := client.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (t *sftpTarget) Get(p string) ([]byte, error) {
+	client, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(t.remotePath(p))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (t *sftpTarget) List(dir string, recursive bool) ([]BackupObject, error) {
+	client, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	var res []BackupObject
+	var list func(dir string) error
+	list = func(dir string) error {
+		fis, err := client.ReadDir(t.remotePath(dir))
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			p := path.Join(dir, fi.Name())
+			if !fi.IsDir() {
+				res = append(res, BackupObject{Path: p, Size: fi.Size()})
+			} else if recursive {
+				if err = list(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err = list(dir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (t *sftpTarget) Delete(p string) error {
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if err = client.Remove(t.remotePath(p)); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *sftpTarget) Close() error {
+	if t.client == nil {
+		return nil
+	}
+	t.client.Close()
+	err := t.conn.Close()
+	t.client = nil
+	t.conn = nil
+	return err
+}
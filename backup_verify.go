@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/blog/internal/fsutil"
+)
+
+// Each backup zip has a manifest next to it (${name}.manifest.json) with
+// sha1 of the zip, of each file in it and the list of crash blobs at the
+// time of the backup. After a backup we download some of the uploaded files
+// and compare their sha1. -restore-backup ${timestamp} downloads a backup
+// and verifies everything.
+
+// how many crash blobs we download after a backup to check them
+const backupVerifySampleSize = 5
+
+type BackupFile struct {
+	Name string `json:"name"`
+	Sha1 string `json:"sha1"`
+	Size int64  `json:"size"`
+}
+
+type BackupManifest struct {
+	// path of the zip in backup target
+	Zip     string       `json:"zip"`
+	ZipSha1 string       `json:"zip_sha1"`
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+	// paths relative to blobs_crashes dir. The name of a blob is its sha1
+	Blobs []string `json:"blobs"`
+	// if true, the zip and all blobs are encrypted with key KeyId (see
+	// backup_encrypt.go). Sha1 of files are of unencrypted content
+	Encrypted bool   `json:"encrypted,omitempty"`
+	KeyId     string `json:"key_id,omitempty"`
+}
+
+// zipKey is path of a backup zip in backup target
+func backupManifestKey(zipKey string) string {
+	return strings.TrimSuffix(zipKey, ".zip") + ".manifest.json"
+}
+
+func sha1HexOfBytes(d []byte) string {
+	h := sha1.Sum(d)
+	return hex.EncodeToString(h[:])
+}
+
+func newBackupManifest(zipPath, zipKey, zipSha1 string, blobs []string) (*BackupManifest, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	m := &BackupManifest{
+		Zip:     zipKey,
+		ZipSha1: zipSha1,
+		Created: time.Now().UTC(),
+		Files:   make([]BackupFile, 0, len(zr.File)),
+		Blobs:   blobs,
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		d, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, BackupFile{Name: f.Name, Sha1: sha1HexOfBytes(d), Size: int64(len(d))})
+	}
+	return m, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func putBackupManifest(t BackupTarget, m *BackupManifest) error {
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return t.Put(backupManifestKey(m.Zip), bytes.NewReader(d))
+}
+
+// path of a crash blob in backup target
+func blobBackupPath(blobsDir, blob string) string {
+	return path.Join(blobsDir, blob)
+}
+
+func verifyBlob(blob string, d []byte) error {
+	if sha1 := sha1HexOfBytes(d); sha1 != path.Base(blob) {
+		return fmt.Errorf("blob %s has sha1 %s", blob, sha1)
+	}
+	return nil
+}
+
+// downloads the zip and up to n random crash blobs from the backup and
+// checks their sha1. Returns number of checked files
+func verifyBackupSample(get func(key string) ([]byte, error), m *BackupManifest, blobsDir string, n int) (int, error) {
+	var errs []string
+	d, err := get(m.Zip)
+	if err != nil {
+		return 0, err
+	}
+	if sha1 := sha1HexOfBytes(d); sha1 != m.ZipSha1 {
+		errs = append(errs, fmt.Sprintf("%s has sha1 %s, expected %s", m.Zip, sha1, m.ZipSha1))
+	}
+	checked := 1
+	for i, idx := range rand.Perm(len(m.Blobs)) {
+		if i == n {
+			break
+		}
+		blob := m.Blobs[idx]
+		if d, err = get(blobBackupPath(blobsDir, blob)); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to download blob %s: %s", blob, err))
+		} else if err = verifyBlob(blob, d); err != nil {
+			errs = append(errs, err.Error())
+		}
+		checked++
+	}
+	if len(errs) > 0 {
+		return checked, errors.New(strings.Join(errs, ", "))
+	}
+	return checked, nil
+}
+
+type RestoreSummary struct {
+	Files int
+	Blobs int
+	Bytes int64
+	// files that were missing or didn't match the manifest
+	Errors []string
+}
+
+func (s *RestoreSummary) String() string {
+	res := fmt.Sprintf("restored %d files and %d crash blobs, %d bytes", s.Files, s.Blobs, s.Bytes)
+	if len(s.Errors) > 0 {
+		res += fmt.Sprintf("\n%d errors:\n%s", len(s.Errors), strings.Join(s.Errors, "\n"))
+	}
+	return res
+}
+
+func writeRestoredFile(path string, d []byte) error {
+	if err := fsutil.CreateDirForFile(path); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+// downloads files of backup m into dstDir (as data/ and blobs_crashes/)
+// and verifies them
+func restoreFromManifest(get func(key string) ([]byte, error), m *BackupManifest, blobsDir, dstDir string) (*RestoreSummary, error) {
+	res := &RestoreSummary{}
+	zipData, err := get(m.Zip)
+	if err != nil {
+		return nil, err
+	}
+	if sha1 := sha1HexOfBytes(zipData); sha1 != m.ZipSha1 {
+		return nil, fmt.Errorf("%s has sha1 %s, expected %s", m.Zip, sha1, m.ZipSha1)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string]BackupFile)
+	for _, f := range m.Files {
+		expected[f.Name] = f
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := filepath.FromSlash(f.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: invalid name", f.Name))
+			continue
+		}
+		d, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		exp, ok := expected[f.Name]
+		delete(expected, f.Name)
+		if !ok {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: not in manifest", f.Name))
+		} else if sha1 := sha1HexOfBytes(d); sha1 != exp.Sha1 || int64(len(d)) != exp.Size {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: sha1 %s, size %d, expected %s, %d", f.Name, sha1, len(d), exp.Sha1, exp.Size))
+		}
+		if err = writeRestoredFile(filepath.Join(dstDir, "data", name), d); err != nil {
+			return nil, err
+		}
+		res.Files++
+		res.Bytes += int64(len(d))
+	}
+	for name := range expected {
+		res.Errors = append(res.Errors, fmt.Sprintf("%s: missing in zip", name))
+	}
+
+	for _, blob := range m.Blobs {
+		d, err := get(blobBackupPath(blobsDir, blob))
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", blob, err))
+			continue
+		}
+		if err = verifyBlob(blob, d); err != nil {
+			res.Errors = append(res.Errors, err.Error())
+		}
+		if err = writeRestoredFile(filepath.Join(dstDir, "blobs_crashes", filepath.FromSlash(blob)), d); err != nil {
+			return nil, err
+		}
+		res.Blobs++
+		res.Bytes += int64(len(d))
+	}
+	return res, nil
+}
+
+// finds backup zip whose name starts with timestamp (in the 060102_1504
+// format used for names of backups)
+func findBackupZip(t BackupTarget, timestamp string) (string, error) {
+	zips, err := listBackupZips(t)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, name := range zips {
+		if strings.HasPrefix(name, timestamp) {
+			found = append(found, name)
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no backup %q in %s", timestamp, t.Name())
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("more than one backup matches %q: %s", timestamp, strings.Join(found, ", "))
+	}
+	return found[0], nil
+}
+
+// -restore-backup ${timestamp}
+func restoreBackup(timestamp string) error {
+	config, err := newBackupConfig()
+	if err != nil {
+		return err
+	}
+	t := config.Target
+	defer t.Close()
+	dstDir := "restored_backup_" + timestamp
+	if exists, err := fsutil.PathExists(dstDir); err != nil || exists {
+		return fmt.Errorf("directory %q already exists", dstDir)
+	}
+	zipKey, err := findBackupZip(t, timestamp)
+	if err != nil {
+		return err
+	}
+	d, err := t.Get(backupManifestKey(zipKey))
+	if err != nil {
+		return fmt.Errorf("can't get manifest of %s (backups made before manifests were added can't be verified): %s", zipKey, err)
+	}
+	var m BackupManifest
+	if err = json.Unmarshal(d, &m); err != nil {
+		return err
+	}
+	// check the key before we write anything
+	get, err := newBackupGetter(t, &m, config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restoring %s from %s (created %s) to %s\n", zipKey, t.Name(), m.Created.Format(time.RFC3339), dstDir)
+	if err = os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+	res, err := restoreFromManifest(get, &m, blobsBackupDir, dstDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", res)
+	if len(res.Errors) > 0 {
+		return errors.New("backup didn't verify")
+	}
+	return nil
+}
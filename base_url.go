@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BaseURL in config.json is the canonical url of the site. Absolute urls
+// (in feeds, Open Graph tags etc.) are made with absURL(). If BaseURL is set,
+// requests for other hosts (e.g. the ip address or www. variant) are
+// redirected to it. Without it, we use defaultBaseUrl and don't redirect.
+
+// http because that's what links in atom feeds always were and changing
+// them would make feed readers show all articles as new
+const defaultBaseUrl = "http://blog.kowalczyk.info"
+
+func validateBaseUrl(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("BaseURL must be an absolute http:// or https:// url")
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return errors.New("BaseURL must not have a path or query")
+	}
+	return nil
+}
+
+// returns base url without trailing "/"
+func siteBaseUrl() string {
+	s := stringOrEmpty(getConfig().BaseURL)
+	if s == "" {
+		s = defaultBaseUrl
+	}
+	return strings.TrimSuffix(s, "/")
+}
+
+// returns absolute url for path on our site e.g. "/atom.xml" =>
+// "http://blog.kowalczyk.info/atom.xml"
+func absURL(path string) string {
+	return siteBaseUrl() + "/" + strings.TrimPrefix(path, "/")
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// returns url on the canonical host for requests to other hosts, "" if r
+// is for the canonical host or BaseURL is not set
+func canonicalHostRedirectUrl(r *http.Request) string {
+	s := stringOrEmpty(getConfig().BaseURL)
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || strings.EqualFold(hostWithoutPort(r.Host), u.Hostname()) {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + r.URL.RequestURI()
+}
+
+// redirects (301) requests for non-canonical hosts to BaseURL
+func withCanonicalHost(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uri := canonicalHostRedirectUrl(r); uri != "" {
+			http.Redirect(w, r, uri, http.StatusMovedPermanently)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
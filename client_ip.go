@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// We're behind nginx, which adds ip address of the client to
+// X-Forwarded-For. Clients can send their own X-Forwarded-For, so only the
+// addresses added by our proxies can be trusted. We walk the list from the
+// right (starting with the address that connected to us), skipping
+// addresses of trusted proxies (TrustedProxies in config.json, private
+// and loopback addresses by default), and the first address that's not
+// a proxy is the client.
+
+var defaultTrustedProxies = []string{"10.0.0.0/8", "172.16.0.0/12",
+	"192.168.0.0/16", "127.0.0.0/8", "::1/128", "fc00::/7"}
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, s := range cidrs {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TrustedProxies %q: %s", s, err)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+var defaultTrustedProxyNets, _ = parseTrustedProxies(defaultTrustedProxies)
+
+func trustedProxyNets() []*net.IPNet {
+	cidrs := getConfig().TrustedProxies
+	if cidrs == nil {
+		return defaultTrustedProxyNets
+	}
+	// validated in parseConfig()
+	nets, _ := parseTrustedProxies(cidrs)
+	return nets
+}
+
+func isTrustedProxy(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// "1.2.3.4:80" => "1.2.3.4", "[::1]:80" => "::1"
+func ipAddrFromRemoteAddr(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.Trim(s, "[]")
+}
+
+func getIpAddress(r *http.Request) string {
+	remoteAddr := ipAddrFromRemoteAddr(r.RemoteAddr)
+	nets := trustedProxyNets()
+	if !isTrustedProxy(nets, remoteAddr) {
+		// not from our proxy, so headers could be made up
+		return remoteAddr
+	}
+	hdr := r.Header
+	var addrs []string
+	// X-Forwarded-For is potentially a list of addresses separated with
+	// "," and there can be more than one header
+	for _, h := range hdr["X-Forwarded-For"] {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				addrs = append(addrs, ipAddrFromRemoteAddr(p))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if ip := strings.TrimSpace(hdr.Get("X-Real-Ip")); ip != "" {
+			return ip
+		}
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if !isTrustedProxy(nets, addrs[i]) {
+			return addrs[i]
+		}
+	}
+	return remoteAddr
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/go-oauth/oauth"
+	"github.com/gorilla/securecookie"
+)
+
+// Config is read from config.json. It can be re-read while running (on
+// SIGHUP or with /app/reload-config), so a *Config must not be changed
+// after it's been set with setConfig(). Use getConfig() to get the current
+// one.
+type Config struct {
+	TwitterOAuthCredentials *oauth.Credentials
+	CookieAuthKeyHexStr     *string
+	CookieEncrKeyHexStr     *string
+	AnalyticsCode           *string
+	AwsAccess               *string
+	AwsSecret               *string
+	S3BackupBucket          *string
+	S3BackupDir             *string
+	// if true, we generate og:image for articles that don't have one
+	GenerateOgImages bool
+	// if EnableAutocert is true, we serve https for TLSHosts with
+	// certificates from Let's Encrypt
+	TLSHosts       []string
+	EnableAutocert bool
+	// if set, enables /login/basic for logging in as admin with a
+	// password (e.g. when Twitter is down)
+	AdminPasswordBcryptHash *string
+	// crash reports older than that many days are deleted (0 = keep)
+	CrashRetentionDays int
+	// only that many newest crash reports per app version are kept
+	// (0 = no limit)
+	MaxCrashesPerVersion int
+	// crash report files older than that many days are moved to backup
+	// target (0 = keep them locally)
+	CrashArchiveDays int
+	// if true, clicks on links to other sites in articles are counted
+	TrackOutboundLinks bool
+	// limits of requests processed at the same time, over which we
+	// reject requests to expensive pages (0 = no limit)
+	MaxConcurrentRequests      int
+	MaxConcurrentCrashRequests int
+	// if both are set, source locations in crash reports link to
+	// SumatraSrcUrl (see linkify_crash_report.go)
+	SumatraSrcDir *string
+	SumatraSrcUrl *string
+	// where we backup to: "s3" (the default), "local" or "sftp". See
+	// backup_target.go
+	BackupTarget *string
+	// for "local" target
+	BackupLocalDir *string
+	// for "sftp" target. BackupSftpHost can have a port (default is 22).
+	// If BackupSftpKnownHosts is not set, ~/.ssh/known_hosts is used
+	BackupSftpHost       *string
+	BackupSftpUser       *string
+	BackupSftpKeyPath    *string
+	BackupSftpDir        *string
+	BackupSftpKnownHosts *string
+	// if set, backups are encrypted (see backup_encrypt.go)
+	BackupEncryptionKeyHexStr *string
+	// if true, crash reports deleted locally (e.g. pruned) are also
+	// deleted from backup (the name is from when we only had s3)
+	S3BackupDeleteRemoved bool
+	// if true, backups are uploaded to s3 as public-read (the default is
+	// private). Crash report archives are always private
+	S3BackupPublicRead bool
+	// markdown extensions (see markdown.go), all enabled if not set. They
+	// can be turned off if one of them breaks an old article
+	MarkdownTables        *bool
+	MarkdownFootnotes     *bool
+	MarkdownStrikethrough *bool
+	MarkdownTaskLists     *bool
+	MarkdownAutolink      *bool
+	// if true, code in articles is highlighted in the browser with
+	// highlight.js instead of when rendering (see highlight.go)
+	ClientSideHighlighting bool
+	// urls of articles e.g. /{year}/{month}/{slug}.html. If not set,
+	// legacyPermalinkScheme is used (see permalinks.go)
+	PermalinkScheme *string
+	// canonical url of the site e.g. https://blog.kowalczyk.info, used in
+	// absolute urls (see base_url.go). If set, requests for other hosts
+	// are redirected to it
+	BaseURL *string
+	// og:image of articles without images (and when GenerateOgImages is
+	// false). Can be relative to BaseURL
+	DefaultOgImageUrl *string
+	// path => limit of POSTs per ip address (see rate_limit.go). Paths
+	// not here use defaultRateLimits. PerMinute of 0 turns limiting off
+	RateLimits map[string]RateLimit
+	// logins expire after that many days (defaultSessionTTLDays if 0)
+	SessionTTLDays int
+	// ip ranges (CIDR) of proxies whose X-Forwarded-For we trust (see
+	// client_ip.go). defaultTrustedProxies if not set
+	TrustedProxies []string
+	// 404s for urls with those prefixes are not recorded. If not set,
+	// defaultIgnored404Prefixes is used
+	Ignored404Prefixes []string
+	// requests with user agents containing one of those (case-insensitive)
+	// are from bots, in addition to defaultBotUserAgents (see
+	// traffic_class.go)
+	BotUserAgents []string
+	// SMTP server for sending emails to subscribers (see email.go and
+	// subscriptions.go). Emails are only sent if SmtpHost and EmailFrom
+	// are set. SmtpPort is defaultSmtpPort if 0, SmtpUser is optional
+	SmtpHost     *string
+	SmtpPort     int
+	SmtpUser     *string
+	SmtpPassword *string
+	EmailFrom    *string
+	// WebSub hubs we ping when articles are published or changed (see
+	// websub.go). defaultWebSubHubs if not set, [] for none
+	WebSubHubs []string
+	// if true, we don't ping anyone (e.g. WebSub hubs) when articles
+	// change. For local development
+	DisableOutboundPings bool
+	// for reading time of articles (defaultWordsPerMinute if 0)
+	WordsPerMinute int
+	// author of articles without "Authors:" header, defaultSiteOwner if
+	// not set
+	SiteOwner *string
+	// paths disallowed in /robots.txt in addition to robotsDisallowPaths
+	RobotsDisallow []string
+	// if true, ip addresses that submit crash reports rejected as spam are
+	// blocked (see crash_spam.go)
+	BlockCrashSpammers bool
+	// origins (e.g. "https://admin.example.com") whose pages can call
+	// /api/ urls (see cors.go)
+	CorsAllowedOrigins []string
+	// if set, static copy of the site is exported to this directory every
+	// night (see export_static.go)
+	ExportStaticDir *string
+	// timeouts of http servers, in seconds (see server_limits.go for
+	// defaults used if 0)
+	ReadHeaderTimeoutSeconds int
+	ReadTimeoutSeconds       int
+	WriteTimeoutSeconds      int
+	IdleTimeoutSeconds       int
+	// max size of request bodies, path => bytes. Paths not here use
+	// defaultMaxBodyBytes
+	MaxBodyBytes map[string]int64
+	// IANA name (e.g. "Europe/Berlin") of time zone in which we show
+	// dates. Local time zone of the server if not set
+	TimeZone *string
+	// Go time layout of dates on pages, defaultDateFormat if not set
+	DateFormat *string
+	// debug, notice or error. Messages below it are not logged (see
+	// log.go), notice if not set
+	LogLevel *string
+	// log file is rotated when it's bigger than that, we keep that many
+	// old files (see log_file.go for defaults used if 0)
+	LogMaxSizeMB int
+	LogMaxFiles  int
+	// when shutting down, for how long /readyz fails before we stop
+	// accepting connections (see health.go)
+	ShutdownDrainSeconds int
+	// if true, notes (see notes.go) are also on the main page and in
+	// /atom.xml and /feed.json, not only on /notes/
+	NotesOnMainPage  bool
+	NotesInMainFeeds bool
+	// like PermalinkScheme, for notes. PermalinkScheme if not set
+	NotesPermalinkScheme *string
+	// on the main page, that many newest articles are shown with their
+	// body and then FrontPageTitles (all if 0) titles. Article with
+	// FrontPageIntroArticleId (0 for none) is shown above them (see
+	// front_page.go)
+	FrontPageFullPosts      int
+	FrontPageTitles         int
+	FrontPageIntroArticleId int
+	// new articles are posted to Mastodon if both are set and to Twitter
+	// if TwitterPostingCredentials (access token of the account we post
+	// as) are set (see crosspost.go)
+	MastodonInstanceUrl       *string
+	MastodonAccessToken       *string
+	TwitterPostingCredentials *oauth.Credentials
+	// re-checking links in articles only checks links to other sites
+	// checked more than that many days ago (see link_checker.go)
+	LinkCheckMaxAgeDays int
+	// if set, requests are logged to this file (relative to data
+	// directory) in Combined Log Format. Rotated files are kept for
+	// AccessLogRetentionDays (see access_log.go for default if 0)
+	AccessLogPath          *string
+	AccessLogRetentionDays int
+}
+
+// fields used when building articles cache (e.g. feeds have absolute urls
+// and authors), when they change we rebuild it
+var configFieldsInArticlesCache = []string{"BaseURL", "SiteOwner",
+	"NotesOnMainPage", "NotesInMainFeeds", "FrontPageFullPosts",
+	"FrontPageTitles", "FrontPageIntroArticleId"}
+
+// fields that are only used at startup. When they change, we keep using
+// the old values and tell that a restart is needed
+var configFieldsRequiringRestart = []string{"TwitterOAuthCredentials",
+	"CookieAuthKeyHexStr", "CookieEncrKeyHexStr", "TLSHosts", "EnableAutocert",
+	"MaxConcurrentRequests", "MaxConcurrentCrashRequests", "PermalinkScheme",
+	"NotesPermalinkScheme",
+	"ReadHeaderTimeoutSeconds", "ReadTimeoutSeconds", "WriteTimeoutSeconds",
+	"IdleTimeoutSeconds", "LogMaxSizeMB", "LogMaxFiles", "AccessLogPath",
+	// html of articles is cached after first render
+	"MarkdownTables", "MarkdownFootnotes", "MarkdownStrikethrough",
+	"MarkdownTaskLists", "MarkdownAutolink", "ClientSideHighlighting"}
+
+var (
+	configMu   sync.RWMutex
+	currConfig = &Config{TwitterOAuthCredentials: &oauth.Credentials{}}
+)
+
+func getConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currConfig
+}
+
+func setConfig(c *Config) {
+	configMu.Lock()
+	currConfig = c
+	configMu.Unlock()
+}
+
+// parses and validates config.json
+func parseConfig(d []byte) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal(d, c); err != nil {
+		return nil, err
+	}
+	if c.TwitterOAuthCredentials == nil {
+		c.TwitterOAuthCredentials = &oauth.Credentials{}
+	}
+	if c.CookieAuthKeyHexStr == nil || c.CookieEncrKeyHexStr == nil {
+		return nil, errors.New("CookieAuthKeyHexStr and CookieEncrKeyHexStr must be set")
+	}
+	authKey, err := hex.DecodeString(*c.CookieAuthKeyHexStr)
+	if err != nil {
+		return nil, err
+	}
+	encrKey, err := hex.DecodeString(*c.CookieEncrKeyHexStr)
+	if err != nil {
+		return nil, err
+	}
+	// verify auth/encr keys are correct
+	val := map[string]string{
+		"foo": "bar",
+	}
+	_, err = securecookie.New(authKey, encrKey).Encode(cookieName, val)
+	if err != nil {
+		// for convenience, if the auth/encr keys are not set,
+		// generate valid, random value for them
+		auth := securecookie.GenerateRandomKey(32)
+		encr := securecookie.GenerateRandomKey(32)
+		fmt.Printf("auth: %s\nencr: %s\n", hex.EncodeToString(auth), hex.EncodeToString(encr))
+		return nil, err
+	}
+	if _, err = backupKeyFromHex(stringOrEmpty(c.BackupEncryptionKeyHexStr)); err != nil {
+		return nil, err
+	}
+	if !StringEmpty(c.PermalinkScheme) {
+		if err = validatePermalinkScheme(*c.PermalinkScheme); err != nil {
+			return nil, err
+		}
+	}
+	if !StringEmpty(c.NotesPermalinkScheme) {
+		if err = validatePermalinkScheme(*c.NotesPermalinkScheme); err != nil {
+			return nil, fmt.Errorf("NotesPermalinkScheme: %s", err)
+		}
+	}
+	if !StringEmpty(c.BaseURL) {
+		if err = validateBaseUrl(*c.BaseURL); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = parseTrustedProxies(c.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for path, limit := range c.RateLimits {
+		if limit.PerMinute < 0 || (limit.PerMinute > 0 && limit.Burst < 1) {
+			return nil, fmt.Errorf("invalid RateLimits for %s: PerMinute must be >= 0 and Burst >= 1", path)
+		}
+	}
+	for _, ua := range c.BotUserAgents {
+		if strings.TrimSpace(ua) == "" {
+			return nil, fmt.Errorf("BotUserAgents can't have empty strings")
+		}
+	}
+	for _, hub := range c.WebSubHubs {
+		if u, err := url.Parse(hub); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid WebSubHubs url %q", hub)
+		}
+	}
+	if c.AccessLogRetentionDays < 0 {
+		return nil, fmt.Errorf("AccessLogRetentionDays can't be negative")
+	}
+	if c.LinkCheckMaxAgeDays < 0 {
+		return nil, fmt.Errorf("LinkCheckMaxAgeDays can't be negative")
+	}
+	if c.FrontPageFullPosts < 0 || c.FrontPageTitles < 0 {
+		return nil, fmt.Errorf("FrontPageFullPosts and FrontPageTitles can't be negative")
+	}
+	if !StringEmpty(c.MastodonInstanceUrl) {
+		if u, err := url.Parse(*c.MastodonInstanceUrl); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid MastodonInstanceUrl %q, must be e.g. https://mastodon.social", *c.MastodonInstanceUrl)
+		}
+	}
+	for _, path := range c.RobotsDisallow {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "\r\n") {
+			return nil, fmt.Errorf("invalid RobotsDisallow path %q, must start with /", path)
+		}
+	}
+	for _, origin := range c.CorsAllowedOrigins {
+		if !isValidCorsOrigin(origin) {
+			return nil, fmt.Errorf("invalid CorsAllowedOrigins origin %q, must be e.g. https://example.com", origin)
+		}
+	}
+	timeouts := map[string]int{"ReadHeaderTimeoutSeconds": c.ReadHeaderTimeoutSeconds,
+		"ReadTimeoutSeconds": c.ReadTimeoutSeconds, "WriteTimeoutSeconds": c.WriteTimeoutSeconds,
+		"IdleTimeoutSeconds": c.IdleTimeoutSeconds}
+	for name, seconds := range timeouts {
+		if seconds < 0 {
+			return nil, fmt.Errorf("invalid %s %d", name, seconds)
+		}
+	}
+	for path, n := range c.MaxBodyBytes {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid MaxBodyBytes for %s: %d, must be >= 1", path, n)
+		}
+	}
+	if !StringEmpty(c.TimeZone) {
+		if _, err = time.LoadLocation(*c.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid TimeZone %q: %s", *c.TimeZone, err)
+		}
+	}
+	if !StringEmpty(c.LogLevel) {
+		if _, ok := parseLogLevel(*c.LogLevel); !ok {
+			return nil, fmt.Errorf("invalid LogLevel %q, must be debug, notice or error", *c.LogLevel)
+		}
+	}
+	if c.LogMaxSizeMB < 0 {
+		return nil, fmt.Errorf("invalid LogMaxSizeMB %d", c.LogMaxSizeMB)
+	}
+	if c.ShutdownDrainSeconds < 0 {
+		return nil, fmt.Errorf("invalid ShutdownDrainSeconds %d", c.ShutdownDrainSeconds)
+	}
+	if c.LogMaxFiles < 0 {
+		return nil, fmt.Errorf("invalid LogMaxFiles %d", c.LogMaxFiles)
+	}
+	if c.WordsPerMinute < 0 {
+		return nil, fmt.Errorf("invalid WordsPerMinute %d", c.WordsPerMinute)
+	}
+	if c.SmtpPort < 0 || c.SmtpPort > 65535 {
+		return nil, fmt.Errorf("invalid SmtpPort %d", c.SmtpPort)
+	}
+	if !StringEmpty(c.EmailFrom) && normalizeEmail(*c.EmailFrom) == "" {
+		return nil, fmt.Errorf("invalid EmailFrom %q", *c.EmailFrom)
+	}
+	if !inProduction {
+		c.AnalyticsCode = &emptyString
+	}
+	// TODO: somehow verify twitter creds
+	return c, nil
+}
+
+// reads the configuration file from the path specified by
+// the config command line flag.
+func readConfig(configFile string) error {
+	d, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	c, err := parseConfig(d)
+	if err != nil {
+		return err
+	}
+	cookieAuthKey, _ = hex.DecodeString(*c.CookieAuthKeyHexStr)
+	cookieEncrKey, _ = hex.DecodeString(*c.CookieEncrKeyHexStr)
+	// we expire logins ourselves (see sessionTTL())
+	secureCookie = securecookie.New(cookieAuthKey, cookieEncrKey).MaxAge(0)
+	oauthClient.Credentials = *c.TwitterOAuthCredentials
+	setConfig(c)
+	return nil
+}
+
+// returns names of fields that differ between old and new config
+func diffConfigs(old, new *Config) []string {
+	var res []string
+	vOld := reflect.ValueOf(old).Elem()
+	vNew := reflect.ValueOf(new).Elem()
+	for i := 0; i < vOld.NumField(); i++ {
+		if !reflect.DeepEqual(vOld.Field(i).Interface(), vNew.Field(i).Interface()) {
+			res = append(res, vOld.Type().Field(i).Name)
+		}
+	}
+	return res
+}
+
+// result of reloading config. We only tell which fields changed and not
+// their values because most are secrets
+type ConfigReload struct {
+	Changed         []string
+	RequiresRestart []string
+}
+
+func (r *ConfigReload) String() string {
+	if len(r.Changed) == 0 && len(r.RequiresRestart) == 0 {
+		return "config reloaded, nothing changed"
+	}
+	s := fmt.Sprintf("config reloaded, changed: %s", strings.Join(r.Changed, ", "))
+	if len(r.RequiresRestart) > 0 {
+		s += fmt.Sprintf("; changes that require restart: %s", strings.Join(r.RequiresRestart, ", "))
+	}
+	return s
+}
+
+// re-reads config file. If it's not valid, the current config is kept
+func reloadConfig(configFile string) (*ConfigReload, error) {
+	d, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	old := getConfig()
+	res := &ConfigReload{}
+	vOld := reflect.ValueOf(old).Elem()
+	vNew := reflect.ValueOf(c).Elem()
+	for _, name := range diffConfigs(old, c) {
+		if stringInSlice(configFieldsRequiringRestart, name) {
+			vNew.FieldByName(name).Set(vOld.FieldByName(name))
+			res.RequiresRestart = append(res.RequiresRestart, name)
+		} else {
+			res.Changed = append(res.Changed, name)
+		}
+	}
+	setConfig(c)
+	return res, nil
+}
+
+func reloadConfigAndLog(configFile string) (*ConfigReload, error) {
+	res, err := reloadConfig(configFile)
+	if err != nil {
+		logger.Errorf("reloadConfig() of %s failed with %s, keeping the current config", configFile, err)
+		return nil, err
+	}
+	logger.Noticef("%s", res)
+	if stringInSlice(res.Changed, "LogLevel") {
+		applyConfigLogLevel()
+	}
+	for _, name := range configFieldsInArticlesCache {
+		if stringInSlice(res.Changed, name) && store != nil {
+			// through the rebuilder so that a re-build with the old
+			// config can't finish after this one. Pages served after
+			// reload already use the new config
+			articlesCacheRebuilder.request()
+			articlesCacheRebuilder.wait()
+			break
+		}
+	}
+	return res, nil
+}
+
+// sets threshold of logger to LogLevel in config
+func applyConfigLogLevel() {
+	lvl, _ := parseLogLevel(stringOrEmpty(getConfig().LogLevel))
+	logger.SetLevel(lvl)
+}
+
+// re-reads config on SIGHUP until done is closed
+func reloadConfigOnSighup(done chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			reloadConfigAndLog(configPath)
+		case <-done:
+			return
+		}
+	}
+}
+
+// POST /app/reload-config
+func handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	res, err := reloadConfigAndLog(configPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusBadRequest)
+		return
+	}
+	textResponse(w, r, res.String())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// /api/ urls can be called from pages on other origins listed in
+// CorsAllowedOrigins in config.json (e.g. "https://admin.example.com").
+// Allowed origins are reflected in Access-Control-Allow-Origin together
+// with Access-Control-Allow-Credentials so that the session cookie and
+// X-CSRF-Token header work. Preflight from other origins gets 403.
+// Other urls don't send CORS headers.
+
+const (
+	corsAllowMethods = "GET, POST, OPTIONS"
+	corsMaxAgeSecs   = "600"
+)
+
+var corsAllowHeaders = "Content-Type, " + csrfHeader
+
+// origin is scheme://host[:port], without path
+func isValidCorsOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+func isCorsAllowedOrigin(origin string) bool {
+	for _, allowed := range getConfig().CorsAllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wraps handler of /api/ url
+func withCors(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if origin != "" {
+			h.Add("Vary", "Origin")
+		}
+		allowed := origin != "" && isCorsAllowedOrigin(origin)
+		if allowed {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method != "OPTIONS" {
+			fn(w, r)
+			return
+		}
+		if origin != "" && !allowed {
+			logger.Noticef("withCors(): preflight of %s from not allowed origin %q", r.URL.Path, origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		h.Set("Allow", corsAllowMethods)
+		if origin != "" {
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			h.Set("Access-Control-Max-Age", corsMaxAgeSecs)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// If CrashArchiveDays is set in config.json, crash report files older than
+// that many days are moved to the backup target (e.g. s3, where a lifecycle
+// rule can move crashArchiveDir to a cheaper storage class). Reports of each
+// day are bundled in a tar.gz (encrypted if BackupEncryptionKeyHexStr is
+// set), uploaded to crashArchiveDir (private even if S3BackupPublicRead is
+// set) and then deleted locally. The index
+// remembers the archive and the offset of the report in its uncompressed
+// tar (A line) so that admin can fetch it back on the crash page. Fetched
+// reports are cached in blobs_crashes.
+//
+// Bundles are built in crash_archive directory (next to blobs_crashes) and
+// deleted after they were uploaded and A lines were written. Bundles left
+// over by an interrupted run are uploaded again by the next run, so it's
+// safe to stop archiving at any point. Starred crashes are not archived.
+
+const crashArchiveDir = "crash_archive"
+
+// encrypted archives have this added to the name
+const crashArchiveEncryptedExt = ".enc"
+
+// tar header size, data of files is padded to the same size
+const tarBlockSize = 512
+
+func crashArchiveEnabled() bool {
+	return getConfig().CrashArchiveDays > 0
+}
+
+func crashArchiveSpoolDir(dataDir string) string {
+	return filepath.Join(dataDir, "crash_archive")
+}
+
+func (c *Crash) IsArchived() bool {
+	return c.Archive != ""
+}
+
+// A/vs1mJI02u0HBsHPceGfxy/Q+JE|crash_archive/2017-01-02-3f2a9c1b.tar.gz|1536
+func serCrashArchiveLine(c *Crash) string {
+	return serCrashSha1ValueLine('A', c, fmt.Sprintf("%s|%d", c.Archive, c.ArchiveOffset))
+}
+
+type crashArchiveLocation struct {
+	Archive string
+	Offset  int64
+}
+
+func parseCrashArchiveLine(line []byte) ([20]byte, crashArchiveLocation) {
+	sha1, val := parseCrashSha1ValueLine(line)
+	idx := strings.LastIndexByte(val, '|')
+	if idx == -1 {
+		panic("invalid crash archive line")
+	}
+	offset, err := strconv.ParseInt(val[idx+1:], 10, 64)
+	if err != nil {
+		panic("invalid offset in crash archive line")
+	}
+	return sha1, crashArchiveLocation{Archive: val[:idx], Offset: offset}
+}
+
+// returns crashes whose report files should be archived, by day. Crashes
+// with the same content share the report file so only one of them is
+// returned and only if all of them are old enough
+func crashesToArchive(crashes []*Crash, now time.Time, days int) map[string][]*Crash {
+	cutoff := now.AddDate(0, 0, -days)
+	keep := make(map[[20]byte]bool)
+	for _, c := range crashes {
+		if c.IsStarred || !c.CreatedOn.Before(cutoff) {
+			keep[c.Sha1] = true
+		}
+	}
+	res := make(map[string][]*Crash)
+	seen := make(map[[20]byte]bool)
+	for _, c := range crashes {
+		if c.IsPruned || c.IsArchived() || keep[c.Sha1] || seen[c.Sha1] {
+			continue
+		}
+		seen[c.Sha1] = true
+		day := c.CreatedOnDay()
+		res[day] = append(res[day], c)
+	}
+	return res
+}
+
+// writes report files of crashes to ${dir}/${day}-${sha1 prefix}.tar.gz and
+// returns its path. Each file is named by hex sha1 of the crash
+func (s *StoreCrashes) buildCrashArchive(dir, day string, crashes []*Crash) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmpPath := filepath.Join(dir, day+".tar.gz.tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, c := range crashes {
+		var d []byte
+		d, err = ioutil.ReadFile(s.MessageFilePath(c.Sha1[:]))
+		if err != nil {
+			break
+		}
+		// ustar so that offsets of files are easy to calculate, see
+		// readCrashArchiveEntries()
+		hdr := &tar.Header{
+			Name:    hex.EncodeToString(c.Sha1[:]),
+			Mode:    0644,
+			Size:    int64(len(d)),
+			ModTime: c.CreatedOn,
+			Format:  tar.FormatUSTAR,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(d); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	var dst, sha1 string
+	if err == nil {
+		sha1, err = u.Sha1HexOfFile(tmpPath)
+	}
+	if err == nil {
+		dst = filepath.Join(dir, day+"-"+sha1[:8]+".tar.gz")
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return dst, nil
+}
+
+type crashArchiveEntry struct {
+	Sha1 [20]byte
+	// of the tar header in uncompressed tar
+	Offset int64
+}
+
+// returns files in tar.gz at path with their offsets
+func readCrashArchiveEntries(path string) ([]crashArchiveEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	var res []crashArchiveEntry
+	var offset int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sha1, err := hex.DecodeString(hdr.Name)
+		if err != nil || len(sha1) != 20 || hdr.Format&tar.FormatUSTAR == 0 {
+			return nil, fmt.Errorf("unexpected file %q in %s", hdr.Name, path)
+		}
+		e := crashArchiveEntry{Offset: offset}
+		copy(e.Sha1[:], sha1)
+		res = append(res, e)
+		offset += tarBlockSize + (hdr.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+	}
+}
+
+// path of local archive in backup target
+func crashArchiveRemotePath(localPath string, key []byte) string {
+	res := path.Join(crashArchiveDir, filepath.Base(localPath))
+	if key != nil {
+		res += crashArchiveEncryptedExt
+	}
+	return res
+}
+
+// returns an error unless remotePath is in t and has the expected size
+func checkCrashArchiveUploaded(t BackupTarget, localPath, remotePath string, key []byte) error {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if key != nil {
+		size += backupEncryptionOverhead
+	}
+	files, err := t.List(crashArchiveDir, false)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Path != remotePath {
+			continue
+		}
+		if f.Size != size {
+			return fmt.Errorf("%s has %d bytes, expected %d", remotePath, f.Size, size)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s wasn't uploaded", remotePath)
+}
+
+// writes A lines for crashes in archive and deletes their report files.
+// Returns number of deleted files and their total size
+func (s *StoreCrashes) markArchived(archive string, entries []crashArchiveEntry) (int, int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	bySha1 := make(map[[20]byte][]*Crash)
+	starred := make(map[[20]byte]bool)
+	for _, c := range s.crashes {
+		bySha1[c.Sha1] = append(bySha1[c.Sha1], c)
+		if c.IsStarred {
+			starred[c.Sha1] = true
+		}
+	}
+	nFiles := 0
+	var nBytes int64
+	for _, e := range entries {
+		crashes := bySha1[e.Sha1]
+		// starred after we started archiving
+		if len(crashes) == 0 || starred[e.Sha1] {
+			continue
+		}
+		// written before deleting the file, like P lines
+		if c := crashes[0]; c.Archive != archive || c.ArchiveOffset != e.Offset {
+			tmp := Crash{Sha1: e.Sha1, Archive: archive, ArchiveOffset: e.Offset}
+			if err := s.appendString(serCrashArchiveLine(&tmp)); err != nil {
+				return nFiles, nBytes, err
+			}
+			for _, c := range crashes {
+				c.Archive, c.ArchiveOffset = archive, e.Offset
+			}
+		}
+		path := s.MessageFilePath(e.Sha1[:])
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			logger.Errorf("StoreCrashes.markArchived(): os.Remove(%s) failed with %s", path, err)
+			continue
+		}
+		nFiles++
+		nBytes += fi.Size()
+	}
+	return nFiles, nBytes, nil
+}
+
+// uploads archive at localPath, marks crashes in it as archived and deletes
+// it. Can be called again if it fails at any point
+func (s *StoreCrashes) uploadCrashArchive(t BackupTarget, key []byte, localPath string) (int, int64, error) {
+	entries, err := readCrashArchiveEntries(localPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	remotePath := crashArchiveRemotePath(localPath, key)
+	// crash reports have install ids and such, they're never public
+	if err = backupPutFileRetry(privateBackupTarget(t), localPath, remotePath, key); err != nil {
+		return 0, 0, err
+	}
+	if err = checkCrashArchiveUploaded(t, localPath, remotePath, key); err != nil {
+		return 0, 0, err
+	}
+	nFiles, nBytes, err := s.markArchived(remotePath, entries)
+	if err != nil {
+		return nFiles, nBytes, err
+	}
+	return nFiles, nBytes, os.Remove(localPath)
+}
+
+// moves report files older than days to t, first finishing archives left
+// over by an interrupted run. Returns number of archived files and their
+// total size
+func (s *StoreCrashes) Archive(t BackupTarget, key []byte, now time.Time, days int) (int, int64, error) {
+	dir := crashArchiveSpoolDir(s.dataDir)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	if err != nil {
+		return 0, 0, err
+	}
+	nFiles := 0
+	var nBytes int64
+	upload := func(path string) error {
+		n, size, err := s.uploadCrashArchive(t, key, path)
+		nFiles += n
+		nBytes += size
+		return err
+	}
+	for _, path := range paths {
+		logger.Noticef("StoreCrashes.Archive(): resuming upload of %s", path)
+		if err = upload(path); err != nil {
+			return nFiles, nBytes, err
+		}
+	}
+
+	s.Lock()
+	byDay := crashesToArchive(s.crashes, now, days)
+	s.Unlock()
+	var daysToArchive []string
+	for day := range byDay {
+		daysToArchive = append(daysToArchive, day)
+	}
+	sort.Strings(daysToArchive)
+	for _, day := range daysToArchive {
+		path, err := s.buildCrashArchive(dir, day, byDay[day])
+		if err != nil {
+			return nFiles, nBytes, err
+		}
+		if err = upload(path); err != nil {
+			return nFiles, nBytes, err
+		}
+	}
+	return nFiles, nBytes, nil
+}
+
+// reads report of crash c from uncompressed archive
+func readCrashFromArchive(d []byte, c *Crash) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, zr, c.ArchiveOffset); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if name := hex.EncodeToString(c.Sha1[:]); hdr.Name != name {
+		return nil, fmt.Errorf("expected %s at offset %d of %s, found %s", name, c.ArchiveOffset, c.Archive, hdr.Name)
+	}
+	return ioutil.ReadAll(tr)
+}
+
+// downloads report of archived crash c from t and saves it in blobs_crashes
+func (s *StoreCrashes) FetchArchived(t BackupTarget, key []byte, c *Crash) ([]byte, error) {
+	d, err := t.Get(c.Archive)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(c.Archive, crashArchiveEncryptedExt) {
+		if key == nil {
+			return nil, errors.New("archive is encrypted but BackupEncryptionKeyHexStr is not set")
+		}
+		if d, err = decryptBackup(key, d); err != nil {
+			return nil, err
+		}
+	}
+	if d, err = readCrashFromArchive(d, c); err != nil {
+		return nil, err
+	}
+	if !crashFileMatchesSha1(c, d) {
+		return nil, fmt.Errorf("crash report in %s doesn't match sha1 of crash %d", c.Archive, c.Id)
+	}
+	return d, s.writeMessageAsSha1(d, c.Sha1[:])
+}
+
+// archives crash reports older than CrashArchiveDays to backup target
+func archiveCrashes(now time.Time) {
+	config, err := newBackupConfig()
+	if err != nil {
+		logger.Errorf("archiveCrashes(): %s", err)
+		return
+	}
+	defer config.Target.Close()
+	nFiles, nBytes, err := storeCrashes.Archive(config.Target, config.EncryptionKey, now, getConfig().CrashArchiveDays)
+	if err != nil {
+		logger.Errorf("archiveCrashes(): storeCrashes.Archive() failed with %s", err)
+	}
+	logger.Noticef("archiveCrashes(): archived %d crash reports (%d bytes) to %s in %s", nFiles, nBytes, config.Target.Name(), time.Since(now))
+}
+
+// POST /app/crashfetcharchived with crash_id=${crash_id}
+func handleCrashFetchArchived(w http.ResponseWriter, r *http.Request) {
+	crashId, err := strconv.Atoi(getTrimmedFormValue(r, "crash_id"))
+	if err != nil || !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	crash := storeCrashes.GetCrashById(crashId)
+	if crash == nil || !crash.IsArchived() {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	config, err := newBackupConfig()
+	if err == nil {
+		defer config.Target.Close()
+		_, err = storeCrashes.FetchArchived(config.Target, config.EncryptionKey, crash)
+	}
+	if err != nil {
+		logger.RequestErrorf(r, "handleCrashFetchArchived(): %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/app/crashshow?crash_id="+strconv.Itoa(crashId), http.StatusSeeOther)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /app/crashes can be filtered with:
+// ver=${ver} : exact version (as shown on the page)
+// contains=${s} : crashing line or signature contains s (case-insensitive)
+// os=${s} : os contains s (case-insensitive)
+// from=${day}, to=${day} : crashed between those days (inclusive, YYYY-MM-DD)
+// All given filters must match.
+
+const crashesPerPage = 100
+
+type CrashFilter struct {
+	AppName  string
+	Ver      string
+	Contains string
+	Os       string
+	From     string
+	To       string
+}
+
+// one active filter and url of the page without it
+type ActiveCrashFilter struct {
+	Name      string
+	Value     string
+	RemoveUrl string
+}
+
+func isValidDay(s string) bool {
+	_, err := time.Parse("2006-01-02", s)
+	return err == nil
+}
+
+func parseCrashFilter(r *http.Request, appName string) (*CrashFilter, error) {
+	f := &CrashFilter{
+		AppName:  appName,
+		Ver:      getTrimmedFormValue(r, "ver"),
+		Contains: getTrimmedFormValue(r, "contains"),
+		Os:       getTrimmedFormValue(r, "os"),
+		From:     getTrimmedFormValue(r, "from"),
+		To:       getTrimmedFormValue(r, "to"),
+	}
+	if f.From != "" && !isValidDay(f.From) {
+		return f, fmt.Errorf("invalid 'from' date %q, should be YYYY-MM-DD", f.From)
+	}
+	if f.To != "" && !isValidDay(f.To) {
+		return f, fmt.Errorf("invalid 'to' date %q, should be YYYY-MM-DD", f.To)
+	}
+	if f.From != "" && f.To != "" && f.From > f.To {
+		return f, fmt.Errorf("'from' date %s is after 'to' date %s", f.From, f.To)
+	}
+	return f, nil
+}
+
+func (f *CrashFilter) IsEmpty() bool {
+	return f.Ver == "" && f.Contains == "" && f.Os == "" && f.From == "" && f.To == ""
+}
+
+func containsIgnoreCase(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+func (f *CrashFilter) Matches(c *Crash) bool {
+	if f.Ver != "" && f.Ver != c.Version() && f.Ver != *c.ProgramVersion {
+		return false
+	}
+	if f.Contains != "" {
+		sig := ""
+		if c.Signature != nil {
+			sig = *c.Signature
+		}
+		if !containsIgnoreCase(*c.CrashingLine, f.Contains) && !containsIgnoreCase(sig, f.Contains) {
+			return false
+		}
+	}
+	if f.Os != "" && (c.Os == nil || !containsIgnoreCase(*c.Os, f.Os)) {
+		return false
+	}
+	// days are YYYY-MM-DD so can be compared as strings
+	day := c.CreatedOnDay()
+	if f.From != "" && day < f.From {
+		return false
+	}
+	if f.To != "" && day > f.To {
+		return false
+	}
+	return true
+}
+
+func (f *CrashFilter) values() [][2]string {
+	return [][2]string{{"ver", f.Ver}, {"contains", f.Contains}, {"os", f.Os},
+		{"from", f.From}, {"to", f.To}}
+}
+
+// url of the crashes page with this filter minus filter called skip.
+// page is only added if > 1
+func (f *CrashFilter) url(skip string, page int) string {
+	v := url.Values{}
+	v.Set("app_name", f.AppName)
+	for _, nv := range f.values() {
+		if nv[0] != skip && nv[1] != "" {
+			v.Set(nv[0], nv[1])
+		}
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return "/app/crashes?" + v.Encode()
+}
+
+func (f *CrashFilter) Active() []ActiveCrashFilter {
+	var res []ActiveCrashFilter
+	for _, nv := range f.values() {
+		if nv[1] != "" {
+			res = append(res, ActiveCrashFilter{Name: nv[0], Value: nv[1], RemoveUrl: f.url(nv[0], 1)})
+		}
+	}
+	return res
+}
+
+func (f *CrashFilter) PageUrl(page int) string {
+	return f.url("", page)
+}
+
+// returns matching crashes, newest first
+func (s *StoreCrashes) FilterCrashes(app *App, f *CrashFilter) []*Crash {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]*Crash, 0)
+	for i := len(app.Crashes) - 1; i >= 0; i-- {
+		if c := app.Crashes[i]; f.Matches(c) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func showFilteredCrashes(w http.ResponseWriter, r *http.Request, app *App, f *CrashFilter, filterErr error) {
+	var crashes []*Crash
+	errMsg := ""
+	if filterErr != nil {
+		errMsg = filterErr.Error()
+	} else {
+		crashes = storeCrashes.FilterCrashes(app, f)
+	}
+	total := len(crashes)
+	page, err := strconv.Atoi(getTrimmedFormValue(r, "page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	start := (page - 1) * crashesPerPage
+	if start > total {
+		start = total
+	}
+	end := start + crashesPerPage
+	if end > total {
+		end = total
+	}
+	prevUrl, nextUrl := "", ""
+	if page > 1 {
+		prevUrl = f.PageUrl(page - 1)
+	}
+	if end < total {
+		nextUrl = f.PageUrl(page + 1)
+	}
+	model := struct {
+		BasePageModel
+		App        *AppDisplay
+		Filter     *CrashFilter
+		Error      string
+		Crashes    []*Crash
+		TotalCount int
+		First      int
+		Last       int
+		PrevUrl    string
+		NextUrl    string
+	}{
+		BasePageModel: newBasePageModel(r),
+		App:           NewAppDisplay(app, false),
+		Filter:        f,
+		Error:         errMsg,
+		Crashes:       crashes[start:end],
+		TotalCount:    total,
+		First:         start + 1,
+		Last:          end,
+		PrevUrl:       prevUrl,
+		NextUrl:       nextUrl,
+	}
+	ExecTemplate(w, tmplCrashReportsFiltered, model)
+}
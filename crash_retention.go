@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Crash report files are deleted when older than CrashRetentionDays or when
+// an app version has more than MaxCrashesPerVersion crashes (we keep the
+// newest). Index entries are kept (and marked with a P line) so that crash
+// counts stay accurate. Starred crashes are never deleted and don't count
+// towards MaxCrashesPerVersion.
+
+// we prune at a quiet hour (local time of the server)
+const crashPruneHour = 4
+
+func crashRetentionEnabled() bool {
+	c := getConfig()
+	return c.CrashRetentionDays > 0 || c.MaxCrashesPerVersion > 0
+}
+
+// returns crashes whose report files should be deleted. 0 for retentionDays
+// or maxPerVersion means no limit
+func crashesToPrune(crashes []*Crash, now time.Time, retentionDays, maxPerVersion int) []*Crash {
+	var res []*Crash
+	cutoff := now.AddDate(0, 0, -retentionDays)
+	perVersion := make(map[string][]*Crash)
+	for _, c := range crashes {
+		if c.IsPruned || c.IsStarred {
+			continue
+		}
+		if retentionDays > 0 && c.CreatedOn.Before(cutoff) {
+			res = append(res, c)
+			continue
+		}
+		key := c.App.Name + "|" + *c.ProgramVersion
+		perVersion[key] = append(perVersion[key], c)
+	}
+	if maxPerVersion > 0 {
+		for _, arr := range perVersion {
+			if len(arr) <= maxPerVersion {
+				continue
+			}
+			sort.Sort(CrashesByCreatedOn(arr))
+			res = append(res, arr[maxPerVersion:]...)
+		}
+	}
+	return res
+}
+
+// deletes report files of crashes according to retention policy. Returns
+// number of deleted files and their total size
+func (s *StoreCrashes) Prune(now time.Time, retentionDays, maxPerVersion int) (int, int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// crashes with the same content share the report file
+	starred := make(map[[20]byte]bool)
+	for _, c := range s.crashes {
+		if c.IsStarred {
+			starred[c.Sha1] = true
+		}
+	}
+	pruned := make(map[[20]byte]bool)
+	nFiles := 0
+	var nBytes int64
+	for _, c := range crashesToPrune(s.crashes, now, retentionDays, maxPerVersion) {
+		if starred[c.Sha1] || pruned[c.Sha1] {
+			continue
+		}
+		// mark as pruned first so that if we crash before deleting the file
+		// we don't end up with index entry pointing to a missing file
+		if err := s.appendString(serCrashSha1Line('P', c)); err != nil {
+			return nFiles, nBytes, err
+		}
+		pruned[c.Sha1] = true
+		path := s.MessageFilePath(c.Sha1[:])
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			logger.Errorf("StoreCrashes.Prune(): os.Remove(%s) failed with %s", path, err)
+			continue
+		}
+		nFiles++
+		nBytes += fi.Size()
+	}
+	for _, c := range s.crashes {
+		if pruned[c.Sha1] {
+			c.IsPruned = true
+		}
+	}
+	return nFiles, nBytes, nil
+}
+
+func (s *StoreCrashes) SetStarred(crash *Crash, starred bool) error {
+	s.Lock()
+	defer s.Unlock()
+	kind := byte('U')
+	if starred {
+		kind = 'S'
+	}
+	if err := s.appendString(serCrashSha1Line(kind, crash)); err != nil {
+		return err
+	}
+	for _, c := range s.crashes {
+		if c.Sha1 == crash.Sha1 {
+			c.IsStarred = starred
+		}
+	}
+	return nil
+}
+
+func durationUntilHour(now time.Time, hour int) time.Duration {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// archives and prunes crash reports once a day, at a quiet hour
+func PruneCrashesLoop(done chan struct{}) {
+	for {
+		select {
+		case <-time.After(durationUntilHour(time.Now(), crashPruneHour)):
+		case <-done:
+			return
+		}
+		// config can change while we run
+		if crashArchiveEnabled() {
+			archiveCrashes(time.Now())
+		}
+		if !crashRetentionEnabled() {
+			continue
+		}
+		timeStart := time.Now()
+		c := getConfig()
+		nFiles, nBytes, err := storeCrashes.Prune(timeStart, c.CrashRetentionDays, c.MaxCrashesPerVersion)
+		if err != nil {
+			logger.Errorf("PruneCrashesLoop(): storeCrashes.Prune() failed with %s", err)
+		}
+		logger.Noticef("PruneCrashesLoop(): deleted %d crash reports, reclaimed %d bytes in %s", nFiles, nBytes, time.Since(timeStart))
+	}
+}
+
+// POST /app/crashstar with crash_id=${crash_id}&star=${0 or 1}
+func handleCrashStar(w http.ResponseWriter, r *http.Request) {
+	crashId, err := strconv.Atoi(getTrimmedFormValue(r, "crash_id"))
+	if err != nil || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	crash := storeCrashes.GetCrashById(crashId)
+	if crash == nil || !CanSeeCrashes(r, crash.App.Name) {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	if err = storeCrashes.SetStarred(crash, getTrimmedFormValue(r, "star") == "1"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/app/crashshow?crash_id="+strconv.Itoa(crashId), http.StatusSeeOther)
+}
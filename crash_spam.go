@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// /app/crashsubmit and /api/crash/v2 get spam (urls and SEO text) which
+// would show up in crash pages. We only accept submissions that look like
+// crash reports: text with at least one stack frame like
+// 0114C072 01:0004B072 sumatrapdf.exe!CrashMe+0x2 (see linkifyCrashReport)
+// and not many urls. If BlockCrashSpammers is set in config, ip addresses
+// of rejected submissions are remembered in data/crash_spam_ips.txt and
+// their later submissions are rejected too.
+
+const maxCrashReportUrls = 5
+
+var (
+	crashFrameRx = regexp.MustCompile(`(?m)^\s*[0-9A-Fa-f]{8,16} [0-9A-Fa-f]{1,4}:[0-9A-Fa-f]{8,16} \S`)
+	crashUrlRx   = regexp.MustCompile(`(?i)https?://`)
+
+	crashSpamIpsMu sync.Mutex
+	crashSpamIps   = make(map[string]bool)
+)
+
+var errCrashSpammer = errors.New("submissions from this address are blocked")
+
+// returns nil if d looks like a crash report
+func checkCrashReport(d []byte) error {
+	if bytes.IndexByte(d, 0) != -1 || !utf8.Valid(d) {
+		return errors.New("binary content")
+	}
+	if n := len(crashUrlRx.FindAllIndex(d, maxCrashReportUrls+1)); n > maxCrashReportUrls {
+		return fmt.Errorf("more than %d urls", maxCrashReportUrls)
+	}
+	if !crashFrameRx.Match(d) {
+		return errors.New("no stack frames")
+	}
+	return nil
+}
+
+func crashSpamIpsPath() string {
+	return filepath.Join(getDataDir(), "data", "crash_spam_ips.txt")
+}
+
+func blockCrashSpammersEnabled() bool {
+	return getConfig().BlockCrashSpammers
+}
+
+func readCrashSpamIps() {
+	d, err := ioutil.ReadFile(crashSpamIpsPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Errorf("readCrashSpamIps(): %s", err)
+		return
+	}
+	crashSpamIpsMu.Lock()
+	for _, l := range strings.Split(string(d), "\n") {
+		if ip := strings.TrimSpace(l); ip != "" {
+			crashSpamIps[ip] = true
+		}
+	}
+	n := len(crashSpamIps)
+	crashSpamIpsMu.Unlock()
+	logger.Noticef("loaded %d blocked crash spam ips", n)
+}
+
+func isCrashSpammer(ipAddr string) bool {
+	crashSpamIpsMu.Lock()
+	defer crashSpamIpsMu.Unlock()
+	return crashSpamIps[ipAddr]
+}
+
+func blockCrashSpammer(ipAddr string) error {
+	if ipAddr == "" || strings.ContainsAny(ipAddr, "\r\n") {
+		return fmt.Errorf("invalid ip address %q", ipAddr)
+	}
+	// we hold the lock while writing so that the file and the set agree
+	crashSpamIpsMu.Lock()
+	defer crashSpamIpsMu.Unlock()
+	if crashSpamIps[ipAddr] {
+		return nil
+	}
+	f, err := os.OpenFile(crashSpamIpsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", ipAddr)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	crashSpamIps[ipAddr] = true
+	return nil
+}
+
+// returns http status and error if a submission of crash report d from
+// ipAddr should be rejected
+func checkCrashSubmission(r *http.Request, ipAddr string, d []byte) (int, error) {
+	block := blockCrashSpammersEnabled()
+	if block && isCrashSpammer(ipAddr) {
+		appMetrics.RejectedCrashes.Inc(1)
+		return http.StatusForbidden, errCrashSpammer
+	}
+	err := checkCrashReport(d)
+	if err == nil {
+		return http.StatusOK, nil
+	}
+	appMetrics.RejectedCrashes.Inc(1)
+	logger.Noticef("rejected crash report from %s: %s", ipAddr, err)
+	if block {
+		if err := blockCrashSpammer(ipAddr); err != nil {
+			logger.RequestErrorf(r, "checkCrashSubmission(): blockCrashSpammer() failed with %s", err)
+		}
+	}
+	return http.StatusBadRequest, fmt.Errorf("not a crash report: %s", err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/blog/internal/fsutil"
+	"github.com/kjk/u"
+)
+
+// -fsck checks crash reports store: that sha1 of every crash report file
+// matches the crash in crashesdata.txt, crashes whose file is missing and
+// files that no crash refers to. With -repair, files that don't match their
+// sha1 are moved to quarantine_crashes directory.
+// -compact re-writes crashesdata.txt with one line per crash and piece of
+// information about it (dropping e.g. stars that were removed later).
+// Both must be run when the server is not running.
+
+type FsckReport struct {
+	Checked int
+	// paths of files whose content doesn't match their sha1
+	Corrupt []string
+	// paths of files of crashes that don't exist
+	Missing []string
+	// paths of files no crash refers to
+	Dangling    []string
+	Quarantined int
+}
+
+func (r *FsckReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "checked %d crash reports\n", r.Checked)
+	for _, p := range r.Corrupt {
+		fmt.Fprintf(&b, "corrupt: %s\n", p)
+	}
+	for _, p := range r.Missing {
+		fmt.Fprintf(&b, "missing: %s\n", p)
+	}
+	for _, p := range r.Dangling {
+		fmt.Fprintf(&b, "dangling: %s\n", p)
+	}
+	fmt.Fprintf(&b, "corrupt: %d, missing: %d, dangling: %d, quarantined: %d\n", len(r.Corrupt), len(r.Missing), len(r.Dangling), r.Quarantined)
+	return b.String()
+}
+
+func (r *FsckReport) HasErrors() bool {
+	return len(r.Corrupt) > 0 || len(r.Missing) > 0 || len(r.Dangling) > 0
+}
+
+func quarantineCrashesDir(dataDir string) string {
+	return filepath.Join(dataDir, "quarantine_crashes")
+}
+
+// reads crashesdata.txt without checking crash report files
+func loadStoreCrashesIndex(dataDir string) (*StoreCrashes, error) {
+	s := newEmptyStoreCrashes(dataDir)
+	path := crashesDataPath(dataDir)
+	exists, err := fsutil.PathExists(path)
+	if err != nil || !exists {
+		return s, err
+	}
+	return s, s.readExistingCrashesData(path)
+}
+
+// sha1 of a crash is of its file prefixed with getCrashPrefixData(), which
+// has the time in local time zone when it was saved. We also try UTC in case
+// the server's time zone changed since
+func crashFileMatchesSha1(c *Crash, d []byte) bool {
+	for _, loc := range []*time.Location{time.Local, time.UTC} {
+		tmp := *c
+		tmp.CreatedOn = c.CreatedOn.In(loc)
+		var buf bytes.Buffer
+		buf.Write(getCrashPrefixData(&tmp))
+		buf.Write(d)
+		if bytes.Equal(u.Sha1OfBytes(buf.Bytes()), c.Sha1[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func fsckCrashes(dataDir string, repair bool) (*FsckReport, error) {
+	s, err := loadStoreCrashesIndex(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	res := &FsckReport{}
+	// crash report files that should exist
+	referenced := make(map[string]bool)
+	for _, c := range s.crashes {
+		path := s.MessageFilePath(c.Sha1[:])
+		if c.IsArchived() {
+			// the file, if it exists, was fetched from the archive
+			referenced[path] = true
+			continue
+		}
+		if c.IsPruned || referenced[path] {
+			continue
+		}
+		referenced[path] = true
+		d, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			res.Missing = append(res.Missing, path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Checked++
+		if crashFileMatchesSha1(c, d) {
+			continue
+		}
+		res.Corrupt = append(res.Corrupt, path)
+		if !repair {
+			continue
+		}
+		dst := filepath.Join(quarantineCrashesDir(dataDir), filepath.Base(path))
+		if err = fsutil.CreateDirForFile(dst); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(path, dst); err != nil {
+			return nil, err
+		}
+		res.Quarantined++
+	}
+
+	blobsDir := filepath.Join(dataDir, "blobs_crashes")
+	err = filepath.Walk(blobsDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == blobsDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !referenced[path] {
+			res.Dangling = append(res.Dangling, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// returns crashesdata.txt with only the lines needed to describe crashes
+func serCrashesCompacted(s *StoreCrashes) []byte {
+	var b bytes.Buffer
+	for _, c := range s.crashes {
+		b.WriteString(serCrash(c))
+		if c.IsPruned {
+			b.WriteString(serCrashSha1Line('P', c))
+		}
+		if c.IsStarred {
+			b.WriteString(serCrashSha1Line('S', c))
+		}
+		if c.Signature != nil {
+			b.WriteString(serCrashIdValueLine('g', c, *c.Signature))
+		}
+		if c.Os != nil {
+			b.WriteString(serCrashIdValueLine('o', c, *c.Os))
+		}
+		if c.InstallId != nil {
+			b.WriteString(serCrashIdValueLine('i', c, *c.InstallId))
+		}
+		if c.IsArchived() {
+			b.WriteString(serCrashArchiveLine(c))
+		}
+	}
+	return b.Bytes()
+}
+
+// re-writes crashesdata.txt. Returns its size before and after
+func compactCrashes(dataDir string) (int64, int64, error) {
+	path := crashesDataPath(dataDir)
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	s, err := loadStoreCrashesIndex(dataDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	d := serCrashesCompacted(s)
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return 0, 0, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return 0, 0, err
+	}
+	return st.Size(), int64(len(d)), nil
+}
+
+// runs -fsck or -compact. Returns exit code. The caller must hold the lock
+// of data directory
+func runCrashesMaintenance(fsck, repair, compact bool) int {
+	dir := getDataDir()
+	if fsck {
+		res, err := fsckCrashes(dir, repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fsck failed: %s\n", err)
+			return 1
+		}
+		fmt.Print(res.String())
+		if res.HasErrors() && !repair {
+			return 1
+		}
+	}
+	if compact {
+		before, after, err := compactCrashes(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "compact failed: %s\n", err)
+			return 1
+		}
+		fmt.Printf("compacted %s: %d => %d bytes, reclaimed %d bytes\n", crashesDataPath(dir), before, after, before-after)
+	}
+	return 0
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/go-oauth/oauth"
+)
+
+// When a public article is published, we post its title and url to
+// Mastodon (if MastodonInstanceUrl and MastodonAccessToken are set in
+// config.json) and Twitter (if TwitterPostingCredentials are set).
+// What we posted is remembered in data/crossposts.json, together with ids
+// of articles we've seen, so that editing an article or restarting doesn't
+// post it again. When there's no file, all current articles are treated as
+// already posted. A failed post is re-tried maxCrosspostTries times, after
+// that it's shown on /app/dashboard where it can be re-tried. Posts that
+// were in progress when the server stopped are marked failed and not
+// re-tried automatically, so that we never post twice.
+// Url of the Mastodon status is shown on the article page.
+
+const (
+	crosspostMastodon = "mastodon"
+	crosspostTwitter  = "twitter"
+
+	maxCrosspostTries = 4
+	// longer titles are cut so that the post fits in 280 chars
+	crosspostMaxTitleChars = 200
+	twitterUpdateUrl       = "https://api.twitter.com/1.1/statuses/update.json"
+)
+
+var (
+	// wait before re-trying a failed post, doubled after every try.
+	// Changed in tests
+	crosspostBackoff = time.Minute
+	crosspostClient  = &http.Client{Timeout: 30 * time.Second}
+	// posts text to service, returns url of the post. Changed in tests
+	postCrosspost = postToService
+)
+
+// Crosspost is an article posted (or being posted) to a service
+type Crosspost struct {
+	ArticleId int
+	Service   string
+	Text      string
+	// url of the post, set when it was posted
+	Url   string
+	Tries int
+	// error of the last try, set when we gave up
+	Error string
+	// of the last try
+	Time time.Time
+}
+
+func (p *Crosspost) IsPending() bool {
+	return p.Url == "" && p.Error == ""
+}
+
+type Crossposts struct {
+	sync.Mutex
+	path string
+	// ids of articles that were posted (or existed before we started
+	// posting them)
+	seen  map[int]bool
+	posts []*Crosspost
+}
+
+// how Crossposts are stored in crossposts.json
+type crosspostsFile struct {
+	SeenArticleIds []int
+	Posts          []*Crosspost
+}
+
+// nil until readCrossposts() is called
+var crossposts *Crossposts
+
+func crosspostsPath() string {
+	return filepath.Join(getDataDir(), "data", "crossposts.json")
+}
+
+func loadCrossposts(path string) (*Crossposts, error) {
+	c := &Crossposts{path: path, seen: make(map[int]bool)}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f crosspostsFile
+	if err = json.Unmarshal(d, &f); err != nil {
+		return nil, err
+	}
+	for _, id := range f.SeenArticleIds {
+		c.seen[id] = true
+	}
+	for _, p := range f.Posts {
+		if p.IsPending() {
+			p.Error = "server stopped while posting, it might have been posted"
+		}
+		c.posts = append(c.posts, p)
+	}
+	return c, nil
+}
+
+func readCrossposts() {
+	c, err := loadCrossposts(crosspostsPath())
+	if err != nil {
+		logger.Errorf("readCrossposts(): %s", err)
+		return
+	}
+	crossposts = c
+}
+
+// must be called with c locked
+func (c *Crossposts) save() error {
+	f := crosspostsFile{Posts: c.posts}
+	for id := range c.seen {
+		f.SeenArticleIds = append(f.SeenArticleIds, id)
+	}
+	sort.Ints(f.SeenArticleIds)
+	d, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// must be called with c locked
+func (c *Crossposts) find(articleId int, service string) *Crosspost {
+	for _, p := range c.posts {
+		if p.ArticleId == articleId && p.Service == service {
+			return p
+		}
+	}
+	return nil
+}
+
+// remembers public articles not seen before and adds posts of them to
+// services. Returns copies of added posts (none the first time, when we
+// didn't know any articles)
+func (c *Crossposts) addNew(articles []*Article, services []string) ([]Crosspost, error) {
+	c.Lock()
+	defer c.Unlock()
+	first := len(c.seen) == 0
+	var res []Crosspost
+	nNew := 0
+	for _, a := range articles {
+		if a.IsDraft || a.IsDeleted || a.IsPrivate || c.seen[a.Id] {
+			continue
+		}
+		c.seen[a.Id] = true
+		nNew++
+		if first {
+			continue
+		}
+		for _, service := range services {
+			p := &Crosspost{ArticleId: a.Id, Service: service, Text: crosspostText(a)}
+			c.posts = append(c.posts, p)
+			res = append(res, *p)
+		}
+	}
+	if nNew == 0 {
+		return nil, nil
+	}
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// calls fn with the post to change it and saves. Returns false if there's
+// no such post
+func (c *Crossposts) update(articleId int, service string, fn func(p *Crosspost)) bool {
+	c.Lock()
+	defer c.Unlock()
+	p := c.find(articleId, service)
+	if p == nil {
+		return false
+	}
+	fn(p)
+	if err := c.save(); err != nil {
+		logger.Errorf("Crossposts.update(): %s", err)
+	}
+	return true
+}
+
+// returns a copy of the post, nil if there's none
+func (c *Crossposts) Get(articleId int, service string) *Crosspost {
+	c.Lock()
+	defer c.Unlock()
+	p := c.find(articleId, service)
+	if p == nil {
+		return nil
+	}
+	res := *p
+	return &res
+}
+
+// returns copies of posts we gave up on, the newest first
+func (c *Crossposts) Failed() []Crosspost {
+	c.Lock()
+	defer c.Unlock()
+	var res []Crosspost
+	for _, p := range c.posts {
+		if p.Error != "" {
+			res = append(res, *p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.After(res[j].Time)
+	})
+	return res
+}
+
+// marks a failed post as pending again. Returns its copy, nil if there's
+// no such failed post
+func (c *Crossposts) Retry(articleId int, service string) *Crosspost {
+	var res *Crosspost
+	c.update(articleId, service, func(p *Crosspost) {
+		if p.Error == "" {
+			return
+		}
+		p.Error = ""
+		p.Tries = 0
+		cp := *p
+		res = &cp
+	})
+	return res
+}
+
+func crosspostText(a *Article) string {
+	title := a.Title
+	if r := []rune(title); len(r) > crosspostMaxTitleChars {
+		title = string(r[:crosspostMaxTitleChars-1]) + "…"
+	}
+	return title + " " + absURL(a.Permalink())
+}
+
+func mastodonEnabled(c *Config) bool {
+	return !StringEmpty(c.MastodonInstanceUrl) && !StringEmpty(c.MastodonAccessToken)
+}
+
+func twitterPostingEnabled(c *Config) bool {
+	cred := c.TwitterPostingCredentials
+	return cred != nil && cred.Token != "" && cred.Secret != ""
+}
+
+// services we post new articles to
+func crosspostServices() []string {
+	c := getConfig()
+	var res []string
+	if mastodonEnabled(c) {
+		res = append(res, crosspostMastodon)
+	}
+	if twitterPostingEnabled(c) {
+		res = append(res, crosspostTwitter)
+	}
+	return res
+}
+
+func postToService(service, text string, articleId int) (string, error) {
+	c := getConfig()
+	switch service {
+	case crosspostMastodon:
+		if !mastodonEnabled(c) {
+			return "", fmt.Errorf("MastodonInstanceUrl or MastodonAccessToken not set")
+		}
+		// makes re-tries safe if a post succeeded but we didn't get
+		// the response
+		key := "blog-article-" + strconv.Itoa(articleId)
+		return postToMastodon(*c.MastodonInstanceUrl, *c.MastodonAccessToken, key, text)
+	case crosspostTwitter:
+		if !twitterPostingEnabled(c) {
+			return "", fmt.Errorf("TwitterPostingCredentials not set")
+		}
+		return postToTwitter(c.TwitterPostingCredentials, text)
+	}
+	return "", fmt.Errorf("unknown service %q", service)
+}
+
+func readCrosspostResponse(rsp *http.Response, v interface{}) error {
+	defer rsp.Body.Close()
+	d, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		if len(d) > 256 {
+			d = d[:256]
+		}
+		return fmt.Errorf("%s returned %s, %s", rsp.Request.URL, rsp.Status, d)
+	}
+	return json.Unmarshal(d, v)
+}
+
+// returns url of the status
+func postToMastodon(instanceUrl, token, idempotencyKey, text string) (string, error) {
+	v := url.Values{}
+	v.Set("status", text)
+	v.Set("visibility", "public")
+	uri := strings.TrimSuffix(instanceUrl, "/") + "/api/v1/statuses"
+	req, err := http.NewRequest("POST", uri, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	rsp, err := crosspostClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	var status struct {
+		Url string `json:"url"`
+	}
+	if err = readCrosspostResponse(rsp, &status); err != nil {
+		return "", err
+	}
+	return status.Url, nil
+}
+
+// returns url of the tweet
+func postToTwitter(cred *oauth.Credentials, text string) (string, error) {
+	params := url.Values{}
+	params.Set("status", text)
+	oauthClient.SignParam(cred, "POST", twitterUpdateUrl, params)
+	rsp, err := crosspostClient.PostForm(twitterUpdateUrl, params)
+	if err != nil {
+		return "", err
+	}
+	var tweet struct {
+		IdStr string `json:"id_str"`
+		User  struct {
+			ScreenName string `json:"screen_name"`
+		} `json:"user"`
+	}
+	if err = readCrosspostResponse(rsp, &tweet); err != nil {
+		return "", err
+	}
+	return "https://twitter.com/" + tweet.User.ScreenName + "/status/" + tweet.IdStr, nil
+}
+
+// posts p, re-trying with backoff if it fails. Returns true if it
+// succeeded
+func crosspostWithRetries(c *Crossposts, p Crosspost) bool {
+	backoff := crosspostBackoff
+	for try := 1; ; try++ {
+		postUrl, err := postCrosspost(p.Service, p.Text, p.ArticleId)
+		c.update(p.ArticleId, p.Service, func(p *Crosspost) {
+			p.Tries++
+			p.Time = time.Now()
+			if err == nil {
+				p.Url = postUrl
+			} else if try == maxCrosspostTries {
+				p.Error = err.Error()
+			}
+		})
+		if err == nil {
+			logger.Noticef("crosspostWithRetries(): posted article %d to %s: %s", p.ArticleId, p.Service, postUrl)
+			return true
+		}
+		if try == maxCrosspostTries {
+			logger.Errorf("crosspostWithRetries(): giving up on posting article %d to %s after %d tries, last error: %s", p.ArticleId, p.Service, try, err)
+			return false
+		}
+		logger.Noticef("crosspostWithRetries(): posting article %d to %s failed with %s, re-trying in %s", p.ArticleId, p.Service, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// posts public articles we haven't seen before. Posting happens in the
+// background. Called after articles are (re)loaded
+func crosspostNewArticles(articles []*Article) {
+	c := crossposts
+	if c == nil {
+		return
+	}
+	// articles published while posting was off are not posted when it's
+	// turned on
+	var services []string
+	if !getConfig().DisableOutboundPings {
+		services = crosspostServices()
+	}
+	posts, err := c.addNew(articles, services)
+	if err != nil {
+		logger.Errorf("crosspostNewArticles(): %s", err)
+	}
+	for _, p := range posts {
+		go crosspostWithRetries(c, p)
+	}
+}
+
+// url of the Mastodon status about the article, "" if it wasn't posted
+func (a *Article) MastodonUrl() string {
+	if crossposts == nil {
+		return ""
+	}
+	if p := crossposts.Get(a.Id, crosspostMastodon); p != nil {
+		return p.Url
+	}
+	return ""
+}
+
+// POST /app/crosspost/retry
+// id      : ${articleId}
+// service : mastodon or twitter
+func handleCrosspostRetry(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	var p *Crosspost
+	if crossposts != nil {
+		p = crossposts.Retry(id, r.FormValue("service"))
+	}
+	if p == nil {
+		serveFieldError(w, r, "id", "no failed post of article with that id")
+		return
+	}
+	logger.Noticef("handleCrosspostRetry(): re-trying posting article %d to %s", id, p.Service)
+	go crosspostWithRetries(crossposts, *p)
+	http.Redirect(w, r, "/app/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// POSTs of logged in users must have a token that's only known to our pages
+// so that other sites can't make them on user's behalf. The token is made
+// at login and stored in the secure cookie. Forms send it in csrf_token
+// field, javascript can send it in X-CSRF-Token header instead. A new
+// login (or logout) changes the token, so forms shown before then are
+// rejected with a page that lets the user re-submit what they typed.
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+func newCsrfToken() string {
+	d := make([]byte, 16)
+	if _, err := rand.Read(d); err != nil {
+		logger.Errorf("newCsrfToken(): rand.Read() failed with %s", err)
+	}
+	return hex.EncodeToString(d)
+}
+
+func requestCsrfToken(r *http.Request) string {
+	if s := r.Header.Get(csrfHeader); s != "" {
+		return s
+	}
+	return r.FormValue(csrfFormField)
+}
+
+// true for calls from javascript, which don't need a html page as a response
+func isApiRequest(r *http.Request) bool {
+	return r.Header.Get(csrfHeader) != "" || strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") || r.Header.Get("X-Requested-With") == "XMLHttpRequest"
+}
+
+type csrfFormValue struct {
+	Name  string
+	Value string
+}
+
+// returns true if POST r has a valid csrf token. If not, it's logged and we
+// respond with 403
+func checkCsrf(w http.ResponseWriter, r *http.Request) bool {
+	expected := getSecureCookie(r).CsrfToken
+	got := requestCsrfToken(r)
+	if expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1 {
+		return true
+	}
+	logger.Noticef("checkCsrf(): warning: rejected POST to %s from %s with invalid csrf token, referer: %q", r.URL.Path, getIpAddress(r), r.Referer())
+	if isApiRequest(r) {
+		serveJsonError(w, r, http.StatusForbidden, csrfFormField, "invalid csrf token")
+		return false
+	}
+
+	// show what was submitted so that it can be re-submitted with the
+	// current token
+	var values []csrfFormValue
+	for name, vals := range r.Form {
+		if name == csrfFormField {
+			continue
+		}
+		for _, v := range vals {
+			values = append(values, csrfFormValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+	model := struct {
+		BasePageModel
+		Action string
+		Values []csrfFormValue
+	}{
+		BasePageModel: newBasePageModel(r),
+		Action:        r.URL.RequestURI(),
+		Values:        values,
+	}
+	w.WriteHeader(http.StatusForbidden)
+	ExecTemplate(w, tmplCsrfExpired, model)
+	return false
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// /app/dashboard shows an overview of traffic for the admin. The data is
+// only kept in memory and is updated for each request in newTimingHandler
+
+const (
+	// we keep request counts for that many hours
+	dashboardHours = 24
+	// max number of urls for which we remember latencies. When exceeded,
+	// the least recently requested url is dropped
+	dashboardMaxUrls = 1000
+	// how many latencies we remember per url
+	dashboardSamplesPerUrl = 100
+	// how many urls / 404s we show
+	dashboardTopN = 20
+)
+
+type hourCount struct {
+	// hours since unix epoch
+	Hour  int64
+	Count int
+	// Count by traffic class (see traffic_class.go)
+	Classes map[trafficClass]int
+}
+
+// latest latencies of a given url, in a ring buffer
+type urlLatencies struct {
+	Url      string
+	Count    int
+	Samples  [dashboardSamplesPerUrl]time.Duration
+	LastSeen time.Time
+}
+
+type TrafficStats struct {
+	sync.Mutex
+	// indexed by hour % dashboardHours
+	Hours [dashboardHours]hourCount
+	Urls  map[string]*urlLatencies
+}
+
+var trafficStats = NewTrafficStats()
+
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{Urls: make(map[string]*urlLatencies)}
+}
+
+func unixHour(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+func (s *TrafficStats) dropLeastRecent() {
+	var least *urlLatencies
+	for _, u := range s.Urls {
+		if least == nil || u.LastSeen.Before(least.LastSeen) {
+			least = u
+		}
+	}
+	if least != nil {
+		delete(s.Urls, least.Url)
+	}
+}
+
+// status is the http status of the response. Latencies of 404s are not
+// remembered because random urls would push out the real ones, latencies
+// of requests from the admin and bots because they'd skew the stats
+func (s *TrafficStats) Add(url string, class trafficClass, status int, dur time.Duration, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	hour := unixHour(now)
+	hc := &s.Hours[hour%dashboardHours]
+	if hc.Hour < hour {
+		hc.Hour = hour
+		hc.Count = 0
+		hc.Classes = make(map[trafficClass]int)
+	}
+	// if hc.Hour > hour, now is over a day old and is not counted
+	if hc.Hour == hour {
+		hc.Count++
+		hc.Classes[class]++
+	}
+
+	if status == http.StatusNotFound || class != trafficHuman {
+		return
+	}
+	u := s.Urls[url]
+	if u == nil {
+		if len(s.Urls) >= dashboardMaxUrls {
+			s.dropLeastRecent()
+		}
+		u = &urlLatencies{Url: url}
+		s.Urls[url] = u
+	}
+	u.Samples[u.Count%dashboardSamplesPerUrl] = dur
+	u.Count++
+	u.LastSeen = now
+}
+
+type RequestsInHour struct {
+	Hour  string `json:"hour"`
+	Count int    `json:"count"`
+	Human int    `json:"human"`
+	Admin int    `json:"admin"`
+	Bot   int    `json:"bot"`
+}
+
+// returns request counts for the last dashboardHours hours, oldest first
+func (s *TrafficStats) RequestsPerHour(now time.Time) []RequestsInHour {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]RequestsInHour, 0, dashboardHours)
+	curr := unixHour(now)
+	for h := curr - dashboardHours + 1; h <= curr; h++ {
+		t := time.Unix(h*3600, 0).UTC()
+		rh := RequestsInHour{Hour: t.Format("2006-01-02 15:00")}
+		if hc := s.Hours[h%dashboardHours]; hc.Hour == h {
+			rh.Count = hc.Count
+			rh.Human = hc.Classes[trafficHuman]
+			rh.Admin = hc.Classes[trafficAdmin]
+			rh.Bot = hc.Classes[trafficBot]
+		}
+		res = append(res, rh)
+	}
+	return res
+}
+
+type UrlLatency struct {
+	Url   string  `json:"url"`
+	Count int     `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+}
+
+type UrlLatencyByP95 []UrlLatency
+
+func (s UrlLatencyByP95) Len() int {
+	return len(s)
+}
+func (s UrlLatencyByP95) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s UrlLatencyByP95) Less(i, j int) bool {
+	if s[i].P95Ms != s[j].P95Ms {
+		return s[i].P95Ms > s[j].P95Ms
+	}
+	return s[i].Url < s[j].Url
+}
+
+type durationsAsc []time.Duration
+
+func (s durationsAsc) Len() int {
+	return len(s)
+}
+func (s durationsAsc) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s durationsAsc) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+// sorted must be sorted and not empty. p is 0-100
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// returns max urls with the highest p95 latency
+func (s *TrafficStats) Slowest(max int) []UrlLatency {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]UrlLatency, 0, len(s.Urls))
+	for _, u := range s.Urls {
+		n := u.Count
+		if n > dashboardSamplesPerUrl {
+			n = dashboardSamplesPerUrl
+		}
+		samples := make([]time.Duration, n)
+		copy(samples, u.Samples[:n])
+		sort.Sort(durationsAsc(samples))
+		res = append(res, UrlLatency{
+			Url:   u.Url,
+			Count: u.Count,
+			P50Ms: durationMs(percentile(samples, 50)),
+			P95Ms: durationMs(percentile(samples, 95)),
+		})
+	}
+	sort.Sort(UrlLatencyByP95(res))
+	if len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+type AppCrashVolume struct {
+	App     string `json:"app"`
+	Last24h int    `json:"last_24h"`
+	Last7d  int    `json:"last_7d"`
+}
+
+// returns number of crashes per app in the last 24 hours and 7 days
+func (s *StoreCrashes) CrashVolume(now time.Time) []AppCrashVolume {
+	s.Lock()
+	defer s.Unlock()
+	dayAgo := now.Add(-24 * time.Hour)
+	weekAgo := now.Add(-7 * 24 * time.Hour)
+	res := make([]AppCrashVolume, 0, len(s.apps))
+	for _, app := range s.apps {
+		v := AppCrashVolume{App: app.Name}
+		// crashes are in the order they were submitted
+		for i := len(app.Crashes) - 1; i >= 0; i-- {
+			t := app.Crashes[i].CreatedOn
+			if t.Before(weekAgo) {
+				break
+			}
+			v.Last7d++
+			if !t.Before(dayAgo) {
+				v.Last24h++
+			}
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+type Dashboard404 struct {
+	Url   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+type DashboardBackup struct {
+	Time   string `json:"time"`
+	Result string `json:"result"`
+	Failed bool   `json:"failed"`
+}
+
+type DashboardCrosspost struct {
+	Time      string `json:"time"`
+	ArticleId int    `json:"article_id"`
+	Title     string `json:"title"`
+	Url       string `json:"url"`
+	Service   string `json:"service"`
+	Tries     int    `json:"tries"`
+	Error     string `json:"error"`
+}
+
+type DashboardLinkCheck struct {
+	Running bool `json:"running"`
+	Done    int  `json:"done"`
+	Total   int  `json:"total"`
+	// "" if links were never checked
+	Finished string `json:"finished"`
+	Broken   int    `json:"broken"`
+}
+
+type DashboardData struct {
+	Time            string           `json:"time"`
+	RequestsPerHour []RequestsInHour `json:"requests_per_hour"`
+	SlowestUrls     []UrlLatency     `json:"slowest_urls"`
+	Top404s         []Dashboard404   `json:"top_404s"`
+	Crashes         []AppCrashVolume `json:"crashes"`
+	// nil if there was no backup since the start
+	Backup *DashboardBackup `json:"backup"`
+	// posts of new articles we gave up on (see crosspost.go)
+	FailedCrossposts []DashboardCrosspost `json:"failed_crossposts"`
+	LinkCheck        DashboardLinkCheck   `json:"link_check"`
+}
+
+func getDashboardData(now time.Time) *DashboardData {
+	d := &DashboardData{
+		Time:             now.UTC().Format(time.RFC3339),
+		RequestsPerHour:  trafficStats.RequestsPerHour(now),
+		SlowestUrls:      trafficStats.Slowest(dashboardTopN),
+		Top404s:          make([]Dashboard404, 0),
+		Crashes:          make([]AppCrashVolume, 0),
+		FailedCrossposts: make([]DashboardCrosspost, 0),
+	}
+	for _, m := range stats404.Top(1, dashboardTopN) {
+		d.Top404s = append(d.Top404s, Dashboard404{Url: m.Url, Count: m.Count})
+	}
+	if storeCrashes != nil {
+		d.Crashes = storeCrashes.CrashVolume(now)
+	}
+	if crossposts != nil && store != nil {
+		for _, p := range crossposts.Failed() {
+			dp := DashboardCrosspost{
+				Time:      p.Time.UTC().Format(time.RFC3339),
+				ArticleId: p.ArticleId,
+				Service:   p.Service,
+				Tries:     p.Tries,
+				Error:     p.Error,
+			}
+			if a := store.GetArticleById(p.ArticleId); a != nil {
+				dp.Title, dp.Url = a.Title, "/"+a.Permalink()
+			}
+			d.FailedCrossposts = append(d.FailedCrossposts, dp)
+		}
+	}
+	lc := linkChecker.Progress()
+	d.LinkCheck = DashboardLinkCheck{Running: lc.Running, Done: lc.Done, Total: lc.Total, Broken: lc.Broken}
+	if !lc.Finished.IsZero() {
+		d.LinkCheck.Finished = lc.Finished.UTC().Format(time.RFC3339)
+	}
+	if b := getLastBackup(); b != nil {
+		d.Backup = &DashboardBackup{
+			Time:   b.Time.UTC().Format(time.RFC3339),
+			Result: b.Result,
+			Failed: b.Failed,
+		}
+	}
+	return d
+}
+
+// /app/dashboard
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	model := struct {
+		BasePageModel
+	}{
+		BasePageModel: newBasePageModel(r),
+	}
+	ExecTemplate(w, tmplDashboard, model)
+}
+
+// /app/dashboard.json, polled by /app/dashboard
+func handleDashboardJson(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := json.Marshal(getDashboardData(time.Now()))
+	if err != nil {
+		logger.RequestErrorf(r, "handleDashboardJson(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeData(w, r, http.StatusOK, d)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The server and commands that change files in data directory (-fsck,
+// -compact) create a lock file with their pid in it, so that they can't run
+// at the same time. A lock file left by a process that no longer runs is
+// ignored.
+
+func dataDirLockPath(dir string) string {
+	return filepath.Join(dir, "blog.lock")
+}
+
+func isProcessRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// returns a function that removes the lock
+func lockDataDir(dir string) (func(), error) {
+	path := dataDirLockPath(dir)
+	for try := 0; try < 2; try++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(d)))
+		if err == nil && pid != os.Getpid() && isProcessRunning(pid) {
+			return nil, fmt.Errorf("data directory %s is used by process %d (%s)", dir, pid, path)
+		}
+		// stale lock
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("couldn't create lock file %s", dataDirLockPath(dir))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Emails are sent through SMTP server from config.json (SmtpHost etc.) by a
+// background goroutine, so that a request that queues many of them (e.g. a
+// new article for all subscribers) doesn't wait for them. We send at most
+// emailsPerRun emails every emailSendFreq, a failed email is re-tried in the
+// next runs up to maxEmailTries times. The queue is only in memory, emails
+// not sent when shutting down are lost.
+
+const (
+	defaultSmtpPort = 587
+	emailSendFreq   = time.Minute
+	emailsPerRun    = 100
+	maxEmailTries   = 3
+)
+
+type Email struct {
+	To      string
+	Subject string
+	// plain text
+	Body string
+	// url for List-Unsubscribe header, if not empty
+	UnsubscribeUrl string
+	tries          int
+}
+
+type EmailQueue struct {
+	sync.Mutex
+	emails []*Email
+	// signaled when emails are added so that we don't wait for the next
+	// run to send them
+	wake chan struct{}
+}
+
+var (
+	emailQueue = NewEmailQueue()
+	// changed in tests
+	sendEmail = smtpSendEmail
+)
+
+func NewEmailQueue() *EmailQueue {
+	return &EmailQueue{wake: make(chan struct{}, 1)}
+}
+
+func emailEnabled() bool {
+	c := getConfig()
+	return !StringEmpty(c.SmtpHost) && !StringEmpty(c.EmailFrom)
+}
+
+func (q *EmailQueue) Add(emails ...*Email) {
+	q.Lock()
+	q.emails = append(q.emails, emails...)
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *EmailQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.emails)
+}
+
+// sends up to emailsPerRun emails with send. Failed emails are put back at
+// the end of the queue unless they failed maxEmailTries times
+func (q *EmailQueue) sendPending(send func(*Email) error) (sent int, failed int) {
+	q.Lock()
+	n := len(q.emails)
+	if n > emailsPerRun {
+		n = emailsPerRun
+	}
+	batch := q.emails[:n]
+	q.emails = q.emails[n:]
+	q.Unlock()
+
+	var retry []*Email
+	for _, e := range batch {
+		err := send(e)
+		if err == nil {
+			sent++
+			continue
+		}
+		failed++
+		e.tries++
+		if e.tries < maxEmailTries {
+			retry = append(retry, e)
+			continue
+		}
+		logger.Errorf("sendPending(): giving up on email %q to %s after %d tries, last error: %s", e.Subject, e.To, e.tries, err)
+	}
+	if len(retry) > 0 {
+		q.Lock()
+		q.emails = append(q.emails, retry...)
+		q.Unlock()
+	}
+	return sent, failed
+}
+
+func SendEmailsLoop(q *EmailQueue, done chan struct{}) {
+	for {
+		select {
+		case <-time.After(emailSendFreq):
+		case <-q.wake:
+		case <-done:
+			return
+		}
+		if q.Len() == 0 || !emailEnabled() {
+			continue
+		}
+		sent, failed := q.sendPending(sendEmail)
+		logger.Noticef("SendEmailsLoop(): sent %d emails, %d failed, %d left", sent, failed, q.Len())
+		// don't start the next run right away if emails were added
+		// while we were sending
+		select {
+		case <-time.After(emailSendFreq):
+		case <-done:
+			return
+		}
+	}
+}
+
+func (e *Email) message(from string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", e.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if e.UnsubscribeUrl != "" {
+		fmt.Fprintf(&b, "List-Unsubscribe: <%s>\r\n", e.UnsubscribeUrl)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(e.Body)
+	return b.Bytes()
+}
+
+func smtpSendEmail(e *Email) error {
+	c := getConfig()
+	host := stringOrEmpty(c.SmtpHost)
+	port := c.SmtpPort
+	if port == 0 {
+		port = defaultSmtpPort
+	}
+	var auth smtp.Auth
+	if user := stringOrEmpty(c.SmtpUser); user != "" {
+		auth = smtp.PlainAuth("", user, stringOrEmpty(c.SmtpPassword), host)
+	}
+	from := stringOrEmpty(c.EmailFrom)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, from, []string{e.To}, e.message(from))
+}
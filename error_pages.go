@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// 404, 410 and 500 pages with the look of the rest of the site. Many links
+// to articles have typos, so 404 pages suggest articles with similar urls.
+// Calls from javascript (see isApiRequest()) get errors as json:
+// {"error": "${message}", "field": "${name of invalid form field}"}.
+
+const (
+	maxSuggestions = 5
+	// urls longer than that are not real links with typos
+	maxSuggestUrlLen = 128
+)
+
+type ErrorPageModel struct {
+	BasePageModel
+	Title       string
+	Message     string
+	Suggestions []*Article
+	// only in dev
+	Stack string
+	// name of invalid form field, if that's the error
+	Field string
+}
+
+type JsonError struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+func serveJsonError(w http.ResponseWriter, r *http.Request, status int, field, msg string) {
+	d, err := json.Marshal(&JsonError{Error: msg, Field: field})
+	if err != nil {
+		logger.RequestErrorf(r, "serveJsonError(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	writeData(w, r, status, d)
+}
+
+func serveErrorPage(w http.ResponseWriter, r *http.Request, status int, model *ErrorPageModel) {
+	if status >= 400 && isApiRequest(r) {
+		msg := model.Message
+		if msg == "" {
+			msg = model.Title
+		}
+		serveJsonError(w, r, status, model.Field, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	ExecTemplate(w, tmplError, model)
+}
+
+// for invalid values of form fields
+func serveFieldError(w http.ResponseWriter, r *http.Request, field, msg string) {
+	serveErrorPage(w, r, http.StatusBadRequest, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Invalid " + field,
+		Message:       msg,
+		Field:         field,
+	})
+}
+
+func serve404(w http.ResponseWriter, r *http.Request) {
+	serveErrorPage(w, r, http.StatusNotFound, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Page not found",
+		Message:       fmt.Sprintf("There's no page %s.", r.URL.Path),
+		Suggestions:   suggestArticles(r.URL.Path, getCachedArticles()),
+	})
+}
+
+// tells crawlers and feed readers that the article is gone for good
+func serve410(w http.ResponseWriter, r *http.Request) {
+	serveErrorPage(w, r, http.StatusGone, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Article deleted",
+		Message:       "This article has been deleted.",
+	})
+}
+
+// stack is only shown in dev
+func serve500(w http.ResponseWriter, r *http.Request, stack string) {
+	model := &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Internal error",
+		Message:       fmt.Sprintf("Something went wrong. If it keeps happening, tell me about it (request id: %s).", getRequestId(r)),
+	}
+	if !inProduction {
+		model.Stack = stack
+	}
+	serveErrorPage(w, r, http.StatusInternalServerError, model)
+}
+
+// logs a panic in a handler and, if nothing was sent yet, responds with
+// 500. Must be deferred
+func recoverHandlerPanic(w http.ResponseWriter, r *http.Request, sw *statusResponseWriter) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+	stack := fmt.Sprintf("%v\n\n%s", rec, debug.Stack())
+	logger.RequestErrorf(r, "panic serving %s: %s", r.URL.Path, stack)
+	if sw.status == 0 {
+		serve500(w, r, stack)
+	}
+}
+
+// "/article/abc/Hello-World.html" => "hello-world"
+func urlSlugKey(uri string) string {
+	s := strings.ToLower(path.Base(uri))
+	return strings.TrimSuffix(s, path.Ext(s))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// number of single character edits to change a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// returns articles whose slug is similar to the last part of uri, most
+// similar first
+func suggestArticles(uri string, articles []*Article) []*Article {
+	if len(uri) > maxSuggestUrlLen {
+		return nil
+	}
+	key := urlSlugKey(uri)
+	if len(key) < 3 {
+		return nil
+	}
+	// allow more typos in longer urls
+	maxDist := 2 + len(key)/8
+	type match struct {
+		a    *Article
+		dist int
+	}
+	var matches []match
+	for _, a := range articles {
+		slug := strings.ToLower(a.GetSlug())
+		dist := editDistance(key, slug)
+		// e.g. a link cut in the middle
+		if strings.HasPrefix(slug, key) && len(key) >= 8 {
+			dist = minInt(dist, 1)
+		}
+		if dist <= maxDist {
+			matches = append(matches, match{a, dist})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].dist < matches[j].dist
+	})
+	var res []*Article
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		res = append(res, matches[i].a)
+	}
+	return res
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kjk/blog/internal/fsutil"
+)
+
+// -export-static ${dir} renders the public part of the site (main page,
+// articles, archives, tag, series and author pages, feeds and static assets)
+// with the same handlers and templates as the server and writes it to dir as
+// plain files, with links between pages rewritten to relative paths so that
+// it can be served by any web server or opened from disk.
+// Pages are found by following links from the main page, archives and all
+// public articles. Drafts, deleted and private articles are not exported
+// (run it with -production so that drafts are not listed either).
+// Re-exporting only writes files whose content changed and removes files
+// that are no longer part of the site, based on .export-manifest.txt in dir.
+// With ExportStaticDir in config.json the server also exports every night
+// and admin can start an export with POST /app/export-static.
+
+const (
+	exportManifestName = ".export-manifest.txt"
+	exportStaticHour   = 3
+	// matches defaultBotUserAgents so that we don't count views of articles
+	exportUserAgent = "static export bot"
+	// how many redirects we follow when rewriting a link
+	exportMaxRedirects = 5
+)
+
+var (
+	// the url is always the second submatch
+	exportHtmlLinkRx = regexp.MustCompile(`(?i)\b(href|src)="([^"]*)"`)
+	exportCssLinkRx  = regexp.MustCompile(`(url)\(\s*['"]?([^'")\s]+)['"]?\s*\)`)
+
+	// urls (other than main page and articles) we follow links to
+	exportUrlPrefixes = []string{
+		"/archives.html", "/archives/", "/tag/", "/series/", "/author/",
+		"/articles/", "/software", "/extremeoptimizations/",
+		"/atom.xml", "/atom-all.xml", "/feed.json", "/robots.txt", "/notes/",
+		"/static/", "/css/", "/js/", "/gfx/", "/djs/", "/og/", "/files/",
+	}
+
+	// 1 when export is running
+	exportStaticRunning int32
+)
+
+type exportedFile struct {
+	url string
+	// relative to export dir, with '/' separators
+	path string
+	d    []byte
+	// which links we follow and rewrite, nil for other files
+	linkRx *regexp.Regexp
+}
+
+type ExportStats struct {
+	Files     int
+	Written   int
+	Unchanged int
+	Removed   int
+	// urls that returned an error
+	Failed []string
+	Bytes  int64
+}
+
+func (s *ExportStats) String() string {
+	var b strings.Builder
+	for _, uri := range s.Failed {
+		fmt.Fprintf(&b, "failed: %s\n", uri)
+	}
+	fmt.Fprintf(&b, "exported %d files (%d bytes): written %d, unchanged %d, removed %d, failed %d\n", s.Files, s.Bytes, s.Written, s.Unchanged, s.Removed, len(s.Failed))
+	return b.String()
+}
+
+// the same handlers as in InitHttpHandlers(), without timing and logging
+func newExportMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleMainPage)
+	mux.HandleFunc("/robots.txt", handleRobotsTxt)
+	mux.HandleFunc("/atom.xml", handleAtom)
+	mux.HandleFunc("/atom-all.xml", handleAtomAll)
+	mux.HandleFunc("/feed.json", handleJsonFeed)
+	mux.HandleFunc("/archives.html", handleArchives)
+	mux.HandleFunc("/archives/", handleArchivesByDate)
+	mux.HandleFunc("/software", handleSoftware)
+	mux.HandleFunc("/software/", handleSoftware)
+	mux.HandleFunc("/extremeoptimizations/", handleExtremeOpt)
+	mux.HandleFunc("/article/", handleArticle)
+	mux.HandleFunc("/articles/", handleArticles)
+	mux.HandleFunc("/tag/", handleTag)
+	mux.HandleFunc("/series/", handleSeries)
+	mux.HandleFunc("/author/", handleAuthor)
+	mux.HandleFunc("/notes/", handleNotes)
+	mux.HandleFunc("/notes/atom.xml", handleNotesAtom)
+	mux.HandleFunc("/static/", handleStatic)
+	mux.HandleFunc("/css/", handleCss)
+	mux.HandleFunc("/js/", handleJs)
+	mux.HandleFunc("/gfx/", handleGfx)
+	mux.HandleFunc("/djs/", handleDjs)
+	mux.HandleFunc("/og/", handleOgImage)
+	mux.HandleFunc("/files/", handleFiles)
+	return mux
+}
+
+func isExportableUrl(d *articlesCacheData, uri string) bool {
+	if uri == "/" {
+		return true
+	}
+	// only current permalinks: articles are also served at urls with any
+	// text after their id, so a broken relative link in an article would
+	// give us an endless number of pages
+	if a := d.permalinks[uri]; a != nil {
+		return !a.IsDraft && !a.IsDeleted && !a.IsPrivate
+	}
+	for _, prefix := range exportUrlPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns path of a link on page uri if it points to our site, "" otherwise
+func exportLocalUrl(uri, link string) string {
+	// e.g. href="' + url + '" in javascript
+	if strings.ContainsAny(link, "' {}<>") {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Opaque != "" {
+		return ""
+	}
+	if u.Scheme != "" || u.Host != "" {
+		base, err := url.Parse(siteBaseUrl())
+		if err != nil || !strings.EqualFold(u.Host, base.Host) {
+			return ""
+		}
+	}
+	if u.RawQuery != "" {
+		return ""
+	}
+	if u.Path == "" {
+		// "#foo" or "?foo"
+		return ""
+	}
+	base := &url.URL{Path: uri}
+	return base.ResolveReference(&url.URL{Path: u.Path}).Path
+}
+
+// file of a page at uri, relative to export dir
+func exportFilePath(uri string, isHtml bool) string {
+	p := strings.TrimPrefix(uri, "/")
+	switch {
+	case p == "" || strings.HasSuffix(p, "/"):
+		p += "index.html"
+	case isHtml:
+		if ext := strings.ToLower(path.Ext(p)); ext != ".html" && ext != ".htm" {
+			p += "/index.html"
+		}
+	case path.Ext(p) == "":
+		p += "/index.html"
+	}
+	return p
+}
+
+// calls fn with the url in every link in d and replaces it with what fn
+// returns. Links fn doesn't change are kept as they are
+func replaceExportLinks(d []byte, rx *regexp.Regexp, fn func(link string) string) []byte {
+	var res []byte
+	prev := 0
+	for _, m := range rx.FindAllSubmatchIndex(d, -1) {
+		start, end := m[4], m[5]
+		link := html.UnescapeString(string(d[start:end]))
+		res = append(res, d[prev:start]...)
+		if s := fn(link); s != link {
+			res = append(res, html.EscapeString(s)...)
+		} else {
+			res = append(res, d[start:end]...)
+		}
+		prev = end
+	}
+	return append(res, d[prev:]...)
+}
+
+func exportLinkRxForContentType(contentType string) *regexp.Regexp {
+	switch {
+	case strings.HasPrefix(contentType, "text/html"):
+		return exportHtmlLinkRx
+	case strings.HasPrefix(contentType, "text/css"):
+		return exportCssLinkRx
+	}
+	return nil
+}
+
+func exportGet(mux *http.ServeMux, uri string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", (&url.URL{Path: uri}).String(), nil)
+	r.Header.Set("User-Agent", exportUserAgent)
+	r.RemoteAddr = "127.0.0.1:0"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// renders all pages of the site. Returns url => file and url => url it
+// redirects to
+func crawlSite(stats *ExportStats) (map[string]*exportedFile, map[string]string) {
+	d := articlesCache.get()
+	mux := newExportMux()
+	seen := make(map[string]bool)
+	var queue []string
+	add := func(uri string) {
+		if !seen[uri] {
+			seen[uri] = true
+			queue = append(queue, uri)
+		}
+	}
+	for _, uri := range []string{"/", "/archives.html", "/archives/", "/atom.xml", "/atom-all.xml", "/feed.json", "/robots.txt"} {
+		add(uri)
+	}
+	for _, a := range d.articles {
+		if !a.IsDraft && !a.IsDeleted && !a.IsPrivate {
+			add("/" + a.Permalink())
+		}
+	}
+	var tags []string
+	for tag := range d.byTag {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		add("/tag/" + tag)
+	}
+	for _, s := range d.series {
+		add(s.Url())
+	}
+	for _, a := range d.authors {
+		add(a.Url())
+	}
+	// nothing links to notes
+	if len(d.byTag[noteTag]) > 0 {
+		add("/notes/")
+		add("/notes/atom.xml")
+	}
+
+	files := make(map[string]*exportedFile)
+	redirects := make(map[string]string)
+	for len(queue) > 0 {
+		uri := queue[0]
+		queue = queue[1:]
+		w := exportGet(mux, uri)
+		if w.Code >= 300 && w.Code < 400 {
+			if to := exportLocalUrl(uri, w.Header().Get("Location")); to != "" && isExportableUrl(d, to) {
+				redirects[uri] = to
+				add(to)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			stats.Failed = append(stats.Failed, fmt.Sprintf("%s (%d)", uri, w.Code))
+			continue
+		}
+		ct := w.Header().Get("Content-Type")
+		f := &exportedFile{
+			url:    uri,
+			path:   exportFilePath(uri, strings.HasPrefix(ct, "text/html")),
+			d:      w.Body.Bytes(),
+			linkRx: exportLinkRxForContentType(ct),
+		}
+		files[uri] = f
+		if f.linkRx == nil {
+			continue
+		}
+		replaceExportLinks(f.d, f.linkRx, func(link string) string {
+			if to := exportLocalUrl(uri, link); to != "" && isExportableUrl(d, to) {
+				add(to)
+			}
+			return link
+		})
+	}
+	return files, redirects
+}
+
+// rewrites links in f to files in export dir to relative paths
+func rewriteExportLinks(f *exportedFile, files map[string]*exportedFile, redirects map[string]string) []byte {
+	dir := path.Dir(f.path)
+	return replaceExportLinks(f.d, f.linkRx, func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			return link
+		}
+		// we don't export /out, link directly to the destination
+		if u.Path == "/out" && u.Host == "" {
+			if to := u.Query().Get("u"); to != "" {
+				return to
+			}
+			return link
+		}
+		to := exportLocalUrl(f.url, link)
+		for i := 0; i < exportMaxRedirects && redirects[to] != ""; i++ {
+			to = redirects[to]
+		}
+		target := files[to]
+		if target == nil {
+			return link
+		}
+		rel := relPath(dir, target.path)
+		res := (&url.URL{Path: rel}).EscapedPath()
+		if u.Fragment != "" {
+			res += "#" + u.EscapedFragment()
+		}
+		return res
+	})
+}
+
+// both paths are relative to the same dir, with '/' separators
+func relPath(fromDir, to string) string {
+	if fromDir == "." {
+		return to
+	}
+	rel, err := filepath.Rel(filepath.FromSlash(fromDir), filepath.FromSlash(to))
+	if err != nil {
+		return "/" + to
+	}
+	return filepath.ToSlash(rel)
+}
+
+// returns path => sha1 of files written by previous export
+func readExportManifest(dir string) map[string]string {
+	res := make(map[string]string)
+	f, err := os.Open(filepath.Join(dir, exportManifestName))
+	if err != nil {
+		return res
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) == 2 {
+			res[parts[1]] = parts[0]
+		}
+	}
+	return res
+}
+
+func writeFileAtomically(path string, d []byte) error {
+	if err := fsutil.CreateDirForFile(path); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func writeExportManifest(dir string, manifest map[string]string) error {
+	var paths []string
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s %s\n", manifest[p], p)
+	}
+	return writeFileAtomically(filepath.Join(dir, exportManifestName), []byte(b.String()))
+}
+
+func exportStatic(dir string) (*ExportStats, error) {
+	stats := &ExportStats{}
+	files, redirects := crawlSite(stats)
+	var urls []string
+	for uri := range files {
+		urls = append(urls, uri)
+	}
+	sort.Strings(urls)
+
+	prevManifest := readExportManifest(dir)
+	manifest := make(map[string]string)
+	for _, uri := range urls {
+		f := files[uri]
+		// e.g. /software and /software/
+		if _, ok := manifest[f.path]; ok {
+			continue
+		}
+		d := f.d
+		if f.linkRx != nil {
+			d = rewriteExportLinks(f, files, redirects)
+		}
+		sha1 := sha1HexOfBytes(d)
+		manifest[f.path] = sha1
+		stats.Files++
+		stats.Bytes += int64(len(d))
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if prevManifest[f.path] == sha1 {
+			if exists, _ := fsutil.PathExists(path); exists {
+				stats.Unchanged++
+				continue
+			}
+		}
+		if err := writeFileAtomically(path, d); err != nil {
+			return stats, err
+		}
+		stats.Written++
+	}
+	for p := range prevManifest {
+		if _, ok := manifest[p]; ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		stats.Removed++
+	}
+	return stats, writeExportManifest(dir, manifest)
+}
+
+// exports unless an export is already running
+func runExportStatic(dir string) (*ExportStats, error) {
+	if !atomic.CompareAndSwapInt32(&exportStaticRunning, 0, 1) {
+		return nil, errors.New("export is already running")
+	}
+	defer atomic.StoreInt32(&exportStaticRunning, 0)
+	timeStart := time.Now()
+	stats, err := exportStatic(dir)
+	if err != nil {
+		logger.Errorf("runExportStatic(): exportStatic(%q) failed with %s", dir, err)
+		return stats, err
+	}
+	logger.Noticef("runExportStatic(): %q: %d files, %d written, %d unchanged, %d removed, %d failed, %d bytes in %s", dir, stats.Files, stats.Written, stats.Unchanged, stats.Removed, len(stats.Failed), stats.Bytes, time.Since(timeStart))
+	return stats, nil
+}
+
+// runs -export-static. Returns exit code
+func runExportStaticCommand(dir string) int {
+	stats, err := runExportStatic(dir)
+	if stats != nil {
+		fmt.Print(stats.String())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// exports to ExportStaticDir every night
+func ExportStaticLoop(done chan struct{}) {
+	for {
+		select {
+		case <-time.After(durationUntilHour(time.Now(), exportStaticHour)):
+		case <-done:
+			return
+		}
+		// config can change while we run
+		if dir := stringOrEmpty(getConfig().ExportStaticDir); dir != "" {
+			runExportStatic(dir)
+		}
+	}
+}
+
+// POST /app/export-static
+func handleExportStatic(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	dir := stringOrEmpty(getConfig().ExportStaticDir)
+	if dir == "" {
+		serveErrorPage(w, r, http.StatusBadRequest, &ErrorPageModel{
+			BasePageModel: newBasePageModel(r),
+			Title:         "Export is not configured",
+			Message:       "Set ExportStaticDir in config.json.",
+		})
+		return
+	}
+	if atomic.LoadInt32(&exportStaticRunning) != 0 {
+		serveErrorPage(w, r, http.StatusConflict, &ErrorPageModel{
+			BasePageModel: newBasePageModel(r),
+			Title:         "Export is already running",
+			Message:       "Try again when it's finished.",
+		})
+		return
+	}
+	backgroundJobs.Add(1)
+	go func() {
+		runExportStatic(dir)
+		backgroundJobs.Done()
+	}()
+	serveErrorPage(w, r, http.StatusAccepted, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Export started",
+		Message:       fmt.Sprintf("Exporting to %s, the summary will be in the log.", dir),
+	})
+}
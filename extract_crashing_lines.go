@@ -104,3 +104,47 @@ func findValidCrashLine(d []byte) string {
 		return string(l)
 	}
 }
+
+// number of frames of the crashing thread that make up a crash signature
+const crashSignatureFrames = 5
+
+// "sumatrapdf.exe!CrashMe+0x2" => "CrashMe"
+func crashSignatureFrame(addr string) string {
+	for _, toSkip := range modulesToSkip {
+		if strings.HasPrefix(addr, toSkip) {
+			addr = addr[len(toSkip):]
+		}
+	}
+	if i := strings.LastIndex(addr, "+0x"); i != -1 {
+		addr = addr[:i]
+	}
+	return addr
+}
+
+// Signature identifies crashes with the same cause. It's made of function
+// names (without offsets) of top frames of the crashing thread, so the same
+// crash in different builds gets the same signature. Frames that weren't
+// resolved to a function are skipped.
+// Returns "" if there are no resolved frames.
+func ExtractSumatraCrashSignature(d []byte) string {
+	if d = SkipPastLine(d, "Crashed thread:"); d == nil {
+		return ""
+	}
+	var frames []string
+	var l []byte
+	for len(frames) < crashSignatureFrames {
+		l, d = ExtractLine(d)
+		if len(l) == 0 {
+			break
+		}
+		parts := strings.Split(string(l), " ")
+		if len(parts) < 3 || len(parts[0]) != 8 {
+			continue
+		}
+		if !strings.Contains(parts[2], "!") {
+			continue
+		}
+		frames = append(frames, crashSignatureFrame(parts[2]))
+	}
+	return strings.Join(frames, ";")
+}
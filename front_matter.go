@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files in blog_posts start with a header of "Key: value" lines, ended by
+// a line starting with "-----", followed by the body. Keys are
+// case-insensitive and lines can end with \r\n. Id, Title (except for
+// notes) and Date are required, Format too unless it can be inferred from file extension.
+// "Tags:" can be repeated. Keys we don't know are kept in Article.Headers
+// and written back by serArticleHeader().
+
+// header line with a key we don't know
+type ArticleHeader struct {
+	Key   string
+	Value string
+}
+
+type FrontMatterError struct {
+	Path string
+	// 1-based, 0 if the problem is not with a given line
+	Line int
+	Msg  string
+}
+
+func (e *FrontMatterError) Error() string {
+	if e.Line == 0 {
+		return e.Path + ": " + e.Msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+}
+
+// keys that can only be set once
+var frontMatterKeys = []string{"id", "title", "date", "format", "slug", "oldslugs", "toc", "draft", "deleted", "private", "pinned", "sharegeneration", "authors", "series", "seriespart", "canonicalurl", "linkurl"}
+
+func formatFromExt(path string) int {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return FormatMarkdown
+	case ".html", ".htm":
+		return FormatHtml
+	case ".textile":
+		return FormatTextile
+	case ".txt":
+		return FormatText
+	case ".rst":
+		return FormatRst
+	case ".org":
+		return FormatOrg
+	}
+	return FormatUnknown
+}
+
+// "Draft:" without a value means yes
+func parseYesNo(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "yes", "true":
+		return true, nil
+	case "no", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a valid value (should be yes or no)", s)
+}
+
+// returns all problems with the article, a is nil if there are any
+func parseArticle(path string, d []byte) (*Article, []error) {
+	a := &Article{Path: path, Format: FormatUnknown}
+	var errs []error
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &FrontMatterError{Path: path, Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+	seen := make(map[string]int)
+	lineNo := 0
+	for {
+		if len(d) == 0 {
+			fail(lineNo, "header is not ended with ----- line")
+			return nil, errs
+		}
+		lineNo++
+		var l string
+		if i := bytes.IndexByte(d, '\n'); i == -1 {
+			l, d = string(d), nil
+		} else {
+			l, d = string(d[:i]), d[i+1:]
+		}
+		l = strings.TrimSpace(l)
+		if isSepLine(l) {
+			break
+		}
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 {
+			fail(lineNo, "unexpected line %q (should be Key: value)", l)
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		v := strings.TrimSpace(parts[1])
+		k := strings.ToLower(key)
+		if stringInSlice(frontMatterKeys, k) {
+			if prev := seen[k]; prev != 0 {
+				fail(lineNo, "%s is already set in line %d", key, prev)
+				continue
+			}
+		}
+		seen[k] = lineNo
+		var err error
+		yesNo := func(dst *bool) {
+			if *dst, err = parseYesNo(v); err != nil {
+				fail(lineNo, "%s: %s", key, err)
+			}
+		}
+		switch k {
+		case "id":
+			a.Id, err = strconv.Atoi(v)
+			if err != nil {
+				fail(lineNo, "%q is not a valid id (not a number)", v)
+			}
+		case "title":
+			a.Title = v
+			if v == "" {
+				fail(lineNo, "title is empty")
+			}
+		case "date":
+			a.PublishedOn, err = parseDate(v)
+			if err != nil {
+				fail(lineNo, "%q is not a valid date (should be e.g. 2006-01-02 or 2006-01-02T15:04:05Z)", v)
+			}
+		case "format":
+			a.Format = parseFormat(v)
+			if a.Format == FormatUnknown {
+				fail(lineNo, "%q is not a valid format (should be one of: %s)", v, strings.Join(formatNames, ", "))
+			}
+		case "tags":
+			a.Tags = append(a.Tags, parseTags(v)...)
+		case "draft":
+			yesNo(&a.IsDraft)
+		case "deleted":
+			yesNo(&a.IsDeleted)
+		case "private":
+			yesNo(&a.IsPrivate)
+		case "pinned":
+			yesNo(&a.IsPinned)
+		case "sharegeneration":
+			a.ShareGeneration, err = strconv.Atoi(v)
+			if err != nil {
+				fail(lineNo, "%q is not a valid share generation (not a number)", v)
+			}
+		case "slug":
+			a.Slug = v
+			if !isValidSlug(v) {
+				fail(lineNo, "%q is not a valid slug", v)
+			}
+		case "oldslugs":
+			for _, slug := range strings.Split(v, ",") {
+				slug = strings.TrimSpace(slug)
+				if !isValidSlug(slug) {
+					fail(lineNo, "%q is not a valid slug", slug)
+				}
+				a.OldSlugs = append(a.OldSlugs, slug)
+			}
+		case "toc":
+			v = strings.ToLower(v)
+			if v != "yes" && v != "no" {
+				fail(lineNo, "%q is not a valid toc value (should be yes or no)", v)
+			}
+			show := v == "yes"
+			a.ShowToc = &show
+		case "authors":
+			a.Authors = parseAuthors(v)
+		case "series":
+			a.Series = v
+		case "seriespart":
+			a.SeriesPart, err = strconv.Atoi(v)
+			if err != nil || a.SeriesPart < 1 {
+				fail(lineNo, "%q is not a valid series part (should be a number >= 1)", v)
+			}
+		case "canonicalurl":
+			if !isValidAbsoluteURL(v) {
+				fail(lineNo, "%q is not a valid canonical url (should be e.g. https://example.com/post.html)", v)
+				continue
+			}
+			a.CanonicalURL = v
+		case "linkurl":
+			if !isValidAbsoluteURL(v) {
+				fail(lineNo, "%q is not a valid link url (should be e.g. https://example.com/post.html)", v)
+				continue
+			}
+			a.LinkURL = v
+		default:
+			a.Headers = append(a.Headers, ArticleHeader{Key: key, Value: v})
+		}
+	}
+	for _, k := range []string{"Id", "Title", "Date"} {
+		if seen[strings.ToLower(k)] == 0 {
+			// notes don't need a title
+			if k == "Title" && a.IsNote() {
+				a.NoTitle = true
+				continue
+			}
+			fail(0, "missing %s: header", k)
+		}
+	}
+	if seen["format"] == 0 {
+		a.Format = formatFromExt(path)
+		if a.Format == FormatUnknown {
+			fail(0, "missing Format: header (can't tell the format from file extension)")
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	a.Body = d
+	if a.NoTitle {
+		a.Title = noteTitleFromBody(d)
+	}
+	return a, nil
+}
+
+// header of a file in blog_posts, including ----- line. parseArticle()
+// of it returns the same header values
+func serArticleHeader(a *Article) string {
+	var b bytes.Buffer
+	add := func(k, v string) {
+		fmt.Fprintf(&b, "%s: %s\n", k, v)
+	}
+	add("Id", strconv.Itoa(a.Id))
+	if !a.NoTitle {
+		add("Title", a.Title)
+	}
+	if a.Slug != "" {
+		add("Slug", a.Slug)
+	}
+	if len(a.OldSlugs) > 0 {
+		add("OldSlugs", strings.Join(a.OldSlugs, ", "))
+	}
+	add("Date", a.PublishedOn.Format(time.RFC3339))
+	add("Format", formatNames[a.Format])
+	if len(a.Tags) > 0 {
+		add("Tags", strings.Join(a.Tags, ", "))
+	}
+	if len(a.Authors) > 0 {
+		add("Authors", strings.Join(a.Authors, ", "))
+	}
+	if a.Series != "" {
+		add("Series", a.Series)
+	}
+	if a.SeriesPart != 0 {
+		add("SeriesPart", strconv.Itoa(a.SeriesPart))
+	}
+	if a.CanonicalURL != "" {
+		add("CanonicalURL", a.CanonicalURL)
+	}
+	if a.LinkURL != "" {
+		add("LinkURL", a.LinkURL)
+	}
+	if a.ShowToc != nil {
+		add("Toc", map[bool]string{true: "yes", false: "no"}[*a.ShowToc])
+	}
+	if a.IsDraft {
+		add("Draft", "yes")
+	}
+	if a.IsDeleted {
+		add("Deleted", "yes")
+	}
+	if a.IsPrivate {
+		add("Private", "yes")
+	}
+	if a.IsPinned {
+		add("Pinned", "yes")
+	}
+	if a.ShareGeneration != 0 {
+		add("ShareGeneration", strconv.Itoa(a.ShareGeneration))
+	}
+	for _, h := range a.Headers {
+		add(h.Key, h.Value)
+	}
+	b.WriteString("--------------\n")
+	return b.String()
+}
+
+// -validate-posts: parses all files in dir and prints all problems.
+// Returns exit code
+func validatePosts(dir string) int {
+	nFiles := 0
+	var errs []error
+	idToPath := make(map[int]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isArticleFile(path) {
+			return err
+		}
+		nFiles++
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		a, parseErrs := parseArticle(path, d)
+		errs = append(errs, parseErrs...)
+		if a == nil {
+			return nil
+		}
+		if prev, ok := idToPath[a.Id]; ok {
+			errs = append(errs, &FrontMatterError{Path: path, Msg: fmt.Sprintf("id %d is also used by %s", a.Id, prev)})
+		}
+		idToPath[a.Id] = path
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	for _, err := range errs {
+		fmt.Printf("%s\n", err)
+	}
+	fmt.Printf("checked %d posts in %s, %d problems\n", nFiles, dir, len(errs))
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+// What's on the main page is decided when building the articles cache:
+// articles pinned with "Pinned: yes" header are first, then
+// FrontPageFullPosts newest articles shown with their body and then
+// FrontPageTitles (all if 0) titles of older articles. Notes are only there
+// if NotesOnMainPage is set. FrontPageIntroArticleId is an article (e.g.
+// about me, can be private) shown above them, it's not in the lists.
+
+// FrontPage is what's shown on the main page
+type FrontPage struct {
+	// nil if FrontPageIntroArticleId is not set
+	Intro *Article
+	// newest first in all lists
+	Pinned []*Article
+	Full   []*Article
+	Titles []*Article
+	// number of articles that could be shown (without the intro)
+	Count int
+	// true if not all of them are shown
+	More bool
+}
+
+// articles are public articles, oldest first. all also has private ones,
+// for the intro
+func buildFrontPage(articles []*Article, all []*Article) *FrontPage {
+	c := getConfig()
+	res := &FrontPage{}
+	if id := c.FrontPageIntroArticleId; id != 0 {
+		for _, a := range all {
+			if a.Id == id {
+				res.Intro = a
+			}
+		}
+		if res.Intro == nil {
+			logger.Errorf("buildFrontPage(): no article with FrontPageIntroArticleId %d", id)
+		}
+	}
+	var rest []*Article
+	for _, a := range getRecentArticles(mainPageArticles(articles), len(articles)) {
+		switch {
+		case res.Intro != nil && a.Id == res.Intro.Id:
+			continue
+		case a.IsPinned:
+			res.Pinned = append(res.Pinned, a)
+		default:
+			rest = append(rest, a)
+		}
+	}
+	res.Count = len(res.Pinned) + len(rest)
+	nFull := c.FrontPageFullPosts
+	if nFull > len(rest) {
+		nFull = len(rest)
+	}
+	res.Full, rest = rest[:nFull], rest[nFull:]
+	if n := c.FrontPageTitles; n > 0 && n < len(rest) {
+		rest = rest[:n]
+		res.More = true
+	}
+	res.Titles = rest
+	return res
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// content types worth compressing. Images, archives etc. are already
+// compressed so we send them as they are
+var compressibleContentTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/javascript",
+	"text/xml",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"application/feed+json",
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+func isCompressibleContentType(contentType string) bool {
+	// strip parameters like "; charset=utf-8"
+	if idx := strings.Index(contentType, ";"); idx != -1 {
+		contentType = contentType[:idx]
+	}
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	for _, ct := range compressibleContentTypes {
+		if ct == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// "gzip;q=0" (also "gzip; q=0.0") means the client doesn't accept gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), "gzip") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response if the client accepts gzip and
+// it has compressible content type. The decision is made when headers are
+// written because that's the first time we know the content type.
+// Compressible responses get "Vary: Accept-Encoding" even if they're not
+// compressed so that caches don't send them to clients that accept gzip
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	acceptsGzip bool
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, r *http.Request) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w, r: r, acceptsGzip: acceptsGzip(r)}
+}
+
+func (w *gzipResponseWriter) shouldCompress(code int) bool {
+	if !w.acceptsGzip {
+		return false
+	}
+	hdr := w.Header()
+	if hdr.Get("Content-Encoding") != "" || hdr.Get("Content-Range") != "" {
+		return false
+	}
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	if w.r.Method == "HEAD" {
+		return false
+	}
+	return isCompressibleContentType(hdr.Get("Content-Type"))
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	hdr := w.Header()
+	if isCompressibleContentType(hdr.Get("Content-Type")) {
+		hdr.Add("Vary", "Accept-Encoding")
+	}
+	if w.shouldCompress(code) {
+		// Content-Length set by e.g. writeResponse() is for uncompressed data
+		hdr.Del("Content-Length")
+		hdr.Set("Content-Encoding", "gzip")
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(d []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(d))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(d)
+	}
+	return w.ResponseWriter.Write(d)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// must be called after the handler finished writing the response
+func (w *gzipResponseWriter) Close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+}
+
+// wraps w in a writer that compresses the response if the client accepts
+// gzip. The returned func must be called when the response is complete
+func maybeGzipResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	gw := newGzipResponseWriter(w, r)
+	return gw, gw.Close
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We aggregate 404s per url per day so that we can see which missing urls
+// get the most hits (and add a redirect or ignore them).
+
+const (
+	// max number of urls we track per day. When exceeded, the url with the
+	// fewest hits is dropped
+	Max404sPerDay = 500
+	// how many days of 404s we keep in memory
+	Max404Days = 7
+	// how many referrers we remember per url
+	Max404Referrers = 3
+)
+
+type Missing404 struct {
+	Url       string
+	Count     int
+	Referrers []string
+}
+
+type Day404s struct {
+	Day  string
+	Urls map[string]*Missing404
+}
+
+type Stats404 struct {
+	sync.Mutex
+	// the newest day is at the end
+	Days []*Day404s
+}
+
+var stats404 = &Stats404{}
+
+func day404Str(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func (s *Stats404) currDay(now time.Time) *Day404s {
+	day := day404Str(now)
+	n := len(s.Days)
+	if n > 0 && s.Days[n-1].Day == day {
+		return s.Days[n-1]
+	}
+	d := &Day404s{Day: day, Urls: make(map[string]*Missing404)}
+	s.Days = append(s.Days, d)
+	if len(s.Days) > Max404Days {
+		s.Days = s.Days[len(s.Days)-Max404Days:]
+	}
+	return d
+}
+
+func (d *Day404s) dropLeastHit() {
+	var least *Missing404
+	for _, m := range d.Urls {
+		if least == nil || m.Count < least.Count {
+			least = m
+		}
+	}
+	if least != nil {
+		delete(d.Urls, least.Url)
+	}
+}
+
+func (s *Stats404) Add(url, referer string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	d := s.currDay(now)
+	m := d.Urls[url]
+	if m == nil {
+		if len(d.Urls) >= Max404sPerDay {
+			d.dropLeastHit()
+		}
+		m = &Missing404{Url: url}
+		d.Urls[url] = m
+	}
+	m.Count++
+	if referer != "" && len(m.Referrers) < Max404Referrers && !stringInSlice(m.Referrers, referer) {
+		m.Referrers = append(m.Referrers, referer)
+	}
+}
+
+func (s *Stats404) Remove(url string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, d := range s.Days {
+		delete(d.Urls, url)
+	}
+}
+
+type Missing404ByCount []*Missing404
+
+func (s Missing404ByCount) Len() int {
+	return len(s)
+}
+func (s Missing404ByCount) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s Missing404ByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Url < s[j].Url
+}
+
+// returns urls with the most hits, summed over the last days
+func (s *Stats404) Top(days, max int) []*Missing404 {
+	s.Lock()
+	defer s.Unlock()
+	byUrl := make(map[string]*Missing404)
+	start := len(s.Days) - days
+	if start < 0 {
+		start = 0
+	}
+	for _, d := range s.Days[start:] {
+		for _, m := range d.Urls {
+			sum := byUrl[m.Url]
+			if sum == nil {
+				sum = &Missing404{Url: m.Url}
+				byUrl[m.Url] = sum
+			}
+			sum.Count += m.Count
+			for _, ref := range m.Referrers {
+				if len(sum.Referrers) < Max404Referrers && !stringInSlice(sum.Referrers, ref) {
+					sum.Referrers = append(sum.Referrers, ref)
+				}
+			}
+		}
+	}
+	res := make([]*Missing404, 0, len(byUrl))
+	for _, m := range byUrl {
+		res = append(res, m)
+	}
+	sort.Sort(Missing404ByCount(res))
+	if max > 0 && len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+// 404s we don't want to record (e.g. junk paths requested by bots) are
+// listed, one url per line, in data/ignored_404s.txt. Urls ignored with
+// /app/404s are appended to it. When the file doesn't exist, it's created
+// with defaultIgnored404s
+
+// this list was determined by watching /logs
+var defaultIgnored404s = []string{
+	"/crossdomain.xml",
+	"/article/Exercise-links-1.html",
+	"/article/Ecco-for-free.html",
+	"/article/Disappointed-by-The-Bat.html",
+	"/article/Comments-need-not-apply.html",
+	"/article/Browsing-Newton.html",
+	"/article/Perl-and-lisp-programmers.html",
+	"/article/iPod-competition.html",
+	"/article/Programming-Jabber.html",
+	"/article/Good-software-design-contradicts-eXtreme-Program.html",
+	"/article/Bloglines-vs-Google-Reader-the-verdict.html",
+	"/2002/07/30/stuid-coding-mistake-of-the-day.html",
+	"/article/Corman-Lisp.html",
+	"/article/Offshore-outsourcing.html",
+	"/article/Nabble-hosted-forums.html",
+}
+
+var defaultIgnored404Prefixes = []string{"/apple-touch-icon"}
+
+var (
+	noLog404Mu sync.Mutex
+	noLog404   = make(map[string]bool)
+)
+
+func ignored404sPath() string {
+	return filepath.Join(getDataDir(), "data", "ignored_404s.txt")
+}
+
+func ignored404Prefixes() []string {
+	if prefixes := getConfig().Ignored404Prefixes; prefixes != nil {
+		return prefixes
+	}
+	return defaultIgnored404Prefixes
+}
+
+func readIgnored404s() {
+	path := ignored404sPath()
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		d = []byte(strings.Join(defaultIgnored404s, "\n") + "\n")
+		err = ioutil.WriteFile(path, d, 0644)
+	}
+	if err != nil {
+		logger.Errorf("readIgnored404s(): %s", err)
+		return
+	}
+	n := 0
+	for _, l := range strings.Split(string(d), "\n") {
+		if url := strings.TrimSpace(l); url != "" {
+			ignore404(url)
+			n++
+		}
+	}
+	logger.Noticef("loaded %d ignored 404s", n)
+}
+
+func shouldLog404(s string) bool {
+	for _, prefix := range ignored404Prefixes() {
+		if strings.HasPrefix(s, prefix) {
+			return false
+		}
+	}
+	noLog404Mu.Lock()
+	_, ok := noLog404[s]
+	noLog404Mu.Unlock()
+	return !ok
+}
+
+// only changes the in-memory set, see suppress404
+func ignore404(s string) {
+	noLog404Mu.Lock()
+	noLog404[s] = true
+	noLog404Mu.Unlock()
+}
+
+// stops recording 404s for url, also after restart
+func suppress404(url string) error {
+	if strings.ContainsAny(url, "\r\n") {
+		return fmt.Errorf("invalid url %q", url)
+	}
+	// we hold the lock while writing so that the file and the set agree
+	noLog404Mu.Lock()
+	defer noLog404Mu.Unlock()
+	if noLog404[url] {
+		return nil
+	}
+	f, err := os.OpenFile(ignored404sPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", url)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	noLog404[url] = true
+	return nil
+}
+
+func stringInSlice(a []string, s string) bool {
+	for _, el := range a {
+		if el == s {
+			return true
+		}
+	}
+	return false
+}
+
+func record404(m *Metrics, r *http.Request) {
+	url := r.URL.Path
+	if !shouldLog404(url) {
+		m.Suppressed404s.Inc(1)
+		return
+	}
+	m.Logged404s.Inc(1)
+	stats404.Add(url, getReferer(r), time.Now())
+}
+
+// logs the most frequent 404s once a week
+func report404sLoop(done chan struct{}) {
+	for {
+		select {
+		case <-time.After(7 * 24 * time.Hour):
+		case <-done:
+			return
+		}
+		top := stats404.Top(Max404Days, 10)
+		parts := make([]string, 0, len(top))
+		for _, m := range top {
+			parts = append(parts, fmt.Sprintf("%s (%d)", m.Url, m.Count))
+		}
+		logger.Noticef("top 404s of the week: %s", strings.Join(parts, ", "))
+	}
+}
+
+// GET /app/404s?days=${days}
+// POST /app/404s with ignore=${url} adds url to the list of ignored 404s
+// (data/ignored_404s.txt)
+func handle404s(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		if !checkCsrf(w, r) {
+			return
+		}
+		if url := getTrimmedFormValue(r, "ignore"); url != "" {
+			if err := suppress404(url); err != nil {
+				logger.RequestErrorf(r, "handle404s(): suppress404() failed with %s", err)
+				http.Error(w, "failed to ignore url", http.StatusInternalServerError)
+				return
+			}
+			stats404.Remove(url)
+			logger.Noticef("handle404s(): ignoring 404s for %q", url)
+		}
+		http.Redirect(w, r, "/app/404s", http.StatusSeeOther)
+		return
+	}
+	days := 1
+	if getTrimmedFormValue(r, "days") == "7" {
+		days = Max404Days
+	}
+	model := struct {
+		BasePageModel
+		Days    int
+		Missing []*Missing404
+	}{
+		BasePageModel: newBasePageModel(r),
+		Days:          days,
+		Missing:       stats404.Top(days, 0),
+	}
+	ExecTemplate(w, tmpl404s, model)
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type MonthArticle struct {
 	*Article
 	DisplayMonth string
+	// "2014-06" for the first article of a month, so that
+	// /archives.html#2014-06 links to it
+	MonthAnchor string
 }
 
 type Year struct {
@@ -15,15 +23,14 @@ type Year struct {
 }
 
 type ArticlesIndexModel struct {
-	IsAdmin       bool
-	AnalyticsCode string
-	JqueryUrl     string
-	LogInOutUrl   string
+	BasePageModel
 	ArticlesJsUrl string
 	Article       *Article
 	PostsCount    int
 	Tag           string
-	Years         []Year
+	// e.g. "June 2014" on /archives/2014/06/
+	Period string
+	Years  []Year
 }
 
 func (a *MonthArticle) DisplayTitle() string {
@@ -44,7 +51,8 @@ func buildYearsFromArticles(articles []*Article) []Year {
 	n := len(articles)
 	for i := n - 1; i >= 0; i-- {
 		a := articles[i]
-		yearName := a.PublishedOn.Format("2006")
+		publishedOn := a.PublishedOn.In(siteLocation())
+		yearName := publishedOn.Format("2006")
 		if currYear == nil || currYear.Name != yearName {
 			if currYear != nil {
 				res = append(res, *currYear)
@@ -53,11 +61,12 @@ func buildYearsFromArticles(articles []*Article) []Year {
 			currMonthName = ""
 		}
 		ma := MonthArticle{Article: a}
-		monthName := a.PublishedOn.Format("01")
+		monthName := publishedOn.Format("01")
 		if monthName != currMonthName {
-			ma.DisplayMonth = a.PublishedOn.Format("January 2")
+			ma.DisplayMonth = publishedOn.Format("January 2")
+			ma.MonthAnchor = publishedOn.Format("2006-01")
 		} else {
-			ma.DisplayMonth = a.PublishedOn.Format("2")
+			ma.DisplayMonth = publishedOn.Format("2")
 		}
 		currMonthName = monthName
 		currYear.Articles = append(currYear.Articles, ma)
@@ -88,17 +97,18 @@ func filterArticlesByTag(articles []*Article, tag string, include bool) []*Artic
 }
 
 func showArchiveArticles(w http.ResponseWriter, r *http.Request, articles []*Article, tag string) {
-	isAdmin := IsAdmin(r)
+	showArchiveArticlesForPeriod(w, r, articles, tag, "")
+}
+
+func showArchiveArticlesForPeriod(w http.ResponseWriter, r *http.Request, articles []*Article, tag string, period string) {
 	articlesJsUrl := getArticlesJsUrl()
 	model := ArticlesIndexModel{
-		IsAdmin:       isAdmin,
-		AnalyticsCode: *config.AnalyticsCode,
-		JqueryUrl:     jQueryUrl(),
-		LogInOutUrl:   getLogInOutUrl(r),
+		BasePageModel: newBasePageModel(r),
 		ArticlesJsUrl: articlesJsUrl,
 		PostsCount:    len(articles),
 		Years:         buildYearsFromArticles(articles),
 		Tag:           tag,
+		Period:        period,
 	}
 
 	ExecTemplate(w, tmplArchive, model)
@@ -107,7 +117,7 @@ func showArchiveArticles(w http.ResponseWriter, r *http.Request, articles []*Art
 func showArchivePage(w http.ResponseWriter, r *http.Request, tag string) {
 	articles := getCachedArticles()
 	if tag != "" {
-		articles = filterArticlesByTag(articles, tag, true)
+		articles = getCachedArticlesWithTag(tag)
 	}
 	showArchiveArticles(w, r, articles, tag)
 }
@@ -115,6 +125,10 @@ func showArchivePage(w http.ResponseWriter, r *http.Request, tag string) {
 // /tag/${tag}
 func handleTag(w http.ResponseWriter, r *http.Request) {
 	tag := r.URL.Path[len("/tag/"):]
+	if to := getTagAlias(tag); to != "" {
+		http.Redirect(w, r, "/tag/"+to, http.StatusMovedPermanently)
+		return
+	}
 	showArchivePage(w, r, tag)
 }
 
@@ -122,3 +136,128 @@ func handleTag(w http.ResponseWriter, r *http.Request) {
 func handleArchives(w http.ResponseWriter, r *http.Request) {
 	showArchivePage(w, r, "")
 }
+
+type ArchiveMonth struct {
+	Month time.Month
+	// oldest first
+	Articles []*Article
+}
+
+func (m *ArchiveMonth) Name() string {
+	return m.Month.String()
+}
+
+type ArchiveYear struct {
+	Year int
+	// only months with articles, oldest first
+	Months []*ArchiveMonth
+	Count  int
+}
+
+func (y *ArchiveYear) Articles() []*Article {
+	var res []*Article
+	for _, m := range y.Months {
+		res = append(res, m.Articles...)
+	}
+	return res
+}
+
+func (y *ArchiveYear) Month(month int) *ArchiveMonth {
+	for _, m := range y.Months {
+		if int(m.Month) == month {
+			return m
+		}
+	}
+	return nil
+}
+
+// public articles grouped by year and month of publishing, most recent
+// year first. Built with articles cache
+func buildArchive(articles []*Article) []*ArchiveYear {
+	var public []*Article
+	for _, a := range articles {
+		if !a.IsDraft {
+			public = append(public, a)
+		}
+	}
+	sort.SliceStable(public, func(i, j int) bool {
+		return public[i].PublishedOn.Before(public[j].PublishedOn)
+	})
+	var res []*ArchiveYear
+	var y *ArchiveYear
+	var m *ArchiveMonth
+	for _, a := range public {
+		year, month, _ := a.PublishedOn.Date()
+		if y == nil || y.Year != year {
+			y = &ArchiveYear{Year: year}
+			res = append(res, y)
+			m = nil
+		}
+		if m == nil || m.Month != month {
+			m = &ArchiveMonth{Month: month}
+			y.Months = append(y.Months, m)
+		}
+		m.Articles = append(m.Articles, a)
+		y.Count++
+	}
+	// most recent year first
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+func getArchiveYear(year int) *ArchiveYear {
+	for _, y := range articlesCache.get().archive {
+		if y.Year == year {
+			return y
+		}
+	}
+	return nil
+}
+
+// /archives/, /archives/${year}/, /archives/${year}/${month}/
+func handleArchivesByDate(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/archives/")
+	if rest == "" {
+		model := struct {
+			BasePageModel
+			Years []*ArchiveYear
+		}{
+			BasePageModel: newBasePageModel(r),
+			Years:         articlesCache.get().archive,
+		}
+		ExecTemplate(w, tmplArchiveIndex, model)
+		return
+	}
+	if !strings.HasSuffix(rest, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) > 2 || len(parts[0]) != 4 {
+		serve404(w, r)
+		return
+	}
+	year, err := strconv.Atoi(parts[0])
+	y := getArchiveYear(year)
+	if err != nil || y == nil {
+		serve404(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		showArchiveArticlesForPeriod(w, r, y.Articles(), "", strconv.Itoa(year))
+		return
+	}
+	month, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 2 {
+		serve404(w, r)
+		return
+	}
+	m := y.Month(month)
+	if m == nil {
+		serve404(w, r)
+		return
+	}
+	showArchiveArticlesForPeriod(w, r, m.Articles, "", fmt.Sprintf("%s %d", m.Name(), year))
+}
@@ -9,82 +9,194 @@ import (
 type DisplayArticle struct {
 	*Article
 	HtmlBody template.HTML
+	Toc      template.HTML
 }
 
+// templates can use {{ fmtDate .Article.PublishedOn }} instead
 func (a *DisplayArticle) PublishedOnShort() string {
-	return a.PublishedOn.Format("Jan 2 2006")
+	return fmtDate(a.PublishedOn)
 }
 
-func articleInfoFromUrl(uri string) *ArticleInfo {
+// returns -1 if uri is not a legacy article url
+func articleIdFromUrl(uri string) int {
 	if strings.HasPrefix(uri, "/") {
 		uri = uri[1:]
 	}
 	if !strings.HasPrefix(uri, "article/") {
-		return nil
+		return -1
 	}
 	// we expect /article/$shortId/$url
 	parts := strings.SplitN(uri[len("article/"):], "/", 2)
 	if len(parts) != 2 {
-		return nil
+		return -1
 	}
+	return UnshortenId(parts[0])
+}
+
+// uri is either a permalink, a permalink with an old slug or a legacy url
+// (/article/$shortId/$url). For old and legacy urls of articles that have
+// a different permalink, also returns the permalink to redirect to
+func articleInfoFromUrl(d *articlesCacheData, uri string) (*ArticleInfo, string) {
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	if a := d.permalinks[uri]; a != nil {
+		if info := d.byId[a.Id]; info != nil {
+			return info, ""
+		}
+	}
+	if a := d.oldPermalinks[uri]; a != nil {
+		if info := d.byId[a.Id]; info != nil {
+			return info, "/" + a.Permalink()
+		}
+	}
+	articleId := articleIdFromUrl(uri)
+	if articleId == -1 {
+		return nil, ""
+	}
+	info := d.byId[articleId]
+	if info == nil {
+		return nil, ""
+	}
+	// with legacy scheme, legacy urls with outdated title are served as is
+	permalink := "/" + info.this.Permalink()
+	if permalinkSchemeOf(info.this) != legacyPermalinkScheme && d.permalinks[permalink] == info.this {
+		return info, permalink
+	}
+	return info, ""
+}
+
+func isDeletedArticleUrl(uri string) bool {
+	if store.IsDeletedArticleId(articleIdFromUrl(uri)) {
+		return true
+	}
+	for _, a := range store.GetDeletedArticles() {
+		if "/"+a.Permalink() == uri {
+			return true
+		}
+	}
+	return false
+}
 
-	articleId := UnshortenId(parts[0])
-	return getCachedArticlesById(articleId)
+// returns false if uri is not a url of an article
+func serveArticleUrl(w http.ResponseWriter, r *http.Request) bool {
+	uri := r.URL.Path
+	d := articlesCache.get()
+	articleInfo, redirectUrl := articleInfoFromUrl(d, uri)
+	if articleInfo == nil {
+		// we don't tell that a private article exists
+		if a := d.private[uri]; a != nil && canViewPrivateArticle(r, a) {
+			serveArticle(w, r, d, &ArticleInfo{this: a})
+			return true
+		}
+	}
+	if articleInfo == nil && isDeletedArticleUrl(uri) {
+		serve410(w, r)
+		return true
+	}
+	if articleInfo == nil {
+		return false
+	}
+	if redirectUrl != "" {
+		http.Redirect(w, r, redirectUrl, http.StatusMovedPermanently)
+		return true
+	}
+	serveArticle(w, r, d, articleInfo)
+	return true
 }
 
-// /article/*, /blog/*, /kb/*
+// /article/*, /blog/*, /kb/*. Permalinks in other forms are handled by
+// handleMainPage
 func handleArticle(w http.ResponseWriter, r *http.Request) {
 	//logger.Noticef("handleArticle: %s", r.URL)
 	if redirectIfNeeded(w, r) {
 		return
 	}
-	isAdmin := IsAdmin(r)
 
-	// /blog/ and /kb/ are only for redirects, we only handle /article/ at this point
-	uri := r.URL.Path
-	articleInfo := articleInfoFromUrl(r.URL.Path)
-	if articleInfo == nil {
-		logger.Noticef("handleArticle: invalid url: %s\n", uri)
-		http.NotFound(w, r)
-		return
+	// /blog/ and /kb/ are only for redirects
+	if !serveArticleUrl(w, r) {
+		logger.Noticef("handleArticle: invalid url: %s\n", r.URL.Path)
+		serve404(w, r)
 	}
+}
+
+// d is the articles cache articleInfo comes from
+func serveArticle(w http.ResponseWriter, r *http.Request, d *articlesCacheData, articleInfo *ArticleInfo) {
+	renderArticle(w, r, d, articleInfo, nil)
+}
+
+// preview is set when showing a draft with a preview link (see
+// preview_links.go)
+func renderArticle(w http.ResponseWriter, r *http.Request, d *articlesCacheData, articleInfo *ArticleInfo, preview *PreviewLink) {
 	article := articleInfo.this
+	if preview == nil {
+		recordArticleView(r, article)
+	}
 	displayArticle := &DisplayArticle{Article: article}
 	msgHtml := article.GetHtmlStr()
+	if outboundTrackingEnabled() {
+		msgHtml = trackOutboundLinks(article.Id, msgHtml)
+	}
 	displayArticle.HtmlBody = template.HTML(msgHtml)
+	displayArticle.Toc = template.HTML(article.TocHtml)
 
 	model := struct {
-		IsAdmin         bool
-		Reload          bool
-		AnalyticsCode   string
-		JqueryUrl       string
+		BasePageModel
 		HighlightJsUrl  string
 		HighlightCssUrl string
 		PageTitle       string
 		Article         *DisplayArticle
+		Og              *OgMeta
 		NextArticle     *Article
 		PrevArticle     *Article
-		LogInOutUrl     string
+		RelatedArticles []*Article
+		Series          *SeriesNav
+		Authors         []*Author
+		Stats           *ArticleStats
+		Reactions       []*ReactionButton
+		Preview         *PreviewLink
 		ArticlesJsUrl   string
 		TagsDisplay     string
 		ArticleNo       int
 		ArticlesCount   int
 	}{
-		IsAdmin:         isAdmin,
-		Reload:          !inProduction,
-		AnalyticsCode:   *config.AnalyticsCode,
-		JqueryUrl:       jQueryUrl(),
+		BasePageModel:   newBasePageModel(r),
 		HighlightJsUrl:  highlightJsUrl(),
 		HighlightCssUrl: highlightCssUrl(),
-		LogInOutUrl:     getLogInOutUrl(r),
 		Article:         displayArticle,
+		Og:              d.ogMeta(article),
 		NextArticle:     articleInfo.next,
 		PrevArticle:     articleInfo.prev,
+		RelatedArticles: d.related[article.Id],
+		Series:          d.seriesNav(article),
+		Authors:         articleAuthors(article),
+		Stats:           d.stats[article.Id],
+		Preview:         preview,
 		PageTitle:       article.Title,
-		ArticlesCount:   store.ArticlesCount(),
+		ArticlesCount:   len(d.articles),
 		ArticleNo:       articleInfo.pos + 1,
-		ArticlesJsUrl:   getArticlesJsUrl(),
+		ArticlesJsUrl:   d.articlesJsUrl(),
 	}
 
+	// reactions are only for published articles
+	if preview == nil {
+		model.Reactions = reactionButtons(r, article.Id)
+	}
 	ExecTemplate(w, tmplArticle, model)
 }
+
+// /app/deleted
+func handleDeleted(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	model := struct {
+		BasePageModel
+		Articles []*Article
+	}{
+		BasePageModel: newBasePageModel(r),
+		Articles:      store.GetDeletedArticles(),
+	}
+	ExecTemplate(w, tmplDeleted, model)
+}
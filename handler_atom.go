@@ -7,21 +7,34 @@ import (
 	atom "github.com/thomas11/atomgenerator"
 )
 
-func handleAtomHelp(w http.ResponseWriter, r *http.Request, excludeNotes bool) {
-	articles := getCachedArticles()
-	if excludeNotes {
-		articles = filterArticlesByTag(articles, "note", false)
-	}
-	n := 25
+const (
+	feedTitle    = "Krzysztof Kowalczyk blog"
+	feedMaxItems = 25
+)
+
+// returns the most recent articles, most recent first. All feeds use it so
+// that they have the same articles
+func feedArticles(articles []*Article) []*Article {
+	n := feedMaxItems
 	if n > len(articles) {
 		n = len(articles)
 	}
-
 	latest := make([]*Article, n, n)
 	size := len(articles)
 	for i := 0; i < n; i++ {
 		latest[i] = articles[size-1-i]
 	}
+	return latest
+}
+
+// path is the url of the feed. Feeds are built with articles cache (see
+// buildArticlesCacheData), WebSub links are added when serving
+func buildAtomFeed(articles []*Article, title, path string, excludeNotes bool) []byte {
+	feedUrl := absURL(path)
+	if excludeNotes {
+		articles = filterArticlesByTag(articles, noteTag, false)
+	}
+	latest := feedArticles(articles)
 
 	pubTime := time.Now()
 	if len(articles) > 0 {
@@ -29,16 +42,20 @@ func handleAtomHelp(w http.ResponseWriter, r *http.Request, excludeNotes bool) {
 	}
 
 	feed := &atom.Feed{
-		Title:   "Krzysztof Kowalczyk blog",
-		Link:    "http://blog.kowalczyk.info/atom.xml",
+		Title:   title,
+		Link:    feedUrl,
 		PubDate: pubTime,
 	}
 
+	var authors [][]string
+	var links []string
 	for _, a := range latest {
+		authors = append(authors, a.AuthorNames())
+		links = append(links, a.LinkURL)
 		//id := fmt.Sprintf("tag:blog.kowalczyk.info,1999:%d", a.Id)
 		e := &atom.Entry{
 			Title:   a.Title,
-			Link:    "http://blog.kowalczyk.info/" + a.Permalink(),
+			Link:    a.CanonicalUrl(),
 			Content: a.GetHtmlStr(),
 			PubDate: a.PublishedOn,
 		}
@@ -47,18 +64,21 @@ func handleAtomHelp(w http.ResponseWriter, r *http.Request, excludeNotes bool) {
 
 	s, err := feed.GenXml()
 	if err != nil {
-		s = []byte("Failed to generate XML feed")
+		return []byte("Failed to generate XML feed")
 	}
+	return addFeedEntryLinks(addFeedEntryAuthors(s, authors), links)
+}
 
-	w.Write(s)
+func serveAtomFeed(w http.ResponseWriter, r *http.Request, feed []byte) {
+	writeData(w, r, http.StatusOK, addFeedHubLinks(feed, absURL(r.URL.Path), webSubHubs()))
 }
 
 // /atom-all.xml
 func handleAtomAll(w http.ResponseWriter, r *http.Request) {
-	handleAtomHelp(w, r, false)
+	serveAtomFeed(w, r, articlesCache.get().atomAll)
 }
 
 // /atom.xml
 func handleAtom(w http.ResponseWriter, r *http.Request) {
-	handleAtomHelp(w, r, true)
+	serveAtomFeed(w, r, articlesCache.get().atom)
 }
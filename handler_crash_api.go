@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// max size of uncompressed crash report json
+	maxCrashApiPayload = 1024 * 1024
+	// max length of app name, version, os and install id
+	maxCrashApiFieldLen = 256
+)
+
+// json sent to /api/crash/v2 (optionally gzip-compressed, with
+// Content-Encoding: gzip)
+type CrashApiRequest struct {
+	AppName   string `json:"app_name"`
+	AppVer    string `json:"app_version"`
+	Os        string `json:"os"`
+	InstallId string `json:"install_id,omitempty"`
+	Crash     string `json:"crash"`
+}
+
+type CrashApiResponse struct {
+	Id    *int   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	// true if crashes from this version are not saved
+	Ignored bool `json:"ignored,omitempty"`
+}
+
+func writeCrashApiResponse(w http.ResponseWriter, code int, rsp *CrashApiResponse) {
+	d, err := json.Marshal(rsp)
+	if err != nil {
+		logger.Errorf("writeCrashApiResponse(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	w.WriteHeader(code)
+	w.Write(d)
+}
+
+func crashApiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeCrashApiResponse(w, code, &CrashApiResponse{Error: fmt.Sprintf(format, args...)})
+}
+
+func isValidCrashApiField(s string) bool {
+	return len(s) <= maxCrashApiFieldLen && !strings.ContainsAny(s, "|\r\n")
+}
+
+func (req *CrashApiRequest) validate() error {
+	if req.AppName == "" {
+		return errors.New("missing app_name")
+	}
+	if req.Crash == "" {
+		return errors.New("missing crash")
+	}
+	fields := [][2]string{{"app_name", req.AppName}, {"app_version", req.AppVer},
+		{"os", req.Os}, {"install_id", req.InstallId}}
+	for _, f := range fields {
+		if !isValidCrashApiField(f[1]) {
+			return fmt.Errorf("invalid %s", f[0])
+		}
+	}
+	return nil
+}
+
+var errTooBig = errors.New("payload too big")
+
+// returns the request body, uncompressed if needed. Returns errTooBig if
+// uncompressed body is over max bytes
+func readCrashApiBody(r *http.Request, max int64) ([]byte, error) {
+	var rd io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	d, err := ioutil.ReadAll(io.LimitReader(rd, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(d)) > max {
+		return nil, errTooBig
+	}
+	return d, nil
+}
+
+// POST /api/crash/v2
+func handleCrashApiV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		crashApiError(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+	d, err := readCrashApiBody(r, maxCrashApiPayload)
+	if err == errTooBig {
+		crashApiError(w, http.StatusRequestEntityTooLarge, "payload over %d bytes", maxCrashApiPayload)
+		return
+	}
+	if err != nil {
+		crashApiError(w, http.StatusBadRequest, "failed to read body: %s", err)
+		return
+	}
+	var req CrashApiRequest
+	if err = json.Unmarshal(d, &req); err != nil {
+		crashApiError(w, http.StatusBadRequest, "invalid json: %s", err)
+		return
+	}
+	if err = req.validate(); err != nil {
+		crashApiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	ipAddr := getIpAddress(r)
+	if code, err := checkCrashSubmission(r, ipAddr, []byte(req.Crash)); err != nil {
+		crashApiError(w, code, "%s", err)
+		return
+	}
+	if !shouldSaveCrash(req.AppName, req.AppVer) {
+		writeCrashApiResponse(w, http.StatusOK, &CrashApiResponse{Ignored: true})
+		return
+	}
+
+	sub := &CrashSubmission{
+		AppName:   req.AppName,
+		AppVer:    req.AppVer,
+		Os:        req.Os,
+		InstallId: req.InstallId,
+		IpAddr:    ipAddr,
+		Data:      []byte(req.Crash),
+	}
+	crash, err := storeCrashes.SaveCrashSubmission(sub)
+	if err != nil {
+		logger.RequestErrorf(r, "handleCrashApiV2(): SaveCrashSubmission() failed with %s", err)
+		crashApiError(w, http.StatusInternalServerError, "failed to save crash")
+		return
+	}
+	logger.Noticef("handleCrashApiV2(): %s %s %s", req.AppName, req.AppVer, ipAddr)
+	writeCrashApiResponse(w, http.StatusOK, &CrashApiResponse{Id: &crash.Id})
+}
@@ -17,6 +17,9 @@ import (
 	"github.com/kjk/u"
 )
 
+// we don't want a page with thousands of links for the most common crashes
+const maxCrashesPerSignatureShown = 100
+
 var blacklistedSumatraVersions = []string{"1.5.1", "1.6", "1.7", "1.8", "1.9",
 	"2.0", "2.0.1", "2.1", "2.1.1", "2.2", "2.2.1", "2.3", "2.3.1", "2.3.2",
 	"2.4", "2.5", "2.5.1", "2.5 dbg", "2.5.1 dbg", "2.5.2", "3.0"}
@@ -48,6 +51,13 @@ func (c *Crash) ShortCrashingLine() string {
 	return s[:56] + "..."
 }
 
+func (c *Crash) OsName() string {
+	if c.Os == nil {
+		return ""
+	}
+	return *c.Os
+}
+
 func (c *Crash) ShortIpAddr() string {
 	s := c.IpAddress()
 	if len(s) <= 16 {
@@ -65,6 +75,72 @@ func (c *CrashesForDay) CrashesCount() int {
 	return len(c.Crashes)
 }
 
+// crashes with the same signature, in the order they were reported
+type CrashesForSignature struct {
+	Signature string
+	Crashes   []*Crash
+}
+
+func (c *CrashesForSignature) CrashesCount() int {
+	return len(c.Crashes)
+}
+
+func (c *CrashesForSignature) Name() string {
+	if c.Signature == "" {
+		return "unparsed"
+	}
+	return c.Signature
+}
+
+// the function the program crashed in
+func (c *CrashesForSignature) TopFrame() string {
+	if c.Signature == "" {
+		return "unparsed"
+	}
+	return strings.Split(c.Signature, ";")[0]
+}
+
+func (c *CrashesForSignature) FirstSeenVersion() string {
+	return c.Crashes[0].Version()
+}
+
+func (c *CrashesForSignature) LastSeenVersion() string {
+	return c.Crashes[len(c.Crashes)-1].Version()
+}
+
+func (c *CrashesForSignature) LastSeenSince() string {
+	return c.Crashes[len(c.Crashes)-1].CreatedOnSince()
+}
+
+// the newest first
+func (c *CrashesForSignature) RecentCrashes() []*Crash {
+	n := len(c.Crashes)
+	if n > maxCrashesPerSignatureShown {
+		n = maxCrashesPerSignatureShown
+	}
+	res := make([]*Crash, n)
+	for i := 0; i < n; i++ {
+		res[i] = c.Crashes[len(c.Crashes)-1-i]
+	}
+	return res
+}
+
+type CrashesForSignatureByCount []CrashesForSignature
+
+func (s CrashesForSignatureByCount) Len() int {
+	return len(s)
+}
+func (s CrashesForSignatureByCount) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s CrashesForSignatureByCount) Less(i, j int) bool {
+	n1, n2 := len(s[i].Crashes), len(s[j].Crashes)
+	if n1 != n2 {
+		return n1 > n2
+	}
+	return s[i].Signature < s[j].Signature
+}
+
 type AppDisplay struct {
 	*App
 	Days []CrashesForDay
@@ -135,28 +211,45 @@ func NewAppDisplay(app *App, addCrashesPerDay bool) *AppDisplay {
 func showCrashesIndex(w http.ResponseWriter, r *http.Request) {
 	apps := storeCrashes.GetApps()
 	model := struct {
+		BasePageModel
 		Apps []*App
-		User string
 	}{
-		Apps: apps,
-		User: getSecureCookie(r).TwitterUser,
+		BasePageModel: newBasePageModel(r),
+		Apps:          apps,
 	}
 	ExecTemplate(w, tmplCrashReportsIndex, model)
 }
 
+func showCrashesBySignature(w http.ResponseWriter, r *http.Request, app *App) {
+	model := struct {
+		BasePageModel
+		App        *AppDisplay
+		Filter     *CrashFilter
+		Signatures []CrashesForSignature
+	}{
+		BasePageModel: newBasePageModel(r),
+		App:           NewAppDisplay(app, false),
+		Filter:        &CrashFilter{AppName: app.Name},
+		Signatures:    storeCrashes.GetCrashesBySignature(app),
+	}
+	ExecTemplate(w, tmplCrashReportsSignatures, model)
+}
+
 func showCrashesByIp(w http.ResponseWriter, r *http.Request, app *App, ipAddrInternal string) {
 	appDisplay := NewAppDisplay(app, false)
 	crashes := storeCrashes.GetCrashesForIpAddrInternal(app, ipAddrInternal)
 	model := struct {
+		BasePageModel
 		App         *AppDisplay
 		ShowSince   bool
 		Crashes     []*Crash
 		DayOrIpAddr string
 	}{
-		App:         appDisplay,
-		ShowSince:   true,
-		Crashes:     crashes,
-		DayOrIpAddr: crashes[0].IpAddress(),
+		BasePageModel: newBasePageModel(r),
+		App:           appDisplay,
+		ShowSince:     true,
+		Crashes:       crashes,
+		DayOrIpAddr:   crashes[0].IpAddress(),
 	}
 	ExecTemplate(w, tmplCrashReportsAppIndex, model)
 }
@@ -165,15 +258,17 @@ func showCrashesByCrashingLine(w http.ResponseWriter, r *http.Request, app *App,
 	appDisplay := NewAppDisplay(app, false)
 	crashes := storeCrashes.GetCrashesForCrashingLine(app, crashingLine)
 	model := struct {
+		BasePageModel
 		App         *AppDisplay
 		ShowSince   bool
 		Crashes     []*Crash
 		DayOrIpAddr string
 	}{
-		App:         appDisplay,
-		ShowSince:   true,
-		Crashes:     crashes,
-		DayOrIpAddr: crashingLine,
+		BasePageModel: newBasePageModel(r),
+		App:           appDisplay,
+		ShowSince:     true,
+		Crashes:       crashes,
+		DayOrIpAddr:   crashingLine,
 	}
 	ExecTemplate(w, tmplCrashReportsAppIndex, model)
 }
@@ -197,7 +292,7 @@ func handleCrashesRss(w http.ResponseWriter, r *http.Request) {
 	appName := getTrimmedFormValue(r, "app_name")
 	app := storeCrashes.GetAppByName(appName)
 	if app == nil {
-		logger.Errorf("handleCrashesRss(): invalid app %q", appName)
+		logger.RequestErrorf(r, "handleCrashesRss(): invalid app %q", appName)
 		http.NotFound(w, r)
 		return
 	}
@@ -220,9 +315,9 @@ func handleCrashesRss(w http.ResponseWriter, r *http.Request) {
 
 	feed := &atom.Feed{
 		Title:   fmt.Sprintf("Crashes %s", appName),
-		Link:    fmt.Sprintf("http://blog.kowalczyk.info/app/crashesrss?app_name=%s", appName),
+		Link:    absURL(fmt.Sprintf("/app/crashesrss?app_name=%s", appName)),
 		PubDate: pubDate}
-	baseUrl := fmt.Sprintf("http://blog.kowalczyk.info/app/crashes?app_name=%s", appName)
+	baseUrl := absURL(fmt.Sprintf("/app/crashes?app_name=%s", appName))
 	if firstDayIdx == -1 {
 		e := &atom.Entry{
 			Title:   fmt.Sprintf("Crashes for %s", appName),
@@ -262,11 +357,14 @@ func handleCrashesRss(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		s = []byte("Failed to generate XML feed")
 	}
-	w.Write(s)
+	writeData(w, r, http.StatusOK, s)
 }
 
 // /app/crashes[?app_name=${appName}][&day=${day}][&ip_addr=${ipAddrInternal}]
-// [&crashing_line=${crashingLine}a]
+// [&crashing_line=${crashingLine}a][&view=day]
+// [&ver=${ver}][&contains=${s}][&os=${s}][&from=${day}][&to=${day}][&page=${n}]
+// (see crash_filter.go)
+// without day, ip_addr or crashing_line shows crashes grouped by signature
 func handleCrashes(w http.ResponseWriter, r *http.Request) {
 	appName := getTrimmedFormValue(r, "app_name")
 	if appName == "" {
@@ -279,11 +377,17 @@ func handleCrashes(w http.ResponseWriter, r *http.Request) {
 	}
 	app := storeCrashes.GetAppByName(appName)
 	if app == nil {
-		logger.Errorf("handleCrashes(): invalid app %q", appName)
+		logger.RequestErrorf(r, "handleCrashes(): invalid app %q", appName)
 		http.NotFound(w, r)
 		return
 	}
 
+	filter, err := parseCrashFilter(r, appName)
+	if err != nil || !filter.IsEmpty() {
+		showFilteredCrashes(w, r, app, filter, err)
+		return
+	}
+
 	ipAddrInternal := getTrimmedFormValue(r, "ip_addr")
 	if ipAddrInternal != "" {
 		showCrashesByIp(w, r, app, ipAddrInternal)
@@ -296,6 +400,10 @@ func handleCrashes(w http.ResponseWriter, r *http.Request) {
 	}
 
 	day := getTrimmedFormValue(r, "day")
+	if day == "" && getTrimmedFormValue(r, "view") != "day" {
+		showCrashesBySignature(w, r, app)
+		return
+	}
 
 	appDisplay := NewAppDisplay(app, true)
 	var crashes []*Crash
@@ -310,15 +418,17 @@ func handleCrashes(w http.ResponseWriter, r *http.Request) {
 		day = appDisplay.Days[0].Day
 	}
 	model := struct {
+		BasePageModel
 		App         *AppDisplay
 		ShowSince   bool
 		Crashes     []*Crash
 		DayOrIpAddr string
 	}{
-		App:         appDisplay,
-		ShowSince:   false,
-		Crashes:     crashes,
-		DayOrIpAddr: day,
+		BasePageModel: newBasePageModel(r),
+		App:           appDisplay,
+		ShowSince:     false,
+		Crashes:       crashes,
+		DayOrIpAddr:   day,
 	}
 	ExecTemplate(w, tmplCrashReportsAppIndex, model)
 }
@@ -344,23 +454,38 @@ func handleCrashShow(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	crashData, err := readCrashReport(crash.Sha1[:])
-	if err != nil {
-		http.NotFound(w, r)
-		return
+	crashBody := "Crash report was deleted by retention policy."
+	// archived report can be fetched from the archive
+	inArchiveOnly := crash.IsArchived() && !storeCrashes.MessageFileExists(crash.Sha1[:])
+	if inArchiveOnly {
+		crashBody = "Crash report was moved to the archive."
+	} else if !crash.IsPruned || crash.IsArchived() {
+		crashData, err := readCrashReport(crash.Sha1[:])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		crashBody = string(linkifyCrashReport(crashData, getSrcIndex(), srcUrlTemplate()))
 	}
 	appName := crash.App.Name
-	crashBody := string(crashData)
 	model := struct {
-		IndexUrl  string
-		IpAddr    string
-		AppName   string
-		CrashBody template.HTML
+		BasePageModel
+		IndexUrl      string
+		IpAddr        string
+		AppName       string
+		CrashBody     template.HTML
+		Crash         *Crash
+		SrcLinks      bool
+		InArchiveOnly bool
 	}{
-		IndexUrl:  fmt.Sprintf("/app/crashes?app_name=%s", appName),
-		IpAddr:    crash.IpAddress(),
-		AppName:   appName,
-		CrashBody: template.HTML(crashBody),
+		BasePageModel: newBasePageModel(r),
+		IndexUrl:      fmt.Sprintf("/app/crashes?app_name=%s", appName),
+		IpAddr:        crash.IpAddress(),
+		AppName:       appName,
+		CrashBody:     template.HTML(crashBody),
+		Crash:         crash,
+		SrcLinks:      srcLinksEnabled(),
+		InArchiveOnly: inArchiveOnly,
 	}
 	ExecTemplate(w, tmplCrashReport, model)
 }
@@ -389,6 +514,18 @@ func extractMacVersion(crashData []byte) string {
 	return parts[0]
 }
 
+// Sumatra: "OS: Windows 7 SP1 6.1"
+// Mac: "OS Version:      Mac OS X 10.8.2 (12C60)"
+func extractCrashOs(crashData []byte) string {
+	if l := FindLineWithPrefix(crashData, "OS: "); l != nil {
+		return strings.TrimSpace(string(l[4:]))
+	}
+	if l := FindLineWithPrefix(crashData, "OS Version:"); l != nil {
+		return strings.TrimSpace(string(l[len("OS Version:"):]))
+	}
+	return ""
+}
+
 var macApps = []string{"VisualAck"}
 
 func isMacApp(name string) bool {
@@ -449,6 +586,10 @@ func handleCrashSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if code, err := checkCrashSubmission(r, ipAddr, crashData); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
 	appVer := extractAppVer(appName, crashData)
 	if shouldSaveCrash(appName, appVer) {
 		err = storeCrashes.SaveCrash(appName, appVer, ipAddr, crashData)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// JSON Feed 1.1 (https://jsonfeed.org/version/1.1). /feed.json has the
+// same articles as /atom.xml, /feed.json?tag=${tag} has the most recent
+// articles with a given tag
+
+type JsonFeed struct {
+	Version     string          `json:"version"`
+	Title       string          `json:"title"`
+	HomePageUrl string          `json:"home_page_url"`
+	FeedUrl     string          `json:"feed_url"`
+	Items       []*JsonFeedItem `json:"items"`
+}
+
+type JsonFeedAuthor struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type JsonFeedItem struct {
+	Id            string            `json:"id"`
+	Url           string            `json:"url"`
+	ExternalUrl   string            `json:"external_url,omitempty"`
+	Title         string            `json:"title"`
+	ContentHtml   string            `json:"content_html"`
+	Tags          []string          `json:"tags,omitempty"`
+	Authors       []*JsonFeedAuthor `json:"authors"`
+	DatePublished string            `json:"date_published"`
+	DateModified  string            `json:"date_modified,omitempty"`
+}
+
+func newJsonFeedItem(a *Article) *JsonFeedItem {
+	// ids don't change when CanonicalURL is set
+	res := &JsonFeedItem{
+		Id:            absURL(a.Permalink()),
+		Url:           a.CanonicalUrl(),
+		ExternalUrl:   a.LinkURL,
+		Title:         a.Title,
+		ContentHtml:   a.GetHtmlStr(),
+		Tags:          a.Tags,
+		DatePublished: a.PublishedOn.Format(time.RFC3339),
+	}
+	for _, author := range articleAuthors(a) {
+		res.Authors = append(res.Authors, &JsonFeedAuthor{Name: author.Name, Url: absURL(author.Url())})
+	}
+	if a.UpdatedOn.After(a.PublishedOn) {
+		res.DateModified = a.UpdatedOn.Format(time.RFC3339)
+	}
+	return res
+}
+
+// articles are in the order of articles cache, tag is "" for all articles
+// (without notes unless NotesInMainFeeds is set)
+func buildJsonFeed(articles []*Article, tag string) *JsonFeed {
+	feedUrl := absURL("/feed.json")
+	if tag != "" {
+		feedUrl += "?tag=" + url.QueryEscape(tag)
+	} else if !getConfig().NotesInMainFeeds {
+		articles = filterArticlesByTag(articles, noteTag, false)
+	}
+	res := &JsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feedTitle,
+		HomePageUrl: absURL("/"),
+		FeedUrl:     feedUrl,
+		Items:       []*JsonFeedItem{},
+	}
+	for _, a := range feedArticles(articles) {
+		res.Items = append(res.Items, newJsonFeedItem(a))
+	}
+	return res
+}
+
+// /feed.json
+// tag: optional, only articles with this tag
+func handleJsonFeed(w http.ResponseWriter, r *http.Request) {
+	d := articlesCache.get()
+	articles := d.articles
+	tag := r.FormValue("tag")
+	if tag != "" {
+		if to := getTagAlias(tag); to != "" {
+			tag = to
+		}
+		articles = d.byTag[tag]
+		if len(articles) == 0 {
+			serve404(w, r)
+			return
+		}
+	}
+	data, err := json.Marshal(buildJsonFeed(articles, tag))
+	if err != nil {
+		logger.RequestErrorf(r, "handleJsonFeed(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/feed+json")
+	writeData(w, r, http.StatusOK, data)
+}
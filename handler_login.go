@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/garyburd/go-oauth/oauth"
 )
@@ -14,6 +16,27 @@ import (
 type SecureCookieValue struct {
 	TwitterUser string
 	TwitterTemp string
+	// made at login, must be sent with POSTs (see csrf.go)
+	CsrfToken string
+	// logins older than SessionTTLDays are ignored
+	LoggedInAt time.Time
+}
+
+const defaultSessionTTLDays = 30
+
+func sessionTTL() time.Duration {
+	days := getConfig().SessionTTLDays
+	if days <= 0 {
+		days = defaultSessionTTLDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// sets cookieVal as logged in as user, with a new session
+func setLoggedIn(cookieVal *SecureCookieValue, user string) {
+	cookieVal.TwitterUser = user
+	cookieVal.CsrfToken = newCsrfToken()
+	cookieVal.LoggedInAt = time.Now()
 }
 
 func IsAdmin(r *http.Request) bool {
@@ -32,12 +55,23 @@ func setSecureCookie(w http.ResponseWriter, cookieVal *SecureCookieValue) {
 	val := make(map[string]string)
 	val["twuser"] = cookieVal.TwitterUser
 	val["twittertemp"] = cookieVal.TwitterTemp
+	val["csrf"] = cookieVal.CsrfToken
+	if !cookieVal.LoggedInAt.IsZero() {
+		val["loggedin"] = strconv.FormatInt(cookieVal.LoggedInAt.Unix(), 10)
+	}
 	if encoded, err := secureCookie.Encode(cookieName, val); err == nil {
-		// TODO: set expiration (Expires    time.Time) long time in the future?
 		cookie := &http.Cookie{
-			Name:  cookieName,
-			Value: encoded,
-			Path:  "/",
+			Name:     cookieName,
+			Value:    encoded,
+			Path:     "/",
+			Secure:   tlsEnabled(),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		// logins survive closing the browser, until they expire
+		if cookieVal.TwitterUser != "" {
+			left := cookieVal.LoggedInAt.Add(sessionTTL()).Sub(time.Now())
+			cookie.MaxAge = int(left.Seconds())
 		}
 		http.SetCookie(w, cookie)
 	} else {
@@ -45,16 +79,17 @@ func setSecureCookie(w http.ResponseWriter, cookieVal *SecureCookieValue) {
 	}
 }
 
-const WeekInSeconds = 60 * 60 * 24 * 7
-
 // to delete the cookie value (e.g. for logging out), we need to set an
 // invalid value
 func deleteSecureCookie(w http.ResponseWriter) {
 	cookie := &http.Cookie{
-		Name:   cookieName,
-		Value:  "deleted",
-		MaxAge: WeekInSeconds,
-		Path:   "/",
+		Name:     cookieName,
+		Value:    "deleted",
+		MaxAge:   -1,
+		Path:     "/",
+		Secure:   tlsEnabled(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, cookie)
 }
@@ -83,6 +118,15 @@ func getSecureCookie(r *http.Request) *SecureCookieValue {
 			logger.Errorf("Error decoding cookie, no 'twittertemp' field")
 			return new(SecureCookieValue)
 		}
+		// cookies from before we had csrf tokens don't have it
+		ret.CsrfToken = val["csrf"]
+		if secs, err := strconv.ParseInt(val["loggedin"], 10, 64); err == nil {
+			ret.LoggedInAt = time.Unix(secs, 0)
+		}
+		// expired (or from before we had expiration) login
+		if ret.TwitterUser != "" && (ret.LoggedInAt.IsZero() || time.Since(ret.LoggedInAt) > sessionTTL()) {
+			return new(SecureCookieValue)
+		}
 	}
 	return ret
 }
@@ -114,6 +158,20 @@ func getTwitter(cred *oauth.Credentials, urlStr string, params url.Values, data
 	return json.Unmarshal(bodyData, data)
 }
 
+// returns redirect if it's a url on this site and "/" otherwise. Browsers
+// treat "/\" like "//" i.e. as a url of another site, so we don't allow '\'
+// anywhere
+func safeLoginRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.Contains(redirect, "\\") {
+		return "/"
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return redirect
+}
+
 // GET /oauthtwittercb?redirect=$redirect
 func handleOauthTwitterCallback(w http.ResponseWriter, r *http.Request) {
 	//fmt.Printf("handleOauthTwitterCallback()\n")
@@ -150,10 +208,10 @@ func handleOauthTwitterCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	if user, ok := info["screen_name"].(string); ok {
 		cookie := getSecureCookie(r)
-		cookie.TwitterUser = user
+		setLoggedIn(cookie, user)
 		setSecureCookie(w, cookie)
 	}
-	http.Redirect(w, r, redirect, 302)
+	http.Redirect(w, r, safeLoginRedirect(redirect), 302)
 }
 
 // GET /login?redirect=$redirect
@@ -179,13 +237,9 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, oauthClient.AuthorizationURL(tempCred, nil), 302)
 }
 
-// GET /logout?redirect=$redirect
+// GET /logout?redirect=$redirect (redirect is optional, "/" by default)
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	redirect := strings.TrimSpace(r.FormValue("redirect"))
-	if redirect == "" {
-		httpErrorf(w, "Missing redirect value for /logout")
-		return
-	}
+	redirect := safeLoginRedirect(strings.TrimSpace(r.FormValue("redirect")))
 	deleteSecureCookie(w)
 	http.Redirect(w, r, redirect, 302)
 }
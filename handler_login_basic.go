@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Emergency admin login with a password, for when Twitter OAuth is down.
+// Only enabled if AdminPasswordBcryptHash is set in config.
+
+const (
+	// after that many failed logins from an ip within loginFailuresWindow
+	// we stop accepting logins from that ip for loginLockoutDuration
+	maxLoginFailures     = 5
+	loginFailuresWindow  = 15 * time.Minute
+	loginLockoutDuration = 15 * time.Minute
+
+	// identity recorded in the log for logins done with a password
+	passwordAdminIdentity = "password-admin"
+)
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter tracks failed logins per ip address
+type LoginLimiter struct {
+	sync.Mutex
+	failures map[string]*loginFailures
+}
+
+var basicLoginLimiter = NewLoginLimiter()
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{failures: make(map[string]*loginFailures)}
+}
+
+func (l *LoginLimiter) IsLockedOut(ip string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	f := l.failures[ip]
+	return f != nil && now.Before(f.lockedUntil)
+}
+
+func (l *LoginLimiter) RecordFailure(ip string, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	f := l.failures[ip]
+	if f == nil || now.Sub(f.first) > loginFailuresWindow {
+		f = &loginFailures{first: now}
+		l.failures[ip] = f
+	}
+	f.count++
+	if f.count >= maxLoginFailures {
+		f.lockedUntil = now.Add(loginLockoutDuration)
+		logger.Noticef("LoginLimiter: locked out %s after %d failed logins", ip, f.count)
+	}
+}
+
+func (l *LoginLimiter) RecordSuccess(ip string) {
+	l.Lock()
+	delete(l.failures, ip)
+	l.Unlock()
+}
+
+func basicLoginEnabled() bool {
+	return !StringEmpty(getConfig().AdminPasswordBcryptHash)
+}
+
+// GET /login/basic?redirect=$redirect shows the form
+// POST /login/basic with password and redirect logs in
+func handleLoginBasic(w http.ResponseWriter, r *http.Request) {
+	if !basicLoginEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	redirect := safeLoginRedirect(getTrimmedFormValue(r, "redirect"))
+	model := struct {
+		BasePageModel
+		Redirect string
+		ErrorMsg string
+	}{
+		BasePageModel: newBasePageModel(r),
+		Redirect:      redirect,
+	}
+	if r.Method != "POST" {
+		ExecTemplate(w, tmplLoginBasic, model)
+		return
+	}
+
+	ip := getIpAddress(r)
+	now := time.Now()
+	if basicLoginLimiter.IsLockedOut(ip, now) {
+		logger.Noticef("handleLoginBasic(): rejected login from locked out %s", ip)
+		w.WriteHeader(http.StatusTooManyRequests)
+		model.ErrorMsg = "Too many failed logins. Try again later."
+		ExecTemplate(w, tmplLoginBasic, model)
+		return
+	}
+	password := r.FormValue("password")
+	err := bcrypt.CompareHashAndPassword([]byte(*getConfig().AdminPasswordBcryptHash), []byte(password))
+	if err != nil {
+		basicLoginLimiter.RecordFailure(ip, now)
+		logger.Noticef("handleLoginBasic(): failed login from %s", ip)
+		w.WriteHeader(http.StatusForbidden)
+		model.ErrorMsg = "Invalid password."
+		ExecTemplate(w, tmplLoginBasic, model)
+		return
+	}
+	basicLoginLimiter.RecordSuccess(ip)
+	logger.Noticef("handleLoginBasic(): %s logged in from %s", passwordAdminIdentity, ip)
+	cookie := getSecureCookie(r)
+	setLoggedIn(cookie, "kjk")
+	setSecureCookie(w, cookie)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -2,21 +2,21 @@ package main
 
 import (
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 )
 
 // url is in the form: $sha1.js
 func handleArticlesJs(w http.ResponseWriter, r *http.Request, url string) {
 	sha1 := url[:len(url)-len(".js")]
 	if len(sha1) != 40 {
-		logger.Errorf("handleArticlesJs(): invalid sha1=%q, url='%s", sha1, url)
+		logger.RequestErrorf(r, "handleArticlesJs(): invalid sha1=%q, url='%s", sha1, url)
 		panic("invalid sha1")
 	}
 
 	jsData, expectedSha1 := getArticlesJsData()
 	if sha1 != expectedSha1 {
-		logger.Errorf("handleArticlesJs(): invalid value of sha1=%q, expected=%q", sha1, expectedSha1)
+		logger.RequestErrorf(r, "handleArticlesJs(): invalid value of sha1=%q, expected=%q", sha1, expectedSha1)
 		panic("invalid value of sha1")
 	}
 
@@ -26,8 +26,7 @@ func handleArticlesJs(w http.ResponseWriter, r *http.Request, url string) {
 	if !IsAdmin(r) {
 		w.Header().Set("Cache-Control", "max-age=31536000, public")
 	}
-	w.Header().Set("Content-Length", strconv.Itoa(len(jsData)))
-	w.Write(jsData)
+	writeData(w, r, http.StatusOK, jsData)
 }
 
 // /djs/$url
@@ -60,31 +59,26 @@ func handleMainPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !isTopLevelUrl(r.URL.Path) {
-		http.NotFound(w, r)
+		// permalinks (see PermalinkScheme) can be any url
+		if !serveArticleUrl(w, r) {
+			serve404(w, r)
+		}
 		return
 	}
 
-	isAdmin := IsAdmin(r)
-	articles := getCachedArticles()
-	articleCount := len(articles)
-	articles = getRecentArticles(articles, articleCount)
-
 	model := struct {
-		IsAdmin       bool
-		AnalyticsCode string
-		JqueryUrl     string
-		Article       *Article
-		Articles      []*Article
-		ArticleCount  int
-		LogInOutUrl   string
+		BasePageModel
+		Article   *Article
+		FrontPage *FrontPage
+		MostRead  []*PopularArticle
+		// if true, we show a form for subscribing by email
+		EmailSubscriptions bool
 	}{
-		IsAdmin:       isAdmin,
-		AnalyticsCode: *config.AnalyticsCode,
-		JqueryUrl:     jQueryUrl(),
-		Article:       nil, // always nil
-		ArticleCount:  articleCount,
-		Articles:      articles,
-		LogInOutUrl:   getLogInOutUrl(r),
+		BasePageModel:      newBasePageModel(r),
+		Article:            nil, // always nil
+		FrontPage:          articlesCache.get().frontPage,
+		MostRead:           PopularArticles(mostReadCount, 30*24*time.Hour),
+		EmailSubscriptions: subscribers != nil && emailEnabled(),
 	}
 
 	ExecTemplate(w, tmplMainPage, model)
@@ -2,9 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -52,44 +58,379 @@ var redirects = map[string]string{
 	"/static/krzysztof.html":                        "/static/resume.html",
 }
 
-var articleRedirects = make(map[string]int)
-var articleRedirectsMutex sync.Mutex
+// Redirects other than the above are in article_redirects.txt, which can be
+// edited on /app/redirects. Each line is "${from}|${to}" where from is:
+// - article id: url ${to} (without leading '/') redirects to the article
+// - /${url} : exact url that redirects to url ${to}
+// - re:${regexp} : urls that fully match regexp redirect to ${to}, which
+//   can refer to submatches as $1, $2 etc. Patterns are only checked when
+//   there's no exact match. Submatches come from the request so if the
+//   result is not a url on this site (e.g. //evil.com/) we return 404
+//   instead of redirecting
+// Number of redirects done is saved in redirect_hits.json in data directory.
+
+const redirectPatternPrefix = "re:"
+
+var redirectsPath = "article_redirects.txt"
+
+type Redirect struct {
+	// url or a regexp if IsPattern
+	From      string
+	To        string
+	ArticleId int
+	IsPattern bool
+	// true for redirects compiled into the binary, which can't be deleted
+	BuiltIn bool
+	re      *regexp.Regexp
+}
+
+func (r *Redirect) Hits() int {
+	return redirectHits.Get(r.Key())
+}
+
+// value of from in the form on /app/redirects and in article_redirects.txt
+func (r *Redirect) Key() string {
+	if r.IsPattern {
+		return redirectPatternPrefix + r.From
+	}
+	return r.From
+}
+
+func (r *Redirect) line() string {
+	if r.ArticleId != 0 {
+		return fmt.Sprintf("%d|%s", r.ArticleId, r.From[1:])
+	}
+	return r.Key() + "|" + r.To
+}
+
+var errRedirectNotLocal = errors.New("redirect to a url that is not on this site")
+
+// true if browsers treat s as a path on this site. They treat "/\" like
+// "//" i.e. as a url of another site
+func isSitePath(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "/\\")
+}
+
+// returns url to redirect to
+func (r *Redirect) target(uri string) (string, error) {
+	if r.ArticleId != 0 {
+		if a := store.GetArticleById(r.ArticleId); a != nil {
+			return "/" + a.Permalink(), nil
+		}
+		return "", nil
+	}
+	if r.IsPattern {
+		m := r.re.FindStringSubmatchIndex(uri)
+		to := string(r.re.ExpandString(nil, r.To, uri, m))
+		if !isSitePath(to) {
+			return "", errRedirectNotLocal
+		}
+		return to, nil
+	}
+	return r.To, nil
+}
+
+// articleExists is used to validate article ids
+func newRedirect(from, to string, articleExists func(int) bool) (*Redirect, error) {
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+	if from == "" || to == "" {
+		return nil, errors.New("empty url")
+	}
+	if strings.ContainsAny(from+to, "\r\n") {
+		return nil, errors.New("urls can't contain new lines")
+	}
+	// '|' separates urls in article_redirects.txt, patterns can have it
+	// because we split at the last one
+	if strings.Contains(to, "|") || (!strings.HasPrefix(from, redirectPatternPrefix) && strings.Contains(from, "|")) {
+		return nil, errors.New("urls can't contain '|'")
+	}
+	if id, err := strconv.Atoi(from); err == nil {
+		// the format of lines in article_redirects.txt is "id|url"
+		from, to = to, from
+		if !articleExists(id) {
+			return nil, fmt.Errorf("no article with id %d", id)
+		}
+		if !strings.HasPrefix(from, "/") {
+			from = "/" + from
+		}
+		return &Redirect{From: from, To: to, ArticleId: id}, nil
+	}
+	if strings.HasPrefix(from, redirectPatternPrefix) {
+		pattern := from[len(redirectPatternPrefix):]
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &Redirect{From: pattern, To: to, IsPattern: true, re: re}, nil
+	}
+	if !strings.HasPrefix(from, "/") {
+		return nil, fmt.Errorf("url %q doesn't start with '/'", from)
+	}
+	if _, err := strconv.Atoi(to); err == nil {
+		return newRedirect(to, from, articleExists)
+	}
+	return &Redirect{From: from, To: to}, nil
+}
+
+type Redirects struct {
+	sync.RWMutex
+	// in the order of article_redirects.txt
+	list     []*Redirect
+	builtIn  map[string]*Redirect
+	exact    map[string]*Redirect
+	patterns []*Redirect
+}
+
+var fileRedirects = NewRedirects(redirects)
+
+func NewRedirects(builtIn map[string]string) *Redirects {
+	res := &Redirects{
+		builtIn: make(map[string]*Redirect),
+		exact:   make(map[string]*Redirect),
+	}
+	for from, to := range builtIn {
+		res.builtIn[from] = &Redirect{From: from, To: to, BuiltIn: true}
+	}
+	return res
+}
+
+// must be called with write lock
+func (rs *Redirects) rebuild() {
+	rs.exact = make(map[string]*Redirect)
+	rs.patterns = nil
+	for _, r := range rs.list {
+		if r.IsPattern {
+			rs.patterns = append(rs.patterns, r)
+		} else {
+			rs.exact[r.From] = r
+		}
+	}
+}
+
+func parseRedirects(d []byte, articleExists func(int) bool) ([]*Redirect, error) {
+	var res []*Redirect
+	for _, l := range bytes.Split(d, []byte{'\n'}) {
+		s := strings.TrimSpace(string(l))
+		if s == "" {
+			continue
+		}
+		// regexps can contain '|' but urls we redirect to don't
+		idx := strings.LastIndex(s, "|")
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed line %q", s)
+		}
+		r, err := newRedirect(s[:idx], s[idx+1:], articleExists)
+		if err != nil {
+			return nil, fmt.Errorf("line %q: %s", s, err)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func articleExists(id int) bool {
+	return store.GetArticleById(id) != nil
+}
 
 func readRedirects() {
-	fname := filepath.Join("article_redirects.txt")
-	d, err := ioutil.ReadFile(fname)
+	d, err := ioutil.ReadFile(redirectsPath)
 	if err != nil {
 		return
 	}
-	lines := bytes.Split(d, []byte{'\n'})
-	for _, l := range lines {
-		if 0 == len(l) {
-			continue
+	list, err := parseRedirects(d, articleExists)
+	panicif(err != nil, "malformed %s: %s", redirectsPath, err)
+	fileRedirects.Lock()
+	fileRedirects.list = list
+	fileRedirects.rebuild()
+	fileRedirects.Unlock()
+	logger.Noticef("loaded %d redirects", len(list))
+}
+
+// must be called with write lock. The file is replaced atomically so that
+// a crash doesn't leave it half-written
+func (rs *Redirects) save(path string) error {
+	var buf bytes.Buffer
+	for _, r := range rs.list {
+		buf.WriteString(r.line() + "\n")
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// adds a redirect or changes where from redirects to
+func (rs *Redirects) Add(r *Redirect, path string) error {
+	rs.Lock()
+	defer rs.Unlock()
+	list := make([]*Redirect, 0, len(rs.list)+1)
+	for _, r2 := range rs.list {
+		if r2.Key() != r.Key() {
+			list = append(list, r2)
 		}
-		parts := strings.Split(string(l), "|")
-		panicif(len(parts) != 2, "malformed article_redirects.txt, len(parts) = %d (!2)", len(parts))
-		idStr := parts[0]
-		url := strings.TrimSpace(parts[1])
-		if id, err := strconv.Atoi(idStr); err != nil {
-			panic("malformed line in article_redirects.txt")
-		} else {
-			a := store.GetArticleById(id)
-			panicif(a == nil, "bad article id (%d) article_redirects.txt", id)
-			articleRedirects[url] = id
+	}
+	prev := rs.list
+	rs.list = append(list, r)
+	if err := rs.save(path); err != nil {
+		rs.list = prev
+		return err
+	}
+	rs.rebuild()
+	return nil
+}
+
+// returns false if there's no redirect with that key
+func (rs *Redirects) Delete(key, path string) (bool, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	list := make([]*Redirect, 0, len(rs.list))
+	for _, r := range rs.list {
+		if r.Key() != key {
+			list = append(list, r)
+		}
+	}
+	if len(list) == len(rs.list) {
+		return false, nil
+	}
+	prev := rs.list
+	rs.list = list
+	if err := rs.save(path); err != nil {
+		rs.list = prev
+		return false, err
+	}
+	rs.rebuild()
+	return true, nil
+}
+
+// returns url to redirect to or "" if uri is not redirected. Returns
+// errRedirectNotLocal if a pattern would redirect to another site
+func (rs *Redirects) Find(uri string) (string, error) {
+	rs.RLock()
+	defer rs.RUnlock()
+	r := rs.builtIn[uri]
+	if r == nil {
+		r = rs.exact[uri]
+	}
+	if r == nil {
+		for _, r2 := range rs.patterns {
+			if r2.re.MatchString(uri) {
+				r = r2
+				break
+			}
+		}
+	}
+	if r == nil {
+		return "", nil
+	}
+	to, err := r.target(uri)
+	if to != "" {
+		redirectHits.Add(r.Key())
+	}
+	return to, err
+}
+
+// number of redirects done, by Key() of the redirect
+type RedirectHits struct {
+	sync.Mutex
+	Hits  map[string]int
+	dirty bool
+}
+
+var redirectHits = &RedirectHits{Hits: make(map[string]int)}
+
+func redirectHitsPath() string {
+	return filepath.Join(getDataDir(), "redirect_hits.json")
+}
+
+func (h *RedirectHits) Add(key string) {
+	h.Lock()
+	h.Hits[key]++
+	h.dirty = true
+	h.Unlock()
+}
+
+func (h *RedirectHits) Get(key string) int {
+	h.Lock()
+	defer h.Unlock()
+	return h.Hits[key]
+}
+
+// doesn't write the file if nothing changed since last save
+func (h *RedirectHits) save(path string) error {
+	h.Lock()
+	if !h.dirty {
+		h.Unlock()
+		return nil
+	}
+	d, err := json.Marshal(h)
+	h.dirty = false
+	h.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadRedirectHits(path string) (*RedirectHits, error) {
+	h := &RedirectHits{}
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(d, h); err != nil {
+			return nil, err
 		}
 	}
-	logger.Noticef("loaded %d article redirects", len(articleRedirects))
+	if h.Hits == nil {
+		h.Hits = make(map[string]int)
+	}
+	return h, nil
+}
+
+func readRedirectHits() {
+	h, err := loadRedirectHits(redirectHitsPath())
+	if err != nil {
+		logger.Errorf("readRedirectHits(): %s", err)
+		return
+	}
+	redirectHits = h
+}
+
+func saveRedirectHits() {
+	if err := redirectHits.save(redirectHitsPath()); err != nil {
+		logger.Errorf("saveRedirectHits(): %s", err)
+	}
+}
+
+type RedirectsByFrom []*Redirect
+
+func (s RedirectsByFrom) Len() int {
+	return len(s)
+}
+func (s RedirectsByFrom) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s RedirectsByFrom) Less(i, j int) bool {
+	return s[i].From < s[j].From
 }
 
-// return -1 if there's no redirect for this urls
-func getRedirectArticleId(url string) int {
-	url = url[1:] // remove '/' from the beginning
-	articleRedirectsMutex.Lock()
-	defer articleRedirectsMutex.Unlock()
-	if articleId, ok := articleRedirects[url]; ok {
-		return articleId
+// returns built-in redirects (sorted) followed by those from the file
+func (rs *Redirects) All() []*Redirect {
+	rs.RLock()
+	defer rs.RUnlock()
+	res := make([]*Redirect, 0, len(rs.builtIn)+len(rs.list))
+	for _, r := range rs.builtIn {
+		res = append(res, r)
 	}
-	return -1
+	sort.Sort(RedirectsByFrom(res))
+	return append(res, rs.list...)
 }
 
 func redirectIfNeeded(w http.ResponseWriter, r *http.Request) bool {
@@ -102,27 +443,70 @@ func redirectIfNeeded(w http.ResponseWriter, r *http.Request) bool {
 		return true
 	}
 
-	if redirUrl, ok := redirects[uri]; ok {
-		//logger.Noticef("Redirecting %q => %q", url, redirUrl)
-		http.Redirect(w, r, redirUrl, 302)
+	redirUrl, err := fileRedirects.Find(uri)
+	if err != nil {
+		logger.RequestErrorf(r, "redirectIfNeeded(): %q: %s", uri, err)
+		serve404(w, r)
 		return true
 	}
-
-	redirectArticleId := getRedirectArticleId(uri)
-	if redirectArticleId == -1 {
-		return false
-	}
-	article := store.GetArticleById(redirectArticleId)
-	if article != nil {
-		redirUrl := "/" + article.Permalink()
-		//logger.Noticef("Redirecting %q => %q", url, redirUrl)
+	if redirUrl != "" {
+		//logger.Noticef("Redirecting %q => %q", uri, redirUrl)
 		http.Redirect(w, r, redirUrl, 302)
 		return true
 	}
-
 	return false
 }
 
+// GET /app/redirects
+// POST /app/redirects with from=${from}&to=${to} adds a redirect and with
+// delete=${from} deletes it
+func handleRedirects(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	errMsg := ""
+	if r.Method == "POST" {
+		if !checkCsrf(w, r) {
+			return
+		}
+		var err error
+		if key := getTrimmedFormValue(r, "delete"); key != "" {
+			_, err = fileRedirects.Delete(key, redirectsPath)
+			if err == nil {
+				logger.Noticef("handleRedirects(): deleted %q", key)
+			}
+		} else {
+			from, to := getTrimmedFormValue(r, "from"), getTrimmedFormValue(r, "to")
+			if getTrimmedFormValue(r, "pattern") != "" && !strings.HasPrefix(from, redirectPatternPrefix) {
+				from = redirectPatternPrefix + from
+			}
+			var redir *Redirect
+			if redir, err = newRedirect(from, to, articleExists); err == nil {
+				err = fileRedirects.Add(redir, redirectsPath)
+			}
+			if err == nil {
+				logger.Noticef("handleRedirects(): added %q => %q", from, to)
+			}
+		}
+		if err == nil {
+			http.Redirect(w, r, "/app/redirects", http.StatusSeeOther)
+			return
+		}
+		errMsg = err.Error()
+	}
+	model := struct {
+		BasePageModel
+		Error     string
+		Redirects []*Redirect
+	}{
+		BasePageModel: newBasePageModel(r),
+		Error:         errMsg,
+		Redirects:     fileRedirects.All(),
+	}
+	ExecTemplate(w, tmplRedirects, model)
+}
+
 // url: /forum_sumatra/${rest}
 func forumRedirect(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path[len("/forum_sumatra/"):]
@@ -101,21 +101,21 @@ func LogSlowPage(url string, generationTime time.Duration) {
 
 // /timings
 func handleTimings(w http.ResponseWriter, r *http.Request) {
-	cookie := getSecureCookie(r)
-	isAdmin := cookie.TwitterUser == "kjk" // only I can see the logs
 	pageTimingsMutex.Lock()
 	timings := pageTimings.GetTimings()
 	pageTimingsMutex.Unlock()
 
-	isAdmin = true
 	model := struct {
-		UserIsAdmin bool
+		BasePageModel
+		ShowTimings bool
 		PageTimings []*PageTiming
 	}{
-		UserIsAdmin: isAdmin,
+		BasePageModel: newBasePageModel(r),
+		// timings are not secret, everyone can see them
+		ShowTimings: true,
 	}
 
-	if model.UserIsAdmin {
+	if model.ShowTimings {
 		model.PageTimings = timings
 	}
 
@@ -5,37 +5,40 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/kjk/blog/internal/fsutil"
 	"github.com/kjk/u"
 )
 
-func getWwwDir() string {
-	// when running locally
-	d := filepath.Join("..", "www")
-	if u.PathExists(d) {
-		return d
-	}
-	// when running on a server
-	d = "www"
-	if u.PathExists(d) {
-		return d
+// returns the first of dirs that exists or "" if none does
+func firstExistingDir(dirs ...string) string {
+	for _, d := range dirs {
+		exists, err := fsutil.PathExists(d)
+		if err != nil {
+			logger.Errorf("firstExistingDir(): %s", err)
+		}
+		if exists {
+			return d
+		}
 	}
-	logger.Errorf("getWwwDir(): %q dir doesn't exist", d)
 	return ""
 }
 
-func getAppEngineTmplDir() string {
-	// when running locally
-	d := filepath.Join("..", "tmpl")
-	if u.PathExists(d) {
-		return d
+func getWwwDir() string {
+	// when running locally and on a server
+	d := firstExistingDir(filepath.Join("..", "www"), "www")
+	if d == "" {
+		logger.Errorf("getWwwDir(): %q dir doesn't exist", "www")
 	}
-	// when running on a server
-	d = "appengtmpl"
-	if u.PathExists(d) {
-		return d
+	return d
+}
+
+func getAppEngineTmplDir() string {
+	// when running locally and on a server
+	d := firstExistingDir(filepath.Join("..", "tmpl"), "appengtmpl")
+	if d == "" {
+		logger.Errorf("getAppEngineTmplDir(): %q dir doesn't exist", "appengtmpl")
 	}
-	logger.Errorf("getAppEngineTmplDir(): %q dir doesn't exist", d)
-	return ""
+	return d
 }
 
 func getCssDir() string {
@@ -109,7 +112,13 @@ func serveFileFromDir(w http.ResponseWriter, r *http.Request, dir, fileName stri
 		return
 	}
 	filePath := filepath.Join(dir, fileName)
-	if u.PathExists(filePath) {
+	exists, err := fsutil.PathExists(filePath)
+	if err != nil {
+		logger.RequestErrorf(r, "serveFileFromDir(): %s", err)
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+	if exists {
 		//logger.Noticef("serveFileFromDir(): %q", filePath)
 		http.ServeFile(w, r, filePath)
 	} else {
@@ -124,6 +133,9 @@ func handleStatic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	file := r.URL.Path[len("/static/"):]
+	if serveFingerprintedAsset(w, r, getStaticDir(), file) {
+		return
+	}
 	serveFileFromDir(w, r, getStaticDir(), file)
 }
 
@@ -175,11 +187,6 @@ func handleContactme(w http.ResponseWriter, r *http.Request) {
 	serveFileFromDir(w, r, getStaticDir(), "contactme.html")
 }
 
-// url: /robots.txt
-func handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
-	serveFileFromDir(w, r, getWwwDir(), "robots.txt")
-}
-
 // url: /extremeoptimizations/
 func handleExtremeOpt(w http.ResponseWriter, r *http.Request) {
 	file := r.URL.Path[len("/extremeoptimizations/"):]
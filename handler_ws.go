@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
+	"github.com/kjk/blog/internal/fsutil"
 )
 
 type watchedFile struct {
@@ -67,31 +71,124 @@ func NotifyFileChanges(ev fsnotify.Event) {
 	}
 }
 
-func watchChanges(watcher *fsnotify.Watcher) {
+// notifies all pages watching for changes e.g. when a template changes
+func NotifyAllWatchers() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, w := range watchedFiles {
+		select {
+		case w.c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// directories of templates and css, changes in which reload open pages
+// but not articles
+func getAssetDirsToWatch() []string {
+	return []string{"tmpl", getCssDir(), getStaticDir()}
+}
+
+func isAssetChange(path string) bool {
+	dir := filepath.Dir(path)
+	for _, d := range getAssetDirsToWatch() {
+		if filepath.Clean(d) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// editors often generate several events when saving a file (and copying
+// files over ssh can take a while), so we wait for this long after the
+// last event before reloading articles
+const reloadDebounce = 1500 * time.Millisecond
+
+// fsnotify doesn't watch sub-directories so we add directories created in
+// blog_posts. Returns events for files that were already in it
+func watchNewDir(watcher *fsnotify.Watcher, dir string) []fsnotify.Event {
+	var res []fsnotify.Event
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			res = append(res, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			return nil
+		}
+		if err = watcher.Add(path); err != nil {
+			logger.Errorf("watchNewDir(): watcher.Add() for %s failed with %s", path, err)
+		}
+		return nil
+	})
+	return res
+}
+
+func watchChanges(watcher *fsnotify.Watcher, done chan struct{}) {
+	var pending []fsnotify.Event
+	var reload <-chan time.Time
 	for {
 		select {
 		case ev := <-watcher.Events:
-			NotifyFileChanges(ev)
+			if isTmpFile(ev.Name) {
+				continue
+			}
+			pending = append(pending, ev)
+			if ev.Op&fsnotify.Create != 0 && !isAssetChange(ev.Name) {
+				if isDir, _ := fsutil.IsDir(ev.Name); isDir {
+					pending = append(pending, watchNewDir(watcher, ev.Name)...)
+				}
+			}
+			reload = time.After(reloadDebounce)
+		case <-reload:
+			assetsChanged := false
+			var changedArticles []string
+			for _, ev := range pending {
+				if isAssetChange(ev.Name) {
+					assetsChanged = true
+				} else if isArticleFile(ev.Name) && !stringInSlice(changedArticles, ev.Name) {
+					changedArticles = append(changedArticles, ev.Name)
+				}
+			}
+			if len(changedArticles) > 0 {
+				reloadArticleFiles(changedArticles)
+			}
+			// notify after reloading so that the reloaded page is up to date.
+			// Templates are re-parsed on every request in dev, so a reload
+			// of the page is all that's needed for them
+			if assetsChanged {
+				NotifyAllWatchers()
+			} else {
+				for _, ev := range pending {
+					NotifyFileChanges(ev)
+				}
+			}
+			pending = nil
+			reload = nil
 		case err := <-watcher.Errors:
 			log.Println("error:", err)
+		case <-done:
+			watcher.Close()
+			return
 		}
 	}
 }
 
-func startWatching() {
-	if inProduction {
-		return
-	}
+func startWatching(done chan struct{}) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		fmt.Printf("fsnotify.NewWather() failed with %s\n", err)
 		return
 	}
 
-	go watchChanges(watcher)
+	go watchChanges(watcher, done)
 
 	dirs := store.GetDirsToWatch()
 	dirs = append(dirs, "blog_posts")
+	// in production templates and css are only read at startup
+	if !inProduction {
+		dirs = append(dirs, getAssetDirsToWatch()...)
+	}
 	for _, dir := range dirs {
 		err = watcher.Add(dir)
 		if err != nil {
@@ -101,22 +198,6 @@ func startWatching() {
 			//fmt.Printf("added watching for dir %s\n", dir)
 		}
 	}
-	//watcher.Close()
-}
-
-func reloadArticle(article *Article) {
-	for i, a := range store.articles {
-		if a == article {
-			fmt.Printf("reloading %s\n", a.Path)
-			newArticle, err := readArticle(a.Path)
-			if err != nil {
-				fmt.Printf("reloading %s failed with %s\n", a.Path, err)
-				return
-			}
-			store.articles[i] = newArticle
-			return
-		}
-	}
 }
 
 // serveWs receives a file name from a websocket client and relays to it
@@ -135,7 +216,7 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	uri := string(p)
-	articleInfo := articleInfoFromUrl(uri)
+	articleInfo, _ := articleInfoFromUrl(articlesCache.get(), uri)
 	if articleInfo == nil {
 		fmt.Printf("serveWs: didn't find article for uri %s\n", uri)
 		return
@@ -163,7 +244,6 @@ loop:
 	for {
 		select {
 		case <-c:
-			reloadArticle(article)
 			err := conn.WriteMessage(websocket.TextMessage, nil)
 			if err != nil {
 				log.Print(err)
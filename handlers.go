@@ -11,19 +11,53 @@ func InitHttpHandlers() {
 	http.HandleFunc("/timings", handleTimings)
 	http.HandleFunc("/oauthtwittercb", handleOauthTwitterCallback)
 	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/login/basic", appRateLimiter.Wrap("/login/basic", handleLoginBasic))
 	http.HandleFunc("/logout", handleLogout)
 
-	http.Handle("/app/crashsubmit", makeTimingHandler(handleCrashSubmit))
+	http.Handle("/app/crashsubmit", makeRateLimitedHandler("/app/crashsubmit", handleCrashSubmit))
+	http.Handle("/api/crash/v2", makeRateLimitedHandler("/api/crash/v2", withCors(handleCrashApiV2)))
 	http.Handle("/app/crashes", makeTimingHandler(handleCrashes))
 	http.Handle("/app/crashesrss", makeTimingHandler(handleCrashesRss))
 	http.Handle("/app/crashshow", makeTimingHandler(handleCrashShow))
+	http.Handle("/app/crashstar", makeTimingHandler(handleCrashStar))
+	http.Handle("/app/crashfetcharchived", makeTimingHandler(handleCrashFetchArchived))
+	http.Handle("/app/crashsrcrefresh", makeTimingHandler(handleCrashSrcRefresh))
+	http.Handle("/app/deleted", makeTimingHandler(handleDeleted))
+	http.Handle("/app/404s", makeTimingHandler(handle404s))
+	http.Handle("/app/views", makeTimingHandler(handleArticleViews))
+	http.Handle("/app/stats", makeTimingHandler(handleStats))
+	http.Handle("/app/share", makeTimingHandler(handleShare))
+	http.Handle("/app/export-static", makeTimingHandler(handleExportStatic))
+	http.Handle("/app/react", makeRateLimitedHandler("/app/react", handleReact))
+	http.Handle("/app/reactions/reset", makeTimingHandler(handleReactionsReset))
+	http.Handle("/app/drafts", makeTimingHandler(handleDrafts))
+	http.Handle("/app/preview-link", makeTimingHandler(handleNewPreviewLink))
+	http.Handle("/app/preview-link/revoke", makeTimingHandler(handleRevokePreviewLink))
+	http.Handle("/preview/", makeTimingHandler(handlePreview))
+	http.Handle("/subscribe", makeRateLimitedHandler("/subscribe", handleSubscribe))
+	http.Handle("/subscribe/confirm", makeTimingHandler(handleSubscribeConfirm))
+	http.Handle("/unsubscribe", makeTimingHandler(handleUnsubscribe))
+	http.Handle("/app/redirects", makeTimingHandler(handleRedirects))
+	http.Handle("/app/reload-config", makeTimingHandler(handleReloadConfig))
+	http.Handle("/app/log-level", makeTimingHandler(handleLogLevel))
+	http.Handle("/app/logs.json", makeTimingHandler(handleLogsJson))
+	http.Handle("/app/tags", makeTimingHandler(handleTags))
+	http.Handle("/app/dashboard", makeTimingHandler(handleDashboard))
+	http.Handle("/app/dashboard.json", makeTimingHandler(handleDashboardJson))
+	http.Handle("/app/crosspost/retry", makeTimingHandler(handleCrosspostRetry))
+	http.Handle("/app/check-links", makeTimingHandler(handleCheckLinks))
+	http.Handle("/app/uploads", makeTimingHandler(handleUploads))
+	http.Handle("/app/uploads.json", makeTimingHandler(handleUploadsJson))
+	http.Handle("/files/", makeTimingHandler(handleFiles))
 	// TODO: I stopped pointing people to FeedBurner feed on 2013-05-22
 	// At some point I should delete /feedburner.xml, which is a source data
 	// for FeedBurner
 	http.Handle("/feedburner.xml", makeTimingHandler(handleAtom))
 	http.Handle("/atom.xml", makeTimingHandler(handleAtom))
 	http.Handle("/atom-all.xml", makeTimingHandler(handleAtomAll))
+	http.Handle("/feed.json", makeTimingHandler(handleJsonFeed))
 	http.Handle("/archives.html", makeTimingHandler(handleArchives))
+	http.Handle("/archives/", makeTimingHandler(handleArchivesByDate))
 	http.Handle("/software", makeTimingHandler(handleSoftware))
 	http.Handle("/software/", makeTimingHandler(handleSoftware))
 	http.Handle("/extremeoptimizations/", makeTimingHandler(handleExtremeOpt))
@@ -33,12 +67,18 @@ func InitHttpHandlers() {
 	http.Handle("/forum_sumatra/", makeTimingHandler(forumRedirect))
 	http.Handle("/articles/", makeTimingHandler(handleArticles))
 	http.Handle("/tag/", makeTimingHandler(handleTag))
+	http.Handle("/series/", makeTimingHandler(handleSeries))
+	http.Handle("/notes/", makeTimingHandler(handleNotes))
+	http.Handle("/notes/atom.xml", makeTimingHandler(handleNotesAtom))
+	http.Handle("/author/", makeTimingHandler(handleAuthor))
 	http.Handle("/static/", makeTimingHandler(handleStatic))
 	http.Handle("/css/", makeTimingHandler(handleCss))
 	http.Handle("/js/", makeTimingHandler(handleJs))
 	http.Handle("/gfx/", makeTimingHandler(handleGfx))
 	http.Handle("/markitup/", makeTimingHandler(handleMarkitup))
 	http.Handle("/djs/", makeTimingHandler(handleDjs))
+	http.Handle("/og/", makeTimingHandler(handleOgImage))
+	http.Handle("/out", makeTimingHandler(handleOutboundLink))
 	http.Handle("/metrics", makeTimingHandler(handleMetrics))
 	if !inProduction {
 		http.HandleFunc("/ws", serveWs)
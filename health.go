@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// For load balancers:
+// /healthz : 200 if the process is up, with build info
+// /readyz  : 200 if we can serve requests, 503 with a list of failed checks
+//            otherwise. When shutting down, it's 503 for ShutdownDrainSeconds
+//            before we stop accepting connections so that the load balancer
+//            stops sending us requests
+// They're served before other handlers so they're not redirected to the
+// canonical host or https, logged or counted in metrics.
+// gitSha and buildDate are set when building e.g.:
+// go build -ldflags "-X main.gitSha=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+
+var (
+	gitSha    = "unknown"
+	buildDate = "unknown"
+
+	processStartTime = time.Now()
+	// 1 when we're shutting down, accessed atomically
+	shuttingDown int32
+)
+
+// in production, unless ShutdownDrainSeconds is set
+const defaultShutdownDrain = 5 * time.Second
+
+func shutdownDrainDuration() time.Duration {
+	if n := getConfig().ShutdownDrainSeconds; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if inProduction {
+		return defaultShutdownDrain
+	}
+	return 0
+}
+
+func setShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+type HealthResponse struct {
+	Status    string `json:"status"`
+	GitSha    string `json:"git_sha"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	UptimeSec int64  `json:"uptime_sec"`
+}
+
+type FailedCheck struct {
+	Check string `json:"check"`
+	Error string `json:"error"`
+}
+
+type ReadyResponse struct {
+	Status string         `json:"status"`
+	Failed []*FailedCheck `json:"failed,omitempty"`
+}
+
+func checkDataDirWritable() error {
+	f, err := ioutil.TempFile(getDataDir(), ".readyz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+type readinessCheck struct {
+	name string
+	fn   func() error
+}
+
+var readinessChecks = []readinessCheck{
+	{"shutdown", func() error {
+		if isShuttingDown() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}},
+	{"store", func() error {
+		if store == nil {
+			return errors.New("articles not loaded")
+		}
+		return nil
+	}},
+	{"templates", func() error {
+		if _, errs := GetTemplates(); errs != nil {
+			return errors.New(templateErrorsString(errs))
+		}
+		return nil
+	}},
+	{"data_dir", checkDataDirWritable},
+}
+
+func serveHealthJson(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeData(w, r, status, d)
+}
+
+// /healthz
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	serveHealthJson(w, r, http.StatusOK, &HealthResponse{
+		Status:    "ok",
+		GitSha:    gitSha,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		UptimeSec: int64(time.Since(processStartTime).Seconds()),
+	})
+}
+
+// /readyz
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res := &ReadyResponse{Status: "ok"}
+	for _, c := range readinessChecks {
+		if err := c.fn(); err != nil {
+			res.Failed = append(res.Failed, &FailedCheck{Check: c.name, Error: err.Error()})
+		}
+	}
+	if len(res.Failed) > 0 {
+		res.Status = "unavailable"
+		serveHealthJson(w, r, http.StatusServiceUnavailable, res)
+		return
+	}
+	serveHealthJson(w, r, http.StatusOK, res)
+}
+
+// serves /healthz and /readyz, passes other requests to h
+func withHealthChecks(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			handleHealthz(w, r)
+		case "/readyz":
+			handleReadyz(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
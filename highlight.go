@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/russross/blackfriday"
+)
+
+// Fenced code blocks with a language (```go) are highlighted when rendering
+// markdown. The html uses the same classes as highlight.js (hljs-keyword
+// etc.), so its css works for it. It's a simple tokenizer that only knows
+// about keywords, literals, strings, numbers and comments, which is most
+// of what highlight.js does for us anyway.
+// With ClientSideHighlighting in config.json, we leave it to highlight.js
+// in the browser instead.
+
+type highlightLang struct {
+	keywords map[string]bool
+	literals map[string]bool
+	// e.g. "//" or "#"
+	lineComments []string
+	// e.g. "/*", "*/"
+	blockCommentStart string
+	blockCommentEnd   string
+	// characters that start and end a string
+	quotes string
+	// quotes in which "\" doesn't escape (e.g. "`" in go)
+	rawQuotes string
+}
+
+func wordSet(s string) map[string]bool {
+	res := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		res[w] = true
+	}
+	return res
+}
+
+var (
+	cKeywords = "auto break case char const continue default do double else enum extern float for goto if inline int long register restrict return short signed sizeof static struct switch typedef union unsigned void volatile while"
+
+	highlightGo = &highlightLang{
+		keywords:          wordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var"),
+		literals:          wordSet("true false nil iota"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'`",
+		rawQuotes:         "`",
+	}
+	highlightC = &highlightLang{
+		keywords:          wordSet(cKeywords),
+		literals:          wordSet("NULL true false"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'",
+	}
+	highlightCpp = &highlightLang{
+		keywords:          wordSet(cKeywords + " bool catch class constexpr delete explicit friend mutable namespace new noexcept operator override private protected public template this throw try typename using virtual"),
+		literals:          wordSet("NULL nullptr true false"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'",
+	}
+	highlightCSharp = &highlightLang{
+		keywords:          wordSet("abstract as base bool break byte case catch char checked class const continue decimal default delegate do double else enum event explicit extern finally fixed float for foreach goto if implicit in int interface internal is lock long namespace new object operator out override params private protected public readonly ref return sbyte sealed short sizeof static string struct switch this throw try typeof uint ulong unchecked unsafe ushort using var virtual void volatile while"),
+		literals:          wordSet("null true false"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'",
+	}
+	highlightJava = &highlightLang{
+		keywords:          wordSet("abstract assert boolean break byte case catch char class const continue default do double else enum extends final finally float for goto if implements import instanceof int interface long native new package private protected public return short static super switch synchronized this throw throws transient try void volatile while"),
+		literals:          wordSet("null true false"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'",
+	}
+	highlightJs = &highlightLang{
+		keywords:          wordSet("break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new return super switch this throw try typeof var void while with yield"),
+		literals:          wordSet("null undefined true false NaN Infinity"),
+		lineComments:      []string{"//"},
+		blockCommentStart: "/*",
+		blockCommentEnd:   "*/",
+		quotes:            "\"'`",
+	}
+	highlightPython = &highlightLang{
+		keywords:     wordSet("and as assert break class continue def del elif else except exec finally for from global if import in is lambda nonlocal not or pass print raise return try while with yield"),
+		literals:     wordSet("None True False"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	highlightShell = &highlightLang{
+		keywords:     wordSet("case do done elif else esac fi for function if in then until while"),
+		literals:     wordSet("true false"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		rawQuotes:    "'",
+	}
+)
+
+// language of a fenced code block => its definition
+var highlightLangs = map[string]*highlightLang{
+	"go":         highlightGo,
+	"golang":     highlightGo,
+	"c":          highlightC,
+	"cpp":        highlightCpp,
+	"c++":        highlightCpp,
+	"cs":         highlightCSharp,
+	"csharp":     highlightCSharp,
+	"java":       highlightJava,
+	"js":         highlightJs,
+	"javascript": highlightJs,
+	"python":     highlightPython,
+	"py":         highlightPython,
+	"sh":         highlightShell,
+	"bash":       highlightShell,
+	"shell":      highlightShell,
+}
+
+// the same as blackfriday's escaping of code
+func writeEscapedCode(out *bytes.Buffer, s []byte) {
+	for _, c := range s {
+		switch c {
+		case '&':
+			out.WriteString("&amp;")
+		case '<':
+			out.WriteString("&lt;")
+		case '>':
+			out.WriteString("&gt;")
+		case '"':
+			out.WriteString("&quot;")
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+func writeHighlightSpan(out *bytes.Buffer, class string, s []byte) {
+	out.WriteString(`<span class="hljs-`)
+	out.WriteString(class)
+	out.WriteString(`">`)
+	writeEscapedCode(out, s)
+	out.WriteString("</span>")
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isNumberChar(c byte) bool {
+	return isIdentChar(c) || c == '.'
+}
+
+// returns length of a string starting at s[0] (which is the quote)
+func stringTokenLen(s []byte, raw bool) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == q:
+			return i + 1
+		case s[i] == '\\' && !raw:
+			i++
+		case s[i] == '\n' && q != '`':
+			// unterminated string
+			return i
+		}
+	}
+	return len(s)
+}
+
+// returns html of highlighted code
+func (l *highlightLang) highlight(code []byte) []byte {
+	var out bytes.Buffer
+	s := code
+	for len(s) > 0 {
+		n := 0
+		class := ""
+		for _, prefix := range l.lineComments {
+			if bytes.HasPrefix(s, []byte(prefix)) {
+				if n = bytes.IndexByte(s, '\n'); n == -1 {
+					n = len(s)
+				}
+				class = "comment"
+				break
+			}
+		}
+		c := s[0]
+		switch {
+		case class != "":
+		case l.blockCommentStart != "" && bytes.HasPrefix(s, []byte(l.blockCommentStart)):
+			start := len(l.blockCommentStart)
+			if n = bytes.Index(s[start:], []byte(l.blockCommentEnd)); n == -1 {
+				n = len(s)
+			} else {
+				n += start + len(l.blockCommentEnd)
+			}
+			class = "comment"
+		case strings.IndexByte(l.quotes, c) != -1:
+			n = stringTokenLen(s, strings.IndexByte(l.rawQuotes, c) != -1)
+			class = "string"
+		case c >= '0' && c <= '9':
+			for n < len(s) && isNumberChar(s[n]) {
+				n++
+			}
+			class = "number"
+		case isIdentStart(c):
+			for n < len(s) && isIdentChar(s[n]) {
+				n++
+			}
+			word := string(s[:n])
+			if l.keywords[word] {
+				class = "keyword"
+			} else if l.literals[word] {
+				class = "literal"
+			}
+		default:
+			n = 1
+		}
+		if class == "" {
+			writeEscapedCode(&out, s[:n])
+		} else {
+			writeHighlightSpan(&out, class, s[:n])
+		}
+		s = s[n:]
+	}
+	return out.Bytes()
+}
+
+// blackfriday html renderer that highlights code blocks in languages we
+// know about
+type highlightingRenderer struct {
+	blackfriday.Renderer
+}
+
+func (r *highlightingRenderer) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	lang := info
+	if i := strings.IndexAny(info, "\t "); i != -1 {
+		lang = info[:i]
+	}
+	hl := highlightLangs[strings.ToLower(lang)]
+	if hl == nil {
+		r.Renderer.BlockCode(out, text, info)
+		return
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	out.WriteString(`<pre><code class="language-`)
+	writeEscapedCode(out, []byte(lang))
+	out.WriteString(` hljs">`)
+	out.Write(hl.highlight(text))
+	out.WriteString("</code></pre>\n")
+}
@@ -0,0 +1,79 @@
+// Package fsutil has file system helpers that return errors instead of
+// panicking or hiding them, so that callers can decide how to report them.
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrNoHomeDir is returned by ExpandTilde when we can't tell the home
+// directory of the current user
+var ErrNoHomeDir = errors.New("can't determine home directory")
+
+// PathExists returns false and no error if path doesn't exist. Other errors
+// (e.g. permission denied) are returned
+func PathExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// IsDir returns false and no error if path doesn't exist
+func IsDir(path string) (bool, error) {
+	st, err := os.Stat(path)
+	if err == nil {
+		return st.IsDir(), nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// CreateDirForFile creates the directory that path is in
+func CreateDirForFile(path string) error {
+	return os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// homeDir looks at env variables first because user.Current() needs cgo
+// and doesn't work in binaries cross-compiled e.g. on mac for linux
+func homeDir(getenv func(string) string, goos string) (string, error) {
+	env := "HOME"
+	if goos == "windows" {
+		env = "USERPROFILE"
+	}
+	if dir := getenv(env); dir != "" {
+		return dir, nil
+	}
+	if usr, err := user.Current(); err == nil && usr.HomeDir != "" {
+		return usr.HomeDir, nil
+	}
+	return "", ErrNoHomeDir
+}
+
+func expandTilde(path string, getenv func(string) string, goos string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path, nil
+	}
+	dir, err := homeDir(getenv, goos)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path[1:]), nil
+}
+
+// ExpandTilde replaces "~" at the beginning of path with home directory of
+// the current user. "~user" is not supported and returned unchanged
+func ExpandTilde(path string) (string, error) {
+	return expandTilde(path, os.Getenv, runtime.GOOS)
+}
@@ -0,0 +1,69 @@
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandTilde(t *testing.T) {
+	env := map[string]string{"HOME": "/home/kjk", "USERPROFILE": `C:\Users\kjk`}
+	getenv := func(k string) string { return env[k] }
+	tests := []struct {
+		path string
+		goos string
+		exp  string
+	}{
+		{"~/data/blog", "linux", filepath.Join("/home/kjk", "data", "blog")},
+		{"~", "linux", "/home/kjk"},
+		{"~/data", "windows", filepath.Join(`C:\Users\kjk`, "data")},
+		{"/var/data", "linux", "/var/data"},
+		{"data/~", "linux", "data/~"},
+		{"~other/data", "linux", "~other/data"},
+	}
+	for _, test := range tests {
+		got, err := expandTilde(test.path, getenv, test.goos)
+		if err != nil || got != test.exp {
+			t.Errorf("expandTilde(%q, %s) = %q, %v, expected %q", test.path, test.goos, got, err, test.exp)
+		}
+	}
+
+	// falls back to user.Current(), which can fail e.g. without cgo
+	noenv := func(string) string { return "" }
+	got, err := expandTilde("~/data", noenv, "linux")
+	if err != nil && err != ErrNoHomeDir {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err == nil && got == "~/data" {
+		t.Errorf("path not expanded")
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a", "b", "file.txt")
+	if exists, err := PathExists(path); exists || err != nil {
+		t.Fatalf("PathExists() of missing file returned %v, %v", exists, err)
+	}
+	if err = CreateDirForFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if isDir, err := IsDir(filepath.Dir(path)); !isDir || err != nil {
+		t.Fatalf("IsDir() returned %v, %v", isDir, err)
+	}
+	if err = ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := PathExists(path); !exists || err != nil {
+		t.Fatalf("PathExists() returned %v, %v", exists, err)
+	}
+	if isDir, err := IsDir(path); isDir || err != nil {
+		t.Fatalf("IsDir() of a file returned %v, %v", isDir, err)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin can check links in public articles with POST /app/check-links. It
+// runs in the background (progress is on /app/dashboard) and the report,
+// grouped by article, is on /app/check-links. Links to other sites are
+// checked with HEAD (GET if the server doesn't like HEAD), links to our
+// site are resolved like requests to the server would be, without http.
+// Results are remembered in data/link_check.json. Re-checking only checks
+// links to other sites that were last checked more than LinkCheckMaxAgeDays
+// (defaultLinkCheckMaxAgeDays if 0) ago.
+
+const (
+	defaultLinkCheckMaxAgeDays = 7
+	// how many links to other sites we check at the same time
+	linkCheckConcurrency = 4
+	linkCheckUserAgent   = "Mozilla/5.0 (compatible; blog link checker)"
+)
+
+var (
+	linkCheckHrefRx = regexp.MustCompile(`(?i)\bhref="([^"]*)"`)
+	linkCheckClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+// LinkCheck is the result of checking a link
+type LinkCheck struct {
+	Url string
+	// http status, 0 if there was an error
+	Status int
+	// where the link redirects to, if it does
+	RedirectUrl string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+	CheckedAt   time.Time
+}
+
+// IsBroken returns true if the link doesn't work
+func (c *LinkCheck) IsBroken() bool {
+	return c.Error != "" || c.Status < 200 || c.Status > 399
+}
+
+// IsOk returns true if the link works and doesn't redirect
+func (c *LinkCheck) IsOk() bool {
+	return !c.IsBroken() && c.RedirectUrl == ""
+}
+
+// what's in link_check.json
+type LinkCheckReport struct {
+	Started  time.Time
+	Finished time.Time
+	// article id => links in it
+	ArticleLinks map[int][]string
+	// url => result
+	Links map[string]*LinkCheck
+}
+
+// progress of checking links, shown on /app/dashboard
+type LinkCheckProgress struct {
+	Running bool
+	Done    int
+	Total   int
+	// of the last finished check, zero if there was none
+	Finished time.Time
+	Broken   int
+}
+
+type LinkChecker struct {
+	sync.Mutex
+	path    string
+	running bool
+	done    int
+	total   int
+	// the last finished check, never modified
+	report *LinkCheckReport
+}
+
+var linkChecker = &LinkChecker{}
+
+func linkCheckPath() string {
+	return filepath.Join(getDataDir(), "data", "link_check.json")
+}
+
+func linkCheckMaxAge() time.Duration {
+	days := getConfig().LinkCheckMaxAgeDays
+	if days == 0 {
+		days = defaultLinkCheckMaxAgeDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func loadLinkCheckReport(path string) (*LinkCheckReport, error) {
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res LinkCheckReport
+	if err = json.Unmarshal(d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func saveLinkCheckReport(path string, r *LinkCheckReport) error {
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func readLinkCheckReport() {
+	path := linkCheckPath()
+	r, err := loadLinkCheckReport(path)
+	if err != nil {
+		logger.Errorf("readLinkCheckReport(): %s", err)
+	}
+	linkChecker.Lock()
+	linkChecker.path = path
+	linkChecker.report = r
+	linkChecker.Unlock()
+}
+
+// returns the last finished check, nil if there was none
+func (lc *LinkChecker) Report() *LinkCheckReport {
+	lc.Lock()
+	defer lc.Unlock()
+	return lc.report
+}
+
+func (lc *LinkChecker) Progress() LinkCheckProgress {
+	lc.Lock()
+	defer lc.Unlock()
+	res := LinkCheckProgress{Running: lc.running, Done: lc.done, Total: lc.total}
+	if r := lc.report; r != nil {
+		res.Finished = r.Finished
+		for _, c := range r.Links {
+			if c.IsBroken() {
+				res.Broken++
+			}
+		}
+	}
+	return res
+}
+
+// returns false if a check is already running
+func (lc *LinkChecker) start() bool {
+	lc.Lock()
+	defer lc.Unlock()
+	if lc.running {
+		return false
+	}
+	lc.running = true
+	lc.done, lc.total = 0, 0
+	return true
+}
+
+func (lc *LinkChecker) setProgress(done, total int) {
+	lc.Lock()
+	lc.done, lc.total = done, total
+	lc.Unlock()
+}
+
+func (lc *LinkChecker) finish(r *LinkCheckReport) {
+	lc.Lock()
+	defer lc.Unlock()
+	lc.running = false
+	lc.report = r
+	if lc.path == "" {
+		return
+	}
+	if err := saveLinkCheckReport(lc.path, r); err != nil {
+		logger.Errorf("LinkChecker.finish(): %s", err)
+	}
+}
+
+// returns urls of links in html of an article with permalink uri. Links to
+// our site are returned as paths
+func extractArticleLinks(uri, s string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, m := range linkCheckHrefRx.FindAllStringSubmatch(s, -1) {
+		link := strings.TrimSpace(html.UnescapeString(m[1]))
+		if link == "" || strings.HasPrefix(link, "#") {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			// we report those as broken
+			if !seen[link] {
+				seen[link] = true
+				res = append(res, link)
+			}
+			continue
+		}
+		u.Fragment = ""
+		if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+			// mailto: etc.
+			continue
+		}
+		if p := exportLocalUrl(uri, u.String()); p != "" {
+			link = p
+		} else if u.Scheme == "" && u.Host == "" {
+			// relative link with a query
+			base := &url.URL{Path: uri}
+			link = base.ResolveReference(u).String()
+		} else {
+			link = u.String()
+		}
+		if !seen[link] {
+			seen[link] = true
+			res = append(res, link)
+		}
+	}
+	return res
+}
+
+func isLocalLink(link string) bool {
+	return strings.HasPrefix(link, "/")
+}
+
+// checks link to our site without http
+func checkLocalLink(d *articlesCacheData, mux *http.ServeMux, link string) *LinkCheck {
+	res := &LinkCheck{Url: link, CheckedAt: time.Now()}
+	u, err := url.Parse(link)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if u.RawQuery == "" {
+		if info, redirectUrl := articleInfoFromUrl(d, u.Path); info != nil {
+			res.Status, res.RedirectUrl = http.StatusOK, redirectUrl
+			return res
+		}
+	}
+	r, _ := http.NewRequest("GET", link, nil)
+	// so that we don't count views of articles
+	r.Header.Set("User-Agent", exportUserAgent)
+	r.RemoteAddr = "127.0.0.1:0"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	res.Status = w.Code
+	if w.Code >= 300 && w.Code <= 399 {
+		res.RedirectUrl = w.Header().Get("Location")
+	}
+	return res
+}
+
+func doLinkCheckRequest(method, link string) (*http.Response, error) {
+	r, err := http.NewRequest(method, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("User-Agent", linkCheckUserAgent)
+	rsp, err := linkCheckClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return rsp, nil
+}
+
+// checks link to other site
+func checkRemoteLink(link string) *LinkCheck {
+	res := &LinkCheck{Url: link, CheckedAt: time.Now()}
+	rsp, err := doLinkCheckRequest("HEAD", link)
+	// some servers don't support HEAD or only reject it
+	if err != nil || rsp.StatusCode == http.StatusMethodNotAllowed || rsp.StatusCode == http.StatusNotImplemented || rsp.StatusCode == http.StatusForbidden {
+		rsp, err = doLinkCheckRequest("GET", link)
+	}
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		res.Error = err.Error()
+		return res
+	}
+	res.Status = rsp.StatusCode
+	if final := rsp.Request.URL.String(); final != link {
+		res.RedirectUrl = final
+	}
+	return res
+}
+
+// checks links in articles. Links to other sites checked in prev less than
+// maxAge ago are not checked again
+func checkLinks(articles []*Article, prev *LinkCheckReport, maxAge time.Duration, progress func(done, total int)) *LinkCheckReport {
+	d := articlesCache.get()
+	mux := newExportMux()
+	now := time.Now()
+	res := &LinkCheckReport{
+		Started:      now,
+		ArticleLinks: make(map[int][]string),
+		Links:        make(map[string]*LinkCheck),
+	}
+	var local, remote []string
+	for _, a := range articles {
+		if a.IsDraft || a.IsDeleted || a.IsPrivate {
+			continue
+		}
+		links := extractArticleLinks("/"+a.Permalink(), a.GetHtmlStr())
+		if len(links) == 0 {
+			continue
+		}
+		res.ArticleLinks[a.Id] = links
+		for _, link := range links {
+			if _, ok := res.Links[link]; ok {
+				continue
+			}
+			if isLocalLink(link) {
+				res.Links[link] = nil
+				local = append(local, link)
+				continue
+			}
+			if prev != nil {
+				if c := prev.Links[link]; c != nil && now.Sub(c.CheckedAt) < maxAge {
+					res.Links[link] = c
+					continue
+				}
+			}
+			res.Links[link] = nil
+			remote = append(remote, link)
+		}
+	}
+	total := len(local) + len(remote)
+	done := 0
+	progress(done, total)
+	for _, link := range local {
+		res.Links[link] = checkLocalLink(d, mux, link)
+		done++
+	}
+	progress(done, total)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < linkCheckConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range queue {
+				c := checkRemoteLink(link)
+				mu.Lock()
+				res.Links[link] = c
+				done++
+				progress(done, total)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, link := range remote {
+		queue <- link
+	}
+	close(queue)
+	wg.Wait()
+	res.Finished = time.Now()
+	return res
+}
+
+func runLinkCheck() {
+	timeStart := time.Now()
+	res := checkLinks(store.GetArticles(), linkChecker.Report(), linkCheckMaxAge(), linkChecker.setProgress)
+	linkChecker.finish(res)
+	p := linkChecker.Progress()
+	logger.Noticef("runLinkCheck(): checked %d links in %s, %d broken", p.Total, time.Since(timeStart), p.Broken)
+}
+
+// links in an article that don't work or redirect
+type LinkCheckArticle struct {
+	Article *Article
+	Links   []*LinkCheck
+}
+
+// returns articles with broken or redirected links (only broken if
+// brokenOnly), newest first
+func linkCheckArticles(r *LinkCheckReport, brokenOnly bool) []*LinkCheckArticle {
+	var res []*LinkCheckArticle
+	if r == nil {
+		return nil
+	}
+	for id, links := range r.ArticleLinks {
+		a := store.GetArticleById(id)
+		if a == nil {
+			continue
+		}
+		la := &LinkCheckArticle{Article: a}
+		for _, link := range links {
+			c := r.Links[link]
+			if c == nil || c.IsOk() || (brokenOnly && !c.IsBroken()) {
+				continue
+			}
+			la.Links = append(la.Links, c)
+		}
+		if len(la.Links) > 0 {
+			res = append(res, la)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Article.PublishedOn.After(res[j].Article.PublishedOn)
+	})
+	return res
+}
+
+// GET /app/check-links : the report
+// broken   : if not empty, only broken links (without redirects)
+// POST /app/check-links : starts checking links
+func handleCheckLinks(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		if !checkCsrf(w, r) {
+			return
+		}
+		if !linkChecker.start() {
+			serveErrorPage(w, r, http.StatusConflict, &ErrorPageModel{
+				BasePageModel: newBasePageModel(r),
+				Title:         "Links are already being checked",
+				Message:       "Progress is on the dashboard.",
+			})
+			return
+		}
+		backgroundJobs.Add(1)
+		go func() {
+			runLinkCheck()
+			backgroundJobs.Done()
+		}()
+		http.Redirect(w, r, "/app/dashboard", http.StatusSeeOther)
+		return
+	}
+	report := linkChecker.Report()
+	brokenOnly := r.FormValue("broken") != ""
+	model := struct {
+		BasePageModel
+		Progress   LinkCheckProgress
+		Articles   []*LinkCheckArticle
+		BrokenOnly bool
+		MaxAge     string
+	}{
+		BasePageModel: newBasePageModel(r),
+		Progress:      linkChecker.Progress(),
+		Articles:      linkCheckArticles(report, brokenOnly),
+		BrokenOnly:    brokenOnly,
+		MaxAge:        fmt.Sprintf("%d days", int(linkCheckMaxAge().Hours()/24)),
+	}
+	ExecTemplate(w, tmplCheckLinks, model)
+}
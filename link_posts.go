@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+)
+
+// Articles with "LinkURL:" header are link posts: commentary on a page
+// elsewhere. Their title links to that page on the main page, in feeds and
+// on the article page, with a separate permalink next to it (★ on the main
+// page). In atom feeds the entry link is LinkURL and the permalink is
+// <link rel="related"> (the id stays the same as for other articles). In
+// JSON Feed it's external_url.
+
+func (a *Article) IsLinkPost() bool {
+	return a.LinkURL != ""
+}
+
+// where the title of the article links to
+func (a *Article) TitleUrl() string {
+	if a.IsLinkPost() {
+		return a.LinkURL
+	}
+	return "/" + a.Permalink()
+}
+
+// host of LinkURL, to show next to the title
+func (a *Article) LinkHost() string {
+	u, err := url.Parse(a.LinkURL)
+	if err != nil {
+		return a.LinkURL
+	}
+	return u.Host
+}
+
+// links[i] is LinkURL of the i-th entry of atom feed d ("" if it's not a
+// link post)
+func addFeedEntryLinks(d []byte, links []string) []byte {
+	var b bytes.Buffer
+	for _, link := range links {
+		end := bytes.Index(d, []byte("</entry>"))
+		if end == -1 {
+			break
+		}
+		if link == "" {
+			b.Write(d[:end])
+		} else {
+			b.Write(setEntryLink(d[:end], link))
+		}
+		d = d[end:]
+	}
+	b.Write(d)
+	return b.Bytes()
+}
+
+// replaces href of the first <link> in entry with link and adds the old
+// href as <link rel="related">. entry is returned unchanged if it has no
+// <link> with href
+func setEntryLink(entry []byte, link string) []byte {
+	entryStart := bytes.Index(entry, []byte("<entry"))
+	if entryStart == -1 {
+		return entry
+	}
+	start := bytes.Index(entry[entryStart:], []byte("<link"))
+	if start == -1 {
+		return entry
+	}
+	start += entryStart
+	tagEnd := bytes.IndexByte(entry[start:], '>')
+	if tagEnd == -1 {
+		return entry
+	}
+	tagEnd += start + 1
+	tag := entry[start:tagEnd]
+	hrefStart := bytes.Index(tag, []byte(`href="`))
+	if hrefStart == -1 {
+		return entry
+	}
+	hrefStart += len(`href="`)
+	hrefLen := bytes.IndexByte(tag[hrefStart:], '"')
+	if hrefLen == -1 {
+		return entry
+	}
+	hrefStart += start
+	hrefEnd := hrefStart + hrefLen
+	// <link ... /> or <link ...></link>
+	end := tagEnd
+	if !bytes.HasSuffix(tag, []byte("/>")) && bytes.HasPrefix(entry[tagEnd:], []byte("</link>")) {
+		end += len("</link>")
+	}
+	var b bytes.Buffer
+	b.Write(entry[:hrefStart])
+	b.WriteString(html.EscapeString(link))
+	b.Write(entry[hrefEnd:end])
+	b.WriteString(`<link rel="related" href="`)
+	b.Write(entry[hrefStart:hrefEnd])
+	b.WriteString(`"/>`)
+	b.Write(entry[end:])
+	return b.Bytes()
+}
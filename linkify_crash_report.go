@@ -3,7 +3,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kjk/u"
 )
@@ -60,23 +66,143 @@ func findFileFixes(dir string) {
 	}
 }
 
-// 0114C072 01:0004B072 sumatrapdf.exe!CrashMe+0x2
+// Crash reports from SumatraPDF have source locations like:
 // c:\users\kkowalczyk\src\sumatrapdf\src\utils\baseutil.cpp+14
+// We turn them into links to the file in the repository. Paths in crash
+// reports are lower-cased so we need an index of files in a checkout of
+// sumatra sources (config.SumatraSrcDir) to get the real name. The index
+// is built on first crash view and can be rebuilt with
+// /app/crashsrcrefresh after updating the checkout.
 
-func linkifyCrashReportLine(l []byte) []byte {
-	i := bytes.Index(l, []byte("\\sumatrapdf"))
-	if -1 == i {
-		return l
+type SrcIndex struct {
+	// lower-cased path with '\' as separator => path with '/'
+	files map[string]string
+}
+
+var (
+	srcIndexMu sync.Mutex
+	srcIndex   *SrcIndex
+)
+
+func srcLinksEnabled() bool {
+	c := getConfig()
+	return !StringEmpty(c.SumatraSrcDir) && !StringEmpty(c.SumatraSrcUrl)
+}
+
+func isSrcExt(path string) bool {
+	for _, ext := range validSrcExts {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
 	}
-	found := false
-	for ; i >= 0; i-- {
-		if l[i] == ' ' {
-			found = true
-			break
+	return false
+}
+
+func buildSrcIndex(dir string) (*SrcIndex, error) {
+	idx := &SrcIndex{files: make(map[string]string)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isSrcExt(path) {
+			return nil
 		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		key := strings.ToLower(strings.Replace(rel, "/", "\\", -1))
+		idx.files[key] = rel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// path is in the form src\utils\baseutil.cpp
+func (idx *SrcIndex) Lookup(path string) (string, bool) {
+	if idx == nil {
+		return "", false
+	}
+	res, ok := idx.files[strings.ToLower(path)]
+	return res, ok
+}
+
+func (idx *SrcIndex) FilesCount() int {
+	return len(idx.files)
+}
+
+// rebuilds the index from config.SumatraSrcDir
+func refreshSrcIndex() (*SrcIndex, error) {
+	timeStart := time.Now()
+	idx, err := buildSrcIndex(*getConfig().SumatraSrcDir)
+	if err != nil {
+		return nil, err
 	}
-	if !found {
-		return l
+	srcIndexMu.Lock()
+	srcIndex = idx
+	srcIndexMu.Unlock()
+	logger.Noticef("refreshSrcIndex(): indexed %d files in %s", idx.FilesCount(), time.Since(timeStart))
+	return idx, nil
+}
+
+// returns nil if source links are not enabled or we failed to build the index
+func getSrcIndex() *SrcIndex {
+	if !srcLinksEnabled() {
+		return nil
+	}
+	srcIndexMu.Lock()
+	idx := srcIndex
+	srcIndexMu.Unlock()
+	if idx != nil {
+		return idx
+	}
+	idx, err := refreshSrcIndex()
+	if err != nil {
+		logger.Errorf("getSrcIndex(): %s", err)
+		// don't re-try on every crash view, /app/crashsrcrefresh does it
+		idx = &SrcIndex{files: make(map[string]string)}
+		srcIndexMu.Lock()
+		srcIndex = idx
+		srcIndexMu.Unlock()
+	}
+	return idx
+}
+
+func srcUrlTemplate() string {
+	if !srcLinksEnabled() {
+		return ""
+	}
+	return *getConfig().SumatraSrcUrl
+}
+
+// urlTmpl is e.g. https://github.com/sumatrapdfreader/sumatrapdf/blob/master/${path}#L${line}
+func srcUrl(urlTmpl, path, line string) string {
+	s := strings.Replace(urlTmpl, "${path}", path, -1)
+	return strings.Replace(s, "${line}", line, -1)
+}
+
+// 0114C072 01:0004B072 sumatrapdf.exe!CrashMe+0x2 c:\users\kkowalczyk\src\sumatrapdf\src\utils\baseutil.cpp+14
+// returns html of the line, with the source location linked if it's a
+// file in idx
+func linkifyCrashReportLine(l []byte, idx *SrcIndex, urlTmpl string) string {
+	escaped := html.EscapeString(string(l))
+	i := bytes.Index(l, []byte("\\sumatrapdf"))
+	if -1 == i {
+		return escaped
+	}
+	i = bytes.LastIndex(l[:i], []byte(" "))
+	if i == -1 {
+		return escaped
 	}
 	before := l[:i]
 	file := l[i+1:]
@@ -84,46 +210,52 @@ func linkifyCrashReportLine(l []byte) []byte {
 	// whose name starts with \sumatrapdf (e.g. \sumatrapdf\ or
 	// \sumatrapdf-2.1.1\)
 	i = bytes.Index(file, []byte("\\sumatrapdf")) + 1
-	found = false
-	for ; i < len(file); i++ {
-		if file[i] == '\\' {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return l
+	j := bytes.IndexByte(file[i:], '\\')
+	if j == -1 {
+		return escaped
 	}
-	file = file[i+1:]
-	fileStr := string(file)
-	// at this point file is in the form src\print+420
-	parts := strings.Split(fileStr, "+")
+	// at this point path is in the form src\print.cpp+420
+	parts := strings.Split(string(file[i+j+1:]), "+")
 	if len(parts) != 2 {
-		return l
+		return escaped
 	}
-	fileStr = parts[0]
-	lineStr := parts[1]
-
-	res := make([]byte, 0)
-	res = append(res, before...)
-	res = append(res, '+')
-	res = append(res, []byte(fileStr)...)
-	res = append(res, '#')
-	res = append(res, []byte(lineStr)...)
-	return res
+	path, ok := idx.Lookup(parts[0])
+	if !ok {
+		return escaped
+	}
+	uri := srcUrl(urlTmpl, path, parts[1])
+	return fmt.Sprintf(`%s <a href="%s">%s</a>`, html.EscapeString(string(before)), html.EscapeString(uri), html.EscapeString(string(file)))
 }
 
-func linkifyCrashReport(s []byte) []byte {
-	res := make([]byte, 0)
+// returns crash report as html, with links to source code if idx is given
+func linkifyCrashReport(s []byte, idx *SrcIndex, urlTmpl string) []byte {
+	var buf bytes.Buffer
 	var l []byte
 	for {
 		l, s = ExtractLine(s)
 		if l == nil {
 			break
 		}
-		l = linkifyCrashReportLine(l)
-		res = append(res, l...)
-		res = append(res, '\n')
+		buf.WriteString(linkifyCrashReportLine(l, idx, urlTmpl))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// POST /app/crashsrcrefresh
+func handleCrashSrcRefresh(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" || !srcLinksEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	idx, err := refreshSrcIndex()
+	if err != nil {
+		logger.Errorf("handleCrashSrcRefresh(): %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	return res
+	textResponse(w, r, fmt.Sprintf("indexed %d source files", idx.FilesCount()))
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// To not run out of memory under a burst of requests to expensive pages we
+// limit how many requests can be processed at the same time. When over
+// the limit, requests to expensive pages get a quick 503. Cheap pages
+// (articles, static files) are always served and so are admin's requests.
+// Crash pages have their own, lower limit.
+
+const (
+	routeCheap = iota
+	routeExpensive
+	routeCrashes
+)
+
+// how long we ask clients to wait before retrying a shed request, in seconds
+const shedRetryAfter = "5"
+
+// prefixes of urls of pages that are expensive to generate
+var expensiveRoutePrefixes = []string{"/app/", "/og/", "/archives.html", "/tag/", "/atom-all.xml"}
+
+func routeClass(path string) int {
+	// submitting crashes is cheap and we don't want to lose them
+	if path == "/app/crashsubmit" {
+		return routeCheap
+	}
+	if strings.HasPrefix(path, "/app/crash") {
+		return routeCrashes
+	}
+	for _, prefix := range expensiveRoutePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return routeExpensive
+		}
+	}
+	return routeCheap
+}
+
+type LoadShedder struct {
+	// 0 means no limit
+	maxReqs      int64
+	maxCrashReqs int64
+	currReqs     int64
+	currCrash    int64
+	m            *Metrics
+}
+
+// current state for the admin
+type LoadStats struct {
+	CurrReqs      int64
+	MaxReqs       int64
+	CurrCrashReqs int64
+	MaxCrashReqs  int64
+	ShedReqs      int64
+}
+
+var appLoadShedder *LoadShedder
+
+func NewLoadShedder(maxReqs, maxCrashReqs int, m *Metrics) *LoadShedder {
+	m.MaxReqs.Update(int64(maxReqs))
+	m.MaxCrashReqs.Update(int64(maxCrashReqs))
+	return &LoadShedder{
+		maxReqs:      int64(maxReqs),
+		maxCrashReqs: int64(maxCrashReqs),
+		m:            m,
+	}
+}
+
+func overLimit(curr, max int64) bool {
+	return max > 0 && curr > max
+}
+
+// returns false if request should be rejected. If it returns true, release()
+// must be called after the request is served
+func (ls *LoadShedder) acquire(class int, isAdmin bool) bool {
+	n := atomic.AddInt64(&ls.currReqs, 1)
+	if class != routeCheap && !isAdmin && overLimit(n, ls.maxReqs) {
+		atomic.AddInt64(&ls.currReqs, -1)
+		return false
+	}
+	if class == routeCrashes {
+		n = atomic.AddInt64(&ls.currCrash, 1)
+		if !isAdmin && overLimit(n, ls.maxCrashReqs) {
+			atomic.AddInt64(&ls.currCrash, -1)
+			atomic.AddInt64(&ls.currReqs, -1)
+			return false
+		}
+		ls.m.CurrentCrashReqs.Inc(1)
+	}
+	return true
+}
+
+func (ls *LoadShedder) release(class int) {
+	if class == routeCrashes {
+		atomic.AddInt64(&ls.currCrash, -1)
+		ls.m.CurrentCrashReqs.Dec(1)
+	}
+	atomic.AddInt64(&ls.currReqs, -1)
+}
+
+func (ls *LoadShedder) Stats() LoadStats {
+	return LoadStats{
+		CurrReqs:      atomic.LoadInt64(&ls.currReqs),
+		MaxReqs:       ls.maxReqs,
+		CurrCrashReqs: atomic.LoadInt64(&ls.currCrash),
+		MaxCrashReqs:  ls.maxCrashReqs,
+		ShedReqs:      ls.m.ShedReqs.Count(),
+	}
+}
+
+// wraps fn so that it's not called when we're over the limit. Returns fn
+// if ls is nil
+func (ls *LoadShedder) Wrap(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if ls == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		class := routeClass(r.URL.Path)
+		if !ls.acquire(class, class != routeCheap && IsAdmin(r)) {
+			ls.m.ShedReqs.Inc(1)
+			w.Header().Set("Retry-After", shedRetryAfter)
+			http.Error(w, "Server is busy, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer ls.release(class)
+		fn(w, r)
+	}
+}
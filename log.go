@@ -1,18 +1,26 @@
 // This code is in Public Domain. Take all the code you want, I'll just write more.
 package main
 
-// TODO: add an option to log to a file in the format:
+// Messages have a level: debug, notice or error. Those below the threshold
+// (notice by default, LogLevel in config.json, can be changed by admin on
+// /logs) are dropped. Errors and notices are remembered for /logs (debug
+// messages with notices) and, if File is set, written to it as:
 // $time E: $msg
 // $time N: $msg
-// E: is for errors, N: is for notices
-// format of $time is TBD (human readable is long, unix timestamp is short
-// but not human-readable)
+// $time D: $msg
+// or as json if JSON is set and the message has fields (see log_file.go).
 
 // TODO: gather all errors and email them periodically (e.g. every day) to myself
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kjk/u"
@@ -21,12 +29,20 @@ import (
 type TimestampedMsg struct {
 	Time time.Time
 	Msg  string
+	// increases with each remembered message (errors and notices share
+	// it), used as a cursor by /app/logs.json
+	Seq   uint64
+	Level LogLevel
+	// id of the request for messages logged with req_id field
+	ReqId string
 }
 
 type CircularMessagesBuf struct {
 	Msgs []TimestampedMsg
 	pos  int
 	full bool
+	// Seq of the last message that was overwritten
+	DroppedSeq uint64
 }
 
 func (m *TimestampedMsg) TimeStr() string {
@@ -46,11 +62,17 @@ func NewCircularMessagesBuf(cap int) *CircularMessagesBuf {
 }
 
 func (b *CircularMessagesBuf) Add(s string) {
-	var msg = TimestampedMsg{time.Now(), s}
+	b.AddMsg(TimestampedMsg{Time: time.Now(), Msg: s})
+}
+
+func (b *CircularMessagesBuf) AddMsg(msg TimestampedMsg) {
 	if b.pos == cap(b.Msgs) {
 		b.pos = 0
 		b.full = true
 	}
+	if b.full {
+		b.DroppedSeq = b.Msgs[b.pos].Seq
+	}
 	b.Msgs[b.pos] = msg
 	b.pos += 1
 }
@@ -71,10 +93,47 @@ func (b *CircularMessagesBuf) GetOrdered() []*TimestampedMsg {
 	return res
 }
 
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelNotice
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "notice", "error"}
+
+func (lvl LogLevel) String() string {
+	if lvl < LevelDebug || lvl > LevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(lvl))
+	}
+	return logLevelNames[lvl]
+}
+
+func parseLogLevel(s string) (LogLevel, bool) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), true
+		}
+	}
+	return LevelNotice, false
+}
+
 type ServerLogger struct {
+	// protects Errors and Notices, which are written from many goroutines
+	mu        sync.Mutex
 	Errors    *CircularMessagesBuf
 	Notices   *CircularMessagesBuf
 	UseStdout bool
+	// if true, messages with fields are logged as json, which is easier
+	// to process by tools. Otherwise as "msg key=value ..."
+	JSON bool
+	// if set, all messages are also written there
+	File *RotatingFile
+	// messages below it are dropped, accessed atomically
+	level int32
+	// Seq of the last remembered message, protected by mu
+	seq uint64
 }
 
 func NewServerLogger(errorsMax, noticesMax int, useStdout bool) *ServerLogger {
@@ -82,62 +141,200 @@ func NewServerLogger(errorsMax, noticesMax int, useStdout bool) *ServerLogger {
 		Errors:    NewCircularMessagesBuf(errorsMax),
 		Notices:   NewCircularMessagesBuf(noticesMax),
 		UseStdout: useStdout,
+		level:     int32(LevelNotice),
 	}
 	return l
 }
 
+func (l *ServerLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *ServerLogger) SetLevel(lvl LogLevel) {
+	atomic.StoreInt32(&l.level, int32(lvl))
+}
+
+func (l *ServerLogger) Enabled(lvl LogLevel) bool {
+	return lvl >= l.Level()
+}
+
+var logLevelPrefixes = []string{"Debug: ", "", "Error: "}
+
+// remember is false for messages that shouldn't push out others from /logs.
+// structured is true if s was formatted by formatFields()
+func (l *ServerLogger) log(lvl LogLevel, s, reqId string, remember, structured bool) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	if remember {
+		l.mu.Lock()
+		l.seq++
+		msg := TimestampedMsg{Time: time.Now(), Msg: s, Seq: l.seq, Level: lvl, ReqId: reqId}
+		if lvl == LevelError {
+			l.Errors.AddMsg(msg)
+		} else {
+			l.Notices.AddMsg(msg)
+		}
+		l.mu.Unlock()
+	}
+	if l.UseStdout {
+		fmt.Printf("%s%s\n", logLevelPrefixes[lvl], s)
+	}
+	if l.File != nil {
+		l.File.WriteLine(formatLogLine(time.Now(), lvl, s, structured && l.JSON))
+	}
+}
+
 func (l *ServerLogger) Error(s string) {
-	l.Errors.Add(s)
-	fmt.Printf("Error: %s\n", s)
+	l.log(LevelError, s, "", true, false)
 }
 
 func (l *ServerLogger) Errorf(format string, v ...interface{}) {
-	s := fmt.Sprintf(format, v...)
-	l.Errors.Add(s)
-	fmt.Printf("Error: %s\n", s)
+	l.log(LevelError, fmt.Sprintf(format, v...), "", true, false)
 }
 
 func (l *ServerLogger) Notice(s string) {
-	l.Notices.Add(s)
-	fmt.Printf("%s\n", s)
+	l.log(LevelNotice, s, "", true, false)
 }
 
 func (l *ServerLogger) Noticef(format string, v ...interface{}) {
-	s := fmt.Sprintf(format, v...)
-	l.Notices.Add(s)
-	fmt.Printf("%s\n", s)
+	l.log(LevelNotice, fmt.Sprintf(format, v...), "", true, false)
+}
+
+func (l *ServerLogger) Debug(s string) {
+	l.log(LevelDebug, s, "", true, false)
+}
+
+// arguments are not formatted if debug messages are dropped
+func (l *ServerLogger) Debugf(format string, v ...interface{}) {
+	if l.Enabled(LevelDebug) {
+		l.log(LevelDebug, fmt.Sprintf(format, v...), "", true, false)
+	}
+}
+
+// kv is a list of key, value pairs
+func (l *ServerLogger) formatFields(level, msg string, kv []interface{}) string {
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(missing)")
+	}
+	var buf bytes.Buffer
+	if l.JSON {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level)
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, kv[i+1])
+		}
+		buf.WriteByte('}')
+		return buf.String()
+	}
+	buf.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&buf, " %v=%s", kv[i], v)
+	}
+	return buf.String()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	if d, ok := v.(time.Duration); ok {
+		v = d.String()
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(d)
+}
+
+// returns value of req_id in a list of key, value pairs
+func reqIdOf(kv []interface{}) string {
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i] == "req_id" {
+			return fmt.Sprint(kv[i+1])
+		}
+	}
+	return ""
+}
+
+// Noticew logs msg with key, value pairs e.g.:
+// logger.Noticew("backup done", "file", name, "size", size)
+func (l *ServerLogger) Noticew(msg string, kv ...interface{}) {
+	if l.Enabled(LevelNotice) {
+		l.log(LevelNotice, l.formatFields("notice", msg, kv), reqIdOf(kv), true, true)
+	}
+}
+
+func (l *ServerLogger) Errorw(msg string, kv ...interface{}) {
+	l.log(LevelError, l.formatFields("error", msg, kv), reqIdOf(kv), true, true)
+}
+
+func (l *ServerLogger) Debugw(msg string, kv ...interface{}) {
+	if l.Enabled(LevelDebug) {
+		l.log(LevelDebug, l.formatFields("debug", msg, kv), reqIdOf(kv), true, true)
+	}
+}
+
+// like Errorf but includes id of the request (see makeTimingHandler)
+func (l *ServerLogger) RequestErrorf(r *http.Request, format string, v ...interface{}) {
+	l.Errorw(fmt.Sprintf(format, v...), "req_id", getRequestId(r))
+}
+
+// logs a served request, at notice level. Those are only printed and
+// written to the file, not remembered, so that they don't push out other
+// messages from /logs
+func (l *ServerLogger) logRequest(kv ...interface{}) {
+	if l.Enabled(LevelNotice) {
+		l.log(LevelNotice, l.formatFields("request", "request", kv), reqIdOf(kv), false, true)
+	}
 }
 
 func (l *ServerLogger) GetErrors() []*TimestampedMsg {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.Errors.GetOrdered()
 }
 
 func (l *ServerLogger) GetNotices() []*TimestampedMsg {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.Notices.GetOrdered()
 }
 
-// /logs
-func handleLogs(w http.ResponseWriter, r *http.Request) {
-	cookie := getSecureCookie(r)
-	isAdmin := cookie.TwitterUser == "kjk" // only I can see the logs
-	model := struct {
-		UserIsAdmin bool
-		Errors      []*TimestampedMsg
-		Notices     []*TimestampedMsg
-		Header      *http.Header
-	}{
-		UserIsAdmin: isAdmin,
+// POST /app/log-level
+// level   : debug, notice or error
+// Changes threshold of messages until restart or until LogLevel in config
+// changes.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
 	}
-
-	if model.UserIsAdmin {
-		model.Errors = logger.GetErrors()
-		model.Notices = logger.GetNotices()
+	if !checkCsrf(w, r) {
+		return
 	}
-
-	if r.FormValue("show") != "" {
-		model.Header = &r.Header
-		model.Header.Add("RealIp", getIpAddress(r))
+	lvl, ok := parseLogLevel(r.FormValue("level"))
+	if !ok {
+		serveFieldError(w, r, "level", "level must be debug, notice or error")
+		return
 	}
-
-	ExecTemplate(w, tmplLogs, model)
+	msg := fmt.Sprintf("handleLogLevel(): log level changed from %s to %s", logger.Level(), lvl)
+	// logged with the level that lets it through
+	if logger.Enabled(LevelNotice) {
+		logger.Notice(msg)
+		logger.SetLevel(lvl)
+	} else {
+		logger.SetLevel(lvl)
+		logger.Notice(msg)
+	}
+	http.Redirect(w, r, "/logs", http.StatusSeeOther)
 }
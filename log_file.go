@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Logs are written to logs/blog.log in data directory. When the file would
+// grow over LogMaxSizeMB (defaultLogMaxSizeMB if 0), it's renamed to
+// blog.log.1 (blog.log.1 to blog.log.2 etc.) and a new one is started. We
+// keep LogMaxFiles (defaultLogMaxFiles if 0) of old files. Both are only
+// used at startup.
+
+const (
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxFiles  = 5
+	logTimeFormat       = "2006-01-02 15:04:05"
+)
+
+var logLevelLetters = []string{"D", "N", "E"}
+
+func logFilePath() string {
+	return filepath.Join(getDataDir(), "logs", "blog.log")
+}
+
+// formats a line of log file. msg is written as is if json is true
+func formatLogLine(t time.Time, lvl LogLevel, msg string, json bool) string {
+	if json {
+		return msg
+	}
+	return t.Format(logTimeFormat) + " " + logLevelLetters[lvl] + ": " + msg
+}
+
+// RotatingFile is a file that is rotated when it gets bigger than maxSize.
+// It's safe to write to it from many goroutines
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+	closed   bool
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotatedPath(n int) string {
+	return rf.path + "." + strconv.Itoa(n)
+}
+
+// must be called with the lock held
+func (rf *RotatingFile) rotate() error {
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+	if rf.maxFiles > 0 {
+		os.Remove(rf.rotatedPath(rf.maxFiles))
+		for n := rf.maxFiles - 1; n >= 1; n-- {
+			err := os.Rename(rf.rotatedPath(n), rf.rotatedPath(n+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(rf.path, rf.rotatedPath(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) Write(d []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.f != nil && rf.size > 0 && rf.size+int64(len(d)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.f == nil {
+		// previous rotation failed, try again
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(d)
+	rf.size += int64(n)
+	return n, err
+}
+
+// we can't log errors of writing logs so they go to stderr. Messages logged
+// after Close() (when shutting down) are dropped
+func (rf *RotatingFile) WriteLine(s string) {
+	if _, err := rf.Write([]byte(s + "\n")); err != nil && err != os.ErrClosed {
+		fmt.Fprintf(os.Stderr, "RotatingFile.WriteLine(): writing to %s failed with %s\n", rf.path, err)
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	rf.closed = true
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// starts writing logs to logFilePath()
+func openLogFile() {
+	c := getConfig()
+	maxSizeMB := c.LogMaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultLogMaxSizeMB
+	}
+	maxFiles := c.LogMaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultLogMaxFiles
+	}
+	rf, err := OpenRotatingFile(logFilePath(), int64(maxSizeMB)*1024*1024, maxFiles)
+	if err != nil {
+		logger.Errorf("openLogFile(): OpenRotatingFile() failed with %s", err)
+		return
+	}
+	logger.File = rf
+	logger.Noticef("openLogFile(): logging to %s", logFilePath())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /logs shows remembered log messages (errors and notices, see log.go),
+// newest first, optionally only those with at least a given level and/or
+// containing a string. In follow mode the page polls /app/logs.json for
+// messages newer than the last one it has. The cursor is Seq of a message,
+// which keeps increasing when ring buffers wrap around; if messages newer
+// than the cursor were pushed out of the buffers before we got them, the
+// response says so (Gap). If the server was restarted (cursor is newer than
+// all messages), we start from the oldest message we have.
+
+const (
+	maxLogEntriesPerResponse = 200
+	maxLogResponseBytes      = 256 * 1024
+	// longer messages are cut in the summary line
+	logSummaryChars = 160
+)
+
+type LogFilter struct {
+	MinLevel LogLevel
+	// case-insensitive, matches message or request id
+	Query string
+}
+
+func parseLogFilter(r *http.Request) *LogFilter {
+	f := &LogFilter{MinLevel: LevelDebug}
+	if lvl, ok := parseLogLevel(r.FormValue("level")); ok {
+		f.MinLevel = lvl
+	}
+	f.Query = strings.TrimSpace(r.FormValue("q"))
+	return f
+}
+
+func (f *LogFilter) Matches(m *TimestampedMsg) bool {
+	if m.Level < f.MinLevel {
+		return false
+	}
+	if f.Query == "" {
+		return true
+	}
+	q := strings.ToLower(f.Query)
+	return strings.Contains(strings.ToLower(m.Msg), q) || strings.Contains(strings.ToLower(m.ReqId), q)
+}
+
+type LogEntry struct {
+	Seq     uint64 `json:"seq"`
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	ReqId   string `json:"req_id,omitempty"`
+	Summary string `json:"summary"`
+	Msg     string `json:"msg"`
+}
+
+func newLogEntry(m *TimestampedMsg) *LogEntry {
+	summary := m.Msg
+	if i := strings.IndexByte(summary, '\n'); i != -1 {
+		summary = summary[:i] + "…"
+	}
+	if r := []rune(summary); len(r) > logSummaryChars {
+		summary = string(r[:logSummaryChars]) + "…"
+	}
+	return &LogEntry{
+		Seq:     m.Seq,
+		Time:    m.TimeStr(),
+		Level:   m.Level.String(),
+		ReqId:   m.ReqId,
+		Summary: summary,
+		Msg:     m.Msg,
+	}
+}
+
+// MessagesAfter returns remembered messages with Seq > after, oldest first,
+// Seq of the newest message and true if some messages with Seq > after
+// were pushed out of the buffers
+func (l *ServerLogger) MessagesAfter(after uint64) ([]*TimestampedMsg, uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []*TimestampedMsg
+	for _, b := range []*CircularMessagesBuf{l.Errors, l.Notices} {
+		for _, m := range b.GetOrdered() {
+			if m.Seq <= after {
+				break
+			}
+			// copy because the buffer will be overwritten
+			msg := *m
+			res = append(res, &msg)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Seq < res[j].Seq
+	})
+	gap := l.Errors.DroppedSeq > after || l.Notices.DroppedSeq > after
+	return res, l.seq, gap
+}
+
+type LogsResponse struct {
+	Entries []*LogEntry `json:"entries"`
+	// pass as after to get entries newer than those
+	Cursor uint64 `json:"cursor"`
+	// true if there are more entries after Cursor (response was capped)
+	More bool `json:"more"`
+	// true if some entries after the cursor were lost
+	Gap bool `json:"gap"`
+	// true if the cursor was newer than all entries (i.e. the server was
+	// restarted) and we started from the oldest one
+	Reset bool `json:"reset"`
+}
+
+// returns entries after the cursor matching f, oldest first, capped at
+// maxLogEntriesPerResponse and roughly maxLogResponseBytes
+func getLogsResponse(l *ServerLogger, after uint64, f *LogFilter) *LogsResponse {
+	res := &LogsResponse{Entries: []*LogEntry{}}
+	msgs, last, gap := l.MessagesAfter(after)
+	if after > last {
+		res.Reset = true
+		msgs, last, gap = l.MessagesAfter(0)
+	}
+	res.Gap = gap
+	res.Cursor = last
+	size := 0
+	for _, m := range msgs {
+		if !f.Matches(m) {
+			continue
+		}
+		e := newLogEntry(m)
+		n := len(e.Msg) + len(e.Summary) + len(e.ReqId) + 100
+		// we always send at least one entry so that the cursor moves
+		if len(res.Entries) == maxLogEntriesPerResponse || (len(res.Entries) > 0 && size+n > maxLogResponseBytes) {
+			res.More = true
+			res.Cursor = res.Entries[len(res.Entries)-1].Seq
+			break
+		}
+		size += n
+		res.Entries = append(res.Entries, e)
+	}
+	return res
+}
+
+// /logs
+// level   : optional, show only messages with at least this level
+// q       : optional, show only messages containing it
+// show    : if not empty, show headers of the request
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	model := struct {
+		BasePageModel
+		Entries []*LogEntry
+		Filter  *LogFilter
+		Cursor  uint64
+		Header  *http.Header
+		Load    *LoadStats
+		// threshold of messages, can be changed
+		Level     LogLevel
+		LogLevels []string
+	}{
+		BasePageModel: newBasePageModel(r),
+		Filter:        parseLogFilter(r),
+		Level:         logger.Level(),
+		LogLevels:     logLevelNames,
+	}
+
+	// only I can see the logs
+	if model.IsAdmin {
+		msgs, last, _ := logger.MessagesAfter(0)
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if model.Filter.Matches(msgs[i]) {
+				model.Entries = append(model.Entries, newLogEntry(msgs[i]))
+			}
+		}
+		model.Cursor = last
+		if appLoadShedder != nil {
+			stats := appLoadShedder.Stats()
+			model.Load = &stats
+		}
+	}
+
+	if r.FormValue("show") != "" {
+		model.Header = &r.Header
+		model.Header.Add("RealIp", getIpAddress(r))
+	}
+
+	ExecTemplate(w, tmplLogs, model)
+}
+
+// /app/logs.json, polled by /logs in follow mode
+// after   : cursor from the previous response
+// level, q: like /logs
+func handleLogsJson(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	after, _ := strconv.ParseUint(r.FormValue("after"), 10, 64)
+	d, err := json.Marshal(getLogsResponse(logger, after, parseLogFilter(r)))
+	if err != nil {
+		logger.RequestErrorf(r, "handleLogsJson(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeData(w, r, http.StatusOK, d)
+}
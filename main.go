@@ -1,27 +1,27 @@
 package main
 
 import (
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	_ "net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-	"unicode/utf8"
 
 	"github.com/garyburd/go-oauth/oauth"
 	"github.com/gorilla/securecookie"
-	"github.com/kjk/u"
+	"github.com/kjk/blog/internal/fsutil"
 )
 
 var (
@@ -35,22 +35,6 @@ var (
 		TokenRequestURI:               "https://api.twitter.com/oauth/access_token",
 	}
 
-	config = struct {
-		TwitterOAuthCredentials *oauth.Credentials
-		CookieAuthKeyHexStr     *string
-		CookieEncrKeyHexStr     *string
-		AnalyticsCode           *string
-		AwsAccess               *string
-		AwsSecret               *string
-		S3BackupBucket          *string
-		S3BackupDir             *string
-	}{
-		&oauthClient.Credentials,
-		nil, nil,
-		nil,
-		nil, nil,
-		nil, nil,
-	}
 	logger        *ServerLogger
 	cookieAuthKey []byte
 	cookieEncrKey []byte
@@ -67,52 +51,89 @@ func StringEmpty(s *string) bool {
 	return s == nil || 0 == len(*s)
 }
 
-func S3BackupEnabled() bool {
-	if !inProduction {
-		logger.Notice("s3 backups disabled because not in production")
-		return false
-	}
-	if StringEmpty(config.AwsAccess) {
-		logger.Notice("s3 backups disabled because AwsAccess not defined in config.json")
-		return false
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
 	}
-	if StringEmpty(config.AwsSecret) {
-		logger.Notice("s3 backups disabled because AwsSecret not defined in config.json")
-		return false
-	}
-	if StringEmpty(config.S3BackupBucket) {
-		logger.Notice("s3 backups disabled because S3BackupBucket not defined in config.json")
+	return *s
+}
+
+func BackupEnabled() bool {
+	if !inProduction {
+		logger.Notice("backups disabled because not in production")
 		return false
 	}
-	if StringEmpty(config.S3BackupDir) {
-		logger.Notice("s3 backups disabled because S3BackupDir not defined in config.json")
+	t, err := newBackupTarget(getConfig())
+	if err != nil {
+		logger.Noticef("backups disabled because %s", err)
 		return false
 	}
+	logger.Noticef("backups to %s enabled", t.Name())
 	return true
 }
 
+// sub-directories of data directory that the app expects to exist:
+// data has crash index (and is backed up as a zip), blobs_crashes has
+// crash reports (and is backed up file by file)
+var dataDirSkeleton = []string{"data", "blobs_crashes"}
+
+// returns data directory resolved by resolveDataDir(). All code that needs
+// data directory should call this instead of re-computing it
 func getDataDir() string {
-	if dataDir != "" {
-		return dataDir
+	panicif(dataDir == "", "getDataDir() called before resolveDataDir()")
+	return dataDir
+}
+
+func createDataDirSkeleton(dir string) error {
+	for _, sub := range dataDirSkeleton {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// on the server, must be done first because ExpandTildeInPath()
-	// doesn't work when cross-compiled on mac for linux
-	serverDir := filepath.Join("..", "..", "data")
-	dataDir = serverDir
-	if u.PathExists(dataDir) {
-		return dataDir
+// picks the data directory, in order of precedence:
+// - -datadir cmd-line flag
+// - BLOG_DATA_DIR env variable
+// - ../../data (on the server)
+// - ~/data/blog (locally)
+// If the directory was explicitly given, it (and expected sub-directories)
+// is created if it doesn't exist.
+func resolveDataDir() {
+	if dataDir == "" {
+		dataDir = os.Getenv("BLOG_DATA_DIR")
+	}
+	if dataDir != "" {
+		if err := createDataDirSkeleton(dataDir); err != nil {
+			log.Fatalf("failed to create data directory %q. %s\n", dataDir, err)
+		}
+		return
 	}
 
-	// locally
-	localDir := u.ExpandTildeInPath("~/data/blog")
-	dataDir = localDir
-	if u.PathExists(dataDir) {
-		return dataDir
+	serverDir := filepath.Join("..", "..", "data")
+	dirs := []string{serverDir}
+	localDir, err := fsutil.ExpandTilde("~/data/blog")
+	if err != nil {
+		logger.Errorf("resolveDataDir(): %s, not looking for ~/data/blog", err)
+	} else {
+		dirs = append(dirs, localDir)
+	}
+	for _, dir := range dirs {
+		exists, err := fsutil.PathExists(dir)
+		if err != nil {
+			log.Fatalf("failed to check data directory %q. %s\n", dir, err)
+		}
+		if exists {
+			dataDir = dir
+			if err := createDataDirSkeleton(dataDir); err != nil {
+				log.Fatalf("failed to create sub-directories of %q. %s\n", dataDir, err)
+			}
+			return
+		}
 	}
 
-	log.Fatalf("data directory (%q or %q) doesn't exist", serverDir, localDir)
-	return ""
+	log.Fatalf("data directory (%q or %q) doesn't exist. Use -datadir or BLOG_DATA_DIR to provide one (it'll be created if missing)", serverDir, localDir)
 }
 
 func isTopLevelUrl(url string) bool {
@@ -123,108 +144,22 @@ func getReferer(r *http.Request) string {
 	return r.Header.Get("Referer")
 }
 
-// this list was determined by watching /logs
-var noLog404 = map[string]bool{
-	"/crossdomain.xml":                                               true,
-	"/article/Exercise-links-1.html":                                 true,
-	"/article/Ecco-for-free.html":                                    true,
-	"/article/Disappointed-by-The-Bat.html":                          true,
-	"/article/Comments-need-not-apply.html":                          true,
-	"/article/Browsing-Newton.html":                                  true,
-	"/article/Perl-and-lisp-programmers.html":                        true,
-	"/article/iPod-competition.html":                                 true,
-	"/article/Programming-Jabber.html":                               true,
-	"/article/Good-software-design-contradicts-eXtreme-Program.html": true,
-	"/article/Bloglines-vs-Google-Reader-the-verdict.html":           true,
-	"/2002/07/30/stuid-coding-mistake-of-the-day.html":               true,
-	"/article/Corman-Lisp.html":                                      true,
-	"/article/Offshore-outsourcing.html":                             true,
-	"/article/Nabble-hosted-forums.html":                             true,
-}
-
-func shouldLog404(s string) bool {
-	if strings.HasPrefix(s, "/apple-touch-icon") {
-		return false
-	}
-	_, ok := noLog404[s]
-	return !ok
-}
-
 func userIsAdmin(cookie *SecureCookieValue) bool {
 	return cookie.TwitterUser == "kjk"
 }
 
-// reads the configuration file from the path specified by
-// the config command line flag.
-func readConfig(configFile string) error {
-	b, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(b, &config)
-	if err != nil {
-		return err
-	}
-	cookieAuthKey, err = hex.DecodeString(*config.CookieAuthKeyHexStr)
-	if err != nil {
-		return err
-	}
-	cookieEncrKey, err = hex.DecodeString(*config.CookieEncrKeyHexStr)
-	if err != nil {
-		return err
-	}
-	secureCookie = securecookie.New(cookieAuthKey, cookieEncrKey)
-	// verify auth/encr keys are correct
-	val := map[string]string{
-		"foo": "bar",
-	}
-	_, err = secureCookie.Encode(cookieName, val)
-	if err != nil {
-		// for convenience, if the auth/encr keys are not set,
-		// generate valid, random value for them
-		auth := securecookie.GenerateRandomKey(32)
-		encr := securecookie.GenerateRandomKey(32)
-		fmt.Printf("auth: %s\nencr: %s\n", hex.EncodeToString(auth), hex.EncodeToString(encr))
-	}
-	// TODO: somehow verify twitter creds
-	return err
-}
-
 // Request.RemoteAddress contains port, which we want to remove i.e.:
 // "[::1]:58292" => "[::1]"
-func ipAddrFromRemoteAddr(s string) string {
-	idx := strings.LastIndex(s, ":")
-	if idx == -1 {
-		return s
-	}
-	return s[:idx]
-}
-
-func getIpAddress(r *http.Request) string {
-	hdr := r.Header
-	hdrRealIp := hdr.Get("X-Real-Ip")
-	hdrForwardedFor := hdr.Get("X-Forwarded-For")
-	if hdrRealIp == "" && hdrForwardedFor == "" {
-		return ipAddrFromRemoteAddr(r.RemoteAddr)
-	}
-	if hdrForwardedFor != "" {
-		// X-Forwarded-For is potentially a list of addresses separated with ","
-		parts := strings.Split(hdrForwardedFor, ",")
-		for i, p := range parts {
-			parts[i] = strings.TrimSpace(p)
-		}
-		// TODO: should return first non-local address
-		return parts[0]
-	}
-	return hdrRealIp
-}
-
 func jQueryUrl() string {
 	//return "/js/jquery-1.4.2.js"
 	return "//cdnjs.cloudflare.com/ajax/libs/jquery/1.8.3/jquery.min.js"
 }
 
+// empty if code is highlighted on the server
 func highlightJsUrl() string {
+	if !getConfig().ClientSideHighlighting {
+		return ""
+	}
 	return "//cdnjs.cloudflare.com/ajax/libs/highlight.js/8.4/highlight.min.js"
 }
 
@@ -232,13 +167,90 @@ func highlightCssUrl() string {
 	return "https://cdnjs.cloudflare.com/ajax/libs/highlight.js/8.4/styles/default.min.css"
 }
 
+// remembers the status code and size of the response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(d []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(d)
+	w.size += n
+	return n, err
+}
+
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type requestIdKey struct{}
+
+// ids only need to be unique enough to find log lines of a given request
+func newRequestId() string {
+	return fmt.Sprintf("%016x", uint64(rand.Int63()))
+}
+
+// returns id assigned to r by newTimingHandler or "" if there's none
+func getRequestId(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
 func makeTimingHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return newTimingHandler(appMetrics, appLoadShedder.Wrap(fn))
+}
+
+// like makeTimingHandler but POSTs are rate limited (see rate_limit.go)
+func makeRateLimitedHandler(path string, fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return makeTimingHandler(appRateLimiter.Wrap(path, fn))
+}
+
+// wraps fn with gzip compression, logging of requests and slow pages,
+// recovering from panics and updating of request metrics in m. Each
+// request gets an id, sent back in X-Request-Id header, which can be used
+// to find its log lines
+func newTimingHandler(m *Metrics, fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		metricCurrentReqs.Inc(1)
-		defer metricCurrentReqs.Dec(1)
+		m.CurrentReqs.Inc(1)
+		defer m.CurrentReqs.Dec(1)
 		startTime := time.Now()
-		fn(w, r)
+		reqId := newRequestId()
+		w.Header().Set("X-Request-Id", reqId)
+		r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, reqId))
+		class := classifyRequest(r)
+		r = withTrafficClass(r, class)
+		sw := &statusResponseWriter{ResponseWriter: w}
+		gw, closeGzip := maybeGzipResponse(sw, r)
+		if r.Method == "HEAD" {
+			gw = &headResponseWriter{gw}
+		}
+		func() {
+			defer recoverHandlerPanic(gw, r, sw)
+			fn(gw, r)
+		}()
+		closeGzip()
+		if sw.status == http.StatusNotFound {
+			record404(m, r)
+		}
 		duration := time.Now().Sub(startTime)
+		logger.logRequest("req_id", reqId, "method", r.Method, "path", r.URL.Path,
+			"status", sw.status, "size", sw.size, "duration_ms", durationMs(duration),
+			"ip", getIpAddress(r), "referer", r.Referer(), "class", class)
 		// log urls that take long time to generate i.e. over 1 sec in production
 		// or over 0.1 sec in dev
 		shouldLog := duration.Seconds() > 1.0
@@ -253,24 +265,63 @@ func makeTimingHandler(fn func(http.ResponseWriter, *http.Request)) http.Handler
 			logger.Noticef("%q took %f seconds to serve", url, duration.Seconds())
 		}
 		// TODO: add query to url
-		metricHttpReqRate.Mark(1)
-		metricHttpReqTime.Update(duration)
-		LogSlowPage(r.URL.Path, duration)
+		m.HttpReqRate.Mark(1)
+		m.HttpReqTime.Update(duration)
+		m.HttpReqRateOf(class).Mark(1)
+		m.HttpReqTimeOf(class).Update(duration)
+		// pages slow only for the admin or bots don't matter
+		if class == trafficHuman {
+			LogSlowPage(r.URL.Path, duration)
+		}
+		trafficStats.Add(r.URL.Path, class, sw.status, duration, time.Now())
+		if l := accessLog; l != nil && !l.Log(formatAccessLogLine(r, startTime, sw.status, sw.size)) {
+			m.DroppedAccessLogLines.Inc(1)
+		}
 	}
 }
 
+// rounded to 0.01 ms to keep log lines short
+func durationMs(d time.Duration) float64 {
+	return float64(d/(10*time.Microsecond)) / 100
+}
+
 func setContentType(w http.ResponseWriter, contentType string) {
 	w.Header().Set("Content-Type", contentType)
 }
 
-func writeResponse(w http.ResponseWriter, responseBody string) {
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(responseBody)), 10))
-	io.WriteString(w, responseBody)
+// writes d with a given status. HEAD requests only get headers, including
+// Content-Length of d
+func writeData(w http.ResponseWriter, r *http.Request, status int, d []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(d)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(d)
+	}
 }
 
-func textResponse(w http.ResponseWriter, text string) {
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, responseBody string) {
+	writeData(w, r, status, []byte(responseBody))
+}
+
+func textResponse(w http.ResponseWriter, r *http.Request, text string) {
 	setContentType(w, "text/plain")
-	writeResponse(w, text)
+	writeResponse(w, r, http.StatusOK, text)
+}
+
+// for HEAD requests, drops the body written by handlers that don't check
+// for HEAD (e.g. ExecTemplate), which already set Content-Length
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(d []byte) (int, error) {
+	return len(d), nil
+}
+
+func (w *headResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 var emptyString = ""
@@ -288,13 +339,123 @@ var (
 	httpAddr        string
 	inProduction    bool
 	newArticleTitle string
+	// max length (in bytes) of slug generated by -newarticle
+	maxSlugLen int
+	// timestamp of backup to restore, e.g. 160301_1204
+	restoreBackupTimestamp string
+	// -fsck, -repair and -compact of crash reports store
+	fsckFlag    bool
+	repairFlag  bool
+	compactFlag bool
+	// parse all files in blog_posts, print problems and exit
+	validatePostsFlag bool
+	// article commands, see article_cli.go
+	listArticlesFlag bool
+	jsonFlag         bool
+	showArticleId    int
+	deleteArticleId  int
+	yesFlag          bool
+	// export static copy of the site to this directory and exit
+	exportStaticDir string
 )
 
+// how long we wait for in-flight requests and background jobs to finish
+// when shutting down
+const shutdownTimeout = 30 * time.Second
+
+// background goroutines that must finish before we exit (e.g. backup
+// upload in progress)
+var backgroundJobs sync.WaitGroup
+
+// runs http server until we get SIGINT or SIGTERM and then shuts it down
+// gracefully i.e. stops accepting new connections and gives in-flight
+// requests and background jobs time to finish
+func runHttpServer(done chan struct{}) {
+	var servers []*http.Server
+	serverErr := make(chan error, 2)
+	if tlsEnabled() {
+		httpsSrv, httpSrv := newTlsServers()
+		servers = append(servers, httpsSrv, httpSrv)
+		logger.Noticef("runHttpServer(): serving https for %v", getConfig().TLSHosts)
+		go func() {
+			serverErr <- httpsSrv.ListenAndServeTLS("", "")
+		}()
+		go func() {
+			serverErr <- httpSrv.ListenAndServe()
+		}()
+	} else {
+		srv := &http.Server{Addr: httpAddr, Handler: withHealthChecks(withCanonicalHost(withBodyLimits(http.DefaultServeMux)))}
+		setServerTimeouts(srv)
+		servers = append(servers, srv)
+		go func() {
+			serverErr <- srv.ListenAndServe()
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		logger.Errorf("runHttpServer(): ListenAndServe() failed with %s", err)
+		close(done)
+		return
+	case sig := <-sigs:
+		logger.Noticef("runHttpServer(): got signal %s, shutting down", sig)
+	}
+
+	// /readyz fails from now on, give load balancer time to notice before
+	// we stop accepting connections. Another signal skips the wait
+	setShuttingDown()
+	if drain := shutdownDrainDuration(); drain > 0 {
+		logger.Noticef("runHttpServer(): draining for %s", drain)
+		select {
+		case <-time.After(drain):
+		case <-sigs:
+		}
+	}
+
+	timeStart := time.Now()
+	inFlight := appMetrics.CurrentReqs.Count()
+	close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Errorf("runHttpServer(): srv.Shutdown() of %s failed with %s", srv.Addr, err)
+		}
+	}
+
+	jobsFinished := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(jobsFinished)
+	}()
+	select {
+	case <-jobsFinished:
+	case <-ctx.Done():
+		logger.Errorf("runHttpServer(): background jobs didn't finish in %s", shutdownTimeout)
+	}
+	logger.Noticef("runHttpServer(): drained %d in-flight requests, shutdown took %s", inFlight, time.Since(timeStart))
+}
+
 func parseCmdLineArgs() {
 	flag.StringVar(&configPath, "config", "config.json", "Path to configuration file")
 	flag.StringVar(&httpAddr, "addr", ":5020", "HTTP server address")
 	flag.BoolVar(&inProduction, "production", false, "are we running in production")
 	flag.StringVar(&newArticleTitle, "newarticle", "", "create a new article")
+	flag.IntVar(&maxSlugLen, "max-slug-len", 32, "max length in bytes of slug (and file name) of article created with -newarticle")
+	flag.StringVar(&restoreBackupTimestamp, "restore-backup", "", "download and verify backup with a given timestamp (e.g. 160301_1204)")
+	flag.BoolVar(&fsckFlag, "fsck", false, "check crash reports store for corrupt, missing and dangling files and exit")
+	flag.BoolVar(&repairFlag, "repair", false, "with -fsck, move corrupt crash report files to quarantine_crashes directory")
+	flag.BoolVar(&compactFlag, "compact", false, "re-write crashesdata.txt without superseded records and exit")
+	flag.BoolVar(&validatePostsFlag, "validate-posts", false, "parse all files in blog_posts, print all problems and exit")
+	flag.BoolVar(&listArticlesFlag, "list-articles", false, "list articles (id, date, title, tags, flags) and exit")
+	flag.BoolVar(&jsonFlag, "json", false, "with -list-articles, list as json")
+	flag.IntVar(&showArticleId, "show-article", 0, "print body of article with a given id and exit")
+	flag.IntVar(&deleteArticleId, "delete-article", 0, "mark article with a given id as deleted and exit")
+	flag.BoolVar(&yesFlag, "yes", false, "with -delete-article, don't ask for confirmation")
+	flag.StringVar(&exportStaticDir, "export-static", "", "export public pages, feeds and static files of the site to a directory and exit")
+	flag.StringVar(&dataDir, "datadir", "", "data directory (overrides BLOG_DATA_DIR env variable), created if doesn't exist")
 	flag.Parse()
 }
 
@@ -302,85 +463,55 @@ func isTmpFile(path string) bool {
 	return strings.HasSuffix(path, ".tmp")
 }
 
-func sanitizeForFile(s string) string {
-	var res []byte
-	toRemove := "/\\#()[]{},?+.'\""
-	var prev rune
-	buf := make([]byte, 3)
-	for _, c := range s {
-		if strings.ContainsRune(toRemove, c) {
-			continue
-		}
-		switch c {
-		case ' ', '_':
-			c = '-'
-		}
-		if c == prev {
-			continue
-		}
-		prev = c
-		n := utf8.EncodeRune(buf, c)
-		for i := 0; i < n; i++ {
-			res = append(res, buf[i])
-		}
-	}
-	if len(res) > 32 {
-		res = res[:32]
-	}
-	s = string(res)
-	s = strings.Trim(s, "_- ")
-	s = strings.ToLower(s)
-	return s
-}
-
-func findUniqueArticleId(articles []*Article) int {
-	ids := make([]int, 0)
-	for _, a := range articles {
-		ids = append(ids, a.Id)
-	}
-	if len(ids) == 0 {
-		return 1
-	}
-	sort.Ints(ids)
-	prevId := ids[0]
-	for i := 1; i < len(ids); i++ {
-		if ids[i] != prevId+1 {
-			return prevId + 1
-		}
-		prevId = ids[i]
-	}
-	return prevId + 1
-}
-
-func genNewArticle(title string) {
+func genNewArticle(title string) error {
 	fmt.Printf("genNewArticle: %q\n", title)
 	store, err := NewStore()
 	if err != nil {
-		log.Fatalf("NewStore() failed with %s", err)
+		return fmt.Errorf("NewStore() failed with %s", err)
 	}
-	newId := findUniqueArticleId(store.articles)
-	name := sanitizeForFile(title) + ".md"
-	fmt.Printf("new id: %d, name: %s\n", newId, name)
+	slug := sanitizeForFile(title, maxSlugLen)
 	t := time.Now()
+	// explicit slug so that permalink doesn't change when the title is
+	// edited
+	a := &Article{
+		Title:       title,
+		Slug:        slug,
+		PublishedOn: t,
+		Format:      FormatMarkdown,
+	}
+	// assigns the id
+	if err = store.CreateOrUpdateArticle(a); err != nil {
+		return err
+	}
+	if slug == "" {
+		slug = strconv.Itoa(a.Id)
+		a.Slug = slug
+	}
+	name := slug + ".md"
+	fmt.Printf("new id: %d, name: %s\n", a.Id, name)
 	dir := "blog_posts"
 	d := t.Format("2006-01")
 	path := filepath.Join(dir, d, name)
-	s := fmt.Sprintf(`Id: %d
-Title: %s
-Date: %s
-Format: Markdown
---------------`, newId, title, t.Format(time.RFC3339))
-	for i := 1; i < 10; i++ {
-		if !u.PathExists(path) {
+	s := serArticleHeader(a)
+	for i := 1; ; i++ {
+		exists, err := fsutil.PathExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
 			break
 		}
-		name := sanitizeForFile(title) + "-" + strconv.Itoa(i) + ".md"
+		if i == 10 {
+			return fmt.Errorf("%q already exists", path)
+		}
+		name := slug + "-" + strconv.Itoa(i) + ".md"
 		path = filepath.Join(dir, d, name)
 	}
-	u.PanicIf(u.PathExists(path))
 	fmt.Printf("path: %s\n", path)
-	u.CreateDirForFileMust(path)
-	ioutil.WriteFile(path, []byte(s), 0644)
+	if err = fsutil.CreateDirForFile(path); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(s), 0644)
 }
 
 func main() {
@@ -390,63 +521,144 @@ func main() {
 	parseCmdLineArgs()
 
 	if newArticleTitle != "" {
-		genNewArticle(newArticleTitle)
+		if err = genNewArticle(newArticleTitle); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create new article: %s\n", err)
+			os.Exit(1)
+		}
 		return
 	}
-
-	/*findFileFixes("../../../sumatrapdf")
-	return
-	s := linkifyCrashReport(test)
-	fmt.Print(string(s))
-	return*/
+	articlesCommand := listArticlesFlag || showArticleId != 0 || deleteArticleId != 0
 
 	if inProduction {
 		reloadTemplates = false
 		alwaysLogTime = false
 	}
 
-	useStdout := !inProduction
+	// article commands print to stdout (e.g. -list-articles -json) so
+	// we don't mix log messages with that
+	useStdout := !inProduction && !validatePostsFlag && !articlesCommand
 	logger = NewServerLogger(256, 256, useStdout)
+	logger.JSON = inProduction
 
 	rand.Seed(time.Now().UnixNano())
+	resolveDataDir()
+	logger.Noticef("data directory: %q", getDataDir())
 
 	if err := readConfig(configPath); err != nil {
 		log.Fatalf("Failed reading config file %s. %s\n", configPath, err)
 	}
+	applyConfigLogLevel()
 
-	if !inProduction {
-		config.AnalyticsCode = &emptyString
+	// they only touch blog_posts so they can run next to the server
+	if validatePostsFlag {
+		os.Exit(validatePosts("blog_posts"))
+	}
+	if articlesCommand {
+		os.Exit(runArticlesCommand())
+	}
+
+	unlockDataDir, err := lockDataDir(getDataDir())
+	if err != nil {
+		log.Fatalf("lockDataDir() failed with %s", err)
+	}
+	defer unlockDataDir()
+
+	if fsckFlag || compactFlag {
+		code := runCrashesMaintenance(fsckFlag, repairFlag, compactFlag)
+		unlockDataDir()
+		os.Exit(code)
+	}
+
+	if restoreBackupTimestamp != "" {
+		if err = restoreBackup(restoreBackupTimestamp); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore backup: %s\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	if store, err = NewStore(); err != nil {
 		log.Fatalf("NewStore() failed with %s", err)
 	}
-	buildArticlesCache()
+	readTagAliases()
+	readIgnored404s()
+	applyTagAliasesToStore(store)
+	if err = buildArticlesCache(); err != nil {
+		log.Fatalf("buildArticlesCache() failed with %s", err)
+	}
+	readOutboundClicks()
+	readSubscribers()
+	readCrossposts()
+	readLinkCheckReport()
+	notifyArticlesPublished()
 
 	if storeCrashes, err = NewStoreCrashes(getDataDir()); err != nil {
 		log.Fatalf("NewStoreCrashes() failed with %s", err)
 	}
 
 	readRedirects()
+	readArticleViews()
+	readRedirectHits()
+	readArticleReactions()
+	readPreviewLinks()
+	readUploads()
+	readCrashSpamIps()
 	InitMetrics()
-
-	backupConfig := &BackupConfig{
-		AwsAccess: *config.AwsAccess,
-		AwsSecret: *config.AwsSecret,
-		Bucket:    *config.S3BackupBucket,
-		S3Dir:     *config.S3BackupDir,
-		LocalDir:  getDataDir(),
-	}
-
-	if S3BackupEnabled() {
-		go BackupLoop(backupConfig)
-	}
-
-	startWatching()
+	c := getConfig()
+	appLoadShedder = NewLoadShedder(c.MaxConcurrentRequests, c.MaxConcurrentCrashRequests, appMetrics)
+	appRateLimiter = NewRateLimiter(appMetrics)
+	buildAssetHashes(getStaticDir())
+	if inProduction {
+		mustParseTemplates()
+	}
+	if exportStaticDir != "" {
+		code := runExportStaticCommand(exportStaticDir)
+		unlockDataDir()
+		os.Exit(code)
+	}
+	openLogFile()
+
+	// closed when we're shutting down to tell background goroutines to exit
+	done := make(chan struct{})
+	if BackupEnabled() {
+		backgroundJobs.Add(1)
+		go func() {
+			BackupLoop(newBackupConfig, done)
+			backgroundJobs.Done()
+		}()
+	}
+
+	// runs even if pruning is disabled because it can be enabled by
+	// reloading config
+	backgroundJobs.Add(1)
+	go func() {
+		PruneCrashesLoop(done)
+		backgroundJobs.Done()
+	}()
+	// saves view counts and reactions one last time when shutting down
+	backgroundJobs.Add(1)
+	go func() {
+		SaveArticleViewsLoop(done)
+		backgroundJobs.Done()
+	}()
+	// runs even if export is disabled because it can be enabled by
+	// reloading config
+	backgroundJobs.Add(1)
+	go func() {
+		ExportStaticLoop(done)
+		backgroundJobs.Done()
+	}()
+	go SendEmailsLoop(emailQueue, done)
+	go reloadConfigOnSighup(done)
+	go report404sLoop(done)
+	startAccessLog(done)
+	go rateLimitEvictLoop(appRateLimiter, done)
+	startWatching(done)
 	InitHttpHandlers()
-	logger.Noticef(fmt.Sprintf("Started runing on %s", httpAddr))
-	if err := http.ListenAndServe(httpAddr, nil); err != nil {
-		fmt.Printf("http.ListendAndServer() failed with %s\n", err)
+	logger.Noticef("Started running on %s", httpAddr)
+	runHttpServer(done)
+	if logger.File != nil {
+		logger.File.Close()
 	}
 	fmt.Printf("Exited\n")
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/russross/blackfriday"
+)
+
+// Markdown is rendered with blackfriday with the same flags as
+// blackfriday.MarkdownCommon() plus footnotes and highlighting of code
+// (see highlight.go). Tables, footnotes, strikethrough, task lists,
+// autolinking and highlighting can be turned off in config.json
+
+// html flags of blackfriday.MarkdownCommon()
+const markdownHtmlFlags = blackfriday.HTML_USE_XHTML |
+	blackfriday.HTML_USE_SMARTYPANTS |
+	blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+	blackfriday.HTML_SMARTYPANTS_DASHES |
+	blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+
+// extensions of blackfriday.MarkdownCommon() that can't be turned off
+const markdownBaseExtensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_SPACE_HEADERS |
+	blackfriday.EXTENSION_HEADER_IDS |
+	blackfriday.EXTENSION_BACKSLASH_LINE_BREAK |
+	blackfriday.EXTENSION_DEFINITION_LISTS
+
+type MarkdownOptions struct {
+	Tables        bool
+	Footnotes     bool
+	Strikethrough bool
+	// "- [ ] todo" and "- [x] done" list items are rendered with checkboxes
+	TaskLists bool
+	Autolink  bool
+	// if false, code is highlighted in the browser by highlight.js
+	Highlight bool
+}
+
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func markdownOptionsFromConfig(c *Config) MarkdownOptions {
+	return MarkdownOptions{
+		Tables:        boolOrDefault(c.MarkdownTables, true),
+		Footnotes:     boolOrDefault(c.MarkdownFootnotes, true),
+		Strikethrough: boolOrDefault(c.MarkdownStrikethrough, true),
+		TaskLists:     boolOrDefault(c.MarkdownTaskLists, true),
+		Autolink:      boolOrDefault(c.MarkdownAutolink, true),
+		Highlight:     !c.ClientSideHighlighting,
+	}
+}
+
+// returns unsanitized html
+func (o MarkdownOptions) render(s []byte) []byte {
+	htmlFlags := markdownHtmlFlags
+	extensions := markdownBaseExtensions
+	if o.Tables {
+		extensions |= blackfriday.EXTENSION_TABLES
+	}
+	if o.Footnotes {
+		extensions |= blackfriday.EXTENSION_FOOTNOTES
+		htmlFlags |= blackfriday.HTML_FOOTNOTE_RETURN_LINKS
+	}
+	if o.Strikethrough {
+		extensions |= blackfriday.EXTENSION_STRIKETHROUGH
+	}
+	if o.Autolink {
+		extensions |= blackfriday.EXTENSION_AUTOLINK
+	}
+	params := blackfriday.HtmlRendererParameters{FootnoteReturnLinkContents: "↩"}
+	renderer := blackfriday.HtmlRendererWithParameters(htmlFlags, "", "", params)
+	if o.Highlight {
+		renderer = &highlightingRenderer{renderer}
+	}
+	return blackfriday.Markdown(s, renderer, extensions)
+}
+
+var (
+	taskListTodo = []byte(`<input type="checkbox" disabled="disabled" /> `)
+	taskListDone = []byte(`<input type="checkbox" checked="checked" disabled="disabled" /> `)
+)
+
+// replaces "[ ] " and "[x] " at the beginning of list items with checkboxes.
+// It's done on sanitized html because sanitizer removes <input>
+func renderTaskLists(html []byte) []byte {
+	if !bytes.Contains(html, []byte("<li>")) {
+		return html
+	}
+	for _, prefix := range []string{"<li>", "<li><p>"} {
+		for _, mark := range []string{"[ ] ", "[x] ", "[X] "} {
+			checkbox := taskListTodo
+			if mark != "[ ] " {
+				checkbox = taskListDone
+			}
+			old := []byte(prefix + mark)
+			repl := append([]byte(prefix), checkbox...)
+			html = bytes.Replace(html, old, repl, -1)
+		}
+	}
+	return html
+}
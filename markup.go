@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// helpers shared by converters of reStructuredText (rst.go) and Org
+// (org.go) to html. They only support a subset of each format (headings,
+// lists, code blocks, links, emphasis). Anything else is shown as escaped
+// text, so nothing written in an article is lost.
+
+// lines of s, without \r and with tabs expanded to 8 spaces
+func markupLines(s []byte) []string {
+	str := strings.Replace(string(s), "\r\n", "\n", -1)
+	str = strings.Replace(str, "\t", "        ", -1)
+	return strings.Split(str, "\n")
+}
+
+func isBlankLine(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+func lineIndent(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+// returns index of the first non-blank line at or after i
+func nextNonBlankLine(lines []string, i int) int {
+	for i < len(lines) && isBlankLine(lines[i]) {
+		i++
+	}
+	return i
+}
+
+// removes common indentation of lines and blank lines at the start and
+// end
+func dedentLines(lines []string) []string {
+	for len(lines) > 0 && isBlankLine(lines[0]) {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && isBlankLine(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
+	}
+	n := -1
+	for _, l := range lines {
+		if !isBlankLine(l) && (n == -1 || lineIndent(l) < n) {
+			n = lineIndent(l)
+		}
+	}
+	res := make([]string, len(lines))
+	for i, l := range lines {
+		if len(l) >= n && n > 0 {
+			l = l[n:]
+		}
+		res[i] = strings.TrimRight(l, " ")
+	}
+	return res
+}
+
+// html of a code block, the same as of <code> in other formats (see
+// txtWithCodeParts())
+func codeBlockHtml(lang string, code string) string {
+	cls := "prettyprint"
+	if l := langToPrettifyLang(strings.ToLower(lang)); l != "" {
+		cls += " " + l
+	}
+	return fmt.Sprintf("<pre class=\"%s\">%s</pre>\n", cls, html.EscapeString(code))
+}
+
+func preHtml(lines []string) string {
+	return "<pre>" + html.EscapeString(strings.Join(dedentLines(lines), "\n")) + "</pre>\n"
+}
+
+var safeLinkUrlRx = regexp.MustCompile(`(?i)^(https?://|mailto:|/|#|\./|\.\./|[^:]*$)`)
+
+// textHtml is already html. Links with urls we don't allow (e.g.
+// javascript:) are shown as text
+func linkHtml(url, textHtml string) string {
+	if !safeLinkUrlRx.MatchString(url) {
+		return textHtml
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), textHtml)
+}
+
+// converts parts of s matched by rx with render and escapes the rest. m
+// has submatches, "" for those that didn't match
+func replaceInline(s string, rx *regexp.Regexp, render func(m []string) string) string {
+	var b strings.Builder
+	prev := 0
+	for _, loc := range rx.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(html.EscapeString(s[prev:loc[0]]))
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = s[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		b.WriteString(render(m))
+		prev = loc[1]
+	}
+	b.WriteString(html.EscapeString(s[prev:]))
+	return b.String()
+}
+
+// returns indentation, if it's an ordered list and text of list item in
+// line l. ok is false if l is not a list item
+type listItemMatcher func(l string) (indent int, ordered bool, text string, ok bool)
+
+// converts a list (possibly with nested lists) starting at lines[i].
+// Returns its html and index of the first line after it
+func listHtml(lines []string, i int, match listItemMatcher, inline func(string) string) (string, int) {
+	indent, ordered, _, _ := match(lines[i])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	var b strings.Builder
+	b.WriteString("<" + tag + ">\n")
+	for i < len(lines) {
+		itemIndent, itemOrdered, text, ok := match(lines[i])
+		if !ok || itemIndent != indent || itemOrdered != ordered {
+			break
+		}
+		texts := []string{text}
+		var nested strings.Builder
+		for i++; i < len(lines); {
+			l := lines[i]
+			if isBlankLine(l) {
+				// an item can have more paragraphs if they're indented
+				if j := nextNonBlankLine(lines, i); j < len(lines) && lineIndent(lines[j]) > indent {
+					i = j
+					continue
+				}
+				break
+			}
+			if lineIndent(l) <= indent {
+				break
+			}
+			if _, _, _, ok := match(l); ok {
+				s, next := listHtml(lines, i, match, inline)
+				nested.WriteString(s)
+				i = next
+				continue
+			}
+			texts = append(texts, strings.TrimSpace(l))
+			i++
+		}
+		b.WriteString("<li>" + inline(strings.Join(texts, "\n")) + nested.String() + "</li>\n")
+		// items can be separated by blank lines
+		if j := nextNonBlankLine(lines, i); j > i && j < len(lines) {
+			if itemIndent, itemOrdered, _, ok := match(lines[j]); ok && itemIndent == indent && itemOrdered == ordered {
+				i = j
+			}
+		}
+	}
+	b.WriteString("</" + tag + ">\n")
+	return b.String(), i
+}
+
+func headingHtml(level int, textHtml string) string {
+	if level > 6 {
+		level = 6
+	}
+	return fmt.Sprintf("<h%d>%s</h%d>\n", level, textHtml, level)
+}
+
+func paragraphHtml(lines []string, inline func(string) string) string {
+	trimmed := make([]string, len(lines))
+	for i, l := range lines {
+		trimmed[i] = strings.TrimSpace(l)
+	}
+	return "<p>" + inline(strings.Join(trimmed, "\n")) + "</p>\n"
+}
@@ -7,35 +7,111 @@ import (
 	"github.com/rcrowley/go-metrics"
 )
 
-var (
-	// number of /resize requests being processed at this time
-	metricCurrentReqs metrics.Counter
+// Metrics groups all metrics of the app. Each Metrics has its own registry
+// so that creating more than one (e.g. in tests) doesn't clash over metric
+// names
+type Metrics struct {
+	Registry metrics.Registry
+	// number of http requests being processed at this time
+	CurrentReqs metrics.Counter
 	// rate of http requests
-	metricHttpReqRate metrics.Meter
+	HttpReqRate metrics.Meter
 	// how long does it take to service http request
-	metricHttpReqTime metrics.Timer
-	// how long does it take to backup to s3
-	metricsBackupTime metrics.Timer
-)
+	HttpReqTime metrics.Timer
+	// how long does it take to backup (to any target, see also
+	// BackupTimeOf())
+	BackupTime metrics.Timer
+	// how long does it take to rebuild articles cache after changes
+	CacheRebuildTime metrics.Timer
+	// how long the last re-build of articles cache took (in milliseconds)
+	// and when it finished (unix time)
+	CacheRebuildLastMs   metrics.Gauge
+	CacheRebuildLastTime metrics.Gauge
+	// number of requests to crash pages being processed at this time
+	CurrentCrashReqs metrics.Counter
+	// number of requests rejected because we were over the limit
+	ShedReqs metrics.Counter
+	// limits of concurrent requests (see load_shedding.go), 0 is no limit
+	MaxReqs      metrics.Gauge
+	MaxCrashReqs metrics.Gauge
+	// number of 404s that were recorded and that were ignored (see
+	// data/ignored_404s.txt)
+	Logged404s     metrics.Counter
+	Suppressed404s metrics.Counter
+	// number of backups whose uploaded files didn't match local files
+	BackupVerifyFailures metrics.Counter
+	// number of crash submissions rejected as spam (see crash_spam.go)
+	RejectedCrashes metrics.Counter
+	// number of access log lines dropped because the writer couldn't keep
+	// up (see access_log.go)
+	DroppedAccessLogLines metrics.Counter
+}
 
-func handleMetrics(w http.ResponseWriter, r *http.Request) {
-	reg, ok := metrics.DefaultRegistry.(*metrics.StandardRegistry)
+func NewMetrics() *Metrics {
+	reg := metrics.NewRegistry()
+	return &Metrics{
+		Registry:              reg,
+		CurrentReqs:           metrics.NewRegisteredCounter("curr_http_req", reg),
+		HttpReqRate:           metrics.NewRegisteredMeter("http_req_rate", reg),
+		HttpReqTime:           metrics.NewRegisteredTimer("http_req_time", reg),
+		BackupTime:            metrics.NewRegisteredTimer("backup_time", reg),
+		CacheRebuildTime:      metrics.NewRegisteredTimer("cache_rebuild_time", reg),
+		CacheRebuildLastMs:    metrics.NewRegisteredGauge("cache_rebuild_last_ms", reg),
+		CacheRebuildLastTime:  metrics.NewRegisteredGauge("cache_rebuild_last_time", reg),
+		CurrentCrashReqs:      metrics.NewRegisteredCounter("curr_crash_http_req", reg),
+		ShedReqs:              metrics.NewRegisteredCounter("shed_http_req", reg),
+		MaxReqs:               metrics.NewRegisteredGauge("max_http_req", reg),
+		MaxCrashReqs:          metrics.NewRegisteredGauge("max_crash_http_req", reg),
+		Logged404s:            metrics.NewRegisteredCounter("logged_404s", reg),
+		Suppressed404s:        metrics.NewRegisteredCounter("suppressed_404s", reg),
+		BackupVerifyFailures:  metrics.NewRegisteredCounter("backup_verify_failures", reg),
+		RejectedCrashes:       metrics.NewRegisteredCounter("rejected_crashes", reg),
+		DroppedAccessLogLines: metrics.NewRegisteredCounter("dropped_access_log_lines", reg),
+	}
+}
+
+// how long does it take to backup to a given target e.g. backup_time_sftp
+func (m *Metrics) BackupTimeOf(target string) metrics.Timer {
+	return metrics.GetOrRegisterTimer("backup_time_"+target, m.Registry)
+}
+
+// rate and time of http requests of a given class (see traffic_class.go)
+// e.g. http_req_rate_bot
+func (m *Metrics) HttpReqRateOf(class trafficClass) metrics.Meter {
+	return metrics.GetOrRegisterMeter("http_req_rate_"+string(class), m.Registry)
+}
+
+func (m *Metrics) HttpReqTimeOf(class trafficClass) metrics.Timer {
+	return metrics.GetOrRegisterTimer("http_req_time_"+string(class), m.Registry)
+}
+
+// number of requests to path rejected by rate limiting e.g.
+// throttled_http_req_app_crashsubmit
+func (m *Metrics) ThrottledReqsOf(path string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(throttledMetricName(path), m.Registry)
+}
+
+// metrics of the app, set by InitMetrics()
+var appMetrics *Metrics
+
+func (m *Metrics) MarshalJSON() ([]byte, error) {
+	reg, ok := m.Registry.(*metrics.StandardRegistry)
 	if !ok {
-		log.Fatalln("metrics.DefaultRegistry type assertion failed")
+		log.Fatalln("Metrics.Registry type assertion failed")
 	}
+	return reg.MarshalJSON()
+}
 
-	json, err := reg.MarshalJSON()
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	json, err := appMetrics.MarshalJSON()
 	if err != nil {
-		log.Fatalln("metrics.DefaultRegistry.MarshalJSON:", err)
+		log.Fatalln("appMetrics.MarshalJSON:", err)
 	}
 
-	textResponse(w, string(json))
+	textResponse(w, r, string(json))
 }
 
+// safe to call more than once, each call creates fresh metrics
 func InitMetrics() {
-	defReg := metrics.DefaultRegistry
-	metricCurrentReqs = metrics.NewRegisteredCounter("curr_http_req", defReg)
-	metricHttpReqRate = metrics.NewRegisteredMeter("http_req_rate", defReg)
-	metricHttpReqTime = metrics.NewRegisteredTimer("http_req_time", defReg)
-	metricsBackupTime = metrics.NewRegisteredTimer("backup_time", defReg)
+	appMetrics = NewMetrics()
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Articles tagged "note" are short posts shown on /notes/ (newest first,
+// notesPerPage per page) with their own feed /notes/atom.xml. Unless
+// NotesOnMainPage / NotesInMainFeeds are set in config.json, they're not
+// on the main page, /atom.xml and /feed.json (/atom-all.xml has them).
+// Notes don't need a Title: header, without it the title (used e.g. in
+// feeds and <title>) is made from the first words of the body. Their
+// permalinks are in NotesPermalinkScheme (e.g. "/note/{id}") if set.
+
+const (
+	noteTag      = "note"
+	notesPerPage = 20
+	// words of the body used as title of notes without Title: header
+	noteTitleWords = 8
+)
+
+func (a *Article) IsNote() bool {
+	return stringInSlice(a.Tags, noteTag)
+}
+
+// returns title for a note without Title: header
+func noteTitleFromBody(body []byte) string {
+	var words []string
+	for _, w := range strings.Fields(string(body)) {
+		w = strings.Trim(w, "#*_`[]()<>")
+		if w != "" {
+			words = append(words, w)
+		}
+	}
+	if len(words) == 0 {
+		return "Note"
+	}
+	return truncateWords(noteTitleWords, strings.Join(words, " "))
+}
+
+func permalinkSchemeOf(a *Article) string {
+	if a.IsNote() {
+		if s := stringOrEmpty(getConfig().NotesPermalinkScheme); s != "" {
+			return s
+		}
+	}
+	return permalinkScheme()
+}
+
+// returns articles without notes unless NotesOnMainPage is set
+func mainPageArticles(articles []*Article) []*Article {
+	if getConfig().NotesOnMainPage {
+		return articles
+	}
+	return filterArticlesByTag(articles, noteTag, false)
+}
+
+// /notes/
+// page    : ${n}, 1 if not given
+func handleNotes(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/notes/" {
+		serve404(w, r)
+		return
+	}
+	notes := articlesCache.get().byTag[noteTag]
+	nPages := (len(notes) + notesPerPage - 1) / notesPerPage
+	page := 1
+	if s := r.FormValue("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > nPages {
+			serve404(w, r)
+			return
+		}
+		page = n
+	}
+	// newest first
+	var res []*Article
+	for i := len(notes) - 1 - (page-1)*notesPerPage; i >= 0 && len(res) < notesPerPage; i-- {
+		res = append(res, notes[i])
+	}
+	model := struct {
+		BasePageModel
+		Notes    []*Article
+		Count    int
+		PrevPage int
+		NextPage int
+	}{
+		BasePageModel: newBasePageModel(r),
+		Notes:         res,
+		Count:         len(notes),
+	}
+	if page > 1 {
+		model.PrevPage = page - 1
+	}
+	if page < nPages {
+		model.NextPage = page + 1
+	}
+	ExecTemplate(w, tmplNotes, model)
+}
+
+// /notes/atom.xml
+func handleNotesAtom(w http.ResponseWriter, r *http.Request) {
+	serveAtomFeed(w, r, articlesCache.get().atomNotes)
+}
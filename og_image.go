@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kjk/u"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// social card images (og:image) generated for articles that don't have an
+// image of their own. Size recommended by Facebook and Twitter.
+const (
+	ogImageDx = 1200
+	ogImageDy = 630
+
+	ogImageMargin       = 80
+	ogImageMaxTitleSize = 72
+	ogImageMinTitleSize = 32
+	ogImageSiteName     = "blog.kowalczyk.info"
+)
+
+var (
+	ogImageBg      = color.RGBA{0xfc, 0xfc, 0xfa, 0xff}
+	ogImageFg      = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	ogImageFgLight = color.RGBA{0x88, 0x88, 0x88, 0xff}
+	ogImageAccent  = color.RGBA{0x00, 0x8a, 0xc0, 0xff}
+
+	ogFontsMu   sync.Mutex
+	ogFontBold  *opentype.Font
+	ogFontRegul *opentype.Font
+
+	// serializes generation so that concurrent requests for the same image
+	// don't render it twice
+	ogImageGenMu sync.Mutex
+)
+
+func ogImageEnabled() bool {
+	return getConfig().GenerateOgImages
+}
+
+func ogImageCacheDir() string {
+	return filepath.Join(getDataDir(), "og_images")
+}
+
+// url of generated og:image for an article
+func ogImageUrl(a *Article) string {
+	return "/og/" + ShortenId(a.Id) + ".png"
+}
+
+// the cache is keyed by the hash of everything that ends up in the image
+// so that changing the title automatically regenerates the image
+func ogImageCacheKey(a *Article) string {
+	s := fmt.Sprintf("%s|%s|%s", a.Title, ogImageSiteName, ogImageDateStr(a))
+	return u.Sha1HexOfBytes([]byte(s))
+}
+
+func ogImageCachePath(dir string, a *Article) string {
+	return filepath.Join(dir, ogImageCacheKey(a)+".png")
+}
+
+func ogImageDateStr(a *Article) string {
+	return a.PublishedOn.Format("January 2, 2006")
+}
+
+func loadOgFonts() error {
+	ogFontsMu.Lock()
+	defer ogFontsMu.Unlock()
+	if ogFontBold != nil {
+		return nil
+	}
+	bold, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return err
+	}
+	regular, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return err
+	}
+	ogFontBold, ogFontRegul = bold, regular
+	return nil
+}
+
+func newOgFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// splits s into lines no wider than maxDx when drawn with face. A single
+// word wider than maxDx gets its own line (and the caller will shrink the
+// font until it fits)
+func wrapText(face font.Face, s string, maxDx int) []string {
+	words := strings.Fields(s)
+	var lines []string
+	curr := ""
+	for _, w := range words {
+		candidate := w
+		if curr != "" {
+			candidate = curr + " " + w
+		}
+		if font.MeasureString(face, candidate).Ceil() <= maxDx || curr == "" {
+			curr = candidate
+			continue
+		}
+		lines = append(lines, curr)
+		curr = w
+	}
+	if curr != "" {
+		lines = append(lines, curr)
+	}
+	return lines
+}
+
+func linesFit(face font.Face, lines []string, maxDx, maxDy int) bool {
+	lineDy := face.Metrics().Height.Ceil()
+	if lineDy*len(lines) > maxDy {
+		return false
+	}
+	for _, l := range lines {
+		if font.MeasureString(face, l).Ceil() > maxDx {
+			return false
+		}
+	}
+	return true
+}
+
+// picks the biggest font size at which the title fits in the given box.
+// If even the smallest size doesn't fit, the lines that don't fit are dropped
+// and the last one is ellipsized
+func layoutTitle(title string, maxDx, maxDy int) (font.Face, []string, error) {
+	for size := ogImageMaxTitleSize; size >= ogImageMinTitleSize; size -= 4 {
+		face, err := newOgFace(ogFontBold, float64(size))
+		if err != nil {
+			return nil, nil, err
+		}
+		lines := wrapText(face, title, maxDx)
+		if linesFit(face, lines, maxDx, maxDy) {
+			return face, lines, nil
+		}
+		face.Close()
+	}
+	face, err := newOgFace(ogFontBold, ogImageMinTitleSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := wrapText(face, title, maxDx)
+	maxLines := maxDy / face.Metrics().Height.Ceil()
+	if maxLines < 1 {
+		maxLines = 1
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		lines[maxLines-1] += "…"
+	}
+	for i, l := range lines {
+		for font.MeasureString(face, l).Ceil() > maxDx {
+			r := []rune(strings.TrimSuffix(l, "…"))
+			if len(r) <= 1 {
+				break
+			}
+			l = string(r[:len(r)-1]) + "…"
+		}
+		lines[i] = l
+	}
+	return face, lines, nil
+}
+
+func drawString(img draw.Image, face font.Face, c color.Color, x, y int, s string) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// renders a social card image for an article as png
+func renderOgImage(a *Article) ([]byte, error) {
+	if err := loadOgFonts(); err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, ogImageDx, ogImageDy))
+	draw.Draw(img, img.Bounds(), image.NewUniform(ogImageBg), image.ZP, draw.Src)
+	accent := image.Rect(0, 0, ogImageDx, 12)
+	draw.Draw(img, accent, image.NewUniform(ogImageAccent), image.ZP, draw.Src)
+
+	small, err := newOgFace(ogFontRegul, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer small.Close()
+	smallDy := small.Metrics().Height.Ceil()
+
+	// title gets everything above the footer with site name and date
+	maxDx := ogImageDx - 2*ogImageMargin
+	maxDy := ogImageDy - 2*ogImageMargin - 2*smallDy
+	face, lines, err := layoutTitle(a.Title, maxDx, maxDy)
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	lineDy := face.Metrics().Height.Ceil()
+	y := ogImageMargin + face.Metrics().Ascent.Ceil()
+	for _, l := range lines {
+		drawString(img, face, ogImageFg, ogImageMargin, y, l)
+		y += lineDy
+	}
+
+	y = ogImageDy - ogImageMargin
+	drawString(img, small, ogImageAccent, ogImageMargin, y, ogImageSiteName)
+	date := ogImageDateStr(a)
+	dateDx := font.MeasureString(small, date).Ceil()
+	drawString(img, small, ogImageFgLight, ogImageDx-ogImageMargin-dateDx, y, date)
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// returns cached og image for the article, generating it if needed
+func getOgImage(dir string, a *Article) ([]byte, error) {
+	path := ogImageCachePath(dir, a)
+	if d, err := ioutil.ReadFile(path); err == nil {
+		return d, nil
+	}
+
+	ogImageGenMu.Lock()
+	defer ogImageGenMu.Unlock()
+	// might have been generated while we were waiting for the lock
+	if d, err := ioutil.ReadFile(path); err == nil {
+		return d, nil
+	}
+	d, err := renderOgImage(a)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// /og/${articleShortId}.png
+func handleOgImage(w http.ResponseWriter, r *http.Request) {
+	if !ogImageEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.URL.Path[len("/og/"):]
+	if !strings.HasSuffix(name, ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	articleId := UnshortenId(name[:len(name)-len(".png")])
+	articleInfo := getCachedArticlesById(articleId)
+	if articleInfo == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := getOgImage(ogImageCacheDir(), articleInfo.this)
+	if err != nil {
+		logger.Errorf("handleOgImage(): getOgImage() for article %d failed with %s", articleId, err)
+		http.Error(w, "failed to generate image", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "image/png")
+	// the url doesn't change when the title changes, so only cache for a day
+	w.Header().Set("Cache-Control", "max-age=86400, public")
+	writeData(w, r, http.StatusOK, d)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Open Graph and Twitter Card meta tags of article pages, so that links to
+// articles show up with a title, description and image on Twitter, Slack
+// etc. Description and the first image are taken from the html of the
+// article when building articles cache. Drafts are private and don't get
+// those tags.
+
+// in characters
+const ogDescriptionMaxLen = 200
+
+var (
+	ogImgSrcRx = regexp.MustCompile(`(?i)<img\s[^>]*?src\s*=\s*["']([^"']+)["']`)
+	// content of those tags is not text of the article
+	ogSkipTagsRx = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+)
+
+// OgMeta is what goes into Open Graph and Twitter Card meta tags
+type OgMeta struct {
+	Title string
+	Url   string
+	// for rel=canonical, different from Url for articles first published
+	// elsewhere
+	CanonicalUrl string
+	Description  string
+	ImageUrl     string
+	// "summary_large_image" if we have an image, "summary" otherwise
+	TwitterCard string
+}
+
+// what we extract from html of an article when building articles cache
+type ogArticleData struct {
+	description string
+	// src of the first image, as in html (can be relative)
+	imageSrc string
+}
+
+// returns text of html, cut at a word boundary to at most maxLen characters
+// (with "…" added if it was cut)
+func ogDescription(s string, maxLen int) string {
+	s = ogSkipTagsRx.ReplaceAllString(s, " ")
+	s = htmlTagRx.ReplaceAllString(s, " ")
+	s = strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+	if utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+	runes := []rune(s)[:maxLen]
+	cut := string(runes)
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:-") + "…"
+}
+
+func firstImageSrc(s string) string {
+	m := ogImgSrcRx.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	return html.UnescapeString(m[1])
+}
+
+// returns article id => data for Open Graph tags. Drafts are skipped
+func buildOgArticleData(articles []*Article) map[int]*ogArticleData {
+	res := make(map[int]*ogArticleData, len(articles))
+	for _, a := range articles {
+		if a.IsDraft || a.IsPrivate {
+			continue
+		}
+		s := a.GetHtmlStr()
+		res[a.Id] = &ogArticleData{
+			description: ogDescription(s, ogDescriptionMaxLen),
+			imageSrc:    firstImageSrc(s),
+		}
+	}
+	return res
+}
+
+// returns nil for articles that shouldn't have Open Graph tags
+func getOgMeta(a *Article) *OgMeta {
+	return articlesCache.get().ogMeta(a)
+}
+
+func (cache *articlesCacheData) ogMeta(a *Article) *OgMeta {
+	d := cache.og[a.Id]
+	if d == nil || a.IsDraft || a.IsPrivate {
+		return nil
+	}
+	articleUrl := absURL(a.Permalink())
+	res := &OgMeta{
+		Title:        a.Title,
+		Url:          articleUrl,
+		CanonicalUrl: a.CanonicalUrl(),
+		Description:  d.description,
+		TwitterCard:  "summary",
+	}
+	if d.imageSrc != "" {
+		base, _ := url.Parse(articleUrl)
+		if img, err := url.Parse(d.imageSrc); err == nil && base != nil {
+			res.ImageUrl = base.ResolveReference(img).String()
+		}
+	}
+	if res.ImageUrl == "" && ogImageEnabled() {
+		res.ImageUrl = absURL(ogImageUrl(a))
+	}
+	if res.ImageUrl == "" {
+		res.ImageUrl = stringOrEmpty(getConfig().DefaultOgImageUrl)
+		if strings.HasPrefix(res.ImageUrl, "/") {
+			res.ImageUrl = absURL(res.ImageUrl)
+		}
+	}
+	if res.ImageUrl != "" {
+		res.TwitterCard = "summary_large_image"
+	}
+	return res
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Org mode to html (see markup.go for what's supported). "* " headings,
+// lists, #+BEGIN_SRC ${lang} / #+BEGIN_EXAMPLE / #+BEGIN_QUOTE blocks, ": "
+// fixed-width lines, [[url][description]] links and *bold*, /italic/,
+// _underline_, =verbatim=, ~code~ and +strike-through+. Export settings
+// (#+TITLE: etc.) and "# " comments are skipped, other blocks and
+// keywords are shown as escaped text.
+
+var (
+	orgInlineRx = regexp.MustCompile(`\[\[([^\]]+)\](?:\[([^\]]+)\])?\]` +
+		`|(^|[\s({'"])(?:` +
+		`\*([^\s*](?:[^*]*?[^\s*])?)\*` +
+		`|/([^\s/](?:[^/]*?[^\s/])?)/` +
+		`|_([^\s_](?:[^_]*?[^\s_])?)_` +
+		`|=([^\s=](?:[^=]*?[^\s=])?)=` +
+		`|~([^\s~](?:[^~]*?[^\s~])?)~` +
+		`|\+([^\s+](?:[^+]*?[^\s+])?)\+)` +
+		`|(https?://[^\s<>\[\]]*[^\s<>\[\].,;:!?)'"])`)
+	orgHeadingRx  = regexp.MustCompile(`^(\*+)\s+(.*)$`)
+	orgListItemRx = regexp.MustCompile(`^( *)([-+*]|\d+[.)])\s+(.*)$`)
+	orgBlockRx    = regexp.MustCompile(`(?i)^#\+begin_(\w+)\s*(.*)$`)
+	orgKeywordRx  = regexp.MustCompile(`^#\+(\w+):`)
+)
+
+// export settings that don't show in exported documents
+var orgSettingsKeywords = []string{"title", "author", "date", "email", "options", "startup", "language", "setupfile", "filetags", "description", "keywords"}
+
+func orgInline(s string) string {
+	return replaceInline(s, orgInlineRx, func(m []string) string {
+		if m[1] != "" {
+			desc := html.EscapeString(m[1])
+			if m[2] != "" {
+				desc = orgInline(m[2])
+			}
+			return linkHtml(m[1], desc)
+		}
+		if m[10] != "" {
+			return linkHtml(m[10], html.EscapeString(m[10]))
+		}
+		// m[3] is the character before the markup
+		res := html.EscapeString(m[3])
+		switch {
+		case m[4] != "":
+			res += "<strong>" + orgInline(m[4]) + "</strong>"
+		case m[5] != "":
+			res += "<em>" + orgInline(m[5]) + "</em>"
+		case m[6] != "":
+			res += "<u>" + orgInline(m[6]) + "</u>"
+		case m[7] != "":
+			res += "<code>" + html.EscapeString(m[7]) + "</code>"
+		case m[8] != "":
+			res += "<code>" + html.EscapeString(m[8]) + "</code>"
+		case m[9] != "":
+			res += "<del>" + orgInline(m[9]) + "</del>"
+		}
+		return res
+	})
+}
+
+func orgListItem(l string) (int, bool, string, bool) {
+	m := orgListItemRx.FindStringSubmatch(l)
+	// "* " at the start of a line is a heading
+	if m == nil || (m[2] == "*" && m[1] == "") {
+		return 0, false, "", false
+	}
+	ordered := !strings.ContainsAny(m[2], "-+*")
+	return len(m[1]), ordered, m[3], true
+}
+
+func isOrgFixedWidth(l string) bool {
+	l = strings.TrimSpace(l)
+	return l == ":" || strings.HasPrefix(l, ": ")
+}
+
+// a line that starts something other than a paragraph
+func isOrgSpecialLine(l string) bool {
+	t := strings.TrimSpace(l)
+	if _, _, _, ok := orgListItem(l); ok {
+		return true
+	}
+	return orgHeadingRx.MatchString(l) || strings.HasPrefix(t, "#") || isOrgFixedWidth(l) || (len(t) >= 5 && strings.Count(t, "-") == len(t))
+}
+
+func org(s []byte) string {
+	return orgLines(markupLines(s))
+}
+
+func orgLines(lines []string) string {
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+		if t == "" {
+			i++
+			continue
+		}
+		if m := orgHeadingRx.FindStringSubmatch(l); m != nil {
+			b.WriteString(headingHtml(len(m[1]), orgInline(m[2])))
+			i++
+			continue
+		}
+		if m := orgBlockRx.FindStringSubmatch(t); m != nil {
+			end := "#+end_" + strings.ToLower(m[1])
+			j := i + 1
+			for j < len(lines) && strings.ToLower(strings.TrimSpace(lines[j])) != end {
+				j++
+			}
+			body := lines[i+1 : j]
+			switch strings.ToLower(m[1]) {
+			case "src":
+				lang := ""
+				if f := strings.Fields(m[2]); len(f) > 0 {
+					lang = f[0]
+				}
+				b.WriteString(codeBlockHtml(lang, strings.Join(dedentLines(body), "\n")))
+			case "example":
+				b.WriteString(codeBlockHtml("", strings.Join(dedentLines(body), "\n")))
+			case "quote":
+				b.WriteString("<blockquote>\n" + orgLines(body) + "</blockquote>\n")
+			default:
+				if j == len(lines) {
+					j--
+				}
+				b.WriteString(preHtml(lines[i : j+1]))
+			}
+			i = j + 1
+			continue
+		}
+		if m := orgKeywordRx.FindStringSubmatch(t); m != nil && stringInSlice(orgSettingsKeywords, strings.ToLower(m[1])) {
+			i++
+			continue
+		}
+		// comment
+		if t == "#" || strings.HasPrefix(t, "# ") {
+			i++
+			continue
+		}
+		if isOrgFixedWidth(l) {
+			var code []string
+			for ; i < len(lines) && isOrgFixedWidth(lines[i]); i++ {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ":"), " "))
+			}
+			b.WriteString(codeBlockHtml("", strings.Join(code, "\n")))
+			continue
+		}
+		if len(t) >= 5 && strings.Count(t, "-") == len(t) {
+			b.WriteString("<hr>\n")
+			i++
+			continue
+		}
+		if _, _, _, ok := orgListItem(l); ok {
+			s, next := listHtml(lines, i, orgListItem, orgInline)
+			b.WriteString(s)
+			i = next
+			continue
+		}
+		start := i
+		for i++; i < len(lines) && !isBlankLine(lines[i]) && !isOrgSpecialLine(lines[i]); i++ {
+		}
+		b.WriteString(paragraphHtml(lines[start:i], orgInline))
+	}
+	return b.String()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// If config.TrackOutboundLinks is true, links to other sites in articles
+// are rewritten to /out?a=${articleShortId}&u=${url}&s=${signature} which
+// counts the click and redirects to the url. The signature ensures that
+// /out only redirects to urls that we generated (otherwise it would be an
+// open redirect).
+// We only remember destination host, not the full url. Each click is
+// recorded as a line "${articleId}|${host}" in data/outbound_clicks.txt.
+// Feeds use the original urls.
+
+var (
+	outboundClicksMu sync.Mutex
+	// article id => host => number of clicks
+	outboundClicks = make(map[int]map[string]int)
+
+	// hosts whose links we don't track
+	ownHosts = []string{"blog.kowalczyk.info"}
+
+	hrefRx = regexp.MustCompile(`href="(https?://[^"]+)"`)
+)
+
+func outboundTrackingEnabled() bool {
+	return getConfig().TrackOutboundLinks
+}
+
+func outboundClicksPath() string {
+	return filepath.Join(getDataDir(), "data", "outbound_clicks.txt")
+}
+
+func isOwnHost(host string) bool {
+	return stringInSlice(ownHosts, host) || stringInSlice(getConfig().TLSHosts, host)
+}
+
+func outboundLinkSignature(articleId int, uri string) string {
+	mac := hmac.New(sha256.New, cookieAuthKey)
+	mac.Write([]byte(fmt.Sprintf("out:%d:%s", articleId, uri)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func outboundLinkUrl(articleId int, uri string) string {
+	v := url.Values{}
+	v.Set("a", ShortenId(articleId))
+	v.Set("u", uri)
+	v.Set("s", outboundLinkSignature(articleId, uri))
+	return "/out?" + v.Encode()
+}
+
+// rewrites links to other sites in html of an article to go through /out
+func trackOutboundLinks(articleId int, s string) string {
+	return hrefRx.ReplaceAllStringFunc(s, func(href string) string {
+		uri := html.UnescapeString(hrefRx.FindStringSubmatch(href)[1])
+		u, err := url.Parse(uri)
+		if err != nil || u.Host == "" || isOwnHost(u.Host) {
+			return href
+		}
+		return `href="` + html.EscapeString(outboundLinkUrl(articleId, uri)) + `"`
+	})
+}
+
+func parseOutboundClicks(d []byte) (map[int]map[string]int, error) {
+	res := make(map[int]map[string]int)
+	for _, l := range bytes.Split(d, []byte{'\n'}) {
+		s := strings.TrimSpace(string(l))
+		if s == "" {
+			continue
+		}
+		parts := strings.Split(s, "|")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line %q in outbound clicks", s)
+		}
+		articleId, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed line %q in outbound clicks", s)
+		}
+		addOutboundClick(res, articleId, parts[1])
+	}
+	return res, nil
+}
+
+func addOutboundClick(clicks map[int]map[string]int, articleId int, host string) {
+	perHost := clicks[articleId]
+	if perHost == nil {
+		perHost = make(map[string]int)
+		clicks[articleId] = perHost
+	}
+	perHost[host]++
+}
+
+func readOutboundClicks() {
+	d, err := ioutil.ReadFile(outboundClicksPath())
+	if err != nil {
+		return
+	}
+	clicks, err := parseOutboundClicks(d)
+	if err != nil {
+		logger.Errorf("readOutboundClicks(): %s", err)
+		return
+	}
+	outboundClicksMu.Lock()
+	outboundClicks = clicks
+	outboundClicksMu.Unlock()
+	logger.Noticef("loaded outbound clicks for %d articles", len(clicks))
+}
+
+func recordOutboundClick(articleId int, host string) error {
+	outboundClicksMu.Lock()
+	defer outboundClicksMu.Unlock()
+	addOutboundClick(outboundClicks, articleId, host)
+	f, err := os.OpenFile(outboundClicksPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d|%s\n", articleId, remSep(host))
+	f.Close()
+	return err
+}
+
+type HostClicks struct {
+	Host  string
+	Count int
+}
+
+type HostClicksByCount []HostClicks
+
+func (s HostClicksByCount) Len() int {
+	return len(s)
+}
+func (s HostClicksByCount) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s HostClicksByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Host < s[j].Host
+}
+
+// the most clicked first
+func getOutboundClicks(articleId int) []HostClicks {
+	outboundClicksMu.Lock()
+	defer outboundClicksMu.Unlock()
+	res := make([]HostClicks, 0)
+	for host, n := range outboundClicks[articleId] {
+		res = append(res, HostClicks{Host: host, Count: n})
+	}
+	sort.Sort(HostClicksByCount(res))
+	return res
+}
+
+// e.g. "github.com: 5, golang.org: 1"
+func (a *MonthArticle) OutboundClicks() string {
+	var parts []string
+	for _, hc := range getOutboundClicks(a.Id) {
+		parts = append(parts, fmt.Sprintf("%s: %d", hc.Host, hc.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// /out?a=${articleShortId}&u=${url}&s=${signature}
+func handleOutboundLink(w http.ResponseWriter, r *http.Request) {
+	articleId := UnshortenId(r.FormValue("a"))
+	uri := r.FormValue("u")
+	sig := r.FormValue("s")
+	if !hmac.Equal([]byte(sig), []byte(outboundLinkSignature(articleId, uri))) {
+		http.Error(w, "invalid link", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		http.Error(w, "invalid link", http.StatusBadRequest)
+		return
+	}
+	// we don't log the url, only the host
+	if err = recordOutboundClick(articleId, strings.ToLower(u.Host)); err != nil {
+		logger.Errorf("handleOutboundLink(): recordOutboundClick() for %s failed with %s", u.Host, err)
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
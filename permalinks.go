@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Urls of articles are built from PermalinkScheme in config.json e.g.
+// /{year}/{month}/{slug}.html (NotesPermalinkScheme for notes, if set). Articles are also found by their legacy url
+// (/article/{id}/{slug}.html) and by permalinks with their old slugs
+// (OldSlugs: header), which redirect to the permalink.
+
+const legacyPermalinkScheme = "/article/{id}/{slug}.html"
+
+var permalinkPlaceholderRx = regexp.MustCompile(`\{[^}]*\}`)
+
+var permalinkPlaceholders = []string{"{id}", "{year}", "{month}", "{slug}"}
+
+func validatePermalinkScheme(scheme string) error {
+	if !strings.HasPrefix(scheme, "/") {
+		return errors.New("PermalinkScheme must start with /")
+	}
+	for _, p := range permalinkPlaceholderRx.FindAllString(scheme, -1) {
+		if !stringInSlice(permalinkPlaceholders, p) {
+			return fmt.Errorf("unknown placeholder %s in PermalinkScheme (known are %s)", p, strings.Join(permalinkPlaceholders, ", "))
+		}
+	}
+	if !strings.Contains(scheme, "{id}") && !strings.Contains(scheme, "{slug}") {
+		return errors.New("PermalinkScheme must have {id} or {slug}")
+	}
+	return nil
+}
+
+func permalinkScheme() string {
+	if s := stringOrEmpty(getConfig().PermalinkScheme); s != "" {
+		return s
+	}
+	return legacyPermalinkScheme
+}
+
+// returns url of a in a given scheme, starting with "/"
+func renderPermalink(scheme string, a *Article) string {
+	return renderPermalinkWithSlug(scheme, a, a.GetSlug())
+}
+
+func renderPermalinkWithSlug(scheme string, a *Article, slug string) string {
+	r := strings.NewReplacer(
+		"{id}", ShortenId(a.Id),
+		"{year}", a.PublishedOn.Format("2006"),
+		"{month}", a.PublishedOn.Format("01"),
+		"{slug}", slug,
+	)
+	return r.Replace(scheme)
+}
+
+// returns permalink => article for all articles. When permalinks of more
+// than one article are the same (e.g. same title in the same month with
+// /{year}/{month}/{slug}.html), the first article gets it and we log it
+func buildPermalinks(articles []*Article) map[string]*Article {
+	res := make(map[string]*Article, len(articles))
+	for _, a := range articles {
+		url := renderPermalink(permalinkSchemeOf(a), a)
+		if prev := res[url]; prev != nil {
+			logger.Errorf("buildPermalinks(): warning: article %d (%s) has the same permalink %s as article %d (%s), it's only reachable by its legacy url", a.Id, a.Path, url, prev.Id, prev.Path)
+			continue
+		}
+		res[url] = a
+	}
+	return res
+}
+
+// returns permalink with an old slug => article. Permalinks of current
+// articles win over old ones
+func buildOldPermalinks(articles []*Article, permalinks map[string]*Article) map[string]*Article {
+	res := make(map[string]*Article)
+	for _, a := range articles {
+		for _, slug := range a.OldSlugs {
+			url := renderPermalinkWithSlug(permalinkSchemeOf(a), a, slug)
+			if permalinks[url] == nil && res[url] == nil {
+				res[url] = a
+			}
+		}
+	}
+	return res
+}
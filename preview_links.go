@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// Admin can make a link to a draft that can be given to a reviewer before
+// it's published: /preview/${token} shows the draft like it will look when
+// published, with a banner saying it's a preview. The token is
+// ${articleId}.${expiry}.${hmac of article id, sha1 of its file and expiry}
+// signed with cookie auth key, so editing the draft makes existing links
+// invalid. Links are remembered in preview_links.json in data directory so
+// that /app/drafts can list them and admin can revoke them. Expired,
+// tampered with, revoked and outdated links are 404.
+// Drafts are not in the store in production so we read them from
+// blog_posts when needed.
+
+const (
+	maxPreviewDays        = 30
+	previewTokenHmacBytes = 16
+)
+
+// a draft with sha1 of its file
+type DraftVersion struct {
+	*Article
+	Sha1 string
+}
+
+type PreviewLink struct {
+	Token     string
+	ArticleId int
+	Title     string
+	Expires   time.Time
+	CreatedOn time.Time
+}
+
+func (l *PreviewLink) Url() string {
+	return absURL("/preview/" + l.Token)
+}
+
+type PreviewLinks struct {
+	sync.Mutex
+	Links []*PreviewLink
+}
+
+var (
+	previewLinks = &PreviewLinks{}
+	// where we look for drafts, changed by tests
+	draftsDir = "blog_posts"
+)
+
+func previewLinksPath() string {
+	return filepath.Join(getDataDir(), "preview_links.json")
+}
+
+// returns drafts in dir, sorted by id
+func readDrafts(dir string) []*DraftVersion {
+	var res []*DraftVersion
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isArticleFile(path) {
+			return nil
+		}
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		a, errs := parseArticle(path, d)
+		if len(errs) > 0 || !a.IsDraft || a.IsDeleted {
+			return nil
+		}
+		a.UpdatedOn = info.ModTime()
+		res = append(res, &DraftVersion{Article: a, Sha1: u.Sha1HexOfBytes(d)})
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Id < res[j].Id
+	})
+	return res
+}
+
+func findDraft(dir string, id int) *DraftVersion {
+	for _, dv := range readDrafts(dir) {
+		if dv.Id == id {
+			return dv
+		}
+	}
+	return nil
+}
+
+func previewTokenHmac(id int, sha1 string, expires int64) string {
+	mac := hmac.New(sha256.New, cookieAuthKey)
+	fmt.Fprintf(mac, "preview:%d:%s:%d", id, sha1, expires)
+	return fmt.Sprintf("%x", mac.Sum(nil)[:previewTokenHmacBytes])
+}
+
+func newPreviewToken(dv *DraftVersion, expires time.Time) string {
+	n := expires.Unix()
+	return fmt.Sprintf("%d.%d.%s", dv.Id, n, previewTokenHmac(dv.Id, dv.Sha1, n))
+}
+
+// returns article id and expiry of a token, without checking it
+func parsePreviewToken(token string) (int, int64, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	id, err1 := strconv.Atoi(parts[0])
+	expires, err2 := strconv.ParseInt(parts[1], 10, 64)
+	return id, expires, err1 == nil && err2 == nil
+}
+
+func isValidPreviewToken(dv *DraftVersion, token string, now time.Time) bool {
+	id, expires, ok := parsePreviewToken(token)
+	if !ok || id != dv.Id || now.Unix() > expires {
+		return false
+	}
+	parts := strings.Split(token, ".")
+	return hmac.Equal([]byte(parts[2]), []byte(previewTokenHmac(dv.Id, dv.Sha1, expires)))
+}
+
+func (p *PreviewLinks) Add(l *PreviewLink) {
+	p.Lock()
+	defer p.Unlock()
+	p.Links = append(p.Links, l)
+}
+
+func (p *PreviewLinks) Find(token string) *PreviewLink {
+	p.Lock()
+	defer p.Unlock()
+	for _, l := range p.Links {
+		if l.Token == token {
+			return l
+		}
+	}
+	return nil
+}
+
+// returns false if there's no link with that token
+func (p *PreviewLinks) Revoke(token string) bool {
+	p.Lock()
+	defer p.Unlock()
+	for i, l := range p.Links {
+		if l.Token == token {
+			p.Links = append(p.Links[:i], p.Links[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// returns links that didn't expire, newest first
+func (p *PreviewLinks) Active(now time.Time) []*PreviewLink {
+	p.Lock()
+	defer p.Unlock()
+	var res []*PreviewLink
+	for i := len(p.Links) - 1; i >= 0; i-- {
+		if l := p.Links[i]; now.Before(l.Expires) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// forgets expired links
+func (p *PreviewLinks) prune(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	var links []*PreviewLink
+	for _, l := range p.Links {
+		if now.Before(l.Expires) {
+			links = append(links, l)
+		}
+	}
+	p.Links = links
+}
+
+func (p *PreviewLinks) save(path string) error {
+	p.Lock()
+	d, err := json.Marshal(p)
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadPreviewLinks(path string) (*PreviewLinks, error) {
+	p := &PreviewLinks{}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readPreviewLinks() {
+	p, err := loadPreviewLinks(previewLinksPath())
+	if err != nil {
+		logger.Errorf("readPreviewLinks(): %s", err)
+		return
+	}
+	previewLinks = p
+}
+
+func savePreviewLinks() {
+	previewLinks.prune(time.Now())
+	if err := previewLinks.save(previewLinksPath()); err != nil {
+		logger.Errorf("savePreviewLinks(): %s", err)
+	}
+}
+
+// /preview/${token}
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/preview/")
+	id, _, ok := parsePreviewToken(token)
+	link := previewLinks.Find(token)
+	if !ok || link == nil {
+		serve404(w, r)
+		return
+	}
+	dv := findDraft(draftsDir, id)
+	if dv == nil || !isValidPreviewToken(dv, token, time.Now()) {
+		serve404(w, r)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Cache-Control", "no-cache")
+	renderArticle(w, r, articlesCache.get(), &ArticleInfo{this: dv.Article}, link)
+}
+
+type DraftRow struct {
+	*DraftVersion
+	Links []*PreviewLink
+}
+
+// GET /app/drafts
+func handleDrafts(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	links := previewLinks.Active(now)
+	var rows []*DraftRow
+	for _, dv := range readDrafts(draftsDir) {
+		row := &DraftRow{DraftVersion: dv}
+		for _, l := range links {
+			if l.ArticleId == dv.Id && isValidPreviewToken(dv, l.Token, now) {
+				row.Links = append(row.Links, l)
+			}
+		}
+		rows = append(rows, row)
+	}
+	model := struct {
+		BasePageModel
+		Drafts []*DraftRow
+		// including links to drafts that changed or were published
+		Links []*PreviewLink
+	}{
+		BasePageModel: newBasePageModel(r),
+		Drafts:        rows,
+		Links:         links,
+	}
+	ExecTemplate(w, tmplDrafts, model)
+}
+
+// POST /app/preview-link
+// id      : ${articleId}
+// days    : ${days}, how long the link is valid
+func handleNewPreviewLink(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	dv := findDraft(draftsDir, id)
+	if dv == nil {
+		serveFieldError(w, r, "id", "no draft with that id")
+		return
+	}
+	days, err := strconv.Atoi(getTrimmedFormValue(r, "days"))
+	if err != nil || days < 1 || days > maxPreviewDays {
+		serveFieldError(w, r, "days", fmt.Sprintf("days must be a number between 1 and %d", maxPreviewDays))
+		return
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(days) * 24 * time.Hour)
+	link := &PreviewLink{
+		Token:     newPreviewToken(dv, expires),
+		ArticleId: dv.Id,
+		Title:     dv.Title,
+		Expires:   expires,
+		CreatedOn: now,
+	}
+	previewLinks.Add(link)
+	savePreviewLinks()
+	logger.Noticef("handleNewPreviewLink(): preview link for draft %d valid until %s", dv.Id, expires.Format(time.RFC3339))
+	serveErrorPage(w, r, http.StatusOK, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Preview link for " + dv.Title,
+		Message:       fmt.Sprintf("Valid until %s: %s", fmtDate(expires, "Jan 2 2006 15:04"), link.Url()),
+	})
+}
+
+// POST /app/preview-link/revoke
+// token   : ${token}
+func handleRevokePreviewLink(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	if !previewLinks.Revoke(r.FormValue("token")) {
+		serveFieldError(w, r, "token", "no preview link with that token")
+		return
+	}
+	savePreviewLinks()
+	http.Redirect(w, r, "/app/drafts", http.StatusSeeOther)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POSTs to endpoints that anyone can call (submitting crashes, logging in
+// with a password) are rate limited per ip address with a token bucket:
+// each request takes a token, tokens are refilled at PerMinute rate up to
+// Burst. When there are no tokens, we return 429 with Retry-After. Limits
+// are in RateLimits in config.json (path => limit), defaultRateLimits are
+// used for paths not there. Admin's requests are never limited.
+
+type RateLimit struct {
+	// how many requests per minute, on average
+	PerMinute float64
+	// how many requests can be made at once
+	Burst int
+}
+
+var defaultRateLimits = map[string]RateLimit{
+	"/app/crashsubmit": {PerMinute: 10, Burst: 30},
+	"/api/crash/v2":    {PerMinute: 10, Burst: 30},
+	"/login/basic":     {PerMinute: 5, Burst: 10},
+	"/subscribe":       {PerMinute: 2, Burst: 5},
+	"/app/react":       {PerMinute: 10, Burst: 20},
+}
+
+// how often we remove state of ips that didn't make requests in a while
+const rateLimitEvictFreq = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// returns number of tokens in b at time now
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Minutes()*limit.PerMinute
+	return math.Min(tokens, float64(limit.Burst))
+}
+
+type RateLimiter struct {
+	sync.Mutex
+	// path => ip => bucket
+	buckets map[string]map[string]*tokenBucket
+	m       *Metrics
+}
+
+var appRateLimiter *RateLimiter
+
+func NewRateLimiter(m *Metrics) *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]map[string]*tokenBucket),
+		m:       m,
+	}
+}
+
+func getRateLimit(path string) (RateLimit, bool) {
+	if limit, ok := getConfig().RateLimits[path]; ok {
+		return limit, true
+	}
+	limit, ok := defaultRateLimits[path]
+	return limit, ok
+}
+
+// takes a token for request from ip to path. If there are none, returns
+// false and how long until there will be one
+func (rl *RateLimiter) take(path, ip string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	if limit.PerMinute <= 0 {
+		return true, 0
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	ips := rl.buckets[path]
+	if ips == nil {
+		ips = make(map[string]*tokenBucket)
+		rl.buckets[path] = ips
+	}
+	b := ips[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		ips[ip] = b
+	}
+	b.tokens = b.refill(limit, now)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.PerMinute * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// removes buckets that are full i.e. of ips that didn't make requests in a
+// while, so that we don't remember every ip forever. Returns number of
+// buckets left
+func (rl *RateLimiter) evictIdle(now time.Time) int {
+	rl.Lock()
+	defer rl.Unlock()
+	n := 0
+	for path, ips := range rl.buckets {
+		limit, _ := getRateLimit(path)
+		for ip, b := range ips {
+			if limit.PerMinute <= 0 || b.refill(limit, now) >= float64(limit.Burst) {
+				delete(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			delete(rl.buckets, path)
+		}
+		n += len(ips)
+	}
+	return n
+}
+
+func rateLimitEvictLoop(rl *RateLimiter, done chan struct{}) {
+	for {
+		select {
+		case <-time.After(rateLimitEvictFreq):
+		case <-done:
+			return
+		}
+		rl.evictIdle(time.Now())
+	}
+}
+
+// throttled_http_req_app_crashsubmit etc.
+func throttledMetricName(path string) string {
+	return "throttled_http_req" + strings.Replace(path, "/", "_", -1)
+}
+
+// wraps fn so that POSTs to path are rate limited. Returns fn if rl is nil
+func (rl *RateLimiter) Wrap(path string, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if rl == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fn(w, r)
+			return
+		}
+		limit, ok := getRateLimit(path)
+		if !ok || IsAdmin(r) {
+			fn(w, r)
+			return
+		}
+		if ok, wait := rl.take(path, getIpAddress(r), limit, time.Now()); !ok {
+			rl.m.ThrottledReqsOf(path).Inc(1)
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Visitors can like articles (there are no comments). Each
+// visitor who reacts gets an anonymous id in a cookie, signed with cookie
+// auth key, so that reacting again (e.g. after reload) doesn't count twice
+// and the button shows if they already did. We only keep a hash of the id.
+// Reactions are kept in memory and saved to article_reactions.json in data
+// directory with article views (see article_views.go).
+
+const (
+	visitorCookieName = "vid"
+	visitorCookieDays = 365
+	visitorIdBytes    = 16
+	visitorHmacBytes  = 16
+	// length of visitor keys kept per reaction
+	reactionKeyBytes = 8
+)
+
+type ReactionType struct {
+	Name string
+	// button before and after visitor reacted
+	Label     string
+	DoneLabel string
+}
+
+var reactionTypes = []*ReactionType{
+	{Name: "like", Label: "Like", DoneLabel: "Liked"},
+}
+
+func isValidReactionType(name string) bool {
+	for _, rt := range reactionTypes {
+		if rt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type ArticleReactions struct {
+	sync.Mutex
+	// article id => reaction type => keys of visitors who reacted
+	Articles map[int]map[string][]string
+	// true if there are changes not saved to the file
+	dirty bool
+}
+
+var articleReactions = newArticleReactions()
+
+func newArticleReactions() *ArticleReactions {
+	return &ArticleReactions{Articles: make(map[int]map[string][]string)}
+}
+
+func articleReactionsPath() string {
+	return filepath.Join(getDataDir(), "article_reactions.json")
+}
+
+func visitorIdHmac(id string) string {
+	mac := hmac.New(sha256.New, cookieAuthKey)
+	mac.Write([]byte("visitor:" + id))
+	return hex.EncodeToString(mac.Sum(nil)[:visitorHmacBytes])
+}
+
+// returns "" if r doesn't have a valid visitor cookie
+func getVisitorId(r *http.Request) string {
+	c, err := r.Cookie(visitorCookieName)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(visitorIdHmac(parts[0]))) {
+		return ""
+	}
+	return parts[0]
+}
+
+// returns visitor id of r, creating a new one if it doesn't have it
+func ensureVisitorId(w http.ResponseWriter, r *http.Request) string {
+	if id := getVisitorId(r); id != "" {
+		return id
+	}
+	d := make([]byte, visitorIdBytes)
+	if _, err := rand.Read(d); err != nil {
+		logger.Errorf("ensureVisitorId(): rand.Read() failed with %s", err)
+	}
+	id := hex.EncodeToString(d)
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookieName,
+		Value:    id + "." + visitorIdHmac(id),
+		Path:     "/",
+		MaxAge:   visitorCookieDays * 24 * 60 * 60,
+		Secure:   tlsEnabled(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// what we store instead of visitor id
+func reactionKey(visitorId string) string {
+	sum := sha256.Sum256([]byte("reaction:" + visitorId))
+	return hex.EncodeToString(sum[:reactionKeyBytes])
+}
+
+func indexOfString(a []string, s string) int {
+	for i, el := range a {
+		if el == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// adds (or removes if undo) reaction of a visitor. Returns true if it
+// changed anything
+func (ar *ArticleReactions) Set(articleId int, typ, visitorId string, undo bool) bool {
+	key := reactionKey(visitorId)
+	ar.Lock()
+	defer ar.Unlock()
+	m := ar.Articles[articleId]
+	if m == nil {
+		m = make(map[string][]string)
+		ar.Articles[articleId] = m
+	}
+	keys := m[typ]
+	i := indexOfString(keys, key)
+	switch {
+	case !undo && i == -1:
+		m[typ] = append(keys, key)
+	case undo && i != -1:
+		m[typ] = append(keys[:i], keys[i+1:]...)
+	default:
+		return false
+	}
+	ar.dirty = true
+	return true
+}
+
+// returns reaction type => count and reaction type => true if visitor
+// reacted that way
+func (ar *ArticleReactions) Get(articleId int, visitorId string) (map[string]int, map[string]bool) {
+	counts := make(map[string]int)
+	mine := make(map[string]bool)
+	key := ""
+	if visitorId != "" {
+		key = reactionKey(visitorId)
+	}
+	ar.Lock()
+	defer ar.Unlock()
+	for typ, keys := range ar.Articles[articleId] {
+		counts[typ] = len(keys)
+		mine[typ] = key != "" && indexOfString(keys, key) != -1
+	}
+	return counts, mine
+}
+
+// returns false if article had no reactions
+func (ar *ArticleReactions) Reset(articleId int) bool {
+	ar.Lock()
+	defer ar.Unlock()
+	if _, ok := ar.Articles[articleId]; !ok {
+		return false
+	}
+	delete(ar.Articles, articleId)
+	ar.dirty = true
+	return true
+}
+
+// doesn't write the file if nothing changed since last save
+func (ar *ArticleReactions) save(path string) error {
+	ar.Lock()
+	if !ar.dirty {
+		ar.Unlock()
+		return nil
+	}
+	d, err := json.Marshal(ar)
+	ar.dirty = false
+	ar.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadArticleReactions(path string) (*ArticleReactions, error) {
+	ar := newArticleReactions()
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, ar); err != nil {
+		return nil, err
+	}
+	if ar.Articles == nil {
+		ar.Articles = make(map[int]map[string][]string)
+	}
+	return ar, nil
+}
+
+func readArticleReactions() {
+	ar, err := loadArticleReactions(articleReactionsPath())
+	if err != nil {
+		logger.Errorf("readArticleReactions(): %s", err)
+		return
+	}
+	articleReactions = ar
+}
+
+func saveArticleReactions() {
+	if err := articleReactions.save(articleReactionsPath()); err != nil {
+		logger.Errorf("saveArticleReactions(): %s", err)
+	}
+}
+
+// a reaction button on article page
+type ReactionButton struct {
+	*ReactionType
+	Count int
+	Mine  bool
+}
+
+func reactionButtons(r *http.Request, articleId int) []*ReactionButton {
+	counts, mine := articleReactions.Get(articleId, getVisitorId(r))
+	var res []*ReactionButton
+	for _, rt := range reactionTypes {
+		res = append(res, &ReactionButton{ReactionType: rt, Count: counts[rt.Name], Mine: mine[rt.Name]})
+	}
+	return res
+}
+
+type ReactionsResponse struct {
+	Counts map[string]int  `json:"counts"`
+	Mine   map[string]bool `json:"mine"`
+}
+
+// we don't have csrf tokens for visitors that are not logged in, but if
+// the browser tells where the request comes from, it must be our page
+func isSameOriginPost(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// POST /app/react
+// id      : ${articleId}
+// type    : like
+// undo    : 1 to take back the reaction
+func handleReact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isSameOriginPost(r) {
+		logger.Noticef("handleReact(): rejected POST from %s with Origin %q", getIpAddress(r), r.Header.Get("Origin"))
+		serveErrorPage(w, r, http.StatusForbidden, &ErrorPageModel{
+			BasePageModel: newBasePageModel(r),
+			Title:         "Cross-origin request",
+		})
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	info := articlesCache.get().byId[id]
+	if info == nil {
+		serveFieldError(w, r, "id", "no article with that id")
+		return
+	}
+	typ := r.FormValue("type")
+	if !isValidReactionType(typ) {
+		serveFieldError(w, r, "type", "type must be like")
+		return
+	}
+	visitorId := ensureVisitorId(w, r)
+	// bots don't get counted but we don't tell them
+	if !isBotUserAgent(r.UserAgent()) {
+		articleReactions.Set(id, typ, visitorId, r.FormValue("undo") == "1")
+	}
+	if isApiRequest(r) {
+		counts, mine := articleReactions.Get(id, visitorId)
+		d, err := json.Marshal(&ReactionsResponse{Counts: counts, Mine: mine})
+		if err != nil {
+			logger.RequestErrorf(r, "handleReact(): json.Marshal() failed with %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		setContentType(w, "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeData(w, r, http.StatusOK, d)
+		return
+	}
+	http.Redirect(w, r, "/"+info.this.Permalink()+"#reactions", http.StatusSeeOther)
+}
+
+// POST /app/reactions/reset
+// id      : ${articleId}
+func handleReactionsReset(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if !articleReactions.Reset(id) {
+		serveFieldError(w, r, "id", "no reactions to article with that id")
+		return
+	}
+	logger.Noticef("handleReactionsReset(): reset reactions to article %d", id)
+	saveArticleReactions()
+	serveErrorPage(w, r, http.StatusOK, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Reactions reset",
+		Message:       "Reactions to article " + strconv.Itoa(id) + " were reset at " + time.Now().Format("Jan 2 2006 15:04") + ".",
+	})
+}
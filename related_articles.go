@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Related articles are calculated once when we build articles cache.
+// Articles are related if they share tags, rare tags count more than
+// common ones. For articles without tags we look at words in the title.
+
+const maxRelatedArticles = 5
+
+// short and common words that don't make titles related
+var titleStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "how": true,
+	"you": true, "are": true, "from": true, "what": true, "why": true,
+	"not": true, "about": true, "your": true, "into": true, "that": true,
+	"this": true, "when": true,
+}
+
+func titleWords(title string) map[string]bool {
+	res := make(map[string]bool)
+	words := strings.FieldsFunc(strings.ToLower(title), func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c > 127)
+	})
+	for _, w := range words {
+		if len(w) >= 3 && !titleStopWords[w] {
+			res[w] = true
+		}
+	}
+	return res
+}
+
+type relatedScore struct {
+	article *Article
+	score   float64
+}
+
+type relatedByScore []relatedScore
+
+func (s relatedByScore) Len() int {
+	return len(s)
+}
+func (s relatedByScore) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s relatedByScore) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score > s[j].score
+	}
+	// newer first
+	return s[i].article.PublishedOn.After(s[j].article.PublishedOn)
+}
+
+func canBeRelated(a *Article) bool {
+	return !a.IsDeleted
+}
+
+func topRelated(scores map[*Article]float64) []*Article {
+	arr := make([]relatedScore, 0, len(scores))
+	for a, score := range scores {
+		arr = append(arr, relatedScore{a, score})
+	}
+	sort.Sort(relatedByScore(arr))
+	if len(arr) > maxRelatedArticles {
+		arr = arr[:maxRelatedArticles]
+	}
+	res := make([]*Article, len(arr))
+	for i, rs := range arr {
+		res[i] = rs.article
+	}
+	return res
+}
+
+// returns related articles for each article id
+func buildRelatedArticles(articles []*Article) map[int][]*Article {
+	byTag := make(map[string][]*Article)
+	for _, a := range articles {
+		if !canBeRelated(a) {
+			continue
+		}
+		for _, tag := range a.Tags {
+			byTag[tag] = append(byTag[tag], a)
+		}
+	}
+	n := float64(len(articles))
+	// a tag shared by fewer articles says more about relatedness (idf)
+	tagWeight := make(map[string]float64)
+	for tag, arr := range byTag {
+		tagWeight[tag] = math.Log(1 + n/float64(len(arr)))
+	}
+
+	var titles map[*Article]map[string]bool
+	res := make(map[int][]*Article)
+	for _, a := range articles {
+		scores := make(map[*Article]float64)
+		if len(a.Tags) > 0 {
+			for _, tag := range a.Tags {
+				for _, other := range byTag[tag] {
+					if other != a {
+						scores[other] += tagWeight[tag]
+					}
+				}
+			}
+		} else {
+			if titles == nil {
+				titles = make(map[*Article]map[string]bool)
+				for _, other := range articles {
+					titles[other] = titleWords(other.Title)
+				}
+			}
+			words := titles[a]
+			for _, other := range articles {
+				if other == a || !canBeRelated(other) {
+					continue
+				}
+				for w := range titles[other] {
+					if words[w] {
+						scores[other]++
+					}
+				}
+			}
+		}
+		if len(scores) > 0 {
+			res[a.Id] = topRelated(scores)
+		}
+	}
+	return res
+}
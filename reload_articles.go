@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// When files in blog_posts change (also in production, e.g. when editing
+// them over ssh) we re-read only the changed files and swap articles in.
+// A file that doesn't parse is logged and the previous version of the
+// article keeps being served. A deleted file marks its article deleted.
+// When the date of an article changes and its permalink scheme has {year}
+// or {month}, a redirect from the old permalink is added to
+// article_redirects.txt.
+
+// returns false for files in blog_posts that are not articles, like
+// temporary files of editors (vim's .swp and 4913, emacs' .#foo.md and
+// #foo.md#, foo.md~)
+func isArticleFile(path string) bool {
+	name := filepath.Base(path)
+	if isTmpFile(path) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "#") || strings.HasSuffix(name, "~") {
+		return false
+	}
+	return formatFromExt(path) != FormatUnknown
+}
+
+func reloadArticleFiles(paths []string) {
+	// previous and current versions of re-read articles
+	var changed [][2]*Article
+	swapped := false
+	err := updateArticles(func(articles []*Article) []*Article {
+		var res []*Article
+		res, changed = readChangedArticles(articles, paths)
+		swapped = res != nil
+		return res
+	})
+	if err != nil {
+		logger.Errorf("reloadArticleFiles(): updateArticles() failed with %s, keeping previous versions", err)
+		return
+	}
+	if !swapped {
+		return
+	}
+	for _, c := range changed {
+		redirectIfDateChanged(c[0], c[1])
+	}
+	notifyArticlesPublished()
+}
+
+// returns articles with files in paths re-read and previous and current
+// versions of re-read articles. Returns nil if nothing changed
+func readChangedArticles(articles []*Article, paths []string) ([]*Article, [][2]*Article) {
+	pathToIdx := make(map[string]int)
+	for i, a := range articles {
+		pathToIdx[filepath.Clean(a.Path)] = i
+	}
+	nChanged := 0
+	// previous and current versions of re-read articles
+	var changed [][2]*Article
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		i, known := pathToIdx[path]
+		a, err := readArticle(path)
+		switch {
+		case os.IsNotExist(err):
+			if !known || articles[i] == nil || articles[i].IsDeleted {
+				continue
+			}
+			deleted := *articles[i]
+			deleted.IsDeleted = true
+			articles[i] = &deleted
+			logger.Noticef("reloadArticleFiles(): %s was deleted", path)
+		case err != nil:
+			logger.Errorf("reloadArticleFiles(): %s, keeping the previous version", err)
+			continue
+		case a == nil:
+			// became a draft in production
+			if !known {
+				continue
+			}
+			articles[i] = nil
+		default:
+			aliasArticleTags(a)
+			if known {
+				if prev := articles[i]; prev != nil && !prev.IsDeleted {
+					changed = append(changed, [2]*Article{prev, a})
+				}
+				articles[i] = a
+			} else {
+				pathToIdx[path] = len(articles)
+				articles = append(articles, a)
+			}
+			logger.Noticef("reloadArticleFiles(): re-read %s", path)
+		}
+		nChanged++
+	}
+	if nChanged == 0 {
+		return nil, nil
+	}
+
+	// when a file is moved, the article at the old path is deleted and
+	// the same article is at the new path
+	liveIds := make(map[int]bool)
+	for _, a := range articles {
+		if a != nil && !a.IsDeleted {
+			liveIds[a.Id] = true
+		}
+	}
+	res := make([]*Article, 0, len(articles))
+	for _, a := range articles {
+		if a != nil && !(a.IsDeleted && liveIds[a.Id]) {
+			res = append(res, a)
+		}
+	}
+	return res, changed
+}
+
+// adds a redirect from the old permalink of an article whose date changed
+func redirectIfDateChanged(prev, a *Article) {
+	if prev.PublishedOn.Equal(a.PublishedOn) || prev.Id != a.Id {
+		return
+	}
+	from, to := renderPermalink(permalinkSchemeOf(prev), prev), renderPermalink(permalinkSchemeOf(a), a)
+	if from == to {
+		return
+	}
+	// the date was changed back, the redirect would be a loop
+	if _, err := fileRedirects.Delete(to, redirectsPath); err != nil {
+		logger.Errorf("redirectIfDateChanged(): deleting redirect from %s failed with %s", to, err)
+	}
+	for _, a2 := range store.GetArticles() {
+		if a2.Id != a.Id && renderPermalink(permalinkSchemeOf(a2), a2) == from {
+			// another article has that permalink now
+			return
+		}
+	}
+	r := &Redirect{From: from, To: strconv.Itoa(a.Id), ArticleId: a.Id}
+	if err := fileRedirects.Add(r, redirectsPath); err != nil {
+		logger.Errorf("redirectIfDateChanged(): adding redirect from %s failed with %s", from, err)
+		return
+	}
+	logger.Noticef("redirectIfDateChanged(): date of article %d changed, %s redirects to %s", a.Id, from, to)
+}
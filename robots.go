@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// /robots.txt is generated so that it follows config.json: extra paths
+// from RobotsDisallow are added to the built-in ones and when not in
+// production (e.g. staging) everything is disallowed so it doesn't get
+// indexed.
+
+// admin pages, crash reports and pages that only list articles
+var robotsDisallowPaths = []string{"/app/", "/api/", "/logout", "/login",
+	"/tag/", "/notes/", "/page/"}
+
+func buildRobotsTxt(production bool, extra []string) string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if !production {
+		b.WriteString("Disallow: /\n")
+		return b.String()
+	}
+	for _, path := range robotsDisallowPaths {
+		b.WriteString("Disallow: " + path + "\n")
+	}
+	for _, path := range extra {
+		if !stringInSlice(robotsDisallowPaths, path) {
+			b.WriteString("Disallow: " + path + "\n")
+		}
+	}
+	b.WriteString("Allow: /\n")
+	return b.String()
+}
+
+// url: /robots.txt
+func handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
+	textResponse(w, r, buildRobotsTxt(inProduction, getConfig().RobotsDisallow))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// reStructuredText to html (see markup.go for what's supported). Section
+// levels are in the order their underline (and overline) styles appear,
+// like in docutils. ".. code-block:: ${lang}" (or "code", "sourcecode")
+// and "::" literal blocks are code blocks. Other directives are shown as
+// escaped text, comments and hyperlink targets are skipped.
+
+var (
+	rstInlineRx = regexp.MustCompile("``(.+?)``" +
+		`|\*\*([^*\s](?:.*?[^*\s])?)\*\*` +
+		`|\*([^*\s](?:[^*]*?[^*\s])?)\*` +
+		"|`([^`<]+?)\\s*<([^`>]+)>`__?" +
+		"|`([^`]+)`_{0,2}" +
+		`|(https?://[^\s<>]*[^\s<>.,;:!?)'"])`)
+	rstListItemRx  = regexp.MustCompile(`^( *)([-*+•]|\d+[.)]|#[.)]|\(\d+\))\s+(.*)$`)
+	rstDirectiveRx = regexp.MustCompile(`^\.\.\s+([\w-]+)::\s*(.*)$`)
+)
+
+func rstInline(s string) string {
+	return replaceInline(s, rstInlineRx, func(m []string) string {
+		switch {
+		case m[1] != "":
+			return "<code>" + html.EscapeString(m[1]) + "</code>"
+		case m[2] != "":
+			return "<strong>" + html.EscapeString(m[2]) + "</strong>"
+		case m[3] != "":
+			return "<em>" + html.EscapeString(m[3]) + "</em>"
+		case m[5] != "":
+			return linkHtml(m[5], html.EscapeString(m[4]))
+		case m[6] != "":
+			// interpreted text and references to targets we don't resolve
+			return html.EscapeString(m[6])
+		case m[7] != "":
+			return linkHtml(m[7], html.EscapeString(m[7]))
+		}
+		return html.EscapeString(m[0])
+	})
+}
+
+func rstListItem(l string) (int, bool, string, bool) {
+	m := rstListItemRx.FindStringSubmatch(l)
+	if m == nil {
+		return 0, false, "", false
+	}
+	ordered := !strings.ContainsAny(m[2], "-*+•")
+	return len(m[1]), ordered, m[3], true
+}
+
+// e.g. "=====", used to underline (and overline) section titles
+func isRstAdornment(l string) bool {
+	l = strings.TrimRight(l, " ")
+	if len(l) < 2 || !strings.ContainsRune("=-~^\"'`#*+:._", rune(l[0])) {
+		return false
+	}
+	return strings.Count(l, l[:1]) == len(l)
+}
+
+func isRstUnderline(l string, title string) bool {
+	return isRstAdornment(l) && len(strings.TrimRight(l, " ")) >= utf8.RuneCountInString(strings.TrimSpace(title))
+}
+
+// returns lines indented more than indent, starting at lines[i], and
+// index of the first line after them
+func rstIndentedBlock(lines []string, i int, indent int) ([]string, int) {
+	start := i
+	for i < len(lines) && (isBlankLine(lines[i]) || lineIndent(lines[i]) > indent) {
+		i++
+	}
+	return lines[start:i], i
+}
+
+func rst(s []byte) string {
+	lines := markupLines(s)
+	var b strings.Builder
+	// "=" for underline only, "=o" with overline
+	var headingStyles []string
+	headingLevel := func(style string) int {
+		for i, s := range headingStyles {
+			if s == style {
+				return i + 1
+			}
+		}
+		headingStyles = append(headingStyles, style)
+		return len(headingStyles)
+	}
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		if isBlankLine(l) {
+			i++
+			continue
+		}
+		// title with overline and underline
+		if isRstAdornment(l) && i+2 < len(lines) && !isBlankLine(lines[i+1]) && strings.TrimRight(lines[i+2], " ") == strings.TrimRight(l, " ") {
+			level := headingLevel(l[:1] + "o")
+			b.WriteString(headingHtml(level, rstInline(strings.TrimSpace(lines[i+1]))))
+			i += 3
+			continue
+		}
+		// transition
+		if isRstAdornment(l) && len(strings.TrimSpace(l)) >= 4 && (i+1 == len(lines) || isBlankLine(lines[i+1])) {
+			b.WriteString("<hr>\n")
+			i++
+			continue
+		}
+		if lineIndent(l) == 0 && i+1 < len(lines) && isRstUnderline(lines[i+1], l) {
+			level := headingLevel(lines[i+1][:1])
+			b.WriteString(headingHtml(level, rstInline(strings.TrimSpace(l))))
+			i += 2
+			continue
+		}
+		if m := rstDirectiveRx.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+			body, next := rstIndentedBlock(lines, i+1, lineIndent(l))
+			switch m[1] {
+			case "code-block", "code", "sourcecode":
+				// skip options like :linenos:
+				for len(body) > 0 && strings.HasPrefix(strings.TrimSpace(body[0]), ":") {
+					body = body[1:]
+				}
+				b.WriteString(codeBlockHtml(m[2], strings.Join(dedentLines(body), "\n")))
+			default:
+				b.WriteString(preHtml(lines[i:next]))
+			}
+			i = next
+			continue
+		}
+		// comment or hyperlink target
+		if strings.HasPrefix(strings.TrimSpace(l), "..") {
+			_, i = rstIndentedBlock(lines, i+1, lineIndent(l))
+			continue
+		}
+		if _, _, _, ok := rstListItem(l); ok {
+			s, next := listHtml(lines, i, rstListItem, rstInline)
+			b.WriteString(s)
+			i = next
+			continue
+		}
+		indent := lineIndent(l)
+		start := i
+		for i < len(lines) && !isBlankLine(lines[i]) && lineIndent(lines[i]) == indent {
+			if _, _, _, ok := rstListItem(lines[i]); ok && i > start {
+				break
+			}
+			i++
+		}
+		para := lines[start:i]
+		last := strings.TrimRight(para[len(para)-1], " ")
+		isLiteral := strings.HasSuffix(last, "::")
+		if isLiteral {
+			// "Paragraph::" is "Paragraph:", "Paragraph ::" and "::" are
+			// removed
+			last = strings.TrimSuffix(last, "::")
+			if !strings.HasSuffix(last, " ") && strings.TrimSpace(last) != "" {
+				last += ":"
+			}
+			para = append(append([]string{}, para[:len(para)-1]...), last)
+		}
+		if text := strings.TrimSpace(strings.Join(para, "")); text != "" {
+			p := paragraphHtml(para, rstInline)
+			if indent > 0 {
+				p = "<blockquote>" + p + "</blockquote>\n"
+			}
+			b.WriteString(p)
+		}
+		if isLiteral {
+			j := nextNonBlankLine(lines, i)
+			if j < len(lines) && lineIndent(lines[j]) > indent {
+				var code []string
+				code, i = rstIndentedBlock(lines, j, indent)
+				b.WriteString(codeBlockHtml("", strings.Join(dedentLines(code), "\n")))
+			}
+		}
+	}
+	return b.String()
+}
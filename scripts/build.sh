@@ -4,6 +4,9 @@ set -o nounset
 set -o errexit
 set -o pipefail
 
+# build info shown by /healthz
+ldflags="-X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+
 #rm -rf $TMPDIR/gdep
-gdep go build -o blog_app *.go
+gdep go build -ldflags "$ldflags" -o blog_app *.go
 rm blog_app
@@ -4,7 +4,10 @@ set -o nounset
 set -o errexit
 set -o pipefail
 
+# build info shown by /healthz
+ldflags="-X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+
 rm -rf $TMPDIR/godep
-GOOS=linux GOARCH=amd64 gdep go build -o blog_app_linux
+GOOS=linux GOARCH=amd64 gdep go build -ldflags "$ldflags" -o blog_app_linux
 fab deploy
 rm blog_app_linux
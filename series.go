@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Articles can be parts of a series (e.g. a multi-part tutorial), set with
+// "Series: ${name}" header and optional "SeriesPart: ${n}" header. Parts are
+// ordered by part number, articles without one go after numbered parts;
+// ties are broken by publish date. Articles in a series link to previous
+// and next part and list all parts, /series/${slug} lists them too.
+
+type Series struct {
+	Name string
+	// Urlify(Name), used in /series/${slug}
+	Slug     string
+	Articles []*Article
+}
+
+func (s *Series) Url() string {
+	return "/series/" + s.Slug
+}
+
+// what an article page shows about its series
+type SeriesNav struct {
+	*Series
+	// 1-based position of the article in the series
+	Part int
+	Prev *Article
+	Next *Article
+}
+
+// returns slug => series
+func buildSeries(articles []*Article) map[string]*Series {
+	res := make(map[string]*Series)
+	for _, a := range articles {
+		if a.Series == "" {
+			continue
+		}
+		slug := Urlify(a.Series)
+		s := res[slug]
+		if s == nil {
+			s = &Series{Name: a.Series, Slug: slug}
+			res[slug] = s
+		}
+		s.Articles = append(s.Articles, a)
+	}
+	for _, s := range res {
+		sort.SliceStable(s.Articles, func(i, j int) bool {
+			a, b := s.Articles[i], s.Articles[j]
+			if a.SeriesPart != b.SeriesPart {
+				if a.SeriesPart == 0 || b.SeriesPart == 0 {
+					return b.SeriesPart == 0
+				}
+				return a.SeriesPart < b.SeriesPart
+			}
+			return a.PublishedOn.Before(b.PublishedOn)
+		})
+	}
+	return res
+}
+
+func getSeries(slug string) *Series {
+	return articlesCache.get().series[slug]
+}
+
+// returns nil if a is not in a series
+func getSeriesNav(a *Article) *SeriesNav {
+	return articlesCache.get().seriesNav(a)
+}
+
+func (d *articlesCacheData) seriesNav(a *Article) *SeriesNav {
+	if a.Series == "" {
+		return nil
+	}
+	s := d.series[Urlify(a.Series)]
+	if s == nil {
+		return nil
+	}
+	for i, part := range s.Articles {
+		if part.Id != a.Id {
+			continue
+		}
+		nav := &SeriesNav{Series: s, Part: i + 1}
+		if i > 0 {
+			nav.Prev = s.Articles[i-1]
+		}
+		if i+1 < len(s.Articles) {
+			nav.Next = s.Articles[i+1]
+		}
+		return nav
+	}
+	return nil
+}
+
+// /series/${slug}
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	slug := strings.TrimPrefix(r.URL.Path, "/series/")
+	s := getSeries(slug)
+	if s == nil {
+		serve404(w, r)
+		return
+	}
+	model := struct {
+		BasePageModel
+		Series *Series
+	}{
+		BasePageModel: newBasePageModel(r),
+		Series:        s,
+	}
+	ExecTemplate(w, tmplSeries, model)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeouts of the http servers and max size of request bodies, so that slow
+// or malicious clients can't tie up connections and memory. Timeouts are
+// ${Name}TimeoutSeconds in config.json (defaults below if 0), body limits
+// are per path in MaxBodyBytes in config.json (path => bytes), with
+// defaultMaxBodyBytes used for paths not there and defaultMaxBodyBytesOther
+// for all other paths. A request whose body is over the limit gets 413.
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 60 * time.Second
+	defaultWriteTimeout      = 120 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+
+	// forms e.g. /subscribe, /app/share
+	defaultMaxBodyBytesOther = 64 * 1024
+)
+
+var defaultMaxBodyBytes = map[string]int64{
+	// multi-part form with a crash report
+	"/app/crashsubmit": 2 * 1024 * 1024,
+	// json, possibly gzip-compressed; uncompressed size is limited by
+	// maxCrashApiPayload
+	"/api/crash/v2": maxCrashApiPayload,
+	// files attached to articles (see uploads.go)
+	"/app/uploads": defaultMaxUploadBytes,
+}
+
+func timeoutOrDefault(seconds int, def time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return def
+}
+
+func setServerTimeouts(srv *http.Server) {
+	c := getConfig()
+	srv.ReadHeaderTimeout = timeoutOrDefault(c.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout)
+	srv.ReadTimeout = timeoutOrDefault(c.ReadTimeoutSeconds, defaultReadTimeout)
+	srv.WriteTimeout = timeoutOrDefault(c.WriteTimeoutSeconds, defaultWriteTimeout)
+	srv.IdleTimeout = timeoutOrDefault(c.IdleTimeoutSeconds, defaultIdleTimeout)
+}
+
+func maxBodyBytes(path string) int64 {
+	if n, ok := getConfig().MaxBodyBytes[path]; ok {
+		return n
+	}
+	if n, ok := defaultMaxBodyBytes[path]; ok {
+		return n
+	}
+	return defaultMaxBodyBytesOther
+}
+
+// remembers if reading failed because the body is over the limit
+type limitedBody struct {
+	io.ReadCloser
+	max    int64
+	n      int64
+	tooBig bool
+}
+
+func (b *limitedBody) Read(d []byte) (int, error) {
+	n, err := b.ReadCloser.Read(d)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.n >= b.max {
+		b.tooBig = true
+	}
+	return n, err
+}
+
+// once the body was over the limit, what the handler writes is replaced by
+// 413. Handlers typically only see an error from reading the form, which
+// they'd report as a bad request (or not at all)
+type bodyLimitResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	body        *limitedBody
+	max         int64
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *bodyLimitResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.body.tooBig {
+		w.discard = true
+		serveBodyTooBig(w.ResponseWriter, w.r, w.max)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyLimitResponseWriter) Write(d []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.discard {
+		return len(d), nil
+	}
+	return w.ResponseWriter.Write(d)
+}
+
+func serveBodyTooBig(w http.ResponseWriter, r *http.Request, max int64) {
+	logger.Noticef("serveBodyTooBig(): %s %s from %s, Content-Length: %d, limit: %d bytes", r.Method, r.URL.Path, getIpAddress(r), r.ContentLength, max)
+	if isApiRequest(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		serveJsonError(w, r, http.StatusRequestEntityTooLarge, "", "request body too large")
+		return
+	}
+	http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+}
+
+// limits size of request bodies to maxBodyBytes() of their path
+func withBodyLimits(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		max := maxBodyBytes(r.URL.Path)
+		if r.ContentLength > max {
+			serveBodyTooBig(w, r, max)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max), max: max}
+		r.Body = body
+		lw := &bodyLimitResponseWriter{ResponseWriter: w, r: r, body: body, max: max}
+		h.ServeHTTP(lw, r)
+		if !lw.wroteHeader && body.tooBig {
+			serveBodyTooBig(w, r, max)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Articles with "Private:" header are not listed anywhere (main page, feeds,
+// archives etc.) and their urls return 404, except for the admin and for
+// links with a share token: permalink?share=${token}. The token is
+// ${expiry}.${hmac of article id, expiry and share generation} signed with
+// cookie auth key. To revoke links that were shared, bump "ShareGeneration:"
+// header of the article.
+
+const (
+	shareParam          = "share"
+	maxShareDays        = 365
+	shareTokenHmacBytes = 16
+)
+
+func shareTokenHmac(a *Article, expires int64) string {
+	mac := hmac.New(sha256.New, cookieAuthKey)
+	fmt.Fprintf(mac, "share:%d:%d:%d", a.Id, a.ShareGeneration, expires)
+	return hex.EncodeToString(mac.Sum(nil)[:shareTokenHmacBytes])
+}
+
+func newShareToken(a *Article, expires time.Time) string {
+	n := expires.Unix()
+	return strconv.FormatInt(n, 10) + "." + shareTokenHmac(a, n)
+}
+
+func isValidShareToken(a *Article, token string, now time.Time) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(shareTokenHmac(a, expires)))
+}
+
+func shareUrl(a *Article, expires time.Time) string {
+	return absURL("/" + a.Permalink() + "?" + shareParam + "=" + url.QueryEscape(newShareToken(a, expires)))
+}
+
+// returns true if r can see a private article
+func canViewPrivateArticle(r *http.Request, a *Article) bool {
+	if IsAdmin(r) {
+		return true
+	}
+	token := r.URL.Query().Get(shareParam)
+	return token != "" && isValidShareToken(a, token, time.Now())
+}
+
+func getCachedPrivateArticles() []*Article {
+	var res []*Article
+	for _, a := range articlesCache.get().private {
+		res = append(res, a)
+	}
+	return res
+}
+
+// POST /app/share
+// id      : ${articleId}
+// days    : ${days}, how long the link is valid
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	var a *Article
+	for _, curr := range getCachedPrivateArticles() {
+		if curr.Id == id {
+			a = curr
+		}
+	}
+	if a == nil {
+		serveFieldError(w, r, "id", "no private article with that id")
+		return
+	}
+	days, err := strconv.Atoi(getTrimmedFormValue(r, "days"))
+	if err != nil || days < 1 || days > maxShareDays {
+		serveFieldError(w, r, "days", fmt.Sprintf("days must be a number between 1 and %d", maxShareDays))
+		return
+	}
+	expires := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	logger.Noticef("handleShare(): share link for article %d valid until %s", a.Id, expires.Format(time.RFC3339))
+	serveErrorPage(w, r, http.StatusOK, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         "Share link for " + a.Title,
+		Message:       fmt.Sprintf("Valid until %s: %s", expires.Format("Jan 2 2006 15:04"), shareUrl(a, expires)),
+	})
+}
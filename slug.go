@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Slugs (and file names) of articles created with -newarticle are made
+// from the title by sanitizeForFile(): letters with diacritics are
+// transliterated to ASCII (German umlauts as "ae", "oe", "ue"), everything
+// that's not a-z or 0-9 separates words and the result is cut at a word
+// boundary. Titles without any latin letters or digits (e.g. Chinese) get
+// id of the article as the slug. Slugs are saved in "Slug:" header of the
+// article so changing this doesn't change urls of existing articles.
+
+// lower case letters => their transliteration
+var slugTransliterations = map[rune]string{}
+
+func init() {
+	for letters, ascii := range map[string]string{
+		"àáâãåāăą":  "a",
+		"äæ":        "ae",
+		"çćĉċč":     "c",
+		"ďđð":       "d",
+		"èéêëēĕėęě": "e",
+		"ĝğġģ":      "g",
+		"ĥħ":        "h",
+		"ìíîïĩīĭįı": "i",
+		"ĵ":         "j",
+		"ķ":         "k",
+		"ĺļľŀł":     "l",
+		"ñńņňŉ":     "n",
+		"òóôõøōŏő":  "o",
+		"öœ":        "oe",
+		"ŕŗř":       "r",
+		"śŝşšș":     "s",
+		"ß":         "ss",
+		"ţťŧț":      "t",
+		"þ":         "th",
+		"ùúûũūŭůűų": "u",
+		"ü":         "ue",
+		"ŵ":         "w",
+		"ýÿŷ":       "y",
+		"źżž":       "z",
+	} {
+		for _, c := range letters {
+			slugTransliterations[c] = ascii
+		}
+	}
+}
+
+// returns slug of s, at most maxLen bytes long, with only a-z, 0-9 and
+// '-' (not at the start or end). Empty if s has no letters or digits
+// we can transliterate
+func sanitizeForFile(s string, maxLen int) string {
+	var b strings.Builder
+	sep := false
+	for _, c := range s {
+		c = unicode.ToLower(c)
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			if sep && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			sep = false
+			b.WriteRune(c)
+		case slugTransliterations[c] != "":
+			if sep && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			sep = false
+			b.WriteString(slugTransliterations[c])
+		case unicode.Is(unicode.Mn, c):
+			// combining marks are dropped, except umlaut ("u" followed by
+			// U+0308 is another way of writing "ü") which must give the same
+			// slug as "ü"
+			if s := b.String(); c == '\u0308' && !sep && s != "" && strings.IndexByte("aou", s[len(s)-1]) != -1 {
+				b.WriteByte('e')
+			}
+		case c == '\'' || c == '’':
+			// "don't" is "dont"
+		default:
+			sep = true
+		}
+	}
+	return truncateSlug(b.String(), maxLen)
+}
+
+// cuts slug s to maxLen bytes, at its last '-' if that's in the second half
+func truncateSlug(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	// s is ASCII
+	if s[maxLen] != '-' {
+		if idx := strings.LastIndexByte(s[:maxLen], '-'); idx >= maxLen/2 {
+			maxLen = idx
+		}
+	}
+	return strings.Trim(s[:maxLen], "-")
+}
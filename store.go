@@ -1,23 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kjk/textiler"
 	"github.com/kr/fs"
 	"github.com/microcosm-cc/bluemonday"
-	"github.com/russross/blackfriday"
 )
 
 type Article struct {
@@ -29,6 +29,49 @@ type Article struct {
 	Path        string
 	Body        []byte
 	BodyHtml    string
+	// set with "Slug:" header. If empty, slug is made from the title
+	Slug string
+	// set with "OldSlugs:" header (comma-separated). Permalinks with old
+	// slugs redirect to the current permalink
+	OldSlugs []string
+	// set with "Toc: yes" or "Toc: no" header. If not set, articles with
+	// at least tocMinHeadings headings have table of contents
+	ShowToc *bool
+	// html of table of contents, set by GetHtmlStr()
+	TocHtml string
+	// set with "Draft:" header. Drafts are only shown when not in
+	// production and are private (e.g. no Open Graph tags)
+	IsDraft bool
+	// set with "Deleted:" header. Deleted articles are not shown in
+	// production but we remember them to return 410 Gone for their urls
+	IsDeleted bool
+	// set with "Series:" and "SeriesPart:" headers (see series.go).
+	// SeriesPart is 0 if not set
+	Series     string
+	SeriesPart int
+	// set with "Private:" header. Private articles are not listed and can
+	// only be seen by the admin and with share links (see share_links.go)
+	IsPrivate bool
+	// set with "Pinned:" header. Pinned articles are first on the main
+	// page (see front_page.go)
+	IsPinned bool
+	// set with "ShareGeneration:" header. Changing it revokes share links
+	ShareGeneration int
+	// modification time of the file, date_modified in /feed.json
+	UpdatedOn time.Time
+	// set with "Authors:" header (comma-separated). If empty, the article
+	// is by the site owner (see authors.go)
+	Authors []string
+	// set with "CanonicalURL:" header, for articles first published
+	// elsewhere. If set, it's the url in rel=canonical and feeds
+	CanonicalURL string
+	// set with "LinkURL:" header for link posts (see link_posts.go)
+	LinkURL string
+	// header lines with keys we don't know, in the order of the file
+	Headers []ArticleHeader
+	// true for notes without "Title:" header, whose Title is made from
+	// the body (see notes.go)
+	NoTitle bool
 }
 
 const (
@@ -36,9 +79,11 @@ const (
 	FormatTextile  = 1
 	FormatMarkdown = 2
 	FormatText     = 3
+	FormatRst      = 4
+	FormatOrg      = 5
 
 	FormatFirst   = 0
-	FormatLast    = 3
+	FormatLast    = 5
 	FormatUnknown = -1
 )
 
@@ -57,7 +102,7 @@ func (s ArticlesByTime) Less(i, j int) bool {
 }
 
 // same format as Format* constants
-var formatNames = []string{"Html", "Textile", "Markdown", "Text"}
+var formatNames = []string{"Html", "Textile", "Markdown", "Text", "Rst", "Org"}
 
 func validFormat(format int) bool {
 	return format >= FormatFirst && format <= FormatLast
@@ -81,10 +126,21 @@ func FormatNameToId(name string) int {
 	return FormatUnknown
 }
 
+// Articles in the store can be replaced (e.g. in dev when files change)
+// while requests are served. Slices returned by the store are never
+// modified after that, replacing creates new slices.
 type Store struct {
+	sync.RWMutex
 	articles    []*Article
 	idToArticle map[int]*Article
 	dirsToWatch []string
+	// only in production, in dev deleted articles are shown as regular
+	// articles
+	deletedArticles []*Article
+	// highest id ever used, including deleted articles and drafts. New
+	// articles get the next one so that ids (which are in permalinks) are
+	// never reused
+	maxId int
 }
 
 func isSepLine(s string) bool {
@@ -92,11 +148,11 @@ func isSepLine(s string) bool {
 }
 
 func parseTags(s string) []string {
-	tags := strings.Split(s, ",")
-	for i, tag := range tags {
-		tag = strings.TrimSpace(tag)
-		tag = strings.ToLower(tag)
-		tags[i] = tag
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
 	return tags
 }
@@ -112,88 +168,48 @@ func parseFormat(s string) int {
 		return FormatMarkdown
 	case "text":
 		return FormatText
+	case "rst", "restructuredtext":
+		return FormatRst
+	case "org":
+		return FormatOrg
 	default:
 		return FormatUnknown
 	}
 }
 
+// Date: is RFC3339 (e.g. 2017-03-04T10:30:00+01:00), date and time in
+// TimeZone from config (2017-03-04 10:30) or just date (2017-03-04, UTC)
 func parseDate(s string) (time.Time, error) {
 	t, err := time.Parse(time.RFC3339, s)
 	if err == nil {
 		return t, nil
 	}
-	t, err = time.Parse(s, "2006-01-02")
-	if err == nil {
+	if t, err = time.ParseInLocation("2006-01-02 15:04", s, siteLocation()); err == nil {
 		return t, nil
 	}
-	// TODO: more formats?
-	return time.Now(), err
+	return time.Parse("2006-01-02", s)
 }
 
-// might return nil if article is meant to be skipped (deleted or draft)
+// might return nil if article is meant to be skipped (draft)
 func readArticle(path string) (*Article, error) {
-	f, err := os.Open(path)
+	d, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	a := &Article{}
-	r := bufio.NewReader(f)
-	for {
-		l, err := r.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		l = strings.TrimSpace(l)
-		if isSepLine(l) {
-			break
-		}
-		parts := strings.SplitN(l, ":", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("Unexpected line: %q\n", l)
-		}
-		k := strings.ToLower(parts[0])
-		v := strings.TrimSpace(parts[1])
-		switch k {
-		case "deleted", "draft":
-			if inProduction {
-				return nil, nil
-			}
-		case "id":
-			id, err := strconv.Atoi(v)
-			if err != nil {
-				return nil, fmt.Errorf("%q is not a valid id (not a number)", v)
-			}
-			a.Id = id
-			a.Path = path
-		case "title":
-			a.Title = v
-		case "tags":
-			a.Tags = parseTags(v)
-		case "format":
-			f := parseFormat(v)
-			if f == FormatUnknown {
-				return nil, fmt.Errorf("%q is not a valid format", v)
-			}
-			a.Format = f
-		case "date":
-			a.PublishedOn, err = parseDate(v)
-			if err != nil {
-				return nil, fmt.Errorf("%q is not a valid date", v)
-			}
-		default:
-			return nil, fmt.Errorf("Unexpected key: %q\n", k)
-		}
+	a, errs := parseArticle(path, d)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
-	a.Body, err = ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
+	if a.IsDraft && inProduction {
+		return nil, nil
+	}
+	if st, err := os.Stat(path); err == nil {
+		a.UpdatedOn = st.ModTime()
 	}
 	return a, nil
 }
 
 func readArticles() ([]*Article, []string, error) {
-	timeStart := time.Now()
 	walker := fs.Walk("blog_posts")
 	res := make([]*Article, 0)
 	dirs := make([]string, 0)
@@ -208,6 +224,9 @@ func readArticles() ([]*Article, []string, error) {
 			dirs = append(dirs, path)
 			continue
 		}
+		if !isArticleFile(path) {
+			continue
+		}
 		a, err := readArticle(path)
 		if err != nil {
 			fmt.Printf("readArticle() of %s failed with %s\n", path, err)
@@ -217,36 +236,196 @@ func readArticles() ([]*Article, []string, error) {
 			res = append(res, a)
 		}
 	}
-	fmt.Printf("read %d articles in %s\n", len(res), time.Since(timeStart))
 	return res, dirs, nil
 }
 
+func splitDeletedArticles(articles []*Article) ([]*Article, []*Article) {
+	var live, deleted []*Article
+	for _, a := range articles {
+		if a.IsDeleted {
+			deleted = append(deleted, a)
+		} else {
+			live = append(live, a)
+		}
+	}
+	return live, deleted
+}
+
+// returns article id => paths of files with that id for all articles in
+// dir, including drafts and deleted
+func readArticleIds(dir string) (map[int][]string, error) {
+	res := make(map[int][]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isArticleFile(path) {
+			return err
+		}
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if a, _ := parseArticle(path, d); a != nil {
+			res[a.Id] = append(res[a.Id], path)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// returns the highest article id in dir or an error listing all ids used
+// by more than one article
+func checkArticleIds(dir string) (int, error) {
+	idToPaths, err := readArticleIds(dir)
+	if err != nil {
+		return 0, err
+	}
+	maxId := 0
+	var dups []int
+	for id, paths := range idToPaths {
+		if id > maxId {
+			maxId = id
+		}
+		if len(paths) > 1 {
+			dups = append(dups, id)
+		}
+	}
+	if len(dups) == 0 {
+		return maxId, nil
+	}
+	sort.Ints(dups)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d article ids are used by more than one article, give them unique ids (-validate-posts shows all problems):", len(dups))
+	for _, id := range dups {
+		fmt.Fprintf(&b, "\n  %d: %s", id, strings.Join(idToPaths[id], ", "))
+	}
+	return 0, errors.New(b.String())
+}
+
 func NewStore() (*Store, error) {
+	timeStart := time.Now()
+	maxId, err := checkArticleIds("blog_posts")
+	if err != nil {
+		return nil, err
+	}
 	articles, dirs, err := readArticles()
 	if err != nil {
 		return nil, err
 	}
+	fmt.Printf("read %d articles in %s\n", len(articles), time.Since(timeStart))
+	// includes ids of drafts which are not in the store in production
+	res := &Store{dirsToWatch: dirs, maxId: maxId}
+	if err = res.SetArticles(articles); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// replaces all articles (including deleted) in the store. Takes ownership
+// of articles
+func (s *Store) SetArticles(articles []*Article) error {
+	var deleted []*Article
+	if inProduction {
+		articles, deleted = splitDeletedArticles(articles)
+	}
 	sort.Sort(ArticlesByTime(articles))
-	res := &Store{articles: articles, dirsToWatch: dirs}
-	res.idToArticle = make(map[int]*Article)
+	idToArticle := make(map[int]*Article)
 	for _, a := range articles {
-		curr := res.idToArticle[a.Id]
-		if curr == nil {
-			res.idToArticle[a.Id] = a
-			continue
+		if curr := idToArticle[a.Id]; curr != nil {
+			return fmt.Errorf("2 articles with the same id %d\n%s\n%s\n", a.Id, curr.Path, a.Path)
 		}
-		log.Fatalf("2 articles with the same id %d\n%s\n%s\n", a.Id, curr.Path, a.Path)
+		idToArticle[a.Id] = a
 	}
-	return res, nil
+	s.Lock()
+	s.articles = articles
+	s.idToArticle = idToArticle
+	s.deletedArticles = deleted
+	s.updateMaxId(articles)
+	s.updateMaxId(deleted)
+	s.Unlock()
+	return nil
+}
+
+// must be called with the lock held
+func (s *Store) updateMaxId(articles []*Article) {
+	for _, a := range articles {
+		if a.Id > s.maxId {
+			s.maxId = a.Id
+		}
+	}
+}
+
+// adds a new article or replaces the article with the same id. An article
+// with id 0 is new and gets the next unused id, which is done under the
+// lock so that concurrent creates get different ids. Takes ownership of a
+func (s *Store) CreateOrUpdateArticle(a *Article) error {
+	if a.Id < 0 {
+		return fmt.Errorf("invalid article id %d", a.Id)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if a.Id == 0 {
+		s.maxId++
+		a.Id = s.maxId
+	} else if a.Id > s.maxId {
+		s.maxId = a.Id
+	}
+	// drafts are not in the store in production
+	if a.IsDraft && inProduction {
+		return nil
+	}
+	var articles, deleted []*Article
+	for _, a2 := range s.articles {
+		if a2.Id != a.Id {
+			articles = append(articles, a2)
+		}
+	}
+	for _, a2 := range s.deletedArticles {
+		if a2.Id != a.Id {
+			deleted = append(deleted, a2)
+		}
+	}
+	if a.IsDeleted && inProduction {
+		deleted = append(deleted, a)
+	} else {
+		articles = append(articles, a)
+		sort.Sort(ArticlesByTime(articles))
+	}
+	idToArticle := make(map[int]*Article, len(articles))
+	for _, a2 := range articles {
+		idToArticle[a2.Id] = a2
+	}
+	s.articles = articles
+	s.idToArticle = idToArticle
+	s.deletedArticles = deleted
+	return nil
+}
+
+// absolute url of the article for rel=canonical and feeds, CanonicalURL if
+// set
+func (a *Article) CanonicalUrl() string {
+	if a.CanonicalURL != "" {
+		return a.CanonicalURL
+	}
+	return absURL(a.Permalink())
 }
 
 func (s *Store) GetArticles() []*Article {
+	s.RLock()
+	defer s.RUnlock()
 	return s.articles
 }
 
+// returns a new slice with all articles, including deleted
+func (s *Store) GetAllArticles() []*Article {
+	s.RLock()
+	defer s.RUnlock()
+	res := make([]*Article, 0, len(s.articles)+len(s.deletedArticles))
+	res = append(res, s.articles...)
+	return append(res, s.deletedArticles...)
+}
+
 func (s *Store) GetArticleById(id int) *Article {
 	//fmt.Printf("GetArticleById: %d\n", id)
-	for _, a := range s.articles {
+	for _, a := range s.GetArticles() {
 		if a.Id == id {
 			return a
 		}
@@ -254,12 +433,46 @@ func (s *Store) GetArticleById(id int) *Article {
 	return nil
 }
 
+func (s *Store) GetDeletedArticles() []*Article {
+	s.RLock()
+	defer s.RUnlock()
+	return s.deletedArticles
+}
+
+func (s *Store) IsDeletedArticleId(id int) bool {
+	for _, a := range s.GetDeletedArticles() {
+		if a.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Store) ArticlesCount() int {
-	return len(s.articles)
+	return len(s.GetArticles())
+}
+
+func isValidSlug(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/?#% ")
 }
 
+// CanonicalURL and LinkURL must be absolute http(s) urls
+func isValidAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && !strings.ContainsAny(s, " \t")
+}
+
+func (a *Article) GetSlug() string {
+	if a.Slug != "" {
+		return a.Slug
+	}
+	return Urlify(a.Title)
+}
+
+// url of the article (without leading "/") in PermalinkScheme or, for
+// notes, NotesPermalinkScheme
 func (a *Article) Permalink() string {
-	return "article/" + ShortenId(a.Id) + "/" + Urlify(a.Title) + ".html"
+	return renderPermalink(permalinkSchemeOf(a), a)[1:]
 }
 
 func (a *Article) TagsDisplay() template.HTML {
@@ -271,9 +484,20 @@ func (a *Article) TagsDisplay() template.HTML {
 	return template.HTML(s)
 }
 
+func (a *Article) showToc(nHeadings int) bool {
+	if a.ShowToc != nil {
+		return *a.ShowToc && nHeadings > 0
+	}
+	return nHeadings >= tocMinHeadings
+}
+
 func (a *Article) GetHtmlStr() string {
 	if a.BodyHtml == "" {
-		a.BodyHtml = msgToHTML(a.Body, a.Format)
+		s, headings := addHeadingIds(msgToHTML(a.Body, a.Format))
+		if a.showToc(len(headings)) {
+			a.TocHtml = renderToc(headings)
+		}
+		a.BodyHtml = s
 	}
 	return a.BodyHtml
 }
@@ -346,11 +570,15 @@ func textile(s []byte) string {
 }
 
 func markdown(s []byte) string {
+	opts := markdownOptionsFromConfig(getConfig())
 	s, replacements := txtWithCodeParts(s)
-	unsafe := blackfriday.MarkdownCommon(s)
+	unsafe := opts.render(s)
 	policy := bluemonday.UGCPolicy()
 	policy.AllowStyling()
 	res := policy.SanitizeBytes(unsafe)
+	if opts.TaskLists {
+		res = renderTaskLists(res)
+	}
 	for kStr, v := range replacements {
 		k := []byte(kStr)
 		res = bytes.Replace(res, k, v, -1)
@@ -368,6 +596,10 @@ func msgToHTML(msg []byte, format int) string {
 		return markdown(msg)
 	case FormatText:
 		return strToHTML(string(msg))
+	case FormatRst:
+		return rst(msg)
+	case FormatOrg:
+		return org(msg)
 	}
 	panic("unknown format")
 }
@@ -14,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/kjk/blog/internal/fsutil"
 	"github.com/kjk/u"
 )
 
@@ -24,7 +25,23 @@ type Crash struct {
 	ProgramVersion *string
 	IpAddrInternal *string
 	CrashingLine   *string
-	Sha1           [20]byte
+	// "" if we couldn't parse the stack of the crashing thread
+	Signature *string
+	// "" if crash report doesn't say
+	Os *string
+	// optional, sent by clients using /api/crash/v2
+	InstallId *string
+	Sha1      [20]byte
+	// crash report file was deleted by retention policy, we only have
+	// the index entry
+	IsPruned bool
+	// starred crashes are never pruned
+	IsStarred bool
+	// if not empty, crash report file was moved to this archive in backup
+	// target (see crash_archive.go), ArchiveOffset is the offset of the
+	// file in the uncompressed tar
+	Archive       string
+	ArchiveOffset int64
 }
 
 type App struct {
@@ -32,6 +49,7 @@ type App struct {
 	Crashes                []*Crash
 	PerDayCrashes          map[string][]*Crash
 	PerCrashingLineCrashes map[string][]*Crash
+	PerSignatureCrashes    map[string][]*Crash
 }
 
 func (a *App) CrashesCount() int {
@@ -46,6 +64,9 @@ type StoreCrashes struct {
 	versions      []*string
 	ips           map[string]*string
 	crashingLines map[string]*string
+	signatures    map[string]*string
+	oses          map[string]*string
+	installIds    map[string]*string
 	dataFile      *os.File
 }
 
@@ -94,6 +115,7 @@ func (s *StoreCrashes) FindOrCreateApp(appName string) *App {
 		Crashes:                make([]*Crash, 0),
 		PerDayCrashes:          make(map[string][]*Crash),
 		PerCrashingLineCrashes: make(map[string][]*Crash),
+		PerSignatureCrashes:    make(map[string][]*Crash),
 	}
 	s.apps = append(s.apps, app)
 	return app
@@ -124,6 +146,30 @@ func (s *StoreCrashes) FindOrCreateCrashingLine(str string) *string {
 	return &str
 }
 
+func (s *StoreCrashes) FindOrCreateSignature(str string) *string {
+	if s2, ok := s.signatures[str]; ok {
+		return s2
+	}
+	s.signatures[str] = &str
+	return &str
+}
+
+func (s *StoreCrashes) FindOrCreateOs(str string) *string {
+	if s2, ok := s.oses[str]; ok {
+		return s2
+	}
+	s.oses[str] = &str
+	return &str
+}
+
+func (s *StoreCrashes) FindOrCreateInstallId(str string) *string {
+	if s2, ok := s.installIds[str]; ok {
+		return s2
+	}
+	s.installIds[str] = &str
+	return &str
+}
+
 func (s *StoreCrashes) FindIp(str string) *string {
 	if s2, ok := s.ips[str]; ok {
 		return s2
@@ -209,11 +255,72 @@ func (s *StoreCrashes) parseCrash(line []byte) {
 		CrashingLine:   crashingLine,
 	}
 	copy(c.Sha1[:], msgSha1)
+	s.appendCrash(c)
+}
 
-	if !s.MessageFileExists(c.Sha1[:]) {
-		panic("message file doesn't exist")
+// parse P, S or U line i.e. pruned, starred, unstarred crash:
+// P/vs1mJI02u0HBsHPceGfxy/Q+JE
+func parseCrashSha1Line(line []byte) [20]byte {
+	var res [20]byte
+	sha1, err := base64.StdEncoding.DecodeString(string(line[1:]) + "=")
+	if err != nil || len(sha1) != 20 {
+		panic("invalid sha1 in crash line")
 	}
-	s.appendCrash(c)
+	copy(res[:], sha1)
+	return res
+}
+
+func serCrashSha1Line(kind byte, c *Crash) string {
+	s := base64.StdEncoding.EncodeToString(c.Sha1[:])
+	s = s[:len(s)-1] // remove '=' from the end
+	return fmt.Sprintf("%c%s\n", kind, s)
+}
+
+// parse G, O or I line i.e. signature, os or install id of a crash:
+// G/vs1mJI02u0HBsHPceGfxy/Q+JE|CrashMe;PrintToDevice
+// O/vs1mJI02u0HBsHPceGfxy/Q+JE|Windows 7 SP1
+// I/vs1mJI02u0HBsHPceGfxy/Q+JE|3f2a9c
+// We no longer write them because crashes with the same content share
+// sha1, we only read them from older files.
+func parseCrashSha1ValueLine(line []byte) ([20]byte, string) {
+	parts := strings.SplitN(string(line), "|", 2)
+	if len(parts) != 2 {
+		panic("invalid crash value line")
+	}
+	return parseCrashSha1Line([]byte(parts[0])), parts[1]
+}
+
+func serCrashSha1ValueLine(kind byte, c *Crash, val string) string {
+	s := serCrashSha1Line(kind, c)
+	return s[:len(s)-1] + "|" + val + "\n"
+}
+
+// parse g, o or i line i.e. signature, os or install id of a crash with
+// a given id (ids are positions of C lines in the file):
+// g12|CrashMe;PrintToDevice
+// o12|Windows 7 SP1
+// i12|3f2a9c
+func parseCrashIdValueLine(line []byte) (int, string) {
+	parts := strings.SplitN(string(line[1:]), "|", 2)
+	if len(parts) != 2 {
+		panic("invalid crash value line")
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		panic("invalid crash id in crash value line")
+	}
+	return id, parts[1]
+}
+
+func serCrashIdValueLine(kind byte, c *Crash, val string) string {
+	return fmt.Sprintf("%c%d|%s\n", kind, c.Id, val)
+}
+
+// crashes are added to per-signature groups separately from appendCrash()
+// because when loading we only know the signature after reading g lines
+func (s *StoreCrashes) setCrashSignature(c *Crash, sig string) {
+	c.Signature = s.FindOrCreateSignature(sig)
+	c.App.PerSignatureCrashes[sig] = append(c.App.PerSignatureCrashes[sig], c)
 }
 
 func (s *StoreCrashes) appendCrash(c *Crash) {
@@ -242,6 +349,15 @@ func (s *StoreCrashes) readExistingCrashesData(fileDataPath string) error {
 		return err
 	}
 
+	pruned := make(map[[20]byte]bool)
+	starred := make(map[[20]byte]bool)
+	signatures := make(map[[20]byte]string)
+	oses := make(map[[20]byte]string)
+	installIds := make(map[[20]byte]string)
+	signaturesById := make(map[int]string)
+	osesById := make(map[int]string)
+	installIdsById := make(map[int]string)
+	archives := make(map[[20]byte]crashArchiveLocation)
 	for len(d) > 0 {
 		idx := bytes.IndexByte(d, '\n')
 		if -1 == idx {
@@ -252,30 +368,159 @@ func (s *StoreCrashes) readExistingCrashesData(fileDataPath string) error {
 		line := d[:idx]
 		d = d[idx+1:]
 		c := line[0]
-		if c == 'C' {
+		switch c {
+		case 'C':
 			s.parseCrash(line)
-		} else {
+		case 'P':
+			pruned[parseCrashSha1Line(line)] = true
+		case 'S':
+			starred[parseCrashSha1Line(line)] = true
+		case 'U':
+			delete(starred, parseCrashSha1Line(line))
+		case 'G':
+			sha1, sig := parseCrashSha1ValueLine(line)
+			signatures[sha1] = sig
+		case 'O':
+			sha1, crashOs := parseCrashSha1ValueLine(line)
+			oses[sha1] = crashOs
+		case 'I':
+			sha1, installId := parseCrashSha1ValueLine(line)
+			installIds[sha1] = installId
+		case 'g':
+			id, sig := parseCrashIdValueLine(line)
+			signaturesById[id] = sig
+		case 'o':
+			id, crashOs := parseCrashIdValueLine(line)
+			osesById[id] = crashOs
+		case 'i':
+			id, installId := parseCrashIdValueLine(line)
+			installIdsById[id] = installId
+		case 'A':
+			sha1, loc := parseCrashArchiveLine(line)
+			archives[sha1] = loc
+		default:
 			fmt.Printf("%q\n", string(line))
 			panic("Unexpected line type")
 		}
 	}
+	for _, c := range s.crashes {
+		c.IsPruned = pruned[c.Sha1]
+		c.IsStarred = starred[c.Sha1]
+		sig, ok := signaturesById[c.Id]
+		if !ok {
+			sig, ok = signatures[c.Sha1]
+		}
+		if ok {
+			s.setCrashSignature(c, sig)
+		}
+		crashOs, ok := osesById[c.Id]
+		if !ok {
+			crashOs, ok = oses[c.Sha1]
+		}
+		if ok {
+			c.Os = s.FindOrCreateOs(crashOs)
+		}
+		installId, ok := installIdsById[c.Id]
+		if !ok {
+			installId, ok = installIds[c.Sha1]
+		}
+		if ok {
+			c.InstallId = s.FindOrCreateInstallId(installId)
+		}
+		if loc, ok := archives[c.Sha1]; ok {
+			c.Archive, c.ArchiveOffset = loc.Archive, loc.Offset
+		}
+	}
 	return nil
 }
 
-func NewStoreCrashes(dataDir string) (*StoreCrashes, error) {
-	dataFilePath := filepath.Join(dataDir, "data", "crashesdata.txt")
-	store := &StoreCrashes{
+// returns an error if a crash report file of a crash that wasn't pruned
+// or archived doesn't exist
+func (s *StoreCrashes) checkCrashFilesExist() error {
+	for _, c := range s.crashes {
+		if c.IsPruned || c.IsArchived() {
+			continue
+		}
+		path := s.MessageFilePath(c.Sha1[:])
+		exists, err := fsutil.PathExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("crash report file %q doesn't exist", path)
+		}
+	}
+	return nil
+}
+
+// crashes saved before we started extracting signature and os don't have
+// G and O lines. We extract them from the crash report and save them so
+// that we only have to do it once
+func (s *StoreCrashes) addMissingCrashInfo() error {
+	n := 0
+	for _, c := range s.crashes {
+		if c.Signature != nil && c.Os != nil {
+			continue
+		}
+		var d []byte
+		if !c.IsPruned && !c.IsArchived() {
+			var err error
+			if d, err = ioutil.ReadFile(s.MessageFilePath(c.Sha1[:])); err != nil {
+				return err
+			}
+		}
+		if c.Signature == nil {
+			s.setCrashSignature(c, storeCrashSignature(d))
+			if err := s.appendString(serCrashIdValueLine('g', c, *c.Signature)); err != nil {
+				return err
+			}
+		}
+		if c.Os == nil {
+			c.Os = s.FindOrCreateOs(storeCrashOs(d))
+			if err := s.appendString(serCrashIdValueLine('o', c, *c.Os)); err != nil {
+				return err
+			}
+		}
+		n++
+	}
+	if n > 0 {
+		logger.Noticef("addMissingCrashInfo(): extracted info of %d crashes", n)
+	}
+	return nil
+}
+
+func crashesDataPath(dataDir string) string {
+	return filepath.Join(dataDir, "data", "crashesdata.txt")
+}
+
+func newEmptyStoreCrashes(dataDir string) *StoreCrashes {
+	return &StoreCrashes{
 		dataDir:       dataDir,
 		crashes:       make([]*Crash, 0),
 		apps:          make([]*App, 0),
 		versions:      make([]*string, 0),
 		ips:           make(map[string]*string),
 		crashingLines: make(map[string]*string),
+		signatures:    make(map[string]*string),
+		oses:          make(map[string]*string),
+		installIds:    make(map[string]*string),
 	}
+}
 
-	var err error
-	if u.PathExists(dataFilePath) {
+func NewStoreCrashes(dataDir string) (*StoreCrashes, error) {
+	dataFilePath := crashesDataPath(dataDir)
+	store := newEmptyStoreCrashes(dataDir)
+
+	exists, err := fsutil.PathExists(dataFilePath)
+	if err != nil {
+		logger.Errorf("NewStoreCrashes(): %s", err)
+		return nil, err
+	}
+	if exists {
 		err = store.readExistingCrashesData(dataFilePath)
+		if err == nil {
+			err = store.checkCrashFilesExist()
+		}
 		if err != nil {
 			logger.Errorf("NewStoreCrashes(): readExistingCrashesData() failed with %s\n", err)
 			return nil, err
@@ -293,7 +538,12 @@ func NewStoreCrashes(dataDir string) (*StoreCrashes, error) {
 		logger.Errorf("NewStoreCrashes(): os.OpenFile(%s) failed with %s", dataFilePath, err)
 		return nil, err
 	}
-	logger.Noticef("crashes: %d, versions: %d, ips: %d, crashing lines: %d", len(store.crashes), len(store.versions), len(store.ips), len(store.crashingLines))
+	if err = store.addMissingCrashInfo(); err != nil {
+		logger.Errorf("NewStoreCrashes(): addMissingCrashInfo() failed with %s", err)
+		store.dataFile.Close()
+		return nil, err
+	}
+	logger.Noticef("crashes: %d, versions: %d, ips: %d, crashing lines: %d, signatures: %d", len(store.crashes), len(store.versions), len(store.ips), len(store.crashingLines), len(store.signatures))
 
 	return store, nil
 }
@@ -316,8 +566,8 @@ func (s *StoreCrashes) MessageFilePath(sha1 []byte) string {
 }
 
 func (s *StoreCrashes) MessageFileExists(sha1 []byte) bool {
-	p := s.MessageFilePath(sha1)
-	return u.PathExists(p)
+	exists, _ := fsutil.PathExists(s.MessageFilePath(sha1))
+	return exists
 }
 
 func (s *StoreCrashes) appendString(str string) error {
@@ -398,6 +648,18 @@ func (s *StoreCrashes) GetCrashesForCrashingLine(app *App, crashingLine string)
 	return res
 }
 
+// returns crashes grouped by signature, the most frequent first
+func (s *StoreCrashes) GetCrashesBySignature(app *App) []CrashesForSignature {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]CrashesForSignature, 0, len(app.PerSignatureCrashes))
+	for sig, crashes := range app.PerSignatureCrashes {
+		res = append(res, CrashesForSignature{Signature: sig, Crashes: crashes})
+	}
+	sort.Sort(CrashesForSignatureByCount(res))
+	return res
+}
+
 func (s *StoreCrashes) GetCrashById(id int) *Crash {
 	s.Lock()
 	defer s.Unlock()
@@ -430,14 +692,47 @@ func storeCrashingLine(d []byte) string {
 	return remSep(l)
 }
 
+func storeCrashSignature(d []byte) string {
+	return remSep(ExtractSumatraCrashSignature(d))
+}
+
+func storeCrashOs(d []byte) string {
+	return remSep(extractCrashOs(d))
+}
+
+// crash report and information about it. Values must not contain '|' or
+// newlines
+type CrashSubmission struct {
+	AppName   string
+	AppVer    string
+	Os        string
+	InstallId string
+	IpAddr    string
+	Data      []byte
+}
+
+// saves crash report sent as plain text, extracting os from it
 func (s *StoreCrashes) SaveCrash(appName, appVer, ipAddr string, crashData []byte) error {
+	sub := &CrashSubmission{
+		AppName: appName,
+		AppVer:  appVer,
+		Os:      storeCrashOs(crashData),
+		IpAddr:  ipAddr,
+		Data:    crashData,
+	}
+	_, err := s.SaveCrashSubmission(sub)
+	return err
+}
+
+func (s *StoreCrashes) SaveCrashSubmission(sub *CrashSubmission) (*Crash, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	crashData := sub.Data
 	// TODO: white-list app names?
-	app := s.FindOrCreateApp(appName)
-	programVersionInterned := s.FindOrCreateVersion(appVer)
-	ipAddrInterned := s.FindOrCreateIp(ipAddrToInternal(ipAddr))
+	app := s.FindOrCreateApp(sub.AppName)
+	programVersionInterned := s.FindOrCreateVersion(sub.AppVer)
+	ipAddrInterned := s.FindOrCreateIp(ipAddrToInternal(sub.IpAddr))
 	cl := storeCrashingLine(crashData)
 	crashingLine := s.FindOrCreateCrashingLine(cl)
 
@@ -458,13 +753,20 @@ func (s *StoreCrashes) SaveCrash(appName, appVer, ipAddr string, crashData []byt
 	copy(c.Sha1[:], sha1)
 
 	if err := s.writeMessageAsSha1(crashData, sha1); err != nil {
-		return err
+		return nil, err
 	}
 	crashLine := serCrash(c)
 	if err := s.appendString(crashLine); err != nil {
-		return err
+		return nil, err
 	}
 
 	s.appendCrash(c)
-	return nil
+	s.setCrashSignature(c, storeCrashSignature(crashData))
+	c.Os = s.FindOrCreateOs(sub.Os)
+	lines := serCrashIdValueLine('g', c, *c.Signature) + serCrashIdValueLine('o', c, *c.Os)
+	if sub.InstallId != "" {
+		c.InstallId = s.FindOrCreateInstallId(sub.InstallId)
+		lines += serCrashIdValueLine('i', c, *c.InstallId)
+	}
+	return c, s.appendString(lines)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Readers can subscribe to get an email when a new article is published.
+// POST /subscribe sends an email with a confirmation link, only after it's
+// visited the address is added to data/subscribers.json (so that nobody can
+// subscribe someone else). Links are signed (and encrypted) with cookie keys
+// so we don't have to remember pending subscriptions. Every email has an
+// unsubscribe link.
+// When articles are (re)loaded, articles we haven't seen before are sent to
+// all subscribers. Ids of articles we've seen are in the same file, when
+// there's no file all current articles are treated as already sent.
+
+const (
+	subscribeTokenName   = "subscribe"
+	unsubscribeTokenName = "unsubscribe"
+	// how long confirmation links are valid
+	subscribeTokenMaxAge = 7 * 24 * time.Hour
+	maxEmailLen          = 254
+)
+
+type Subscribers struct {
+	sync.Mutex
+	path   string
+	emails map[string]bool
+	// ids of articles that were sent to subscribers (or existed before
+	// we started sending them)
+	notified map[int]bool
+}
+
+// how Subscribers are stored in subscribers.json
+type subscribersFile struct {
+	Emails             []string
+	NotifiedArticleIds []int
+}
+
+// nil until readSubscribers() is called
+var subscribers *Subscribers
+
+func subscribersPath() string {
+	return filepath.Join(getDataDir(), "data", "subscribers.json")
+}
+
+func loadSubscribers(path string) (*Subscribers, error) {
+	s := &Subscribers{
+		path:     path,
+		emails:   make(map[string]bool),
+		notified: make(map[int]bool),
+	}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f subscribersFile
+	if err = json.Unmarshal(d, &f); err != nil {
+		return nil, err
+	}
+	for _, email := range f.Emails {
+		s.emails[email] = true
+	}
+	for _, id := range f.NotifiedArticleIds {
+		s.notified[id] = true
+	}
+	return s, nil
+}
+
+func readSubscribers() {
+	s, err := loadSubscribers(subscribersPath())
+	if err != nil {
+		logger.Errorf("readSubscribers(): %s", err)
+		return
+	}
+	logger.Noticef("loaded %d email subscribers", len(s.emails))
+	subscribers = s
+}
+
+// must be called with s locked
+func (s *Subscribers) save() error {
+	var f subscribersFile
+	for email := range s.emails {
+		f.Emails = append(f.Emails, email)
+	}
+	for id := range s.notified {
+		f.NotifiedArticleIds = append(f.NotifiedArticleIds, id)
+	}
+	sort.Strings(f.Emails)
+	sort.Ints(f.NotifiedArticleIds)
+	d, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *Subscribers) Has(email string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.emails[email]
+}
+
+func (s *Subscribers) Add(email string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.emails[email] = true
+	return s.save()
+}
+
+func (s *Subscribers) Remove(email string) error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.emails[email] {
+		return nil
+	}
+	delete(s.emails, email)
+	return s.save()
+}
+
+// remembers articles not seen before as notified. Returns the new ones (none
+// the first time, when we didn't know any articles) and current subscribers
+func (s *Subscribers) markNotified(articles []*Article) ([]*Article, []string, error) {
+	s.Lock()
+	defer s.Unlock()
+	first := len(s.notified) == 0
+	var res []*Article
+	for _, a := range articles {
+		if a.IsDraft || a.IsDeleted || a.IsPrivate || s.notified[a.Id] {
+			continue
+		}
+		s.notified[a.Id] = true
+		res = append(res, a)
+	}
+	if len(res) == 0 {
+		return nil, nil, nil
+	}
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+	if first {
+		return nil, nil, nil
+	}
+	var emails []string
+	for email := range s.emails {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return res, emails, nil
+}
+
+// returns a lower-cased email or "" if s is not a valid email address
+func normalizeEmail(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > maxEmailLen {
+		return ""
+	}
+	addr, err := mail.ParseAddress(s)
+	// only "foo@bar.com", not "Foo <foo@bar.com>"
+	if err != nil || addr.Address != s || addr.Name != "" {
+		return ""
+	}
+	at := strings.LastIndex(s, "@")
+	if at < 1 || !strings.Contains(s[at:], ".") {
+		return ""
+	}
+	return strings.ToLower(s)
+}
+
+func subscriptionCodec(name string) *securecookie.SecureCookie {
+	sc := securecookie.New(cookieAuthKey, cookieEncrKey)
+	if name == subscribeTokenName {
+		return sc.MaxAge(int(subscribeTokenMaxAge.Seconds()))
+	}
+	return sc.MaxAge(0)
+}
+
+// name is subscribeTokenName or unsubscribeTokenName, so that one can't be
+// used as the other
+func encodeSubscriptionToken(name, email string) (string, error) {
+	return subscriptionCodec(name).Encode(name, email)
+}
+
+func decodeSubscriptionToken(name, token string) (string, error) {
+	var email string
+	if err := subscriptionCodec(name).Decode(name, token, &email); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+func subscriptionUrl(path, name, email string) (string, error) {
+	token, err := encodeSubscriptionToken(name, email)
+	if err != nil {
+		return "", err
+	}
+	return absURL(path + "?t=" + url.QueryEscape(token)), nil
+}
+
+func newArticleEmail(a *Article, to string) (*Email, error) {
+	unsubscribeUrl, err := subscriptionUrl("/unsubscribe", unsubscribeTokenName, to)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\r\n\r\n", a.Title)
+	if desc := ogDescription(a.GetHtmlStr(), ogDescriptionMaxLen); desc != "" {
+		fmt.Fprintf(&b, "%s\r\n\r\n", desc)
+	}
+	fmt.Fprintf(&b, "Read it at %s\r\n\r\n", absURL(a.Permalink()))
+	fmt.Fprintf(&b, "--\r\nTo stop getting those emails, go to %s\r\n", unsubscribeUrl)
+	return &Email{To: to, Subject: a.Title, Body: b.String(), UnsubscribeUrl: unsubscribeUrl}, nil
+}
+
+// queues emails about articles that subscribers haven't been told about.
+// Called after articles are (re)loaded. Returns number of queued emails
+func notifySubscribers(articles []*Article) int {
+	s := subscribers
+	if s == nil {
+		return 0
+	}
+	newArticles, emails, err := s.markNotified(articles)
+	if err != nil {
+		logger.Errorf("notifySubscribers(): %s", err)
+		return 0
+	}
+	// articles published while sending was off are not sent when it's
+	// turned on
+	if len(newArticles) == 0 || len(emails) == 0 || !emailEnabled() {
+		return 0
+	}
+	var queue []*Email
+	for _, a := range newArticles {
+		for _, to := range emails {
+			e, err := newArticleEmail(a, to)
+			if err != nil {
+				logger.Errorf("notifySubscribers(): newArticleEmail() failed with %s", err)
+				return 0
+			}
+			queue = append(queue, e)
+		}
+	}
+	emailQueue.Add(queue...)
+	logger.Noticef("notifySubscribers(): queued %d emails about %d new articles", len(queue), len(newArticles))
+	return len(queue)
+}
+
+func serveSubscriptionPage(w http.ResponseWriter, r *http.Request, status int, title, msg string) {
+	serveErrorPage(w, r, status, &ErrorPageModel{
+		BasePageModel: newBasePageModel(r),
+		Title:         title,
+		Message:       msg,
+	})
+}
+
+// POST /subscribe
+// email : ${email}
+func handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if subscribers == nil || !emailEnabled() {
+		serve404(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := normalizeEmail(r.FormValue("email"))
+	if email == "" {
+		serveFieldError(w, r, "email", "That doesn't look like an email address. Go back and try again.")
+		return
+	}
+	// we don't tell if the address is already subscribed
+	if !subscribers.Has(email) {
+		confirmUrl, err := subscriptionUrl("/subscribe/confirm", subscribeTokenName, email)
+		if err != nil {
+			logger.Errorf("handleSubscribe(): %s", err)
+			serve500(w, r, err.Error())
+			return
+		}
+		body := fmt.Sprintf("Someone (hopefully you) asked to get an email when there's a new article on %s.\r\n\r\nTo confirm, go to %s\r\n\r\nIf it wasn't you, ignore this email.\r\n", siteBaseUrl(), confirmUrl)
+		emailQueue.Add(&Email{To: email, Subject: "Confirm your subscription", Body: body})
+	}
+	serveSubscriptionPage(w, r, http.StatusOK, "Check your email", "We've sent you an email with a link to confirm your subscription.")
+}
+
+// GET /subscribe/confirm?t=${token}
+func handleSubscribeConfirm(w http.ResponseWriter, r *http.Request) {
+	if subscribers == nil {
+		serve404(w, r)
+		return
+	}
+	email, err := decodeSubscriptionToken(subscribeTokenName, r.FormValue("t"))
+	if err != nil {
+		serveSubscriptionPage(w, r, http.StatusBadRequest, "Invalid link", "The link is invalid or has expired. Subscribe again to get a new one.")
+		return
+	}
+	if err = subscribers.Add(email); err != nil {
+		logger.Errorf("handleSubscribeConfirm(): %s", err)
+		serve500(w, r, err.Error())
+		return
+	}
+	logger.Noticef("new email subscriber: %s", email)
+	serveSubscriptionPage(w, r, http.StatusOK, "Subscribed", "You'll get an email when there's a new article.")
+}
+
+// GET /unsubscribe?t=${token}
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if subscribers == nil {
+		serve404(w, r)
+		return
+	}
+	email, err := decodeSubscriptionToken(unsubscribeTokenName, r.FormValue("t"))
+	if err != nil {
+		serveSubscriptionPage(w, r, http.StatusBadRequest, "Invalid link", "The unsubscribe link is invalid.")
+		return
+	}
+	if err = subscribers.Remove(email); err != nil {
+		logger.Errorf("handleUnsubscribe(): %s", err)
+		serve500(w, r, err.Error())
+		return
+	}
+	logger.Noticef("email unsubscribed: %s", email)
+	serveSubscriptionPage(w, r, http.StatusOK, "Unsubscribed", "You won't get emails about new articles anymore.")
+}
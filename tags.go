@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tags can be renamed or merged site-wide without editing article files.
+// Each rename (or merge) is recorded as a line "old|new" in
+// data/tag_aliases.txt in data directory and applied to tags of articles
+// when they're loaded. /tag/old redirects to /tag/new.
+
+var (
+	tagAliasesMu sync.Mutex
+	tagAliases   = make(map[string]string)
+)
+
+func tagAliasesPath() string {
+	return filepath.Join(getDataDir(), "data", "tag_aliases.txt")
+}
+
+func parseTagAliases(d []byte) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, l := range bytes.Split(d, []byte{'\n'}) {
+		s := strings.TrimSpace(string(l))
+		if s == "" {
+			continue
+		}
+		parts := strings.Split(s, "|")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed line %q in tag aliases", s)
+		}
+		addTagAlias(res, parts[0], parts[1])
+	}
+	return res, nil
+}
+
+// also re-points aliases of from so that we never have to follow chains
+func addTagAlias(aliases map[string]string, from, to string) {
+	for k, v := range aliases {
+		if v == from {
+			aliases[k] = to
+		}
+	}
+	delete(aliases, to)
+	aliases[from] = to
+}
+
+func readTagAliases() {
+	d, err := ioutil.ReadFile(tagAliasesPath())
+	if err != nil {
+		return
+	}
+	aliases, err := parseTagAliases(d)
+	if err != nil {
+		logger.Errorf("readTagAliases(): %s", err)
+		return
+	}
+	tagAliasesMu.Lock()
+	tagAliases = aliases
+	tagAliasesMu.Unlock()
+	logger.Noticef("loaded %d tag aliases", len(aliases))
+}
+
+// returns "" if tag is not renamed
+func getTagAlias(tag string) string {
+	tagAliasesMu.Lock()
+	defer tagAliasesMu.Unlock()
+	return tagAliases[tag]
+}
+
+// replaces renamed tags and removes duplicates (e.g. after a merge).
+// Returns true if tags changed
+func applyTagAliases(a *Article, aliases map[string]string) bool {
+	changed := false
+	tags := make([]string, 0, len(a.Tags))
+	for _, tag := range a.Tags {
+		if to, ok := aliases[tag]; ok {
+			tag = to
+			changed = true
+		}
+		if stringInSlice(tags, tag) {
+			changed = true
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	if changed {
+		a.Tags = tags
+	}
+	return changed
+}
+
+func aliasArticleTags(a *Article) bool {
+	tagAliasesMu.Lock()
+	defer tagAliasesMu.Unlock()
+	return applyTagAliases(a, tagAliases)
+}
+
+// only safe to call before we start serving requests
+func applyTagAliasesToStore(s *Store) {
+	for _, a := range s.GetAllArticles() {
+		aliasArticleTags(a)
+	}
+}
+
+// renames tag from to to. If to already exists, it's a merge
+func renameTag(from, to string) error {
+	f, err := os.OpenFile(tagAliasesPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s|%s\n", from, to)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	tagAliasesMu.Lock()
+	addTagAlias(tagAliases, from, to)
+	tagAliasesMu.Unlock()
+
+	var ids []string
+	err = updateArticles(func(articles []*Article) []*Article {
+		// articles might be used by requests in flight so we change copies
+		for i, a := range articles {
+			c := *a
+			if aliasArticleTags(&c) {
+				articles[i] = &c
+				ids = append(ids, fmt.Sprintf("%d", a.Id))
+			}
+		}
+		return articles
+	})
+	if err != nil {
+		return err
+	}
+	logger.Noticef("renameTag(): %q => %q, updated articles: %s", from, to, strings.Join(ids, ", "))
+	// so that the page we redirect to shows renamed tags
+	articlesCacheRebuilder.wait()
+	return nil
+}
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+type TagCountsByName []*TagCount
+
+func (s TagCountsByName) Len() int {
+	return len(s)
+}
+func (s TagCountsByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s TagCountsByName) Less(i, j int) bool {
+	return s[i].Tag < s[j].Tag
+}
+
+func countTags(articles []*Article) []*TagCount {
+	m := make(map[string]*TagCount)
+	for _, a := range articles {
+		for _, tag := range a.Tags {
+			tc := m[tag]
+			if tc == nil {
+				tc = &TagCount{Tag: tag}
+				m[tag] = tc
+			}
+			tc.Count++
+		}
+	}
+	res := make([]*TagCount, 0, len(m))
+	for _, tc := range m {
+		res = append(res, tc)
+	}
+	sort.Sort(TagCountsByName(res))
+	return res
+}
+
+// GET /app/tags
+// POST /app/tags with from=${tag}&to=${tag} renames (or merges) a tag
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		if !checkCsrf(w, r) {
+			return
+		}
+		from := strings.ToLower(getTrimmedFormValue(r, "from"))
+		to := strings.ToLower(getTrimmedFormValue(r, "to"))
+		if from == "" || to == "" || from == to || strings.Contains(from+to, "|") {
+			httpErrorf(w, "invalid tags %q => %q", from, to)
+			return
+		}
+		if err := renameTag(from, to); err != nil {
+			logger.Errorf("handleTags(): renameTag(%q, %q) failed with %s", from, to, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/app/tags", http.StatusSeeOther)
+		return
+	}
+	model := struct {
+		BasePageModel
+		Tags []*TagCount
+	}{
+		BasePageModel: newBasePageModel(r),
+		Tags:          countTags(getCachedArticles()),
+	}
+	ExecTemplate(w, tmplTags, model)
+}
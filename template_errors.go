@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// In dev, templates are re-parsed for every request. When one of them is
+// broken we show a page with the error and the source around it instead
+// of a bare 500. In production all templates are parsed at startup and we
+// exit, listing every broken template, if any of them doesn't parse.
+
+// how many lines before and after the line with an error we show
+const templateErrorContext = 3
+
+// "template: article.html:12: unexpected ..." (parsing) or
+// "template: article.html:12:7: executing ..." (executing)
+var templateErrorRx = regexp.MustCompile(`^template: ([^:]+):(\d+):(?:\d+:)?\s*(.*)$`)
+
+type TemplateSourceLine struct {
+	No      int
+	Text    string
+	IsError bool
+}
+
+// TemplateError is an error in a template and where it is
+type TemplateError struct {
+	Name string
+	// 0 if we don't know
+	Line    int
+	Msg     string
+	Context []TemplateSourceLine
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Name, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Name, e.Line, e.Msg)
+}
+
+// name is used if err doesn't say which template it's in
+func newTemplateError(dir, name string, err error) *TemplateError {
+	res := &TemplateError{Name: name, Msg: err.Error()}
+	m := templateErrorRx.FindStringSubmatch(err.Error())
+	if m == nil {
+		return res
+	}
+	res.Name = m[1]
+	res.Line, _ = strconv.Atoi(m[2])
+	res.Msg = m[3]
+	d, err := ioutil.ReadFile(filepath.Join(dir, res.Name))
+	if err != nil {
+		return res
+	}
+	lines := strings.Split(string(d), "\n")
+	for no := res.Line - templateErrorContext; no <= res.Line+templateErrorContext; no++ {
+		if no >= 1 && no <= len(lines) {
+			l := TemplateSourceLine{No: no, Text: lines[no-1], IsError: no == res.Line}
+			res.Context = append(res.Context, l)
+		}
+	}
+	return res
+}
+
+// parses templates in dir. If some of them are broken, returns errors
+// for all of them
+func parseTemplates(dir string, names []string) (*template.Template, []*TemplateError) {
+	var paths []string
+	var errs []*TemplateError
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		paths = append(paths, path)
+		// parsed one by one so that we know about all broken templates
+		if _, err := template.New(name).Funcs(templateFuncs).ParseFiles(path); err != nil {
+			errs = append(errs, newTemplateError(dir, name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	t, err := template.New("").Funcs(templateFuncs).ParseFiles(paths...)
+	if err != nil {
+		return nil, []*TemplateError{newTemplateError(dir, "", err)}
+	}
+	return t, nil
+}
+
+func templateErrorsString(errs []*TemplateError) string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// not in tmpl directory because we show it when templates are broken
+var templateErrorsPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta http-equiv="Content-Type" content="text/html;charset=utf-8">
+	<title>Template error</title>
+</head>
+<body style="font-size:80%;">
+{{ range . }}
+<h2>{{ .Name | html }}{{ if .Line }}, line {{ .Line }}{{ end }}</h2>
+<p style="color:red;">{{ .Msg | html }}</p>
+{{ if .Context }}<pre style="background-color:#f4f4f4;padding:8px;">
+{{- range .Context }}
+<span{{ if .IsError }} style="background-color:#fcc;"{{ end }}>{{ printf "%4d" .No }}  {{ .Text | html }}</span>
+{{- end }}
+</pre>{{ end }}
+{{ end }}
+</body>
+</html>
+`))
+
+func serveTemplateErrors(w http.ResponseWriter, errs []*TemplateError) {
+	var buf bytes.Buffer
+	templateErrorsPage.Execute(&buf, errs)
+	setContentType(w, "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Functions available in all templates, so that handlers can pass values
+// (e.g. time.Time) instead of strings formatted for display:
+// {{ fmtDate .PublishedOn }}                 : in DateFormat and TimeZone from config.json
+// {{ fmtDate .PublishedOn "January 2" }}     : with a given layout
+// {{ .Title | truncateWords 10 }}            : at most 10 words, with "…" if cut
+// {{ plural .Count "article" "articles" }}   : "1 article", "3 articles"
+// {{ .Html | safeHTML }}                     : html that is meant to be output as is
+// {{ absURL "/atom.xml" }}                   : url with BaseURL
+// {{ assetUrl "main.css" }}                  : fingerprinted url of a file in static dir
+// Templates are text/template so nothing is escaped unless piped to html;
+// safeHTML marks places where that's intended.
+
+const defaultDateFormat = "Jan 2 2006"
+
+func siteDateFormat() string {
+	if s := stringOrEmpty(getConfig().DateFormat); s != "" {
+		return s
+	}
+	return defaultDateFormat
+}
+
+var (
+	siteLocationMu   sync.Mutex
+	siteLocationName string
+	siteLocationVal  *time.Location
+)
+
+// time zone in which we show dates, from TimeZone in config.json. Local
+// time zone of the server if not set
+func siteLocation() *time.Location {
+	name := stringOrEmpty(getConfig().TimeZone)
+	if name == "" {
+		return time.Local
+	}
+	siteLocationMu.Lock()
+	defer siteLocationMu.Unlock()
+	if name != siteLocationName || siteLocationVal == nil {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			// parseConfig() checks it so it shouldn't happen
+			logger.Errorf("siteLocation(): time.LoadLocation(%q) failed with %s", name, err)
+			return time.Local
+		}
+		siteLocationName = name
+		siteLocationVal = loc
+	}
+	return siteLocationVal
+}
+
+func fmtDate(t time.Time, layout ...string) string {
+	format := siteDateFormat()
+	if len(layout) > 0 && layout[0] != "" {
+		format = layout[0]
+	}
+	return t.In(siteLocation()).Format(format)
+}
+
+func truncateWords(n int, s string) string {
+	words := strings.Fields(s)
+	if len(words) <= n {
+		return strings.Join(words, " ")
+	}
+	return strings.Join(words[:n], " ") + "…"
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+func safeHTML(v interface{}) string {
+	return fmt.Sprint(v)
+}
@@ -2,46 +2,140 @@ package main
 
 import (
 	"bytes"
+	"log"
 	"net/http"
-	"path/filepath"
 	"strconv"
+	"sync"
 	"text/template"
 )
 
 var (
-	tmplLogs                 = "logs.html"
-	tmplTimings              = "timings.html"
-	tmplMainPage             = "mainpage.html"
-	tmplArticle              = "article.html"
-	tmplArchive              = "archive.html"
-	tmplCrashReportsIndex    = "crash_reports_index.html"
-	tmplCrashReportsAppIndex = "crash_reports_app_index.html"
-	tmplCrashReport          = "crash_report.html"
-	templateNames            = [...]string{tmplLogs, tmplMainPage, tmplArticle,
+	tmplLogs                   = "logs.html"
+	tmplTimings                = "timings.html"
+	tmplMainPage               = "mainpage.html"
+	tmplArticle                = "article.html"
+	tmplArchive                = "archive.html"
+	tmplCrashReportsIndex      = "crash_reports_index.html"
+	tmplCrashReportsAppIndex   = "crash_reports_app_index.html"
+	tmplCrashReport            = "crash_report.html"
+	tmplCrashReportsSignatures = "crash_reports_signatures.html"
+	tmplCrashReportsFiltered   = "crash_reports_filtered.html"
+	tmplDeleted                = "deleted.html"
+	tmplLoginBasic             = "login_basic.html"
+	tmpl404s                   = "404s.html"
+	tmplTags                   = "tags.html"
+	tmplDashboard              = "dashboard.html"
+	tmplRedirects              = "redirects.html"
+	tmplCsrfExpired            = "csrf_expired.html"
+	tmplError                  = "error.html"
+	tmplArticleViews           = "views.html"
+	tmplSeries                 = "series.html"
+	tmplNotes                  = "notes.html"
+	tmplStats                  = "stats.html"
+	tmplArchiveIndex           = "archive_index.html"
+	tmplAuthor                 = "author.html"
+	tmplDrafts                 = "drafts.html"
+	tmplCheckLinks             = "check_links.html"
+	tmplUploads                = "uploads.html"
+	templateNames              = [...]string{tmplLogs, tmplMainPage, tmplArticle,
 		tmplArchive, tmplCrashReportsIndex, tmplCrashReportsAppIndex,
-		tmplCrashReport, tmplTimings,
-		"analytics.html", "inline_css.html", "tagcloud.js", "page_navbar.html"}
-	templatePaths   []string
+		tmplCrashReport, tmplCrashReportsSignatures, tmplCrashReportsFiltered,
+		tmplTimings, tmplDeleted, tmplLoginBasic, tmpl404s, tmplTags, tmplDashboard,
+		tmplRedirects, tmplCsrfExpired, tmplError, tmplArticleViews, tmplSeries, tmplStats, tmplArchiveIndex, tmplAuthor, tmplDrafts, tmplNotes, tmplCheckLinks, tmplUploads, "crash_filter_form.html", "analytics.html", "inline_css.html",
+		"tagcloud.js", "page_navbar.html", "admin_user.html"}
+	// protects templates, which are shared by concurrent requests
+	templatesMu     sync.Mutex
 	templates       *template.Template
 	reloadTemplates = true
+
+	// see template_funcs.go
+	templateFuncs = template.FuncMap{
+		"assetUrl":      assetUrl,
+		"absURL":        absURL,
+		"fmtDate":       fmtDate,
+		"truncateWords": truncateWords,
+		"plural":        plural,
+		"safeHTML":      safeHTML,
+	}
 )
 
-func GetTemplates() *template.Template {
+// BasePageModel has values needed by all pages. Page models embed it and
+// fill it with newBasePageModel() so that templates can always check e.g.
+// .IsAdmin
+type BasePageModel struct {
+	IsAdmin bool
+	// twitter user name of the viewer, empty if not logged in
+	User          string
+	CsrfToken     string
+	Path          string
+	Reload        bool
+	AnalyticsCode string
+	JqueryUrl     string
+	LogInOutUrl   string
+}
+
+// empty for the admin so that we don't count our own page views
+func analyticsCode(r *http.Request) string {
+	if getTrafficClass(r) == trafficAdmin {
+		return ""
+	}
+	return stringOrEmpty(getConfig().AnalyticsCode)
+}
+
+func newBasePageModel(r *http.Request) BasePageModel {
+	cookie := getSecureCookie(r)
+	user := cookie.TwitterUser
+	csrf := ""
+	if user != "" {
+		csrf = cookie.CsrfToken
+	}
+	return BasePageModel{
+		IsAdmin:       user == "kjk",
+		User:          user,
+		CsrfToken:     csrf,
+		Path:          r.URL.Path,
+		Reload:        !inProduction,
+		AnalyticsCode: analyticsCode(r),
+		JqueryUrl:     jQueryUrl(),
+		LogInOutUrl:   getLogInOutUrl(r),
+	}
+}
+
+func GetTemplates() (*template.Template, []*TemplateError) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
 	if reloadTemplates || (nil == templates) {
-		if 0 == len(templatePaths) {
-			for _, name := range templateNames {
-				templatePaths = append(templatePaths, filepath.Join("tmpl", name))
-			}
+		t, errs := parseTemplates("tmpl", templateNames[:])
+		if errs != nil {
+			return nil, errs
 		}
-		templates = template.Must(template.ParseFiles(templatePaths...))
+		templates = t
+	}
+	return templates, nil
+}
+
+// in production templates must parse at startup, we don't want to find out
+// on the first request
+func mustParseTemplates() {
+	if _, errs := GetTemplates(); errs != nil {
+		log.Fatalf("broken templates:\n%s\n", templateErrorsString(errs))
 	}
-	return templates
 }
 
 func ExecTemplate(w http.ResponseWriter, templateName string, model interface{}) bool {
+	t, errs := GetTemplates()
+	if errs != nil {
+		logger.Errorf("Failed to parse templates: %s", templateErrorsString(errs))
+		serveTemplateErrors(w, errs)
+		return false
+	}
 	var buf bytes.Buffer
-	if err := GetTemplates().ExecuteTemplate(&buf, templateName, model); err != nil {
+	if err := t.ExecuteTemplate(&buf, templateName, model); err != nil {
 		logger.Errorf("Failed to execute template %q, error: %s", templateName, err)
+		if !inProduction {
+			serveTemplateErrors(w, []*TemplateError{newTemplateError("tmpl", templateName, err)})
+			return false
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return false
 	} else {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// When EnableAutocert is set in config, we serve https on :443 with
+// certificates from Let's Encrypt for TLSHosts. :80 only answers HTTP-01
+// challenges and redirects everything else to https.
+
+func tlsEnabled() bool {
+	c := getConfig()
+	return c.EnableAutocert && len(c.TLSHosts) > 0
+}
+
+func autocertCacheDir() string {
+	return filepath.Join(getDataDir(), "autocert")
+}
+
+func newAutocertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(getConfig().TLSHosts...),
+		Cache:      autocert.DirCache(autocertCacheDir()),
+	}
+}
+
+// http://${host}/${path}?${query} => https://${host}/${path}?${query}
+func httpsRedirectUrl(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+func handleRedirectToHttps(w http.ResponseWriter, r *http.Request) {
+	// go straight to the canonical host instead of redirecting twice
+	uri := canonicalHostRedirectUrl(r)
+	if uri == "" {
+		uri = httpsRedirectUrl(r)
+	}
+	http.Redirect(w, r, uri, http.StatusMovedPermanently)
+}
+
+// returns servers for https and for http (challenges + redirect). The
+// https server must be started with ListenAndServeTLS("", "")
+func newTlsServers() (*http.Server, *http.Server) {
+	m := newAutocertManager()
+	httpsSrv := &http.Server{
+		Addr:    ":443",
+		Handler: withHealthChecks(withCanonicalHost(withBodyLimits(http.DefaultServeMux))),
+		TLSConfig: &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", "acme-tls/1"},
+		},
+	}
+	httpSrv := &http.Server{
+		Addr:    ":80",
+		Handler: withHealthChecks(m.HTTPHandler(http.HandlerFunc(handleRedirectToHttps))),
+	}
+	setServerTimeouts(httpsSrv)
+	setServerTimeouts(httpSrv)
+	return httpsSrv, httpSrv
+}
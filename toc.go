@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Headings in html of articles get ids made from their text (e.g.
+// "Getting started" => getting-started, the second one is
+// getting-started-2), so links to #getting-started keep working as long as
+// the heading doesn't change. Articles with at least tocMinHeadings headings
+// (or with "Toc: yes" header) get a table of contents made from them.
+
+const tocMinHeadings = 3
+
+type TocHeading struct {
+	Level int
+	Id    string
+	// text of the heading, without html tags
+	Text string
+}
+
+var (
+	headingRx = regexp.MustCompile(`(?is)<h([1-6])(\s[^>]*)?>(.*?)</h[1-6]>`)
+	idAttrRx  = regexp.MustCompile(`(?i)\sid\s*=\s*["']([^"']*)["']`)
+	htmlTagRx = regexp.MustCompile(`<[^>]*>`)
+)
+
+func headingText(s string) string {
+	s = htmlTagRx.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// returns id for a heading with a given text, e.g. "Hello, world" =>
+// "hello-world"
+func headingId(text string) string {
+	var res []rune
+	dash := false
+	for _, c := range strings.ToLower(text) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && len(res) > 0 {
+				res = append(res, '-')
+			}
+			res = append(res, c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if len(res) == 0 {
+		return "section"
+	}
+	return string(res)
+}
+
+// adds id to headings in s that don't have one. Returns the new html and
+// all headings, in order
+func addHeadingIds(s string) (string, []TocHeading) {
+	matches := headingRx.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+	used := make(map[string]bool)
+	// ids that are already there win over the ones we make
+	for _, m := range matches {
+		if m[4] != -1 {
+			if id := idAttrRx.FindStringSubmatch(s[m[4]:m[5]]); id != nil {
+				used[id[1]] = true
+			}
+		}
+	}
+	var headings []TocHeading
+	var res strings.Builder
+	prevEnd := 0
+	for _, m := range matches {
+		h := TocHeading{Level: int(s[m[2]] - '0'), Text: headingText(s[m[6]:m[7]])}
+		var attrs string
+		if m[4] != -1 {
+			attrs = s[m[4]:m[5]]
+		}
+		if id := idAttrRx.FindStringSubmatch(attrs); id != nil {
+			h.Id = id[1]
+			res.WriteString(s[prevEnd:m[1]])
+		} else {
+			base := headingId(h.Text)
+			h.Id = base
+			for n := 2; used[h.Id]; n++ {
+				h.Id = fmt.Sprintf("%s-%d", base, n)
+			}
+			used[h.Id] = true
+			// insert id right after "<hN"
+			res.WriteString(s[prevEnd:m[3]])
+			res.WriteString(` id="` + html.EscapeString(h.Id) + `"`)
+			res.WriteString(s[m[3]:m[1]])
+		}
+		prevEnd = m[1]
+		headings = append(headings, h)
+	}
+	res.WriteString(s[prevEnd:])
+	return res.String(), headings
+}
+
+// returns nested lists with links to headings
+func renderToc(headings []TocHeading) string {
+	if len(headings) == 0 {
+		return ""
+	}
+	minLevel := headings[0].Level
+	for _, h := range headings {
+		if h.Level < minLevel {
+			minLevel = h.Level
+		}
+	}
+	var b strings.Builder
+	depth := 0
+	for _, h := range headings {
+		level := h.Level - minLevel + 1
+		// we don't skip levels e.g. when h1 is followed by h3
+		if level > depth+1 {
+			level = depth + 1
+		}
+		if level > depth {
+			b.WriteString("<ul>")
+			depth++
+		} else {
+			b.WriteString("</li>")
+			for depth > level {
+				b.WriteString("</ul></li>")
+				depth--
+			}
+		}
+		b.WriteString(`<li><a href="#` + html.EscapeString(h.Id) + `">` + html.EscapeString(h.Text) + "</a>")
+	}
+	b.WriteString("</li>")
+	for depth > 1 {
+		b.WriteString("</ul></li>")
+		depth--
+	}
+	b.WriteString("</ul>")
+	return b.String()
+}
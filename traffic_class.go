@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Each request is classified in newTimingHandler as coming from the admin
+// (logged in), a bot (empty user agent or one containing one of
+// defaultBotUserAgents or BotUserAgents from config.json, case-insensitive)
+// or a human. Only views by humans are counted (see article_views.go) and
+// only their requests are used for latency stats. Request metrics and
+// counts on the dashboard are split by class.
+
+type trafficClass string
+
+const (
+	trafficHuman trafficClass = "human"
+	trafficAdmin trafficClass = "admin"
+	trafficBot   trafficClass = "bot"
+)
+
+var trafficClasses = []trafficClass{trafficHuman, trafficAdmin, trafficBot}
+
+// lower case
+var defaultBotUserAgents = []string{"bot", "crawl", "spider", "slurp",
+	"curl", "wget", "python", "java/", "go-http-client", "feed", "rss",
+	"preview", "facebookexternalhit", "headless"}
+
+func containsAnyLower(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.Contains(s, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBotUserAgent(ua string) bool {
+	if ua == "" {
+		return true
+	}
+	ua = strings.ToLower(ua)
+	return containsAnyLower(ua, defaultBotUserAgents) || containsAnyLower(ua, getConfig().BotUserAgents)
+}
+
+func classifyRequest(r *http.Request) trafficClass {
+	if IsAdmin(r) {
+		return trafficAdmin
+	}
+	if isBotUserAgent(r.UserAgent()) {
+		return trafficBot
+	}
+	return trafficHuman
+}
+
+type trafficClassKey struct{}
+
+func withTrafficClass(r *http.Request, class trafficClass) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), trafficClassKey{}, class))
+}
+
+// class set by newTimingHandler. Requests that didn't go through it (e.g.
+// in tests) are classified now
+func getTrafficClass(r *http.Request) trafficClass {
+	if class, ok := r.Context().Value(trafficClassKey{}).(trafficClass); ok {
+		return class
+	}
+	return classifyRequest(r)
+}
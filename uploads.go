@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin can upload files (zips, PDFs etc.) to link from articles on
+// /app/uploads. Files are stored in uploads directory in data directory
+// under sha1 of their content, so the same file uploaded twice is stored
+// once. Original names (and content types) are remembered in uploads.json
+// in data directory. Files are served at /files/${sha1}/${name}, with
+// support for range requests so that downloads can be resumed. Max size
+// of an upload is MaxBodyBytes["/app/uploads"] in config.json
+// (defaultMaxUploadBytes if not set).
+
+const (
+	defaultMaxUploadBytes = 100 * 1024 * 1024
+	uploadMemoryBytes     = 1024 * 1024
+	// how many uploads are listed on /app/uploads
+	recentUploadsCount = 50
+)
+
+var uploadSha1Rx = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+type Upload struct {
+	Sha1        string
+	Name        string
+	ContentType string
+	Size        int64
+	UploadedOn  time.Time
+}
+
+func (u *Upload) Url() string {
+	return "/files/" + u.Sha1 + "/" + url.PathEscape(u.Name)
+}
+
+func (u *Upload) IsImage() bool {
+	return strings.HasPrefix(u.ContentType, "image/")
+}
+
+// markdown link to the file (image for images)
+func (u *Upload) Markdown() string {
+	text := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(u.Name)
+	s := fmt.Sprintf("[%s](%s)", text, u.Url())
+	if u.IsImage() {
+		s = "!" + s
+	}
+	return s
+}
+
+// browsers show those, other files are downloaded. SVG files can have
+// scripts so they're downloaded too (<img> still shows them)
+func (u *Upload) ContentDisposition() string {
+	typ := "attachment"
+	isSvg := strings.HasPrefix(u.ContentType, "image/svg")
+	if (u.IsImage() && !isSvg) || u.ContentType == "application/pdf" {
+		typ = "inline"
+	}
+	return mime.FormatMediaType(typ, map[string]string{"filename": u.Name})
+}
+
+type Uploads struct {
+	sync.Mutex
+	// oldest first
+	Uploads []*Upload
+}
+
+var uploads = &Uploads{}
+
+func uploadsPath() string {
+	return filepath.Join(getDataDir(), "uploads.json")
+}
+
+func uploadsDir() string {
+	return filepath.Join(getDataDir(), "uploads")
+}
+
+// uploading a file with the same name and content again makes it the most
+// recent one
+func (p *Uploads) Add(u *Upload) {
+	p.Lock()
+	defer p.Unlock()
+	for i, u2 := range p.Uploads {
+		if u2.Sha1 == u.Sha1 && u2.Name == u.Name {
+			p.Uploads = append(p.Uploads[:i], p.Uploads[i+1:]...)
+			break
+		}
+	}
+	p.Uploads = append(p.Uploads, u)
+}
+
+func (p *Uploads) Find(sha1, name string) *Upload {
+	p.Lock()
+	defer p.Unlock()
+	for _, u := range p.Uploads {
+		if u.Sha1 == sha1 && u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// returns up to n most recent uploads, newest first
+func (p *Uploads) Recent(n int) []*Upload {
+	p.Lock()
+	defer p.Unlock()
+	var res []*Upload
+	for i := len(p.Uploads) - 1; i >= 0 && len(res) < n; i-- {
+		res = append(res, p.Uploads[i])
+	}
+	return res
+}
+
+func (p *Uploads) save(path string) error {
+	p.Lock()
+	d, err := json.Marshal(p)
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadUploads(path string) (*Uploads, error) {
+	p := &Uploads{}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readUploads() {
+	p, err := loadUploads(uploadsPath())
+	if err != nil {
+		logger.Errorf("readUploads(): %s", err)
+		return
+	}
+	uploads = p
+}
+
+func saveUploads() {
+	if err := uploads.save(uploadsPath()); err != nil {
+		logger.Errorf("saveUploads(): %s", err)
+	}
+}
+
+// name of the file without directories (some browsers send full path) or
+// characters that would break headers
+func cleanUploadName(name string) string {
+	if idx := strings.LastIndexAny(name, `/\`); idx != -1 {
+		name = name[idx+1:]
+	}
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// content type based on extension of the name or, if unknown, the content
+func uploadContentType(name string, start []byte) string {
+	if ct := mime.TypeByExtension(strings.ToLower(filepath.Ext(name))); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(start)
+}
+
+// copies r to dir/${sha1 of content}
+func storeUpload(dir string, name string, r io.Reader) (*Upload, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(512)
+	u := &Upload{
+		Name:        cleanUploadName(name),
+		ContentType: uploadContentType(name, start),
+		UploadedOn:  time.Now(),
+	}
+	f, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := f.Name()
+	h := sha1.New()
+	u.Size, err = io.Copy(io.MultiWriter(f, h), br)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	u.Sha1 = fmt.Sprintf("%x", h.Sum(nil))
+	path := filepath.Join(dir, u.Sha1)
+	if _, err = os.Stat(path); err == nil {
+		// we already have this content
+		os.Remove(tmpPath)
+		return u, nil
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return u, nil
+}
+
+type UploadJson struct {
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	UploadedOn  string `json:"uploaded_on"`
+	Markdown    string `json:"markdown"`
+}
+
+func uploadsJson(list []*Upload) []UploadJson {
+	res := make([]UploadJson, 0, len(list))
+	for _, u := range list {
+		res = append(res, UploadJson{
+			Name:        u.Name,
+			Url:         u.Url(),
+			Size:        u.Size,
+			ContentType: u.ContentType,
+			UploadedOn:  u.UploadedOn.UTC().Format(time.RFC3339),
+			Markdown:    u.Markdown(),
+		})
+	}
+	return res
+}
+
+func serveUploadsJson(w http.ResponseWriter, r *http.Request, list []*Upload) {
+	d, err := json.Marshal(struct {
+		Uploads []UploadJson `json:"uploads"`
+	}{uploadsJson(list)})
+	if err != nil {
+		logger.RequestErrorf(r, "serveUploadsJson(): json.Marshal() failed with %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeData(w, r, http.StatusOK, d)
+}
+
+// GET /app/uploads
+// POST /app/uploads
+// file    : one or more files (multipart/form-data)
+// Javascript (e.g. editor) gets json with uploaded files, the form is
+// redirected back to the list.
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		model := struct {
+			BasePageModel
+			Uploads  []*Upload
+			MaxBytes int64
+		}{
+			BasePageModel: newBasePageModel(r),
+			Uploads:       uploads.Recent(recentUploadsCount),
+			MaxBytes:      maxBodyBytes("/app/uploads"),
+		}
+		ExecTemplate(w, tmplUploads, model)
+		return
+	}
+	if !checkCsrf(w, r) {
+		return
+	}
+	// files over uploadMemoryBytes are stored in temporary files. If the
+	// body is over the limit, withBodyLimits() responds with 413
+	err := r.ParseMultipartForm(uploadMemoryBytes)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if err != nil || len(r.MultipartForm.File["file"]) == 0 {
+		serveFieldError(w, r, "file", "no file was uploaded")
+		return
+	}
+	var files []*Upload
+	for _, fh := range r.MultipartForm.File["file"] {
+		f, err := fh.Open()
+		if err == nil {
+			var u *Upload
+			u, err = storeUpload(uploadsDir(), fh.Filename, f)
+			f.Close()
+			if err == nil {
+				files = append(files, u)
+				continue
+			}
+		}
+		logger.RequestErrorf(r, "handleUploads(): storing %q failed with %s", fh.Filename, err)
+		serveErrorPage(w, r, http.StatusInternalServerError, &ErrorPageModel{
+			BasePageModel: newBasePageModel(r),
+			Title:         "Upload failed",
+			Message:       fmt.Sprintf("Storing %s failed.", fh.Filename),
+		})
+		return
+	}
+	for _, u := range files {
+		uploads.Add(u)
+		logger.Noticef("handleUploads(): uploaded %s (%d bytes) as %s", u.Name, u.Size, u.Sha1)
+	}
+	saveUploads()
+	if isApiRequest(r) {
+		serveUploadsJson(w, r, files)
+		return
+	}
+	http.Redirect(w, r, "/app/uploads", http.StatusSeeOther)
+}
+
+// /app/uploads.json, recent uploads with markdown for linking to them
+func handleUploadsJson(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		http.NotFound(w, r)
+		return
+	}
+	serveUploadsJson(w, r, uploads.Recent(recentUploadsCount))
+}
+
+// /files/${sha1}/${name}
+func handleFiles(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/files/"), "/", 2)
+	if len(parts) != 2 || !uploadSha1Rx.MatchString(parts[0]) {
+		serve404(w, r)
+		return
+	}
+	u := uploads.Find(parts[0], parts[1])
+	if u == nil {
+		serve404(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(uploadsDir(), u.Sha1))
+	if err != nil {
+		logger.RequestErrorf(r, "handleFiles(): %s", err)
+		serve404(w, r)
+		return
+	}
+	defer f.Close()
+	hdr := w.Header()
+	hdr.Set("Content-Type", u.ContentType)
+	hdr.Set("Content-Disposition", u.ContentDisposition())
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	// content of a url never changes
+	hdr.Set("Cache-Control", "public, max-age=31536000, immutable")
+	hdr.Set("ETag", `"`+u.Sha1+`"`)
+	// handles range and conditional requests
+	http.ServeContent(w, r, u.Name, u.UploadedOn, f)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When a public article is published or changed, we tell WebSub hubs
+// (WebSubHubs in config.json) that our feeds changed, so that readers
+// subscribed through them get it right away. Feeds advertise the hubs with
+// <link rel="hub">.
+// To know what changed (also across restarts, since in production articles
+// change with a deploy), we remember a hash of every public article in
+// data/published_articles.json. When there's no file, we assume nothing
+// changed. DisableOutboundPings turns pinging off (e.g. for local
+// development).
+
+var defaultWebSubHubs = []string{"https://pubsubhubbub.appspot.com/"}
+
+const maxHubPingTries = 4
+
+var (
+	// wait before re-trying a failed ping, doubled after every try.
+	// Changed in tests
+	hubPingBackoff = 30 * time.Second
+	hubPingClient  = &http.Client{Timeout: 30 * time.Second}
+
+	publishedArticlesMu sync.Mutex
+)
+
+// urls of feeds we announce to hubs
+func feedUrls() []string {
+	return []string{absURL("/atom.xml"), absURL("/atom-all.xml")}
+}
+
+func webSubHubs() []string {
+	hubs := getConfig().WebSubHubs
+	if hubs == nil {
+		return defaultWebSubHubs
+	}
+	return hubs
+}
+
+func publishedArticlesPath() string {
+	return filepath.Join(getDataDir(), "data", "published_articles.json")
+}
+
+// changes when anything shown in feeds changes
+func articleFeedHash(a *Article) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", a.Title, a.Permalink(), strings.Join(a.Tags, ","))
+	h.Write(a.Body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// compares hashes of public articles with the ones in file at path and
+// updates it. Returns ids of articles that are new or changed (none if
+// there was no file)
+func updatePublishedArticles(path string, articles []*Article) ([]int, error) {
+	publishedArticlesMu.Lock()
+	defer publishedArticlesMu.Unlock()
+	var prev map[int]string
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(d, &prev); err != nil {
+			return nil, err
+		}
+	}
+	curr := make(map[int]string)
+	var changed []int
+	for _, a := range articles {
+		if a.IsDraft || a.IsDeleted || a.IsPrivate {
+			continue
+		}
+		curr[a.Id] = articleFeedHash(a)
+		if prev != nil && prev[a.Id] != curr[a.Id] {
+			changed = append(changed, a.Id)
+		}
+	}
+	if d, err = json.Marshal(curr); err != nil {
+		return nil, err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, d, 0644); err != nil {
+		return nil, err
+	}
+	return changed, os.Rename(tmpPath, path)
+}
+
+func pingHub(hub string, feeds []string) error {
+	v := url.Values{}
+	v.Set("hub.mode", "publish")
+	for _, feed := range feeds {
+		v.Add("hub.url", feed)
+	}
+	rsp, err := hubPingClient.PostForm(hub, v)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", hub, rsp.Status)
+	}
+	return nil
+}
+
+// pings hub, re-trying with backoff if it fails. Returns true if it
+// succeeded
+func pingHubWithRetries(hub string, feeds []string) bool {
+	backoff := hubPingBackoff
+	for try := 1; ; try++ {
+		err := pingHub(hub, feeds)
+		if err == nil {
+			logger.Noticef("pingHubWithRetries(): pinged %s", hub)
+			return true
+		}
+		if try == maxHubPingTries {
+			logger.Errorf("pingHubWithRetries(): giving up on %s after %d tries, last error: %s", hub, try, err)
+			return false
+		}
+		logger.Noticef("pingHubWithRetries(): pinging %s failed with %s, re-trying in %s", hub, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// tells hubs that feeds changed if public articles were published or
+// changed since the last time. Pings happen in the background. Returns
+// ids of changed articles
+func pingHubsIfChanged(articles []*Article) []int {
+	changed, err := updatePublishedArticles(publishedArticlesPath(), articles)
+	if err != nil {
+		logger.Errorf("pingHubsIfChanged(): %s", err)
+		return nil
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if getConfig().DisableOutboundPings {
+		logger.Noticef("pingHubsIfChanged(): %d articles changed, not pinging because of DisableOutboundPings", len(changed))
+		return changed
+	}
+	feeds := feedUrls()
+	for _, hub := range webSubHubs() {
+		go pingHubWithRetries(hub, feeds)
+	}
+	return changed
+}
+
+// adds <link rel="hub"> for every hub and <link rel="self"> (which hubs
+// require) right after <feed> of atom xml
+func addFeedHubLinks(d []byte, selfUrl string, hubs []string) []byte {
+	if len(hubs) == 0 {
+		return d
+	}
+	start := bytes.Index(d, []byte("<feed"))
+	if start == -1 {
+		return d
+	}
+	end := bytes.IndexByte(d[start:], '>')
+	if end == -1 || d[start+end-1] == '/' {
+		return d
+	}
+	end += start + 1
+	var b bytes.Buffer
+	b.Write(d[:end])
+	fmt.Fprintf(&b, `<link rel="self" href="%s"></link>`, html.EscapeString(selfUrl))
+	for _, hub := range hubs {
+		fmt.Fprintf(&b, `<link rel="hub" href="%s"></link>`, html.EscapeString(hub))
+	}
+	b.Write(d[end:])
+	return b.Bytes()
+}